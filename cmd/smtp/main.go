@@ -6,6 +6,7 @@ import (
 	"os/signal"
 	"syscall"
 
+	"gitea.v3m.net/idriss/gossiper/pkg/notify"
 	"gitea.v3m.net/idriss/gossiper/pkg/services"
 	"gitea.v3m.net/idriss/gossiper/pkg/smtp"
 )
@@ -28,7 +29,9 @@ func main() {
 		}
 	}()
 
-	backend := smtp.NewBackend(c.ORM, c.Config.SMTP.Hostname, StdLogger{})
+	socket := notify.SocketPath(c.Config.Worker.NotifySocket, c.Config.Database.Connection)
+	notifier := notify.NewNotifier(c.Config.Database.Driver, c.Database, socket)
+	backend := smtp.NewBackend(c.ORM, c.Config.SMTP.Hostname, notifier, StdLogger{})
 
 	// Start SMTP server in a goroutine
 	go func() {
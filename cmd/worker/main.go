@@ -10,7 +10,11 @@ import (
 	"syscall"
 	"time"
 
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/notify"
+	"gitea.v3m.net/idriss/gossiper/pkg/secrets"
 	"gitea.v3m.net/idriss/gossiper/pkg/services"
+	"gitea.v3m.net/idriss/gossiper/pkg/tasks"
 	"gitea.v3m.net/idriss/gossiper/pkg/worker"
 )
 
@@ -37,6 +41,7 @@ func main() {
 	// Create processor (no fetcher needed anymore!)
 	jobRepo := worker.NewEntJobRepository(c.ORM)
 	processor := worker.NewMessageProcessor(jobRepo, logger, nil, c.Config.SMTP.Hostname)
+	deliveryLog := worker.NewGormDeliveryLog(c.ORM)
 	
 	// Create webhook sender
 	config := worker.Config{
@@ -45,8 +50,15 @@ func main() {
 		ShutdownTimeout: 10 * time.Second,
 	}
 	
+	// Keep webhooks from reaching internal services, whatever their URLs resolve or redirect to
+	guard, err := worker.NewNetworkGuard(c.Config.Worker.AllowedNetworks)
+	if err != nil {
+		log.Fatalf("invalid worker configuration: %v", err)
+	}
+	transport := guard.Transport()
+
 	// Create HTTP client with optional proxy support
-	httpClient := &http.Client{Timeout: config.HTTPTimeout}
+	httpClient := &http.Client{Timeout: config.HTTPTimeout, Transport: transport}
 	
 	// Check for proxy configuration
 	if c.Config.Proxy.Enabled && c.Config.Proxy.URL != "" {
@@ -54,14 +66,22 @@ func main() {
 		if err != nil {
 			log.Fatalf("invalid proxy URL: %v", err)
 		}
-		httpClient.Transport = &http.Transport{
-			Proxy: http.ProxyURL(proxy),
-		}
+		// Only the proxy address is checked then, an internal proxy must be allowed and do its own filtering
+		transport.Proxy = http.ProxyURL(proxy)
 		log.Printf("using HTTP proxy: %s", c.Config.Proxy.URL)
 	}
 	
 	webhookSender := worker.NewWebhookSender(httpClient, logger, config)
 
+	// Jobs with their own timeout, certificates or proxy get clients built from the same transport,
+	// and credentials sealed by the web server are opened with the same key
+	box, err := secrets.New(c.Config.App.EncryptionKey)
+	if err != nil {
+		log.Fatalf("invalid app configuration: %v", err)
+	}
+	webhookSender.SetTransportPool(worker.NewTransportPool(transport, config.HTTPTimeout, box))
+	webhookSender.SetAuthenticator(worker.NewAuthenticator(box, logger))
+
 	// Create email replier for auto-replies
 	emailReplier := worker.NewEmailReplier(
 		c.Config.Mail.Hostname,
@@ -72,12 +92,110 @@ func main() {
 		logger,
 	)
 
-	// Create poller
-	poller := worker.NewSMTPMessagePoller(c.ORM, processor, webhookSender, emailReplier, logger, 1*time.Second)
+	// Fail fast on endpoints that are down rather than waiting for each call to time out
+	if cb := c.Config.Worker.CircuitBreaker; cb.Threshold > 0 {
+		breaker := worker.NewCircuitBreaker(
+			cb.Threshold,
+			cb.Cooldown,
+			cb.MaxCooldown,
+			worker.NewGormCircuitStore(c.ORM),
+			worker.NewCircuitMailer(c.ORM, emailReplier, logger),
+			logger,
+		)
+		if err := breaker.Load(context.Background()); err != nil {
+			log.Printf("starting with every circuit closed: %v", err)
+		}
+		webhookSender.SetCircuitBreaker(breaker)
+	}
+
+	// Hold back the requests over the rate limit of their destination host
+	limits := c.Config.Worker.RateLimits
+	hostLimits := worker.HostRateLimits{
+		Default: models.RateLimit{PerMinute: limits.Host.PerMinute, PerHour: limits.Host.PerHour},
+		Hosts:   make(map[string]models.RateLimit, len(limits.Hosts)),
+	}
+	for _, h := range limits.Hosts {
+		hostLimits.Hosts[h.Host] = models.RateLimit{PerMinute: h.PerMinute, PerHour: h.PerHour}
+	}
+	// Jobs, users and hosts share a limiter whose counts are saved, so limits hold across restarts
+	limiter := worker.NewRateLimiter()
+	limiter.SetStore(worker.NewGormRateStore(c.ORM), logger)
+	if err := limiter.Load(context.Background(), time.Now()); err != nil {
+		log.Printf("starting with every rate limit reset: %v", err)
+	}
+	webhookSender.SetHostRateLimits(hostLimits, limiter)
+
+	// Email destinations relay messages through the same mail server
+	dispatcher := worker.NewDispatcher(webhookSender, logger)
+	dispatcher.SetSecrets(box)
+	srsKey, err := secrets.DeriveKey(c.Config.App.EncryptionKey, "srs")
+	if err != nil {
+		log.Fatalf("failed to derive the SRS key: %v", err)
+	}
+	forwarder := worker.NewEmailForwarder(
+		c.Config.Mail.Hostname,
+		int(c.Config.Mail.Port),
+		c.Config.Mail.User,
+		c.Config.Mail.Password,
+		c.Config.SMTP.Hostname,
+		srsKey,
+		logger,
+	)
+	dispatcher.Register(models.DestinationTypeEmail, forwarder)
+
+	// Broker destinations keep their connections open until the worker stops, and go through the same guard as webhooks
+	brokers := worker.NewBrokerDestination(logger)
+	brokers.SetNetworkGuard(guard)
+	defer brokers.Close()
+	dispatcher.Register(models.DestinationTypeNATS, brokers)
+	dispatcher.Register(models.DestinationTypeAMQP, brokers)
+	dispatcher.Register(models.DestinationTypeRedis, brokers)
+
+	// Pull destinations queue messages for API clients of the web server
+	pullQueue := worker.NewPullQueue(c.ORM, logger)
+	pullSocket := notify.SocketPath(c.Config.Worker.PullSocket, c.Config.Database.Connection)
+	pullQueue.SetNotifier(notify.NewChannelNotifier(c.Config.Database.Driver, c.Database, notify.PullChannel, pullSocket))
+	dispatcher.Register(models.DestinationTypePull, pullQueue)
+
+	// Listen for wakeups from the SMTP server, polling remains as a fallback
+	var wakeup <-chan struct{}
+	socket := notify.SocketPath(c.Config.Worker.NotifySocket, c.Config.Database.Connection)
+	listener, err := notify.NewListener(c.Config.Database.Driver, c.Config.Database.Connection, socket)
+	if err != nil {
+		log.Printf("failed to listen for notifications, relying on polling only: %v", err)
+	} else {
+		defer listener.Close()
+		wakeup = listener.C()
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Digests are closed by tasks of their own queue, the web server's tasks are left to it
+	digestTasks, err := tasks.NewDigestTaskClient(c)
+	if err != nil {
+		log.Fatalf("failed to create the digest task client: %v", err)
+	}
+	go digestTasks.StartRunner(ctx)
+
+	// Create poller
+	poller := worker.NewSMTPMessagePoller(worker.PollerDependencies{
+		DB:            c.ORM,
+		Processor:     processor,
+		Dispatcher:    dispatcher,
+		EmailReplier:  emailReplier,
+		DeliveryLog:   deliveryLog,
+		Logger:        logger,
+		PollInterval:  c.Config.Worker.PollInterval,
+		Wakeup:        wakeup,
+		MaxRetries:    config.MaxRetries,
+		RetryBackoff:  5 * time.Second,
+		Digests:       tasks.NewDigestScheduler(digestTasks),
+		UserRateLimit: models.RateLimit{PerMinute: limits.User.PerMinute, PerHour: limits.User.PerHour},
+		RateLimiter:   limiter,
+		Bounces:       forwarder,
+	})
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
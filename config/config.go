@@ -62,6 +62,7 @@ type (
 		Tasks         TasksConfig
 		Mail          MailConfig
 		Proxy         ProxyConfig
+		Worker        WorkerConfig
 	}
 
 	// HTTPConfig stores HTTP configuration
@@ -129,6 +130,59 @@ type (
 		SkipTlsVerify bool
 	}
 
+	// WorkerConfig stores the message processing worker configuration
+	WorkerConfig struct {
+		// PollInterval is the fallback interval used to pick up messages whose wakeup was missed
+		PollInterval time.Duration
+		// NotifySocket is the unix socket used to wake the worker when not running on Postgres. A relative path
+		// is taken from the directory of the database file, the socket must be on a volume the SMTP server and
+		// the worker share.
+		NotifySocket string
+		// PullSocket is the unix socket the worker wakes the web server's pull API clients on when not running
+		// on Postgres, resolved like NotifySocket
+		PullSocket string
+		// CircuitBreaker stops calling destination hosts that keep failing
+		CircuitBreaker CircuitBreakerConfig
+		// AllowedNetworks lists the internal addresses or CIDR ranges webhooks may be delivered to.
+		// Loopback, private, link-local and metadata addresses are refused otherwise.
+		AllowedNetworks []string
+		// RateLimits throttle deliveries on top of the limits of each job
+		RateLimits RateLimitsConfig
+	}
+
+	// RateLimitsConfig stores the rate limits of the worker
+	RateLimitsConfig struct {
+		// User caps the messages delivered for the jobs of each user
+		User RateLimitConfig
+		// Host caps the requests to each destination host
+		Host RateLimitConfig
+		// Hosts replace the Host limit for given hosts, such as partners with a lower API quota
+		Hosts []HostRateLimitConfig
+	}
+
+	// RateLimitConfig stores a rate limit, zero for no limit
+	RateLimitConfig struct {
+		PerMinute int
+		PerHour   int
+	}
+
+	// HostRateLimitConfig stores the rate limit of a destination host
+	HostRateLimitConfig struct {
+		Host      string
+		PerMinute int
+		PerHour   int
+	}
+
+	// CircuitBreakerConfig stores the circuit breaker configuration
+	CircuitBreakerConfig struct {
+		// Threshold is the number of consecutive failures opening the circuit of a host, zero disables the breaker
+		Threshold int
+		// Cooldown is how long an open circuit fails fast before letting a probe through
+		Cooldown time.Duration
+		// MaxCooldown caps the cooldown, which doubles each time a probe fails
+		MaxCooldown time.Duration
+	}
+
 	// ProxyConfig stores the HTTP proxy configuration
 	ProxyConfig struct {
 		Enabled bool
@@ -3,6 +3,7 @@ package form
 import (
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/go-playground/validator/v10"
 	"gitea.v3m.net/idriss/gossiper/pkg/context"
@@ -105,6 +106,10 @@ func (f *Submission) setErrorMessages(err error) {
 			message = "Does not match."
 		case "gte":
 			message = fmt.Sprintf("Must be greater than or equal to %v.", ve.Param())
+		case "url", "http_url":
+			message = "Enter a valid URL."
+		case "oneof":
+			message = fmt.Sprintf("Must be one of: %v.", strings.ReplaceAll(ve.Param(), " ", ", "))
 		default:
 			message = "Invalid value."
 		}
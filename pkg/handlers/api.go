@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	stdlog "log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/config"
+	gocontext "gitea.v3m.net/idriss/gossiper/pkg/context"
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/notify"
+	"gitea.v3m.net/idriss/gossiper/pkg/secrets"
+	"gitea.v3m.net/idriss/gossiper/pkg/services"
+	"gitea.v3m.net/idriss/gossiper/pkg/worker"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	routeNameAPIJobMessages     = "api.job.messages"
+	routeNameAPIJobMessagesAck  = "api.job.messages.ack"
+	routeNameAPIJobMessagesNack = "api.job.messages.nack"
+	routeNameAPIJobLiveEvents   = "api.job.live.events"
+	routeNameAPIJobLiveWS       = "api.job.live.ws"
+)
+
+const (
+	// apiMaxWait is the longest a client may long-poll for messages
+	apiMaxWait = 60 * time.Second
+
+	// apiDefaultVisibility is how long received messages stay hidden unless the client asks otherwise
+	apiDefaultVisibility = 30 * time.Second
+
+	// apiMaxVisibility is the longest a client may hide received messages
+	apiMaxVisibility = 12 * time.Hour
+
+	// apiMaxMessages is the most messages received at once
+	apiMaxMessages = 100
+)
+
+type (
+	// API lets clients that can't receive webhooks pull the messages of their pull destinations,
+	// or follow the job's live stream, authenticated with the destination's token. The live stream also accepts the
+	// session of the job's owner, for dashboards of the app.
+	API struct {
+		orm   *models.DB
+		queue *worker.PullQueue
+		feed  *liveFeed
+	}
+
+	apiMessage struct {
+		ID          int       `json:"id"`
+		Receipt     string    `json:"receipt"`
+		Destination string    `json:"destination"`
+		Payload     string    `json:"payload"`
+		ContentType string    `json:"content_type"`
+		Receives    int       `json:"receives"`
+		QueuedAt    time.Time `json:"queued_at"`
+		VisibleAt   time.Time `json:"visible_until"`
+	}
+
+	apiMessages struct {
+		Messages []apiMessage `json:"messages"`
+	}
+)
+
+func init() {
+	Register(new(API))
+}
+
+func (h *API) Init(c *services.Container) error {
+	h.orm = c.ORM
+	h.queue = worker.NewPullQueue(c.ORM, stdlog.Default())
+	h.feed = newLiveFeed(c.ORM, c.TemplateRenderer)
+
+	// The worker signals queued messages so waiting clients don't poll the database, tests run both in one process
+	if c.Config.App.Environment != config.EnvTest {
+		socket := notify.SocketPath(c.Config.Worker.PullSocket, c.Config.Database.Connection)
+		listener, err := notify.NewChannelListener(c.Config.Database.Driver, c.Config.Database.Connection, notify.PullChannel, socket)
+		if err != nil {
+			stdlog.Printf("failed to listen for queued messages, pull clients poll instead: %v", err)
+		} else {
+			go h.queue.Listen(context.Background(), listener.C())
+		}
+	}
+	return nil
+}
+
+func (h *API) Routes(g *echo.Group) {
+	api := g.Group(apiPrefix)
+	api.GET("/jobs/:id/messages", h.Receive).Name = routeNameAPIJobMessages
+	api.POST("/jobs/:id/messages/:message/ack", h.Ack).Name = routeNameAPIJobMessagesAck
+	api.POST("/jobs/:id/messages/:message/nack", h.Nack).Name = routeNameAPIJobMessagesNack
+	api.GET("/jobs/:id/live/events", h.LiveEvents).Name = routeNameAPIJobLiveEvents
+	api.GET("/jobs/:id/live/ws", h.LiveWebSocket).Name = routeNameAPIJobLiveWS
+}
+
+// Receive returns the visible messages of the destination, waiting up to ?wait= for some when there are none.
+// Received messages are hidden for ?visibility= and must be acknowledged before it ends.
+func (h *API) Receive(ctx echo.Context) error {
+	dest, err := h.authorize(ctx)
+	if err != nil {
+		return err
+	}
+
+	wait, err := durationParam(ctx, "wait", 0, apiMaxWait)
+	if err != nil {
+		return err
+	}
+	visibility, err := durationParam(ctx, "visibility", apiDefaultVisibility, apiMaxVisibility)
+	if err != nil {
+		return err
+	}
+	limit := 10
+	if v := ctx.QueryParam("max"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > apiMaxMessages {
+			return echo.NewHTTPError(http.StatusBadRequest, "max must be between 1 and "+strconv.Itoa(apiMaxMessages))
+		}
+	}
+
+	// Long polls outlast the server's write timeout
+	if wait > 0 {
+		rc := http.NewResponseController(ctx.Response())
+		if err := rc.SetWriteDeadline(time.Now().Add(wait + 10*time.Second)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return fail(err, "unable to extend the write deadline")
+		}
+	}
+
+	messages, err := h.queue.Receive(ctx.Request().Context(), dest.ID, limit, visibility, wait)
+	if err != nil {
+		return fail(err, "unable to receive messages")
+	}
+
+	res := apiMessages{Messages: make([]apiMessage, 0, len(messages))}
+	for _, msg := range messages {
+		res.Messages = append(res.Messages, apiMessage{
+			ID:          msg.ID,
+			Receipt:     msg.Receipt,
+			Destination: dest.Name,
+			Payload:     msg.Payload,
+			ContentType: msg.ContentType,
+			Receives:    msg.Receives,
+			QueuedAt:    msg.CreatedAt,
+			VisibleAt:   msg.VisibleAt,
+		})
+	}
+
+	return ctx.JSON(http.StatusOK, res)
+}
+
+// Ack removes a received message from the queue
+func (h *API) Ack(ctx echo.Context) error {
+	dest, id, err := h.authorizeMessage(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = h.queue.Ack(ctx.Request().Context(), dest.ID, id, ctx.FormValue("receipt"))
+	return settled(ctx, err)
+}
+
+// Nack returns a received message to the queue, visible again after ?delay=
+func (h *API) Nack(ctx echo.Context) error {
+	dest, id, err := h.authorizeMessage(ctx)
+	if err != nil {
+		return err
+	}
+
+	delay, err := durationParam(ctx, "delay", 0, apiMaxVisibility)
+	if err != nil {
+		return err
+	}
+
+	err = h.queue.Nack(ctx.Request().Context(), dest.ID, id, ctx.FormValue("receipt"), delay)
+	return settled(ctx, err)
+}
+
+// LiveEvents streams the job's processed messages as Server-Sent Events, like the live inbox
+func (h *API) LiveEvents(ctx echo.Context) error {
+	jobID, err := h.authorizeLive(ctx)
+	if err != nil {
+		return err
+	}
+
+	return h.feed.serveSSE(ctx, jobID)
+}
+
+// LiveWebSocket streams the job's processed messages as JSON WebSocket messages
+func (h *API) LiveWebSocket(ctx echo.Context) error {
+	jobID, err := h.authorizeLive(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The default origin check lets through clients that send no Origin, like the bearer token clients this is meant
+	// for, and pages of the app itself, browsers on other sites are refused
+	return h.feed.serveWebSocket(ctx, jobID, websocket.Upgrader{})
+}
+
+// authorizeLive returns the :id job when the session user owns it, or else when the request's bearer token is
+// the token of one of its pull destinations
+func (h *API) authorizeLive(ctx echo.Context) (int, error) {
+	if ctx.Get(gocontext.AuthenticatedUserKey) != nil {
+		job, err := loadUserJob(ctx, h.orm)
+		if err != nil {
+			return 0, err
+		}
+		return job.ID, nil
+	}
+
+	dest, err := h.authorize(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return dest.JobID, nil
+}
+
+// authorize returns the pull destination of the :id job whose token is the request's bearer token
+func (h *API) authorize(ctx echo.Context) (*models.Destination, error) {
+	unauthorized := echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
+	ctx.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="gossiper"`)
+
+	token, ok := strings.CutPrefix(ctx.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	if !ok || token == "" {
+		return nil, unauthorized
+	}
+
+	jobID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return nil, unauthorized
+	}
+
+	var dests []models.Destination
+	err = h.orm.WithContext(ctx.Request().Context()).
+		Where("job_id = ? AND type = ?", jobID, models.DestinationTypePull).
+		Find(&dests).Error
+	if err != nil {
+		return nil, fail(err, "unable to load destinations")
+	}
+
+	for i := range dests {
+		if secrets.Verify(dests[i].Token, token) {
+			return &dests[i], nil
+		}
+	}
+
+	return nil, unauthorized
+}
+
+// authorizeMessage authorizes the request and parses the :message route parameter
+func (h *API) authorizeMessage(ctx echo.Context) (*models.Destination, int, error) {
+	dest, err := h.authorize(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	id, err := strconv.Atoi(ctx.Param("message"))
+	if err != nil {
+		return nil, 0, echo.NewHTTPError(http.StatusNotFound, worker.ErrPullMessageNotFound.Error())
+	}
+
+	if ctx.FormValue("receipt") == "" {
+		return nil, 0, echo.NewHTTPError(http.StatusBadRequest, "receipt is required")
+	}
+
+	return dest, id, nil
+}
+
+// settled maps the outcome of an ack or nack to a response
+func settled(ctx echo.Context, err error) error {
+	switch {
+	case err == nil:
+		return ctx.NoContent(http.StatusNoContent)
+	case errors.Is(err, worker.ErrPullMessageNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, worker.ErrPullReceiptMismatch):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	default:
+		return fail(err, "unable to settle message")
+	}
+}
+
+// durationParam parses a duration query parameter, such as ?wait=30s, between 0 and max
+func durationParam(ctx echo.Context, name string, def, max time.Duration) (time.Duration, error) {
+	v := ctx.QueryParam(name)
+	if v == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 || d > max {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, name+" must be a duration between 0s and "+max.String())
+	}
+	return d, nil
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/secrets"
+	"gitea.v3m.net/idriss/gossiper/pkg/tests"
+	"gitea.v3m.net/idriss/gossiper/pkg/worker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const apiTestToken = "0123456789abcdef"
+
+func apiRequest(t *testing.T, method, path string, body url.Values) *http.Response {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body.Encode()))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+apiTestToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+func receive(t *testing.T, path string) []apiMessage {
+	resp := apiRequest(t, http.MethodGet, path, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var res apiMessages
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	return res.Messages
+}
+
+func TestAPI_PullMessages(t *testing.T) {
+	usr, err := tests.CreateUser(c.ORM)
+	require.NoError(t, err)
+
+	job := models.Job{Email: "pull-" + usr.Email, URL: "https://example.com", UserID: usr.ID}
+	require.NoError(t, c.ORM.Create(&job).Error)
+	dest := models.Destination{JobID: job.ID, Name: "consumer", Type: models.DestinationTypePull, Token: secrets.Hash(apiTestToken)}
+	require.NoError(t, c.ORM.Create(&dest).Error)
+
+	queue := worker.NewPullQueue(c.ORM, log.Default())
+	for _, payload := range []string{`{"n":1}`, `{"n":2}`} {
+		res := queue.Deliver(context.Background(), worker.ProcessResult{JobID: job.ID, DestinationID: dest.ID, Payload: payload})
+		require.NoError(t, res.Error)
+	}
+
+	base := c.Web.Reverse(routeNameAPIJobMessages, job.ID)
+
+	t.Run("unauthorized", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + base)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		assert.Equal(t, "application/json", strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	})
+
+	var received []apiMessage
+	t.Run("receive", func(t *testing.T) {
+		received = receive(t, base+"?max=1&visibility=1h")
+		require.Len(t, received, 1)
+		assert.Equal(t, `{"n":1}`, received[0].Payload)
+		assert.Equal(t, "consumer", received[0].Destination)
+		assert.Equal(t, 1, received[0].Receives)
+
+		// The first message is hidden until acknowledged
+		next := receive(t, base)
+		require.Len(t, next, 1)
+		assert.Equal(t, `{"n":2}`, next[0].Payload)
+
+		// Nack makes it visible again right away
+		resp := apiRequest(t, http.MethodPost, c.Web.Reverse(routeNameAPIJobMessagesNack, job.ID, next[0].ID), url.Values{"receipt": {next[0].Receipt}})
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		again := receive(t, base)
+		require.Len(t, again, 1)
+		assert.Equal(t, 2, again[0].Receives)
+		assert.NotEqual(t, next[0].Receipt, again[0].Receipt)
+
+		// Its previous receipt can no longer settle it
+		resp = apiRequest(t, http.MethodPost, c.Web.Reverse(routeNameAPIJobMessagesAck, job.ID, next[0].ID), url.Values{"receipt": {next[0].Receipt}})
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	})
+
+	t.Run("ack", func(t *testing.T) {
+		path := c.Web.Reverse(routeNameAPIJobMessagesAck, job.ID, received[0].ID)
+		resp := apiRequest(t, http.MethodPost, path, url.Values{"receipt": {received[0].Receipt}})
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp = apiRequest(t, http.MethodPost, path, url.Values{"receipt": {received[0].Receipt}})
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("long poll", func(t *testing.T) {
+		start := time.Now()
+		messages := receive(t, base+"?wait=1500ms")
+		assert.Empty(t, messages)
+		assert.GreaterOrEqual(t, time.Since(start), 1500*time.Millisecond)
+
+		go func() {
+			time.Sleep(500 * time.Millisecond)
+			queue.Deliver(context.Background(), worker.ProcessResult{JobID: job.ID, DestinationID: dest.ID, Payload: `{"n":3}`})
+		}()
+		messages = receive(t, base+"?wait=5s")
+		require.Len(t, messages, 1)
+		assert.Equal(t, `{"n":3}`, messages[0].Payload)
+	})
+
+	t.Run("wakeup", func(t *testing.T) {
+		// A receiver listening for wakeups only checks the queue on its own every 10 seconds
+		receiver := worker.NewPullQueue(c.ORM, log.Default())
+		wakeups := make(chan struct{})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go receiver.Listen(ctx, wakeups)
+
+		go func() {
+			time.Sleep(500 * time.Millisecond)
+			queue.Deliver(context.Background(), worker.ProcessResult{JobID: job.ID, DestinationID: dest.ID, Payload: `{"n":4}`})
+			wakeups <- struct{}{}
+		}()
+
+		start := time.Now()
+		messages, err := receiver.Receive(context.Background(), dest.ID, 1, time.Hour, 8*time.Second)
+		require.NoError(t, err)
+		require.Len(t, messages, 1)
+		assert.Equal(t, `{"n":4}`, messages[0].Payload)
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+
+	t.Run("invalid parameters", func(t *testing.T) {
+		resp := apiRequest(t, http.MethodGet, base+"?wait=forever", nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
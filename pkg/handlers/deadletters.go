@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"fmt"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/log"
+	"gitea.v3m.net/idriss/gossiper/pkg/middleware"
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/msg"
+	"gitea.v3m.net/idriss/gossiper/pkg/notify"
+	"gitea.v3m.net/idriss/gossiper/pkg/page"
+	"gitea.v3m.net/idriss/gossiper/pkg/redirect"
+	"gitea.v3m.net/idriss/gossiper/pkg/services"
+	"gitea.v3m.net/idriss/gossiper/templates"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	routeNameJobDeadLetters       = "job.deadletters"
+	routeNameJobDeadLettersReplay = "job.deadletters.replay"
+)
+
+type (
+	// DeadLetters lists the deliveries that failed on every attempt and queues them for the worker to replay
+	DeadLetters struct {
+		orm      *models.DB
+		notifier notify.Notifier
+		*services.TemplateRenderer
+	}
+
+	deadLettersData struct {
+		Job         *models.Job
+		DeadLetters []deadLetter
+	}
+
+	deadLetter struct {
+		models.Delivery
+		Message models.SMTPMessage
+	}
+)
+
+func init() {
+	Register(new(DeadLetters))
+}
+
+func (h *DeadLetters) Init(c *services.Container) error {
+	h.TemplateRenderer = c.TemplateRenderer
+	h.orm = c.ORM
+	socket := notify.SocketPath(c.Config.Worker.NotifySocket, c.Config.Database.Connection)
+	h.notifier = notify.NewNotifier(c.Config.Database.Driver, c.Database, socket)
+	return nil
+}
+
+func (h *DeadLetters) Routes(g *echo.Group) {
+	g.GET("/jobs/:id/dead-letters", h.Page, middleware.RequireAuthentication()).Name = routeNameJobDeadLetters
+	g.POST("/jobs/:id/dead-letters/replay", h.Replay, middleware.RequireAuthentication()).Name = routeNameJobDeadLettersReplay
+}
+
+func (h *DeadLetters) Page(ctx echo.Context) error {
+	job, err := loadUserJob(ctx, h.orm)
+	if err != nil {
+		return err
+	}
+
+	p := page.New(ctx)
+	p.Layout = templates.LayoutMain
+	p.Name = templates.PageDeadLetters
+	p.Title = "Dead letters"
+	p.Pager = page.NewPager(ctx, page.DefaultItemsPerPage)
+
+	var count int64
+	query := h.orm.WithContext(ctx.Request().Context()).
+		Model(&models.Delivery{}).
+		Where("job_id = ? AND status IN ?", job.ID, []string{models.DeliveryStatusDead, models.DeliveryStatusReplaying})
+	if err := query.Count(&count).Error; err != nil {
+		return fail(err, "unable to count dead letters")
+	}
+	p.Pager.SetItems(int(count))
+
+	var deliveries []models.Delivery
+	err = query.
+		Order("id DESC").
+		Limit(p.Pager.ItemsPerPage).
+		Offset(p.Pager.GetOffset()).
+		Find(&deliveries).Error
+	if err != nil {
+		return fail(err, "unable to load dead letters")
+	}
+
+	messages, err := loadDeliveryMessages(ctx.Request().Context(), h.orm, deliveries)
+	if err != nil {
+		return fail(err, "unable to load messages")
+	}
+
+	data := deadLettersData{Job: job}
+	for _, d := range deliveries {
+		data.DeadLetters = append(data.DeadLetters, deadLetter{Delivery: d, Message: messages[d.SMTPMessageID]})
+	}
+	p.Data = data
+
+	return h.RenderPage(ctx, p)
+}
+
+// Replay queues the selected dead letters, or all of them, for the worker to deliver again
+func (h *DeadLetters) Replay(ctx echo.Context) error {
+	job, err := loadUserJob(ctx, h.orm)
+	if err != nil {
+		return err
+	}
+
+	query := h.orm.WithContext(ctx.Request().Context()).
+		Model(&models.Delivery{}).
+		Where("job_id = ? AND status = ?", job.ID, models.DeliveryStatusDead)
+
+	if query, err = selectedDeliveries(ctx, query); err != nil {
+		return err
+	}
+	if query == nil {
+		msg.Warning(ctx, "Select the dead letters to replay.")
+		return h.back(ctx, job)
+	}
+
+	res := query.Update("status", models.DeliveryStatusReplaying)
+	if res.Error != nil {
+		return fail(res.Error, "unable to queue the replay")
+	}
+
+	if err := h.notifier.Notify(ctx.Request().Context()); err != nil {
+		log.Ctx(ctx).Warn("failed to wake the worker", "error", err)
+	}
+
+	msg.Success(ctx, fmt.Sprintf("%d message(s) queued for replay.", res.RowsAffected))
+	return h.back(ctx, job)
+}
+
+func (h *DeadLetters) back(ctx echo.Context, job *models.Job) error {
+	return redirect.New(ctx).
+		Route(routeNameJobDeadLetters).
+		Params(job.ID).
+		Go()
+}
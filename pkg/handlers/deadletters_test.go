@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/context"
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/tests"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetters_Replay(t *testing.T) {
+	usr, err := tests.CreateUser(c.ORM)
+	require.NoError(t, err)
+	job := models.Job{Email: "dead-" + usr.Email, URL: "https://example.com", UserID: usr.ID}
+	require.NoError(t, c.ORM.Create(&job).Error)
+
+	dead := []models.Delivery{
+		{JobID: job.ID, Status: models.DeliveryStatusDead},
+		{JobID: job.ID, Status: models.DeliveryStatusDead},
+		{JobID: job.ID, Status: models.DeliveryStatusDelivered},
+	}
+	require.NoError(t, c.ORM.Create(&dead).Error)
+
+	replay := func(form url.Values) {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := c.Web.NewContext(req, httptest.NewRecorder())
+		ctx.SetParamNames("id")
+		ctx.SetParamValues(strconv.Itoa(job.ID))
+		ctx.Set(context.AuthenticatedUserKey, usr)
+		tests.InitSession(ctx)
+
+		h := new(DeadLetters)
+		require.NoError(t, h.Init(c))
+		require.NoError(t, h.Replay(ctx))
+	}
+
+	status := func(d models.Delivery) string {
+		require.NoError(t, c.ORM.First(&d, d.ID).Error)
+		return d.Status
+	}
+
+	replay(url.Values{"ids": {strconv.Itoa(dead[0].ID)}})
+	assert.Equal(t, models.DeliveryStatusReplaying, status(dead[0]))
+	assert.Equal(t, models.DeliveryStatusDead, status(dead[1]))
+
+	replay(url.Values{"all": {"1"}})
+	assert.Equal(t, models.DeliveryStatusReplaying, status(dead[1]))
+	assert.Equal(t, models.DeliveryStatusDelivered, status(dead[2]))
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	gocontext "gitea.v3m.net/idriss/gossiper/pkg/context"
+	"gitea.v3m.net/idriss/gossiper/pkg/middleware"
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/page"
+	"gitea.v3m.net/idriss/gossiper/pkg/services"
+	"gitea.v3m.net/idriss/gossiper/templates"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const routeNameJobDeliveries = "job.deliveries"
+
+type (
+	Deliveries struct {
+		orm *models.DB
+		*services.TemplateRenderer
+	}
+
+	deliveriesData struct {
+		Job        *models.Job
+		Deliveries []models.Delivery
+	}
+)
+
+func init() {
+	Register(new(Deliveries))
+}
+
+func (h *Deliveries) Init(c *services.Container) error {
+	h.TemplateRenderer = c.TemplateRenderer
+	h.orm = c.ORM
+	return nil
+}
+
+func (h *Deliveries) Routes(g *echo.Group) {
+	g.GET("/jobs/:id/deliveries", h.Page, middleware.RequireAuthentication()).Name = routeNameJobDeliveries
+}
+
+func (h *Deliveries) Page(ctx echo.Context) error {
+	job, err := loadUserJob(ctx, h.orm)
+	if err != nil {
+		return err
+	}
+
+	p := page.New(ctx)
+	p.Layout = templates.LayoutMain
+	p.Name = templates.PageDeliveries
+	p.Title = "Delivery log"
+	p.Pager = page.NewPager(ctx, page.DefaultItemsPerPage)
+
+	var count int64
+	query := h.orm.WithContext(ctx.Request().Context()).
+		Model(&models.Delivery{}).
+		Where("job_id = ?", job.ID)
+	if err := query.Count(&count).Error; err != nil {
+		return fail(err, "unable to count deliveries")
+	}
+	p.Pager.SetItems(int(count))
+
+	var deliveries []models.Delivery
+	err = query.
+		Order("created_at DESC, id DESC").
+		Limit(p.Pager.ItemsPerPage).
+		Offset(p.Pager.GetOffset()).
+		Find(&deliveries).Error
+	if err != nil {
+		return fail(err, "unable to load deliveries")
+	}
+
+	p.Data = deliveriesData{
+		Job:        job,
+		Deliveries: deliveries,
+	}
+
+	return h.RenderPage(ctx, p)
+}
+
+// loadUserJob loads the job in the :id route parameter, as long as it belongs to the authenticated user
+func loadUserJob(ctx echo.Context, orm *models.DB) (*models.Job, error) {
+	user := ctx.Get(gocontext.AuthenticatedUserKey).(*models.User)
+
+	jobID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	var job models.Job
+	err = orm.WithContext(ctx.Request().Context()).
+		Where("id = ? AND user_id = ?", jobID, user.ID).
+		First(&job).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, echo.NewHTTPError(http.StatusNotFound)
+	case err != nil:
+		return nil, fail(err, "unable to load job")
+	}
+
+	return &job, nil
+}
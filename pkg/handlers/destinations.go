@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/form"
+	"gitea.v3m.net/idriss/gossiper/pkg/middleware"
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/msg"
+	"gitea.v3m.net/idriss/gossiper/pkg/page"
+	"gitea.v3m.net/idriss/gossiper/pkg/redirect"
+	"gitea.v3m.net/idriss/gossiper/pkg/secrets"
+	"gitea.v3m.net/idriss/gossiper/pkg/services"
+	"gitea.v3m.net/idriss/gossiper/pkg/worker"
+	"gitea.v3m.net/idriss/gossiper/templates"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	routeNameJobDestinations       = "job.destinations"
+	routeNameJobDestinationsSubmit = "job.destinations.submit"
+	routeNameJobDestinationsDelete = "job.destinations.delete"
+)
+
+type (
+	Destinations struct {
+		orm     *models.DB
+		secrets *secrets.Box
+		*services.TemplateRenderer
+	}
+
+	destinationForm struct {
+		Name    string `form:"name" validate:"required"`
+		Type    string `form:"type" validate:"required"`
+		URL     string `form:"url" validate:"omitempty,url"`
+		Method  string `form:"method" validate:"omitempty,oneof=GET POST PUT PATCH DELETE"`
+		Token   string `form:"token"`
+		Options string `form:"options"`
+		Headers string `form:"headers"`
+		Payload string `form:"payload"`
+		Match   string `form:"match"`
+		form.Submission
+	}
+
+	destinationsData struct {
+		Job   *models.Job
+		Types []destinationType
+	}
+
+	destinationType struct {
+		Value string
+		Label string
+	}
+)
+
+// destinationTypes lists the types offered in the form, in order
+var destinationTypes = []destinationType{
+	{Value: models.DestinationTypeHTTP, Label: "HTTP webhook"},
+	{Value: models.DestinationTypeSlack, Label: "Slack"},
+	{Value: models.DestinationTypeDiscord, Label: "Discord"},
+	{Value: models.DestinationTypeTeams, Label: "Microsoft Teams"},
+	{Value: models.DestinationTypeMatrix, Label: "Matrix"},
+	{Value: models.DestinationTypeTelegram, Label: "Telegram"},
+	{Value: models.DestinationTypeNtfy, Label: "ntfy"},
+	{Value: models.DestinationTypeEmail, Label: "Forward by email"},
+	{Value: models.DestinationTypeNATS, Label: "NATS"},
+	{Value: models.DestinationTypeAMQP, Label: "AMQP"},
+	{Value: models.DestinationTypeRedis, Label: "Redis stream"},
+	{Value: models.DestinationTypePull, Label: "Pull API"},
+}
+
+func init() {
+	Register(new(Destinations))
+}
+
+func (h *Destinations) Init(c *services.Container) error {
+	h.TemplateRenderer = c.TemplateRenderer
+	h.orm = c.ORM
+
+	var err error
+	h.secrets, err = secrets.New(c.Config.App.EncryptionKey)
+	return err
+}
+
+func (h *Destinations) Routes(g *echo.Group) {
+	g.GET("/jobs/:id/destinations", h.Page, middleware.RequireAuthentication()).Name = routeNameJobDestinations
+	g.POST("/jobs/:id/destinations", h.Submit, middleware.RequireAuthentication()).Name = routeNameJobDestinationsSubmit
+	g.DELETE("/jobs/:id/destinations/:destination", h.Delete, middleware.RequireAuthentication()).Name = routeNameJobDestinationsDelete
+}
+
+func (h *Destinations) Page(ctx echo.Context) error {
+	job, err := loadUserJob(ctx, h.orm)
+	if err != nil {
+		return err
+	}
+
+	return h.render(ctx, job)
+}
+
+func (h *Destinations) render(ctx echo.Context, job *models.Job) error {
+	err := h.orm.WithContext(ctx.Request().Context()).
+		Where("job_id = ?", job.ID).
+		Order("id ASC").
+		Find(&job.Destinations).Error
+	if err != nil {
+		return fail(err, "unable to load destinations")
+	}
+
+	p := page.New(ctx)
+	p.Layout = templates.LayoutMain
+	p.Name = templates.PageDestinations
+	p.Title = "Destinations"
+	p.Form = form.Get[destinationForm](ctx)
+	p.Data = destinationsData{
+		Job:   job,
+		Types: destinationTypes,
+	}
+
+	return h.RenderPage(ctx, p)
+}
+
+func (h *Destinations) Submit(ctx echo.Context) error {
+	job, err := loadUserJob(ctx, h.orm)
+	if err != nil {
+		return err
+	}
+
+	var input destinationForm
+
+	err = form.Submit(ctx, &input)
+	switch err.(type) {
+	case nil:
+	case validator.ValidationErrors:
+		return h.render(ctx, job)
+	default:
+		return err
+	}
+
+	dest := models.Destination{
+		JobID:           job.ID,
+		Name:            input.Name,
+		Type:            input.Type,
+		URL:             input.URL,
+		Method:          input.Method,
+		PayloadTemplate: input.Payload,
+		Token:           input.Token,
+	}
+
+	if input.Options != "" {
+		if err := json.Unmarshal([]byte(input.Options), &dest.Options); err != nil {
+			input.SetFieldError("Options", "Options must be a JSON object of strings.")
+		}
+	}
+
+	if input.Headers != "" {
+		if err := json.Unmarshal([]byte(input.Headers), &dest.Headers); err != nil {
+			input.SetFieldError("Headers", "Headers must be a JSON object of strings.")
+		}
+	}
+
+	if input.Match != "" {
+		if err := json.Unmarshal([]byte(input.Match), &dest.Match); err != nil {
+			input.SetFieldError("Match", "Match rules must be a JSON rule object.")
+		}
+	}
+
+	var jobErr *worker.JobError
+	if err := worker.ValidateDestination(job, dest); errors.As(err, &jobErr) {
+		input.SetFieldError(jobFormFields[jobErr.Field], jobErr.Err.Error())
+	}
+
+	// Pull API tokens are only compared with, the others are sealed for the worker to open
+	if dest.Type == models.DestinationTypePull {
+		dest.Token = secrets.Hash(dest.Token)
+	} else if dest.Token, err = h.secrets.Seal(dest.Token); err != nil {
+		input.SetFieldError("Token", "Unable to encrypt the token.")
+	}
+
+	if !input.IsValid() {
+		return h.render(ctx, job)
+	}
+
+	err = h.orm.WithContext(ctx.Request().Context()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&dest).Error; err != nil {
+			return err
+		}
+		return touchJob(tx, job)
+	})
+	if err != nil {
+		return fail(err, "unable to save the destination")
+	}
+
+	msg.Success(ctx, fmt.Sprintf("Destination <strong>%s</strong> added.", template.HTMLEscapeString(dest.Name)))
+
+	return redirect.New(ctx).
+		Route(routeNameJobDestinations).
+		Params(job.ID).
+		Go()
+}
+
+func (h *Destinations) Delete(ctx echo.Context) error {
+	job, err := loadUserJob(ctx, h.orm)
+	if err != nil {
+		return err
+	}
+
+	destID, err := strconv.Atoi(ctx.Param("destination"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	err = h.orm.WithContext(ctx.Request().Context()).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("id = ? AND job_id = ?", destID, job.ID).
+			Delete(&models.Destination{}).Error
+		if err != nil {
+			return err
+		}
+		return touchJob(tx, job)
+	})
+	if err != nil {
+		return fail(err, "unable to delete the destination")
+	}
+
+	return h.render(ctx, job)
+}
+
+// touchJob bumps the job's UpdatedAt, the worker recompiles a job once its version changes
+func touchJob(tx *gorm.DB, job *models.Job) error {
+	return tx.Model(job).Update("updated_at", time.Now()).Error
+}
@@ -35,6 +35,22 @@ func (e *Error) Page(err error, ctx echo.Context) {
 		logger.Warn(err.Error())
 	}
 
+	// API clients get the error as JSON
+	if isAPIRequest(ctx) {
+		message := http.StatusText(code)
+		if he, ok := err.(*echo.HTTPError); ok && code < 500 {
+			if m, ok := he.Message.(string); ok {
+				message = m
+			}
+		}
+		if err = ctx.JSON(code, map[string]string{"error": message}); err != nil {
+			log.Ctx(ctx).Error("failed to render error",
+				"error", err,
+			)
+		}
+		return
+	}
+
 	// Render the error page
 	p := page.New(ctx)
 	p.Layout = templates.LayoutMain
@@ -0,0 +1,519 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/log"
+	"gitea.v3m.net/idriss/gossiper/pkg/middleware"
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/page"
+	"gitea.v3m.net/idriss/gossiper/pkg/services"
+	"gitea.v3m.net/idriss/gossiper/templates"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	routeNameJobLive       = "job.live"
+	routeNameJobLiveEvents = "job.live.events"
+	routeNameJobLiveWS     = "job.live.ws"
+)
+
+const (
+	// livePollInterval is how often the delivery log is checked for new messages, while anyone is subscribed
+	livePollInterval = time.Second
+
+	// liveHeartbeat is how often idle streams are pinged so proxies keep them open
+	liveHeartbeat = 15 * time.Second
+
+	// liveRecent is the number of past messages the live inbox starts with
+	liveRecent = 10
+
+	// liveSincePage is the most messages streamed to a subscriber at once
+	liveSincePage = 100
+)
+
+type (
+	// Live streams the messages processed for a job as they arrive, over Server-Sent Events or a WebSocket
+	Live struct {
+		orm  *models.DB
+		feed *liveFeed
+		*services.TemplateRenderer
+	}
+
+	liveData struct {
+		Job    *models.Job
+		Events []liveEvent
+		After  int
+	}
+
+	// liveEvent is a processed message as streamed to subscribers, one per delivery of the message
+	liveEvent struct {
+		ID            int       `json:"id"`
+		MessageID     int       `json:"message_id"`
+		DestinationID int       `json:"destination_id,omitempty"`
+		From          string    `json:"from"`
+		Subject       string    `json:"subject"`
+		Status        string    `json:"status"`
+		StatusCode    int       `json:"status_code,omitempty"`
+		Detail        string    `json:"detail,omitempty"`
+		At            time.Time `json:"at"`
+	}
+
+	// liveFeed follows the delivery log, which the worker fills as it processes messages. A single poller checks it
+	// for every subscriber, and wakes those of the jobs that got new deliveries.
+	liveFeed struct {
+		orm       *models.DB
+		templates *services.TemplateRenderer
+		interval  time.Duration
+
+		mu          sync.Mutex
+		subscribers map[int]map[chan struct{}]struct{}
+		polling     bool
+	}
+)
+
+func init() {
+	Register(new(Live))
+}
+
+func (h *Live) Init(c *services.Container) error {
+	h.TemplateRenderer = c.TemplateRenderer
+	h.orm = c.ORM
+	h.feed = newLiveFeed(c.ORM, c.TemplateRenderer)
+	return nil
+}
+
+func (h *Live) Routes(g *echo.Group) {
+	g.GET("/jobs/:id/live", h.Page, middleware.RequireAuthentication()).Name = routeNameJobLive
+	g.GET("/jobs/:id/live/events", h.Events, middleware.RequireAuthentication()).Name = routeNameJobLiveEvents
+	g.GET("/jobs/:id/live/ws", h.WebSocket, middleware.RequireAuthentication()).Name = routeNameJobLiveWS
+}
+
+// Page renders the live inbox panel, which HTMX keeps up to date from the event stream
+func (h *Live) Page(ctx echo.Context) error {
+	job, err := loadUserJob(ctx, h.orm)
+	if err != nil {
+		return err
+	}
+
+	events, err := h.feed.recent(ctx.Request().Context(), job.ID, liveRecent)
+	if err != nil {
+		return fail(err, "unable to load messages")
+	}
+
+	p := page.New(ctx)
+	p.Layout = templates.LayoutMain
+	p.Name = templates.PageLive
+	p.Title = "Live inbox"
+	p.Data = liveData{
+		Job:    job,
+		Events: events,
+		After:  maxEventID(events),
+	}
+
+	return h.RenderPage(ctx, p)
+}
+
+// Events streams the job's messages as Server-Sent Events
+func (h *Live) Events(ctx echo.Context) error {
+	job, err := loadUserJob(ctx, h.orm)
+	if err != nil {
+		return err
+	}
+
+	return h.feed.serveSSE(ctx, job.ID)
+}
+
+// WebSocket streams the job's messages as JSON WebSocket messages
+func (h *Live) WebSocket(ctx echo.Context) error {
+	job, err := loadUserJob(ctx, h.orm)
+	if err != nil {
+		return err
+	}
+
+	// The session cookie authenticates the connection, so only pages of our origin may open it
+	return h.feed.serveWebSocket(ctx, job.ID, websocket.Upgrader{})
+}
+
+// isStreamRequest tells apart the long-lived streaming routes
+func isStreamRequest(ctx echo.Context) bool {
+	return strings.HasSuffix(ctx.Path(), "/live/events") || strings.HasSuffix(ctx.Path(), "/live/ws")
+}
+
+func newLiveFeed(orm *models.DB, templates *services.TemplateRenderer) *liveFeed {
+	return &liveFeed{
+		orm:       orm,
+		templates: templates,
+		interval:  livePollInterval,
+
+		subscribers: make(map[int]map[chan struct{}]struct{}),
+	}
+}
+
+// subscribe returns a channel signaled when the job gets new deliveries, starting the poller if it isn't running.
+// The channel starts signaled so the subscriber catches up first.
+func (f *liveFeed) subscribe(ctx context.Context, jobID int) (chan struct{}, error) {
+	wake := make(chan struct{}, 1)
+	wake <- struct{}{}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.polling {
+		// The poller starts from the latest delivery, subscribers catch up on the ones before on their own
+		var last int
+		err := f.orm.WithContext(ctx).
+			Model(&models.Delivery{}).
+			Select("COALESCE(MAX(id), 0)").
+			Scan(&last).Error
+		if err != nil {
+			return nil, err
+		}
+		f.polling = true
+		go f.poll(last)
+	}
+
+	if f.subscribers[jobID] == nil {
+		f.subscribers[jobID] = make(map[chan struct{}]struct{})
+	}
+	f.subscribers[jobID][wake] = struct{}{}
+	return wake, nil
+}
+
+func (f *liveFeed) unsubscribe(jobID int, wake chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.subscribers[jobID], wake)
+	if len(f.subscribers[jobID]) == 0 {
+		delete(f.subscribers, jobID)
+	}
+}
+
+// poll checks the delivery log for the jobs with deliveries after last, and wakes their subscribers,
+// until none are left
+func (f *liveFeed) poll(last int) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		f.mu.Lock()
+		if len(f.subscribers) == 0 {
+			f.polling = false
+			f.mu.Unlock()
+			return
+		}
+		f.mu.Unlock()
+
+		var jobs []struct {
+			JobID int
+			Last  int
+		}
+		err := f.orm.
+			Model(&models.Delivery{}).
+			Select("job_id, MAX(id) AS last").
+			Where("id > ?", last).
+			Group("job_id").
+			Scan(&jobs).Error
+		if err != nil {
+			log.Default().Error("unable to check for new deliveries", "error", err)
+			continue
+		}
+
+		f.mu.Lock()
+		for _, job := range jobs {
+			last = max(last, job.Last)
+			for wake := range f.subscribers[job.JobID] {
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+// recent returns the latest events of a job, newest first
+func (f *liveFeed) recent(ctx context.Context, jobID, limit int) ([]liveEvent, error) {
+	var deliveries []models.Delivery
+	err := f.orm.WithContext(ctx).
+		Where("job_id = ?", jobID).
+		Order("id DESC").
+		Limit(limit).
+		Find(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return f.events(ctx, deliveries)
+}
+
+// since returns the events of a job following the after event, oldest first
+func (f *liveFeed) since(ctx context.Context, jobID, after int) ([]liveEvent, error) {
+	var deliveries []models.Delivery
+	err := f.orm.WithContext(ctx).
+		Where("job_id = ? AND id > ?", jobID, after).
+		Order("id ASC").
+		Limit(liveSincePage).
+		Find(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return f.events(ctx, deliveries)
+}
+
+// events adds the sender and subject of their message to deliveries
+func (f *liveFeed) events(ctx context.Context, deliveries []models.Delivery) ([]liveEvent, error) {
+	messages, err := loadDeliveryMessages(ctx, f.orm, deliveries)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]liveEvent, 0, len(deliveries))
+	for _, d := range deliveries {
+		events = append(events, liveEvent{
+			ID:            d.ID,
+			MessageID:     d.SMTPMessageID,
+			DestinationID: d.DestinationID,
+			From:          messages[d.SMTPMessageID].From,
+			Subject:       messages[d.SMTPMessageID].Subject,
+			Status:        d.Status,
+			StatusCode:    d.StatusCode,
+			Detail:        d.Detail,
+			At:            d.CreatedAt,
+		})
+	}
+	return events, nil
+}
+
+// cursor returns the event a subscriber resumes after: the Last-Event-ID of a reconnecting EventSource,
+// the ?after= parameter, or else the latest event so only new messages are streamed
+func (f *liveFeed) cursor(ctx echo.Context, jobID int) (int, error) {
+	for _, v := range []string{ctx.Request().Header.Get("Last-Event-ID"), ctx.QueryParam("after")} {
+		if v == "" {
+			continue
+		}
+		after, err := strconv.Atoi(v)
+		if err != nil || after < 0 {
+			return 0, echo.NewHTTPError(http.StatusBadRequest, "invalid event ID")
+		}
+		return after, nil
+	}
+
+	events, err := f.recent(ctx.Request().Context(), jobID, 1)
+	if err != nil {
+		return 0, fail(err, "unable to load messages")
+	}
+	return maxEventID(events), nil
+}
+
+// follow calls send with every new event until ctx ends or send fails, and ping when idle
+func (f *liveFeed) follow(ctx context.Context, jobID, after int, send func(liveEvent) error, ping func() error) error {
+	wake, err := f.subscribe(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	defer f.unsubscribe(jobID, wake)
+
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-heartbeat.C:
+			if err := ping(); err != nil {
+				return err
+			}
+
+		case <-wake:
+			events, err := f.since(ctx, jobID, after)
+			if err != nil {
+				return err
+			}
+			for _, event := range events {
+				if err := send(event); err != nil {
+					return err
+				}
+				after = event.ID
+			}
+
+			// since returns a page at a time, the next one follows right away
+			if len(events) == liveSincePage {
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// serveSSE streams events as Server-Sent Events. With ?format=html, events carry a table row of the live inbox
+// rather than JSON, for the HTMX SSE extension to insert.
+func (f *liveFeed) serveSSE(ctx echo.Context, jobID int) error {
+	after, err := f.cursor(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	html := ctx.QueryParam("format") == "html"
+
+	// The stream outlasts the server's write timeout
+	rc := http.NewResponseController(ctx.Response())
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Ctx(ctx).Warn("unable to clear the write deadline", "error", err)
+	}
+
+	res := ctx.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	fmt.Fprint(res, "retry: 5000\n\n")
+	res.Flush()
+
+	send := func(event liveEvent) error {
+		data, err := f.format(event, html)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(res, "id: %d\nevent: delivery\n", event.ID)
+		for _, line := range strings.Split(data, "\n") {
+			fmt.Fprintf(res, "data: %s\n", line)
+		}
+		if _, err := fmt.Fprint(res, "\n"); err != nil {
+			return err
+		}
+		res.Flush()
+		return nil
+	}
+
+	ping := func() error {
+		if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+			return err
+		}
+		res.Flush()
+		return nil
+	}
+
+	if err := f.follow(ctx.Request().Context(), jobID, after, send, ping); err != nil {
+		log.Ctx(ctx).Debug("live stream ended", "error", err)
+	}
+	return nil
+}
+
+// serveWebSocket streams events as JSON text messages
+func (f *liveFeed) serveWebSocket(ctx echo.Context, jobID int, upgrader websocket.Upgrader) error {
+	after, err := f.cursor(ctx, jobID)
+	if err != nil {
+		return err
+	}
+
+	conn, err := upgrader.Upgrade(ctx.Response(), ctx.Request(), nil)
+	if err != nil {
+		// The upgrader already replied
+		return nil
+	}
+	defer conn.Close()
+
+	// Subscribers only listen, reading is how we notice they left
+	streamCtx, cancel := context.WithCancel(ctx.Request().Context())
+	defer cancel()
+	conn.SetReadLimit(512)
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(event liveEvent) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteJSON(event)
+	}
+
+	ping := func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+	}
+
+	err = f.follow(streamCtx, jobID, after, send, ping)
+	if err != nil {
+		log.Ctx(ctx).Debug("live stream ended", "error", err)
+	}
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return nil
+}
+
+// format encodes an event as JSON, or as a live inbox row
+func (f *liveFeed) format(event liveEvent, html bool) (string, error) {
+	if !html {
+		b, err := json.Marshal(event)
+		return string(b), err
+	}
+
+	tp, err := f.templates.
+		Parse().
+		Group("component").
+		Key("live").
+		Base("live").
+		Files("components/live").
+		Store()
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err := tp.Template.ExecuteTemplate(&b, "live-event", event); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func maxEventID(events []liveEvent) int {
+	var id int
+	for _, event := range events {
+		id = max(id, event.ID)
+	}
+	return id
+}
+
+// loadDeliveryMessages loads the sender and subject of the messages of deliveries, by ID
+func loadDeliveryMessages(ctx context.Context, orm *models.DB, deliveries []models.Delivery) (map[int]models.SMTPMessage, error) {
+	ids := make([]int, 0, len(deliveries))
+	for _, d := range deliveries {
+		ids = append(ids, d.SMTPMessageID)
+	}
+
+	messages := make(map[int]models.SMTPMessage, len(ids))
+	if len(ids) == 0 {
+		return messages, nil
+	}
+
+	var found []models.SMTPMessage
+	err := orm.WithContext(ctx).
+		Select("id", "from", "subject").
+		Where("id IN ?", ids).
+		Find(&found).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range found {
+		messages[m.ID] = m
+	}
+	return messages, nil
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	gocontext "gitea.v3m.net/idriss/gossiper/pkg/context"
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/secrets"
+	"gitea.v3m.net/idriss/gossiper/pkg/tests"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createLiveJob creates a job with a pull destination authenticating API requests, and a delivered message
+func createLiveJob(t *testing.T) (models.Job, models.Delivery) {
+	usr, err := tests.CreateUser(c.ORM)
+	require.NoError(t, err)
+
+	job := models.Job{Email: "live-" + usr.Email, URL: "https://example.com", UserID: usr.ID}
+	require.NoError(t, c.ORM.Create(&job).Error)
+	dest := models.Destination{JobID: job.ID, Name: "cli", Type: models.DestinationTypePull, Token: secrets.Hash(apiTestToken + "-live")}
+	require.NoError(t, c.ORM.Create(&dest).Error)
+
+	msg := models.SMTPMessage{To: job.Email, From: "alice@example.org", Subject: "Invoice <42>", Body: "Hello"}
+	require.NoError(t, c.ORM.Create(&msg).Error)
+	delivery := models.Delivery{JobID: job.ID, SMTPMessageID: msg.ID, Status: models.DeliveryStatusDelivered, StatusCode: 200}
+	require.NoError(t, c.ORM.Create(&delivery).Error)
+
+	return job, delivery
+}
+
+func TestLive_Events(t *testing.T) {
+	job, delivery := createLiveJob(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api"+c.Web.Reverse(routeNameJobLiveEvents, job.ID)+"?after=0", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+apiTestToken+"-live")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if strings.HasPrefix(scanner.Text(), "data: ") {
+			break
+		}
+	}
+	require.NoError(t, scanner.Err())
+
+	assert.Contains(t, lines, "event: delivery")
+	var event liveEvent
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[len(lines)-1], "data: ")), &event))
+	assert.Equal(t, delivery.ID, event.ID)
+	assert.Equal(t, "alice@example.org", event.From)
+	assert.Equal(t, "Invoice <42>", event.Subject)
+}
+
+func TestLive_WebSocket(t *testing.T) {
+	job, _ := createLiveJob(t)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api" + c.Web.Reverse(routeNameJobLiveWS, job.ID)
+	header := http.Header{"Authorization": {"Bearer " + apiTestToken + "-live"}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Only messages processed after subscribing are streamed
+	msg := models.SMTPMessage{To: job.Email, From: "bob@example.org", Subject: "Later", Body: "Hi"}
+	require.NoError(t, c.ORM.Create(&msg).Error)
+	require.NoError(t, c.ORM.Create(&models.Delivery{JobID: job.ID, SMTPMessageID: msg.ID, Status: models.DeliveryStatusFailed, Detail: "timeout"}).Error)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	var event liveEvent
+	require.NoError(t, conn.ReadJSON(&event))
+	assert.Equal(t, "Later", event.Subject)
+	assert.Equal(t, models.DeliveryStatusFailed, event.Status)
+	assert.Equal(t, "timeout", event.Detail)
+}
+
+func TestLive_WebSocketOtherOrigin(t *testing.T) {
+	job, _ := createLiveJob(t)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api" + c.Web.Reverse(routeNameJobLiveWS, job.ID)
+	header := http.Header{"Authorization": {"Bearer " + apiTestToken + "-live"}, "Origin": {"https://evil.example.com"}}
+	_, resp, err := websocket.DefaultDialer.Dial(url, header)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestLive_Unauthorized(t *testing.T) {
+	job, _ := createLiveJob(t)
+
+	resp, err := http.Get(srv.URL + c.Web.Reverse(routeNameJobLiveEvents, job.ID))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.NotEqual(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	resp, err = http.Get(srv.URL + "/api" + c.Web.Reverse(routeNameJobLiveEvents, job.ID))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestLive_APISession(t *testing.T) {
+	job, _ := createLiveJob(t)
+	other, err := tests.CreateUser(c.ORM)
+	require.NoError(t, err)
+
+	h := new(API)
+	require.NoError(t, h.Init(c))
+
+	authorize := func(usr *models.User) (int, error) {
+		ctx := c.Web.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+		ctx.SetParamNames("id")
+		ctx.SetParamValues(strconv.Itoa(job.ID))
+		ctx.Set(gocontext.AuthenticatedUserKey, usr)
+		return h.authorizeLive(ctx)
+	}
+
+	// The owner's dashboard follows the stream without a token
+	var owner models.User
+	require.NoError(t, c.ORM.First(&owner, job.UserID).Error)
+	jobID, err := authorize(&owner)
+	require.NoError(t, err)
+	assert.Equal(t, job.ID, jobID)
+
+	_, err = authorize(other)
+	tests.AssertHTTPErrorCode(t, err, http.StatusNotFound)
+}
+
+func TestLiveFeed_SharedPoller(t *testing.T) {
+	job, _ := createLiveJob(t)
+	quiet, _ := createLiveJob(t)
+
+	feed := newLiveFeed(c.ORM, c.TemplateRenderer)
+	feed.interval = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wake, err := feed.subscribe(ctx, job.ID)
+	require.NoError(t, err)
+	defer feed.unsubscribe(job.ID, wake)
+	quietWake, err := feed.subscribe(ctx, quiet.ID)
+	require.NoError(t, err)
+	defer feed.unsubscribe(quiet.ID, quietWake)
+
+	// Both start signaled to catch up
+	<-wake
+	<-quietWake
+
+	msg := models.SMTPMessage{To: job.Email, From: "bob@example.org", Subject: "Later", Body: "Hi"}
+	require.NoError(t, c.ORM.Create(&msg).Error)
+	require.NoError(t, c.ORM.Create(&models.Delivery{JobID: job.ID, SMTPMessageID: msg.ID, Status: models.DeliveryStatusDelivered}).Error)
+
+	select {
+	case <-wake:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscriber not woken")
+	}
+	select {
+	case <-quietWake:
+		t.Fatal("subscriber of another job woken")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestLiveFeed_FormatHTML(t *testing.T) {
+	feed := newLiveFeed(c.ORM, c.TemplateRenderer)
+
+	row, err := feed.format(liveEvent{ID: 3, From: "alice@example.org", Subject: "<b>Hi</b>", Status: models.DeliveryStatusRejected}, true)
+	require.NoError(t, err)
+	assert.Contains(t, row, `id="live-event-3"`)
+	assert.Contains(t, row, "&lt;b&gt;Hi&lt;/b&gt;")
+	assert.Contains(t, row, `<span class="tag is-light">rejected</span>`)
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/services"
+	"github.com/labstack/echo/v4"
+)
+
+const routeNameMetrics = "metrics"
+
+// Metrics exposes the message counts in the Prometheus text format
+type Metrics struct {
+	orm *models.DB
+}
+
+func init() {
+	Register(new(Metrics))
+}
+
+func (h *Metrics) Init(c *services.Container) error {
+	h.orm = c.ORM
+	return nil
+}
+
+func (h *Metrics) Routes(g *echo.Group) {
+	g.GET("/metrics", h.Page).Name = routeNameMetrics
+}
+
+func (h *Metrics) Page(ctx echo.Context) error {
+	counts, err := h.orm.CountMessagesByStatus(ctx.Request().Context())
+	if err != nil {
+		return fail(err, "unable to count messages")
+	}
+
+	var b strings.Builder
+	b.WriteString("# HELP gossiper_messages Number of received messages by delivery status.\n")
+	b.WriteString("# TYPE gossiper_messages gauge\n")
+	for _, status := range models.MessageStatuses {
+		fmt.Fprintf(&b, "gossiper_messages{status=%q} %d\n", status, counts[status])
+	}
+
+	return ctx.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
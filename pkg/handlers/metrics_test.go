@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	before, err := c.ORM.CountMessagesByStatus(t.Context())
+	require.NoError(t, err)
+
+	msg := models.SMTPMessage{To: "metrics@example.com", From: "a@example.org", Subject: "Hi", Body: "Hello", Status: models.MessageStatusDead}
+	require.NoError(t, c.ORM.Create(&msg).Error)
+
+	resp, err := http.Get(srv.URL + c.Web.Reverse(routeNameMetrics))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "# TYPE gossiper_messages gauge\n")
+	assert.Contains(t, string(body), `gossiper_messages{status="no_match"} `)
+	assert.Contains(t, string(body), `gossiper_messages{status="dead"} `+strconv.FormatInt(before[models.MessageStatusDead]+1, 10)+"\n")
+}
@@ -2,14 +2,24 @@ package handlers
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
 	echomw "github.com/labstack/echo/v4/middleware"
 	"gitea.v3m.net/idriss/gossiper/config"
 	"gitea.v3m.net/idriss/gossiper/pkg/middleware"
 	"gitea.v3m.net/idriss/gossiper/pkg/services"
 )
 
+// apiPrefix is the path of the routes used by API clients rather than browsers
+const apiPrefix = "/api"
+
+// isAPIRequest skips the browser specific middleware on API routes
+func isAPIRequest(ctx echo.Context) bool {
+	return strings.HasPrefix(ctx.Path(), apiPrefix+"/")
+}
+
 // BuildRouter builds the router
 func BuildRouter(c *services.Container) error {
 	// Static files with proper cache control
@@ -35,14 +45,23 @@ func BuildRouter(c *services.Container) error {
 		echomw.RequestID(),
 		middleware.SetLogger(),
 		middleware.LogRequest(),
-		echomw.Gzip(),
+		echomw.GzipWithConfig(echomw.GzipConfig{
+			// Streamed events must reach subscribers as soon as they are written
+			Skipper: isStreamRequest,
+		}),
 		echomw.TimeoutWithConfig(echomw.TimeoutConfig{
+			// API clients long-poll for messages, and subscribers keep streams open
+			Skipper: func(ctx echo.Context) bool {
+				return isAPIRequest(ctx) || isStreamRequest(ctx)
+			},
 			Timeout: c.Config.App.Timeout,
 		}),
 		middleware.Session(sessions.NewCookieStore([]byte(c.Config.App.EncryptionKey))),
 		middleware.LoadAuthenticatedUser(c.Auth),
 		middleware.ServeCachedPage(c.TemplateRenderer),
 		echomw.CSRFWithConfig(echomw.CSRFConfig{
+			// API clients authenticate with a bearer token instead of a session cookie
+			Skipper:     isAPIRequest,
 			TokenLookup: "form:csrf",
 		}),
 	)
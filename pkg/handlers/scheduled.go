@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/log"
+	"gitea.v3m.net/idriss/gossiper/pkg/middleware"
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/msg"
+	"gitea.v3m.net/idriss/gossiper/pkg/notify"
+	"gitea.v3m.net/idriss/gossiper/pkg/page"
+	"gitea.v3m.net/idriss/gossiper/pkg/redirect"
+	"gitea.v3m.net/idriss/gossiper/pkg/services"
+	"gitea.v3m.net/idriss/gossiper/templates"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	routeNameJobScheduled       = "job.scheduled"
+	routeNameJobScheduledCancel = "job.scheduled.cancel"
+	routeNameJobScheduledSend   = "job.scheduled.send"
+)
+
+type (
+	// Scheduled lists the deliveries a job's schedule holds back, which can be cancelled or sent right away
+	Scheduled struct {
+		orm      *models.DB
+		notifier notify.Notifier
+		*services.TemplateRenderer
+	}
+
+	scheduledData struct {
+		Job        *models.Job
+		Deliveries []scheduledDelivery
+	}
+
+	scheduledDelivery struct {
+		models.Delivery
+		Message models.SMTPMessage
+	}
+)
+
+func init() {
+	Register(new(Scheduled))
+}
+
+func (h *Scheduled) Init(c *services.Container) error {
+	h.TemplateRenderer = c.TemplateRenderer
+	h.orm = c.ORM
+	socket := notify.SocketPath(c.Config.Worker.NotifySocket, c.Config.Database.Connection)
+	h.notifier = notify.NewNotifier(c.Config.Database.Driver, c.Database, socket)
+	return nil
+}
+
+func (h *Scheduled) Routes(g *echo.Group) {
+	g.GET("/jobs/:id/scheduled", h.Page, middleware.RequireAuthentication()).Name = routeNameJobScheduled
+	g.POST("/jobs/:id/scheduled/cancel", h.Cancel, middleware.RequireAuthentication()).Name = routeNameJobScheduledCancel
+	g.POST("/jobs/:id/scheduled/send", h.Send, middleware.RequireAuthentication()).Name = routeNameJobScheduledSend
+}
+
+func (h *Scheduled) Page(ctx echo.Context) error {
+	job, err := loadUserJob(ctx, h.orm)
+	if err != nil {
+		return err
+	}
+
+	p := page.New(ctx)
+	p.Layout = templates.LayoutMain
+	p.Name = templates.PageScheduled
+	p.Title = "Scheduled deliveries"
+	p.Pager = page.NewPager(ctx, page.DefaultItemsPerPage)
+
+	var count int64
+	query := h.orm.WithContext(ctx.Request().Context()).
+		Model(&models.Delivery{}).
+		Where("job_id = ? AND status = ?", job.ID, models.DeliveryStatusScheduled)
+	if err := query.Count(&count).Error; err != nil {
+		return fail(err, "unable to count scheduled deliveries")
+	}
+	p.Pager.SetItems(int(count))
+
+	var deliveries []models.Delivery
+	err = query.
+		Order("scheduled_at ASC, id ASC").
+		Limit(p.Pager.ItemsPerPage).
+		Offset(p.Pager.GetOffset()).
+		Find(&deliveries).Error
+	if err != nil {
+		return fail(err, "unable to load scheduled deliveries")
+	}
+
+	messages, err := loadDeliveryMessages(ctx.Request().Context(), h.orm, deliveries)
+	if err != nil {
+		return fail(err, "unable to load messages")
+	}
+
+	data := scheduledData{Job: job}
+	for _, d := range deliveries {
+		data.Deliveries = append(data.Deliveries, scheduledDelivery{Delivery: d, Message: messages[d.SMTPMessageID]})
+	}
+	p.Data = data
+
+	return h.RenderPage(ctx, p)
+}
+
+// Cancel drops the selected scheduled deliveries, or all of them
+func (h *Scheduled) Cancel(ctx echo.Context) error {
+	return h.update(ctx, map[string]any{"status": models.DeliveryStatusCancelled, "detail": "cancelled"}, "%d delivery(ies) cancelled.")
+}
+
+// Send makes the selected scheduled deliveries, or all of them, due right away
+func (h *Scheduled) Send(ctx echo.Context) error {
+	return h.update(ctx, map[string]any{"scheduled_at": time.Now()}, "%d delivery(ies) queued to be sent now.")
+}
+
+// update applies updates to the scheduled deliveries picked in the form, then wakes the worker up
+func (h *Scheduled) update(ctx echo.Context, updates map[string]any, done string) error {
+	job, err := loadUserJob(ctx, h.orm)
+	if err != nil {
+		return err
+	}
+
+	query := h.orm.WithContext(ctx.Request().Context()).
+		Model(&models.Delivery{}).
+		Where("job_id = ? AND status = ?", job.ID, models.DeliveryStatusScheduled)
+
+	if query, err = selectedDeliveries(ctx, query); err != nil {
+		return err
+	}
+	if query == nil {
+		msg.Warning(ctx, "Select the scheduled deliveries first.")
+		return h.back(ctx, job)
+	}
+
+	res := query.Updates(updates)
+	if res.Error != nil {
+		return fail(res.Error, "unable to update the scheduled deliveries")
+	}
+
+	if err := h.notifier.Notify(ctx.Request().Context()); err != nil {
+		log.Ctx(ctx).Warn("failed to wake the worker", "error", err)
+	}
+
+	msg.Success(ctx, fmt.Sprintf(done, res.RowsAffected))
+	return h.back(ctx, job)
+}
+
+// selectedDeliveries narrows query down to the deliveries checked in the form, unless all of them were asked for.
+// It returns nil when none were checked.
+func selectedDeliveries(ctx echo.Context, query *gorm.DB) (*gorm.DB, error) {
+	if ctx.FormValue("all") != "" {
+		return query, nil
+	}
+
+	params, err := ctx.FormParams()
+	if err != nil {
+		return nil, fail(err, "unable to parse the form")
+	}
+
+	var ids []int
+	for _, v := range params["ids"] {
+		if id, err := strconv.Atoi(v); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return query.Where("id IN ?", ids), nil
+}
+
+func (h *Scheduled) back(ctx echo.Context, job *models.Job) error {
+	return redirect.New(ctx).
+		Route(routeNameJobScheduled).
+		Params(job.ID).
+		Go()
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/context"
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/tests"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduled_CancelAndSend(t *testing.T) {
+	usr, err := tests.CreateUser(c.ORM)
+	require.NoError(t, err)
+	job := models.Job{Email: "scheduled-" + usr.Email, URL: "https://example.com", UserID: usr.ID}
+	require.NoError(t, c.ORM.Create(&job).Error)
+
+	later := time.Now().Add(time.Hour)
+	scheduled := []models.Delivery{
+		{JobID: job.ID, Status: models.DeliveryStatusScheduled, ScheduledAt: later},
+		{JobID: job.ID, Status: models.DeliveryStatusScheduled, ScheduledAt: later},
+		{JobID: job.ID, Status: models.DeliveryStatusScheduled, ScheduledAt: later},
+	}
+	require.NoError(t, c.ORM.Create(&scheduled).Error)
+
+	post := func(action func(*Scheduled, echo.Context) error, form url.Values) {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := c.Web.NewContext(req, httptest.NewRecorder())
+		ctx.SetParamNames("id")
+		ctx.SetParamValues(strconv.Itoa(job.ID))
+		ctx.Set(context.AuthenticatedUserKey, usr)
+		tests.InitSession(ctx)
+
+		h := new(Scheduled)
+		require.NoError(t, h.Init(c))
+		require.NoError(t, action(h, ctx))
+	}
+
+	load := func(d models.Delivery) models.Delivery {
+		require.NoError(t, c.ORM.First(&d, d.ID).Error)
+		return d
+	}
+
+	post((*Scheduled).Send, url.Values{"ids": {strconv.Itoa(scheduled[0].ID)}})
+	sent := load(scheduled[0])
+	assert.Equal(t, models.DeliveryStatusScheduled, sent.Status)
+	assert.True(t, sent.ScheduledAt.Before(later), "expected the delivery to be due now")
+	assert.True(t, load(scheduled[1]).ScheduledAt.Equal(later))
+
+	post((*Scheduled).Cancel, url.Values{"ids": {strconv.Itoa(scheduled[1].ID)}})
+	assert.Equal(t, models.DeliveryStatusCancelled, load(scheduled[1]).Status)
+	assert.Equal(t, models.DeliveryStatusScheduled, load(scheduled[2]).Status)
+
+	post((*Scheduled).Cancel, url.Values{"all": {"1"}})
+	assert.Equal(t, models.DeliveryStatusCancelled, load(scheduled[0]).Status)
+	assert.Equal(t, models.DeliveryStatusCancelled, load(scheduled[2]).Status)
+}
@@ -26,11 +26,15 @@ func TestServeCachedPage(t *testing.T) {
 	p.Headers["a"] = "b"
 	p.Headers["c"] = "d"
 	p.Data = struct {
-		Jobs        interface{}
-		InputFields interface{}
+		Jobs          interface{}
+		InputFields   interface{}
+		ShowForm      bool
+		MessageCounts interface{}
 	}{
 		nil,
 		nil,
+		false,
+		nil,
 	}
 	err := c.TemplateRenderer.RenderPage(ctx, p)
 	output := rec.Body.Bytes()
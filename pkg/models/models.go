@@ -2,10 +2,13 @@ package models
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"strings"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // User represents a user in the system
@@ -61,17 +64,206 @@ type Job struct {
 	ID              int               `gorm:"primaryKey"`
 	Email           string            `gorm:"uniqueIndex;not null"` // Email address to watch
 	FromRegex       string            `gorm:"default:'.*'"`
-	URL             string            `gorm:"not null"` // Webhook URL
+	Match           *MatchRule        `gorm:"serializer:json"` // Optional: Conditions a message must meet on top of FromRegex
+	URL             string            `gorm:"not null"`        // Webhook URL
 	Method          string            `gorm:"default:'GET'"`
 	Headers         map[string]string `gorm:"serializer:json"`
 	PayloadTemplate string            `gorm:"type:text"`
-	Response        string            `gorm:"type:text"` // Optional: Email response to send back to sender
+	PayloadFormat   string            // Optional: One of the PayloadFormat* values, JSON when empty
+	Extract         []ExtractRule     `gorm:"serializer:json"` // Named values exposed to templates as {{.Vars.name}}
+	Response        string            `gorm:"type:text"`       // Optional: Email response to send back to sender
+	Transport       *TransportOptions `gorm:"serializer:json"` // Optional: HTTP client settings of the job's webhooks
+	Auth            *WebhookAuth      `gorm:"serializer:json"` // Optional: Credentials the job's webhooks authenticate with
+	Digest          *DigestOptions    `gorm:"serializer:json"` // Optional: Collects messages and delivers them together
+	Schedule        *DeliverySchedule `gorm:"serializer:json"` // Optional: Holds deliveries back for a delay or until a window opens
+	DedupWindow     int               // Optional: Seconds within which copies of a message are skipped, zero delivers them all
+	RateLimit       *RateLimit        `gorm:"serializer:json"` // Optional: Caps the messages delivered per minute or hour
 	IsActive        bool              `gorm:"default:true"`
 	UserID          int               `gorm:"not null;index"`
 	CreatedAt       time.Time         `gorm:"not null"`
+	UpdatedAt       time.Time         // Doubles as the job version for cached compiled templates
 
 	// Relations
-	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	User         User          `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	Destinations []Destination // When empty, the job delivers to its own URL
+}
+
+// TransportOptions tune the HTTP client a job's webhooks are sent with, when the defaults of the worker don't do.
+// ClientKey and Proxy are sealed with the app encryption key, as they may hold credentials.
+type TransportOptions struct {
+	Timeout    int    `json:"timeout,omitempty"`     // Request timeout in seconds, zero for the worker default
+	ClientCert string `json:"client_cert,omitempty"` // PEM certificate chain presented for mutual TLS
+	ClientKey  string `json:"client_key,omitempty"`  // Sealed PEM private key of ClientCert
+	CACert     string `json:"ca_cert,omitempty"`     // PEM bundle trusted instead of the system roots
+	Proxy      string `json:"proxy,omitempty"`       // Sealed proxy URL replacing the worker's one
+}
+
+// WebhookAuth authenticates the webhook calls of a job. Secret is sealed with the app encryption key
+// and never shown again once saved.
+type WebhookAuth struct {
+	Type     string `json:"type"`                // One of the Auth* values
+	Username string `json:"username,omitempty"`  // Basic auth user, or OAuth2 client ID
+	Secret   string `json:"secret,omitempty"`    // Sealed basic auth password, bearer token or OAuth2 client secret
+	TokenURL string `json:"token_url,omitempty"` // OAuth2 token endpoint
+	Scope    string `json:"scope,omitempty"`     // Space separated OAuth2 scopes
+}
+
+// DigestOptions make a job collect its messages and deliver them together, once the window is over
+// or MaxItems were collected. The job's templates then render the whole list of messages.
+type DigestOptions struct {
+	Window   int `json:"window"`              // Seconds messages are collected for
+	MaxItems int `json:"max_items,omitempty"` // Sends the digest early once this many messages were collected
+}
+
+// DeliverySchedule holds back the deliveries of a job. Each message waits for Delay, then for the
+// window to be open: from Start to End on Days, in Timezone. End before Start makes the window run
+// overnight, and a window without times is open all day.
+type DeliverySchedule struct {
+	Delay    int      `json:"delay,omitempty"`    // Seconds each message is held for, so it can be cancelled
+	Timezone string   `json:"timezone,omitempty"` // IANA name of the window's timezone, UTC when empty
+	Days     []string `json:"days,omitempty"`     // Days the window opens, "mon" to "sun", every day when empty
+	Start    string   `json:"start,omitempty"`    // Opening time of the window, such as "09:00"
+	End      string   `json:"end,omitempty"`      // Closing time of the window, such as "17:00"
+}
+
+// HasWindow tells whether deliveries wait for a window, rather than for the delay only
+func (s *DeliverySchedule) HasWindow() bool {
+	return len(s.Days) > 0 || s.Start != "" || s.End != ""
+}
+
+// RateLimit caps the messages delivered per minute and per hour, zero for no limit. Overflow tells
+// what happens to the messages over the limit, they are queued until it lets them through by default.
+type RateLimit struct {
+	PerMinute int    `json:"per_minute,omitempty"`
+	PerHour   int    `json:"per_hour,omitempty"`
+	Overflow  string `json:"overflow,omitempty"` // One of the Overflow* values
+}
+
+// Overflow policies of rate limits
+const (
+	OverflowQueue  = "queue"  // Delivered later, once the limit lets them through
+	OverflowDrop   = "drop"   // Skipped, with an entry in the delivery log
+	OverflowDigest = "digest" // Collected in an overflow digest of the job, apart from its regular ones, sent when the limit period is over
+)
+
+// OverflowPolicies lists the overflow policies of rate limits
+var OverflowPolicies = []string{OverflowQueue, OverflowDrop, OverflowDigest}
+
+// Webhook authentication types
+const (
+	AuthBasic  = "basic"
+	AuthBearer = "bearer"
+	AuthOAuth2 = "oauth2"
+)
+
+// Payload formats of the generic HTTP destinations of a job
+const (
+	PayloadFormatJSON              = "json"
+	PayloadFormatForm              = "form"
+	PayloadFormatMultipart         = "multipart"
+	PayloadFormatCloudEvents       = "cloudevents"
+	PayloadFormatCloudEventsBinary = "cloudevents_binary"
+	PayloadFormatRFC822            = "rfc822"
+)
+
+// PayloadFormats lists the payload formats in the order they are offered
+var PayloadFormats = []string{
+	PayloadFormatJSON,
+	PayloadFormatForm,
+	PayloadFormatMultipart,
+	PayloadFormatCloudEvents,
+	PayloadFormatCloudEventsBinary,
+	PayloadFormatRFC822,
+}
+
+// Destination is an endpoint a job fans messages out to.
+// Method, Headers and PayloadTemplate of HTTP destinations fall back to the job's when left empty.
+type Destination struct {
+	ID              int    `gorm:"primaryKey"`
+	JobID           int    `gorm:"not null;index"`
+	Name            string `gorm:"not null"`
+	Type            string `gorm:"default:'http'"` // One of the DestinationType* values
+	URL             string `gorm:"not null"`
+	Method          string
+	Headers         map[string]string `gorm:"serializer:json"`
+	PayloadTemplate string            `gorm:"type:text"` // For chat and push types, replaces the default message text
+	Token           string            // Sealed bot or access token of chat and push types or broker password, or the hash of the API token of pull destinations
+	Options         map[string]string `gorm:"serializer:json"` // Type specific settings, such as a Telegram chat_id or the mailboxes to forward to
+	Match           *MatchRule        `gorm:"serializer:json"` // Optional: Conditions routing a message to this destination
+	CreatedAt       time.Time         `gorm:"not null"`
+	UpdatedAt       time.Time
+
+	// Relations
+	Job Job `gorm:"foreignKey:JobID;constraint:OnDelete:CASCADE"`
+}
+
+// Destination types
+const (
+	DestinationTypeHTTP     = "http"
+	DestinationTypeSlack    = "slack"
+	DestinationTypeDiscord  = "discord"
+	DestinationTypeTeams    = "teams"
+	DestinationTypeMatrix   = "matrix"
+	DestinationTypeTelegram = "telegram"
+	DestinationTypeNtfy     = "ntfy"
+	DestinationTypeEmail    = "email"
+	DestinationTypeNATS     = "nats"
+	DestinationTypeAMQP     = "amqp"
+	DestinationTypeRedis    = "redis"
+	DestinationTypePull     = "pull"
+)
+
+// BeforeCreate is a GORM hook that sets the created_at timestamp
+func (d *Destination) BeforeCreate(tx *gorm.DB) error {
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now()
+	}
+	return nil
+}
+
+// MatchRule is a condition tree a message must satisfy for a job to deliver it.
+// A rule either combines other rules with And, Or or Not, or is a single condition of a Type.
+type MatchRule struct {
+	And []MatchRule `json:"and,omitempty"`
+	Or  []MatchRule `json:"or,omitempty"`
+	Not *MatchRule  `json:"not,omitempty"`
+
+	// Type is one of the MatchRule* condition types
+	Type string `json:"type,omitempty"`
+	// Header is the header name of header conditions, or spf, dkim or dmarc for auth conditions
+	Header string `json:"header,omitempty"`
+	// Value is the text, regex, size in bytes or expected auth result to compare with.
+	// Auth conditions compare with the verdicts of the SMTP server, never with headers of the message.
+	Value string `json:"value,omitempty"`
+}
+
+// Match rule condition types
+const (
+	MatchRuleSubjectRegex  = "subject_regex"
+	MatchRuleBodyContains  = "body_contains"
+	MatchRuleBodyRegex     = "body_regex"
+	MatchRuleHeaderEquals  = "header_equals"
+	MatchRuleHeaderRegex   = "header_regex"
+	MatchRuleHasAttachment = "has_attachment"
+	MatchRuleSizeAbove     = "size_above"
+	MatchRuleSizeBelow     = "size_below"
+	MatchRuleAuth          = "auth"
+)
+
+// ExtractRule pulls a named value, such as a code or a link, out of a message
+type ExtractRule struct {
+	Name string `json:"name"`
+	// Source is the part of the message to search: "body" (default), "subject" or "html"
+	Source string `json:"source,omitempty"`
+	// Kind is "regex" (default), "url" for the first link or "code" for the first numeric code
+	Kind string `json:"kind,omitempty"`
+	// Pattern is the regex to apply, its first capture group is used when it has one.
+	// For "url" rules it optionally filters which links are considered.
+	Pattern string `json:"pattern,omitempty"`
+	// Length is the number of digits of a "code", 6 when unset
+	Length int `json:"length,omitempty"`
+	// Required skips the delivery when nothing was extracted
+	Required bool `json:"required,omitempty"`
 }
 
 // BeforeCreate is a GORM hook that sets the created_at timestamp
@@ -82,25 +274,277 @@ func (j *Job) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
-// SMTPMessage represents an incoming SMTP message waiting to be processed
+// Delivery records what happened to a message for a given job
+type Delivery struct {
+	ID            int       `gorm:"primaryKey"`
+	JobID         int       `gorm:"not null;index"`
+	DestinationID int       // Zero when the job delivered to its own URL
+	SMTPMessageID int       `gorm:"index"` // Zero for the delivery of a digest
+	DigestID      int       `gorm:"index"` // The digest collecting the message, or the one delivered
+	ScheduledAt   time.Time `gorm:"index"` // When a scheduled delivery is sent
+	Status        string    `gorm:"not null;index"`
+	StatusCode    int       // HTTP status returned by the endpoint, if any
+	Attempts      int       // Number of delivery attempts, retries included
+	Detail        string    `gorm:"type:text"` // Rule that rejected the message, or the last delivery error
+	CreatedAt     time.Time `gorm:"not null;index"`
+
+	// Relations
+	Job Job `gorm:"foreignKey:JobID;constraint:OnDelete:CASCADE"`
+}
+
+// Delivery statuses
+const (
+	DeliveryStatusDelivered = "delivered"
+	DeliveryStatusFailed    = "failed"
+	DeliveryStatusRejected  = "rejected"
+	DeliveryStatusDigested  = "digested"  // Collected in a digest, delivered with it
+	DeliveryStatusDuplicate = "duplicate" // Skipped as a copy of a message received earlier
+	DeliveryStatusThrottled = "throttled" // Dropped by the rate limit of the job or its user
+
+	// Scheduled deliveries wait for their ScheduledAt time, they can be cancelled or sent right away until then
+	DeliveryStatusScheduled = "scheduled"
+	DeliveryStatusCancelled = "cancelled"
+
+	// Forwards follow the delivery of a message whose endpoint answered with addresses to forward it to,
+	// they are sent once and don't count towards the status of the message
+	DeliveryStatusForwarded     = "forwarded"
+	DeliveryStatusForwardFailed = "forward_failed"
+
+	// Dead deliveries failed on every attempt and wait in the job's dead letters to be replayed
+	DeliveryStatusDead      = "dead"
+	DeliveryStatusReplaying = "replaying"
+	DeliveryStatusReplayed  = "replayed"
+)
+
+// BeforeCreate is a GORM hook that sets the created_at timestamp
+func (d *Delivery) BeforeCreate(tx *gorm.DB) error {
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now()
+	}
+	return nil
+}
+
+// PullMessage is a message queued for a pull destination until an API client acknowledges it
+type PullMessage struct {
+	ID            int       `gorm:"primaryKey"`
+	JobID         int       `gorm:"not null;index"`
+	DestinationID int       `gorm:"not null;index"`
+	SMTPMessageID int       `gorm:"index"`
+	Payload       string    `gorm:"type:text"`
+	ContentType   string    `gorm:"not null"`
+	Receipt       string    // Changes every time the message is received, acks must present the latest one
+	Receives      int       `gorm:"default:0"`
+	VisibleAt     time.Time `gorm:"not null;index"` // Receivers don't see the message until then
+	CreatedAt     time.Time `gorm:"not null"`
+
+	// Relations
+	Job         Job         `gorm:"foreignKey:JobID;constraint:OnDelete:CASCADE"`
+	Destination Destination `gorm:"foreignKey:DestinationID;constraint:OnDelete:CASCADE"`
+}
+
+// BeforeCreate is a GORM hook that sets the created_at timestamp and makes the message visible
+func (pm *PullMessage) BeforeCreate(tx *gorm.DB) error {
+	if pm.CreatedAt.IsZero() {
+		pm.CreatedAt = time.Now()
+	}
+	if pm.VisibleAt.IsZero() {
+		pm.VisibleAt = pm.CreatedAt
+	}
+	return nil
+}
+
+// SMTPMessage represents an incoming SMTP message and where it is in its processing
 type SMTPMessage struct {
+	ID            int       `gorm:"primaryKey"`
+	To            string    `gorm:"not null;index"` // Recipient email (already filtered for valid hostname)
+	From          string    `gorm:"not null"`
+	Subject       string    `gorm:"not null"`
+	Body          string    `gorm:"type:text;not null"`
+	Raw           string    `gorm:"type:text"`                        // Full source of messages stored by earlier versions, see Source
+	MessageID     string    `gorm:"index"`                            // Message-ID header, used to spot copies of the message
+	ContentHash   string    `gorm:"index"`                            // Hash of the subject and body, used to spot copies of the message
+	Status        string    `gorm:"not null;default:'pending';index"` // One of the MessageStatus* values
+	Attempts      int       `gorm:"default:0"`
+	NextAttemptAt time.Time `gorm:"index"` // When the worker picks up a pending or retrying message
+	LastError     string    `gorm:"type:text"`
+	CreatedAt     time.Time `gorm:"not null;index"`
+
+	// Verdicts of the checks the SMTP server ran on the connection it received the message from
+	Auth AuthResults `gorm:"embedded;embeddedPrefix:auth_"`
+
+	// Full RFC 5322 source, used to give templates headers and MIME parts. It is stored once and shared
+	// by the rows of every recipient of the message.
+	SourceID *int `gorm:"index"`
+	Source   *MessageSource
+}
+
+// RawSource returns the full source of the message, empty when it was stored without one
+func (sm *SMTPMessage) RawSource() string {
+	if sm.Source != nil {
+		return sm.Source.Raw
+	}
+	return sm.Raw
+}
+
+// MessageSource is the full source of a received message, stored once for all of its recipients
+type MessageSource struct {
 	ID        int       `gorm:"primaryKey"`
-	To        string    `gorm:"not null;index"` // Recipient email (already filtered for valid hostname)
-	From      string    `gorm:"not null"`
-	Subject   string    `gorm:"not null"`
-	Body      string    `gorm:"type:text;not null"`
-	Processed bool      `gorm:"default:false;index"`
-	CreatedAt time.Time `gorm:"not null;index"`
+	Raw       string    `gorm:"type:text;not null"`
+	CreatedAt time.Time `gorm:"not null"`
 }
 
-// BeforeCreate is a GORM hook that sets the created_at timestamp
+// AuthResults holds the SPF, DKIM and DMARC verdicts of a received message.
+// Each field is a result keyword such as "pass", "fail" or "none", and empty when the check didn't run.
+type AuthResults struct {
+	SPF   string `json:"spf"`
+	DKIM  string `json:"dkim"`
+	DMARC string `json:"dmarc"`
+}
+
+// Message statuses. Pending and retrying messages wait for the worker, the others are settled:
+//
+//	pending -> no_match | duplicate | throttled | delivered | partially_failed | dead | retrying | scheduled
+//	retrying -> delivered | partially_failed | dead | retrying | scheduled | throttled
+//	scheduled -> delivered | partially_failed | dead | no_match
+//
+// Duplicate messages were skipped by every job as copies of earlier ones, throttled messages were dropped
+// by the rate limits of their jobs. Scheduled messages wait for
+// the scheduled deliveries of their jobs. Replaying dead letters settles a message again.
+// Legacy messages were processed by versions that didn't record how, without a delivery to tell.
+const (
+	MessageStatusPending         = "pending"
+	MessageStatusRetrying        = "retrying"
+	MessageStatusScheduled       = "scheduled"
+	MessageStatusNoMatch         = "no_match"
+	MessageStatusDelivered       = "delivered"
+	MessageStatusPartiallyFailed = "partially_failed"
+	MessageStatusDead            = "dead"
+	MessageStatusDuplicate       = "duplicate"
+	MessageStatusThrottled       = "throttled"
+	MessageStatusLegacy          = "legacy"
+)
+
+// MessageStatuses lists the message statuses, in the order they are shown
+var MessageStatuses = []string{
+	MessageStatusPending,
+	MessageStatusRetrying,
+	MessageStatusScheduled,
+	MessageStatusDelivered,
+	MessageStatusPartiallyFailed,
+	MessageStatusDead,
+	MessageStatusDuplicate,
+	MessageStatusThrottled,
+	MessageStatusNoMatch,
+	MessageStatusLegacy,
+}
+
+// BeforeCreate is a GORM hook that sets the created_at timestamp and content hash, and schedules the message right away
 func (sm *SMTPMessage) BeforeCreate(tx *gorm.DB) error {
+	if sm.ContentHash == "" {
+		sm.ContentHash = ContentHash(sm.Subject, sm.Body)
+	}
 	if sm.CreatedAt.IsZero() {
 		sm.CreatedAt = time.Now()
 	}
+	if sm.Status == "" {
+		sm.Status = MessageStatusPending
+	}
+	if sm.NextAttemptAt.IsZero() {
+		sm.NextAttemptAt = sm.CreatedAt
+	}
 	return nil
 }
 
+// ContentHash identifies the content of a message, copies sent again get the same hash
+func ContentHash(subject, body string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(subject) + "\x00" + strings.TrimSpace(body)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Digest collects the messages of a job with DigestOptions, or those over its rate limit, until it is closed and delivered
+type Digest struct {
+	ID            int       `gorm:"primaryKey"`
+	JobID         int       `gorm:"not null;index"`
+	Status        string    `gorm:"not null;default:'open';index"` // One of the DigestStatus* values
+	Count         int       // Messages collected
+	ClosesAt      time.Time `gorm:"not null"` // End of the window
+	Attempts      int
+	NextAttemptAt time.Time `gorm:"index"` // When a retrying digest is sent again
+	LastError     string    `gorm:"type:text"`
+	CreatedAt     time.Time `gorm:"not null"`
+
+	// Overflow digests collect the messages over the job's rate limit, apart from its regular digests
+	Overflow bool `gorm:"not null;default:false"`
+
+	// Relations
+	Job Job `gorm:"foreignKey:JobID;constraint:OnDelete:CASCADE"`
+}
+
+// Digest statuses. Open digests collect messages, closed ones wait for the worker to deliver them:
+//
+//	open -> closed -> sent | failed | retrying
+//	retrying -> sent | failed | retrying
+const (
+	DigestStatusOpen     = "open"
+	DigestStatusClosed   = "closed"
+	DigestStatusRetrying = "retrying"
+	DigestStatusSent     = "sent"
+	DigestStatusFailed   = "failed"
+)
+
+// DigestItem is a message collected in a digest
+type DigestItem struct {
+	DigestID      int `gorm:"primaryKey"`
+	SMTPMessageID int `gorm:"primaryKey"`
+
+	// Relations
+	Digest      Digest      `gorm:"foreignKey:DigestID;constraint:OnDelete:CASCADE"`
+	SMTPMessage SMTPMessage `gorm:"foreignKey:SMTPMessageID;constraint:OnDelete:CASCADE"`
+}
+
+// BeforeCreate is a GORM hook that sets the created_at timestamp
+func (d *Digest) BeforeCreate(tx *gorm.DB) error {
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now()
+	}
+	return nil
+}
+
+// CloseDigest closes the window of an open digest so the worker delivers it, closed digests are left as they are
+func (db *DB) CloseDigest(ctx context.Context, id int) error {
+	return db.DB.WithContext(ctx).
+		Model(&Digest{}).
+		Where("id = ? AND status = ?", id, DigestStatusOpen).
+		Update("status", DigestStatusClosed).Error
+}
+
+// CircuitBreaker is the state of the circuit breaker guarding a destination host. The worker keeps it
+// so the dashboard can show which endpoints are failing fast.
+type CircuitBreaker struct {
+	Host      string    `gorm:"primaryKey"`
+	State     string    `gorm:"not null"` // One of the Circuit* values
+	Failures  int       // Consecutive failures
+	LastError string    `gorm:"type:text"`
+	OpenedAt  time.Time // When the circuit last opened
+	RetryAt   time.Time // When an open circuit lets a probe through
+	UpdatedAt time.Time
+}
+
+// Circuit breaker states
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// RateEvent is an event counted by a rate limit, such as a delivery of a job or a request to a host.
+// The worker keeps the recent ones so its limits hold across restarts.
+type RateEvent struct {
+	ID  int       `gorm:"primaryKey"`
+	Key string    `gorm:"not null"` // What the event counts against, such as "job:3" or "host:api.example.com"
+	At  time.Time `gorm:"not null;index"`
+}
+
 // DB wraps gorm.DB with additional helper methods
 type DB struct {
 	*gorm.DB
@@ -118,10 +562,88 @@ func (db *DB) WithContext(ctx context.Context) *DB {
 
 // AutoMigrate runs auto migration for all models
 func (db *DB) AutoMigrate() error {
-	return db.DB.AutoMigrate(
+	err := db.DB.AutoMigrate(
 		&User{},
 		&PasswordToken{},
 		&Job{},
+		&Destination{},
+		&MessageSource{},
 		&SMTPMessage{},
+		&Delivery{},
+		&PullMessage{},
+		&CircuitBreaker{},
+		&RateEvent{},
+		&Digest{},
+		&DigestItem{},
 	)
+	if err != nil {
+		return err
+	}
+
+	return db.migrateMessageStatus()
+}
+
+// CountMessagesByStatus counts the messages in each status, limited to the given recipients unless none are given.
+// Every status is present in the result.
+func (db *DB) CountMessagesByStatus(ctx context.Context, recipients ...string) (map[string]int64, error) {
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+
+	query := db.DB.WithContext(ctx).Model(&SMTPMessage{}).Select("status, COUNT(*) AS count").Group("status")
+	if len(recipients) > 0 {
+		values := make([]any, len(recipients))
+		for i, recipient := range recipients {
+			values[i] = recipient
+		}
+		// The column is quoted by the dialect, to is a reserved word
+		query = query.Where(clause.IN{Column: clause.Column{Name: "to"}, Values: values})
+	}
+	if err := query.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(MessageStatuses))
+	for _, status := range MessageStatuses {
+		counts[status] = 0
+	}
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, nil
+}
+
+// migrateMessageStatus replaces the processed flag of messages stored by earlier versions with a status,
+// settled messages get the one their deliveries point to. Those without deliveries may have matched no job, or
+// have been delivered before deliveries were logged, they are left as legacy rather than guessed.
+func (db *DB) migrateMessageStatus() error {
+	migrator := db.DB.Migrator()
+	if !migrator.HasColumn(&SMTPMessage{}, "processed") {
+		return nil
+	}
+
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		delivered := "EXISTS (SELECT 1 FROM deliveries WHERE deliveries.smtp_message_id = smtp_messages.id AND deliveries.status = 'delivered')"
+		failed := "EXISTS (SELECT 1 FROM deliveries WHERE deliveries.smtp_message_id = smtp_messages.id AND deliveries.status IN ('failed', 'dead'))"
+
+		err := tx.Exec(`UPDATE smtp_messages SET status = CASE
+			WHEN NOT processed THEN ?
+			WHEN `+delivered+` AND `+failed+` THEN ?
+			WHEN `+delivered+` THEN ?
+			WHEN `+failed+` THEN ?
+			ELSE ? END,
+			next_attempt_at = created_at`,
+			MessageStatusPending,
+			MessageStatusPartiallyFailed,
+			MessageStatusDelivered,
+			MessageStatusDead,
+			MessageStatusLegacy,
+		).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Migrator().DropColumn(&SMTPMessage{}, "processed")
+	})
 }
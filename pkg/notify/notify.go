@@ -0,0 +1,243 @@
+package notify
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// Channel is the Postgres channel used to signal that new SMTP messages were stored
+	Channel = "gossiper_smtp_messages"
+
+	// PullChannel is the Postgres channel used to signal that messages were queued for pull API clients
+	PullChannel = "gossiper_pull_messages"
+)
+
+type (
+	// Notifier signals listeners that new messages are waiting to be processed
+	Notifier interface {
+		Notify(ctx context.Context) error
+	}
+
+	// Listener delivers wakeups sent by a Notifier.
+	// Wakeups are coalesced, so a single receive may stand for several notifications.
+	Listener interface {
+		C() <-chan struct{}
+		Close() error
+	}
+)
+
+// NewNotifier creates the Notifier matching the database driver.
+// Postgres deployments use NOTIFY, everything else writes to a local unix socket.
+func NewNotifier(driver string, db *sql.DB, socket string) Notifier {
+	return NewChannelNotifier(driver, db, Channel, socket)
+}
+
+// NewListener creates the Listener matching the database driver
+func NewListener(driver, connection, socket string) (Listener, error) {
+	return NewChannelListener(driver, connection, Channel, socket)
+}
+
+// NewChannelNotifier creates a Notifier for another channel than Channel, socket is the channel's own socket
+func NewChannelNotifier(driver string, db *sql.DB, channel, socket string) Notifier {
+	if driver == "postgres" {
+		return &pgNotifier{db: db, channel: channel}
+	}
+	return &socketNotifier{path: socket}
+}
+
+// NewChannelListener creates a Listener for another channel than Channel, socket is the channel's own socket
+func NewChannelListener(driver, connection, channel, socket string) (Listener, error) {
+	if driver == "postgres" {
+		return newPGListener(connection, channel)
+	}
+	return newSocketListener(socket)
+}
+
+// SocketPath resolves the notify socket of a SQLite database. The SMTP server and the worker run as separate
+// processes, often in separate containers, so a relative path is taken from the directory of the database file
+// they share rather than from their working directories. The socket must be on a volume both can reach.
+func SocketPath(socket, connection string) string {
+	if socket == "" || filepath.IsAbs(socket) {
+		return socket
+	}
+
+	file, _, _ := strings.Cut(strings.TrimPrefix(connection, "file:"), "?")
+	if file == "" || strings.HasPrefix(file, ":memory:") {
+		return socket
+	}
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return socket
+	}
+	return filepath.Join(dir, socket)
+}
+
+// pgNotifier notifies through Postgres NOTIFY
+type pgNotifier struct {
+	db      *sql.DB
+	channel string
+}
+
+func (n *pgNotifier) Notify(ctx context.Context) error {
+	_, err := n.db.ExecContext(ctx, "SELECT pg_notify($1, '')", n.channel)
+	return err
+}
+
+// pgListener listens through Postgres LISTEN
+type pgListener struct {
+	listener *pq.Listener
+	c        chan struct{}
+	done     chan struct{}
+}
+
+func newPGListener(connection, channel string) (*pgListener, error) {
+	l := &pgListener{
+		c:    make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+
+	l.listener = pq.NewListener(connection, time.Second, time.Minute, nil)
+	if err := l.listener.Listen(channel); err != nil {
+		l.listener.Close()
+		return nil, fmt.Errorf("failed to listen on %s: %w", channel, err)
+	}
+
+	go l.run()
+	return l, nil
+}
+
+func (l *pgListener) run() {
+	for {
+		select {
+		case <-l.done:
+			return
+		case _, ok := <-l.listener.Notify:
+			if !ok {
+				return
+			}
+			// A nil notification means the connection was re-established, in which case
+			// messages may have been missed, so waking up is the safe thing to do
+			wake(l.c)
+		}
+	}
+}
+
+func (l *pgListener) C() <-chan struct{} {
+	return l.c
+}
+
+func (l *pgListener) Close() error {
+	close(l.done)
+	return l.listener.Close()
+}
+
+// socketNotifier notifies through a unix datagram socket
+type socketNotifier struct {
+	path string
+	// failing is set once a failure was reported, the following ones are quiet until a notification goes through
+	failing atomic.Bool
+}
+
+// Notify wakes the worker. The worker picks the message up on its next poll when this fails,
+// so only the first of consecutive failures is returned, for the caller to log once.
+func (n *socketNotifier) Notify(ctx context.Context) error {
+	if n.path == "" {
+		return nil
+	}
+
+	err := n.send(ctx)
+	if err == nil {
+		n.failing.Store(false)
+		return nil
+	}
+	if n.failing.Swap(true) {
+		return nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no worker listening on %s, it must be on a volume shared with the worker: %w", n.path, err)
+	}
+	return err
+}
+
+func (n *socketNotifier) send(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unixgram", n.path)
+	if err != nil {
+		return fmt.Errorf("failed to dial notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{1})
+	return err
+}
+
+// socketListener listens on a unix datagram socket
+type socketListener struct {
+	conn *net.UnixConn
+	path string
+	c    chan struct{}
+}
+
+func newSocketListener(path string) (*socketListener, error) {
+	if path == "" {
+		return nil, errors.New("notify socket path is not set")
+	}
+
+	// Remove a socket left behind by a previous run
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale notify socket: %w", err)
+	}
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on notify socket: %w", err)
+	}
+
+	l := &socketListener{
+		conn: conn,
+		path: path,
+		c:    make(chan struct{}, 1),
+	}
+
+	go l.run()
+	return l, nil
+}
+
+func (l *socketListener) run() {
+	buf := make([]byte, 16)
+	for {
+		if _, err := l.conn.Read(buf); err != nil {
+			return
+		}
+		wake(l.c)
+	}
+}
+
+func (l *socketListener) C() <-chan struct{} {
+	return l.c
+}
+
+func (l *socketListener) Close() error {
+	err := l.conn.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// wake signals the channel without blocking when a wakeup is already pending
+func wake(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSocket_NotifyWakesListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "worker.sock")
+
+	l, err := NewListener("sqlite3", "", path)
+	require.NoError(t, err)
+	defer l.Close()
+
+	n := NewNotifier("sqlite3", nil, path)
+	require.NoError(t, n.Notify(context.Background()))
+
+	select {
+	case <-l.C():
+	case <-time.After(time.Second):
+		t.Fatal("listener was not woken up")
+	}
+}
+
+func TestSocket_NotificationsAreCoalesced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "worker.sock")
+
+	l, err := NewListener("sqlite3", "", path)
+	require.NoError(t, err)
+	defer l.Close()
+
+	n := NewNotifier("sqlite3", nil, path)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, n.Notify(context.Background()))
+	}
+
+	select {
+	case <-l.C():
+	case <-time.After(time.Second):
+		t.Fatal("listener was not woken up")
+	}
+
+	// Give the remaining datagrams time to be read, they must not queue up further wakeups
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-l.C():
+	default:
+	}
+	select {
+	case <-l.C():
+		t.Fatal("expected pending wakeups to be coalesced")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSocket_NotifyWithoutListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.sock")
+	n := NewNotifier("sqlite3", nil, path)
+	assert.ErrorContains(t, n.Notify(context.Background()), "shared with the worker")
+	assert.NoError(t, n.Notify(context.Background()), "expected a failure to be reported once")
+
+	// A listener showing up ends the failure, the next one is reported again
+	l, err := NewListener("sqlite3", "", path)
+	require.NoError(t, err)
+	require.NoError(t, n.Notify(context.Background()))
+	l.Close()
+	assert.Error(t, n.Notify(context.Background()))
+
+	n = NewNotifier("sqlite3", nil, "")
+	assert.NoError(t, n.Notify(context.Background()))
+}
+
+func TestNewListener_MissingSocketPath(t *testing.T) {
+	_, err := NewListener("sqlite3", "", "")
+	assert.Error(t, err)
+}
+
+func TestSocketPath(t *testing.T) {
+	dir, err := filepath.Abs("dbs")
+	require.NoError(t, err)
+
+	assert.Equal(t, filepath.Join(dir, "worker.sock"), SocketPath("worker.sock", "dbs/main.db?_journal=WAL&_fk=true"))
+	assert.Equal(t, filepath.Join(dir, "worker.sock"), SocketPath("worker.sock", "file:dbs/main.db"))
+	assert.Equal(t, "/run/gossiper/worker.sock", SocketPath("/run/gossiper/worker.sock", "dbs/main.db"))
+	assert.Equal(t, "worker.sock", SocketPath("worker.sock", ":memory:?_fk=true"))
+	assert.Equal(t, "", SocketPath("", "dbs/main.db"))
+}
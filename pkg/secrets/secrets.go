@@ -0,0 +1,112 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// prefix marks sealed values, and the format they were sealed with
+const prefix = "v1:"
+
+// hashPrefix marks token hashes, and the function they were hashed with
+const hashPrefix = "sha256:"
+
+// ErrNotSealed is returned when opening a value that wasn't sealed
+var ErrNotSealed = errors.New("value is not sealed")
+
+// Box seals the secrets stored in the database, such as job credentials, with AES-GCM.
+// The web server and the worker share the key through the app encryption key.
+type Box struct {
+	aead cipher.AEAD
+}
+
+// New creates a box deriving its AES-256 key from key
+func New(key string) (*Box, error) {
+	if key == "" {
+		return nil, errors.New("an encryption key is required")
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Box{aead: aead}, nil
+}
+
+// Seal encrypts plaintext, empty values stay empty
+func (b *Box) Seal(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return prefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value returned by Seal
+func (b *Box) Open(sealed string) (string, error) {
+	if sealed == "" {
+		return "", nil
+	}
+	if !IsSealed(sealed) {
+		return "", ErrNotSealed
+	}
+
+	data, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(sealed, prefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode sealed value: %w", err)
+	}
+	if len(data) < b.aead.NonceSize() {
+		return "", errors.New("sealed value is too short")
+	}
+
+	nonce, ciphertext := data[:b.aead.NonceSize()], data[b.aead.NonceSize():]
+	plaintext, err := b.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt sealed value: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// DeriveKey derives a 32 byte key for a single purpose from key with HKDF, label names the purpose
+// so keys of different purposes are unrelated
+func DeriveKey(key, label string) ([]byte, error) {
+	if key == "" {
+		return nil, errors.New("an encryption key is required")
+	}
+	return hkdf.Key(sha256.New, []byte(key), nil, label, 32)
+}
+
+// Hash returns the digest of a token stored in place of the token, for those only ever compared with
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hashPrefix + hex.EncodeToString(sum[:])
+}
+
+// Verify tells whether token hashes to hash, in constant time
+func Verify(hash, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(Hash(token))) == 1
+}
+
+// IsSealed tells whether value was returned by Seal
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
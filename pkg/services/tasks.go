@@ -63,6 +63,12 @@ type (
 
 // NewTaskClient creates a new task client
 func NewTaskClient(cfg config.TasksConfig, db *sql.DB) (*TaskClient, error) {
+	return NewNamedTaskClient(cfg, db, "tasks")
+}
+
+// NewNamedTaskClient creates a task client of its own queue, so its runner only receives the tasks added to it
+// rather than those of every queue registered with the main client
+func NewNamedTaskClient(cfg config.TasksConfig, db *sql.DB, name string) (*TaskClient, error) {
 	// Install the schema
 	if err := goqite.Setup(context.Background(), db); err != nil {
 		// An error is returned if we already ran this and there's no better way to check.
@@ -75,7 +81,7 @@ func NewTaskClient(cfg config.TasksConfig, db *sql.DB) (*TaskClient, error) {
 	t := &TaskClient{
 		queue: goqite.New(goqite.NewOpts{
 			DB:         db,
-			Name:       "tasks",
+			Name:       name,
 			MaxReceive: cfg.MaxRetries,
 		}),
 		buffers: sync.Pool{
@@ -67,3 +67,26 @@ waitLoop:
 
 	assert.True(t, subCalled)
 }
+
+func TestNamedTaskClient(t *testing.T) {
+	client, err := NewNamedTaskClient(c.Config.Tasks, c.QueueDatabase, "named")
+	require.NoError(t, err)
+
+	called := make(chan int, 1)
+	client.Register(NewQueue[testTask](func(ctx context.Context, task testTask) error {
+		called <- task.Val
+		return nil
+	}))
+	require.NoError(t, client.New(testTask{Val: 7}).Save())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.StartRunner(ctx)
+
+	select {
+	case val := <-called:
+		assert.Equal(t, 7, val)
+	case <-time.After(5 * time.Second):
+		t.Fatal("task not executed")
+	}
+}
@@ -92,11 +92,15 @@ func TestTemplateRenderer_RenderPage(t *testing.T) {
 		p.Headers["C"] = "d"
 		p.StatusCode = http.StatusCreated
 		p.Data = struct {
-			Jobs        interface{}
-			InputFields interface{}
+			Jobs          interface{}
+			InputFields   interface{}
+			ShowForm      bool
+			MessageCounts interface{}
 		}{
 			nil,
 			nil,
+			false,
+			nil,
 		}
 		return ctx, rec, p
 	}
@@ -0,0 +1,143 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/spf"
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+// authTimeout bounds the DNS lookups of the checks of a message. They run while the client waits for
+// the reply to DATA, checks that run out of time end up as temperror.
+const authTimeout = 4 * time.Second
+
+// maxSignatures caps the DKIM signatures verified per message, the others are ignored
+const maxSignatures = 5
+
+// Resolver looks up the DNS records the SPF, DKIM and DMARC checks need, *net.Resolver implements it
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// authenticate runs the SPF, DKIM and DMARC checks of a message received from ip.
+// The verdicts come from the connection and DNS only, Authentication-Results headers in the message are ignored.
+func authenticate(resolver Resolver, ip net.IP, helo, mailFrom string, raw []byte) models.AuthResults {
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	defer cancel()
+	lookupTXT := func(name string) ([]string, error) {
+		return resolver.LookupTXT(ctx, name)
+	}
+
+	var results models.AuthResults
+	var spfDomain string
+	if ip != nil {
+		result, _ := spf.CheckHostWithSender(ip, helo, mailFrom, spf.WithContext(ctx), spf.WithResolver(resolver))
+		results.SPF = string(result)
+		spfDomain = domainOf(mailFrom)
+		if spfDomain == "" {
+			// Null senders are checked against the HELO name
+			spfDomain = strings.ToLower(helo)
+		}
+	}
+
+	var dkimDomains []string
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(raw), &dkim.VerifyOptions{LookupTXT: lookupTXT, MaxVerifications: maxSignatures})
+	switch {
+	case err != nil && !errors.Is(err, dkim.ErrTooManySignatures):
+		results.DKIM = "permerror"
+	case len(verifications) == 0:
+		results.DKIM = "none"
+	default:
+		results.DKIM = "fail"
+		for _, v := range verifications {
+			if v.Err == nil {
+				results.DKIM = "pass"
+				dkimDomains = append(dkimDomains, strings.ToLower(v.Domain))
+			} else if dkim.IsTempFail(v.Err) && results.DKIM != "pass" {
+				results.DKIM = "temperror"
+			}
+		}
+	}
+
+	results.DMARC = checkDMARC(raw, lookupTXT, results.SPF == string(spf.Pass), spfDomain, dkimDomains)
+	return results
+}
+
+// checkDMARC evaluates the DMARC policy of the domain of the From header against the SPF and DKIM results
+func checkDMARC(raw []byte, lookupTXT func(string) ([]string, error), spfPass bool, spfDomain string, dkimDomains []string) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "permerror"
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return "permerror"
+	}
+	domain := domainOf(from.Address)
+
+	// Without a record of its own, the domain falls under the policy of its organizational domain
+	record, err := dmarc.LookupWithOptions(domain, &dmarc.LookupOptions{LookupTXT: lookupTXT})
+	if errors.Is(err, dmarc.ErrNoPolicy) {
+		if org := organizationalDomain(domain); org != domain {
+			record, err = dmarc.LookupWithOptions(org, &dmarc.LookupOptions{LookupTXT: lookupTXT})
+		}
+	}
+	switch {
+	case errors.Is(err, dmarc.ErrNoPolicy):
+		return "none"
+	case dmarc.IsTempFail(err):
+		return "temperror"
+	case err != nil:
+		return "permerror"
+	}
+
+	if spfPass && aligned(domain, spfDomain, record.SPFAlignment) {
+		return "pass"
+	}
+	for _, d := range dkimDomains {
+		if aligned(domain, d, record.DKIMAlignment) {
+			return "pass"
+		}
+	}
+	return "fail"
+}
+
+// aligned tells whether an authenticated domain matches the From domain, relaxed alignment is the default
+func aligned(from, authenticated string, mode dmarc.AlignmentMode) bool {
+	if authenticated == "" {
+		return false
+	}
+	if mode == dmarc.AlignmentStrict {
+		return from == authenticated
+	}
+	return organizationalDomain(from) == organizationalDomain(authenticated)
+}
+
+// organizationalDomain returns the registered domain of domain, or domain itself when it has none
+func organizationalDomain(domain string) string {
+	if org, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return org
+	}
+	return domain
+}
+
+// domainOf returns the lowercased domain of an address, empty when it has none
+func domainOf(address string) string {
+	_, domain, ok := strings.Cut(strings.Trim(address, "<>"), "@")
+	if !ok {
+		return ""
+	}
+	return strings.ToLower(domain)
+}
@@ -0,0 +1,90 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// fakeResolver answers TXT lookups from a map and finds nothing else
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := r[strings.TrimSuffix(name, ".")]; ok {
+		return txt, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+const forgedEmail = "From: Alice <alice@example.org>\r\n" +
+	"To: hook@example.com\r\n" +
+	"Subject: Invoice\r\n" +
+	"Authentication-Results: example.com; spf=pass smtp.mailfrom=example.org; dkim=pass header.d=example.org; dmarc=pass\r\n" +
+	"\r\n" +
+	"Pay now\r\n"
+
+func TestAuthenticate(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := fakeResolver{
+		"example.org":                          {"v=spf1 ip4:192.0.2.10 -all"},
+		"_dmarc.example.org":                   {"v=DMARC1; p=reject"},
+		"mail._domainkey.example.org":          {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(public)},
+		"mail._domainkey.attacker.example.net": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(public)},
+	}
+
+	sign := func(domain string) []byte {
+		t.Helper()
+		var signed bytes.Buffer
+		options := &dkim.SignOptions{Domain: domain, Selector: "mail", Signer: private}
+		if err := dkim.Sign(&signed, strings.NewReader(forgedEmail), options); err != nil {
+			t.Fatal(err)
+		}
+		return signed.Bytes()
+	}
+
+	for _, tt := range []struct {
+		name     string
+		ip       string
+		raw      []byte
+		expected models.AuthResults
+	}{
+		{"forged headers", "198.51.100.7", []byte(forgedEmail), models.AuthResults{SPF: "fail", DKIM: "none", DMARC: "fail"}},
+		{"authorized server", "192.0.2.10", []byte(forgedEmail), models.AuthResults{SPF: "pass", DKIM: "none", DMARC: "pass"}},
+		{"aligned signature", "198.51.100.7", sign("example.org"), models.AuthResults{SPF: "fail", DKIM: "pass", DMARC: "pass"}},
+		{"unaligned signature", "198.51.100.7", sign("attacker.example.net"), models.AuthResults{SPF: "fail", DKIM: "pass", DMARC: "fail"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			results := authenticate(resolver, net.ParseIP(tt.ip), "mx.example.org", "alice@example.org", tt.raw)
+			if results != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, results)
+			}
+		})
+	}
+
+	if results := authenticate(fakeResolver{}, net.ParseIP("192.0.2.10"), "mx.example.org", "alice@example.org", []byte(forgedEmail)); results.DMARC != "none" {
+		t.Errorf("expected no DMARC verdict without a policy, got %+v", results)
+	}
+}
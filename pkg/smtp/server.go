@@ -1,12 +1,16 @@
 package smtp
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net"
+	"net/mail"
 	"strings"
 	"time"
 
 	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/notify"
 	"github.com/emersion/go-smtp"
 )
 
@@ -14,7 +18,9 @@ import (
 type Backend struct {
 	db              *models.DB
 	allowedHostname string
+	notifier        notify.Notifier
 	logger          Logger
+	resolver        Resolver
 }
 
 // Logger interface for logging
@@ -24,20 +30,33 @@ type Logger interface {
 }
 
 // NewBackend creates a new SMTP backend
-func NewBackend(db *models.DB, allowedHostname string, logger Logger) *Backend {
+func NewBackend(db *models.DB, allowedHostname string, notifier notify.Notifier, logger Logger) *Backend {
 	return &Backend{
 		db:              db,
 		allowedHostname: allowedHostname,
+		notifier:        notifier,
 		logger:          logger,
+		resolver:        net.DefaultResolver,
 	}
 }
 
+// SetResolver replaces the DNS resolver of the SPF, DKIM and DMARC checks
+func (b *Backend) SetResolver(resolver Resolver) {
+	b.resolver = resolver
+}
+
 // NewSession creates a new SMTP session
 func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	var ip net.IP
+	if addr, ok := c.Conn().RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
 	return &Session{
 		backend: b,
 		from:    "",
 		to:      []string{},
+		ip:      ip,
+		helo:    c.Hostname(),
 	}, nil
 }
 
@@ -46,6 +65,8 @@ type Session struct {
 	backend *Backend
 	from    string
 	to      []string
+	ip      net.IP // Address of the client, SPF checks it against the sender's domain
+	helo    string
 }
 
 // AuthPlain implements PLAIN authentication (we accept everything)
@@ -91,6 +112,15 @@ func (s *Session) Data(r io.Reader) error {
 	// Parse the message to extract subject
 	subject := extractSubject(string(body))
 	messageBody := extractBody(string(body))
+	messageID := extractMessageID(string(body))
+	auth := authenticate(s.backend.resolver, s.ip, s.helo, s.from, body)
+
+	// The source is stored once, the row of each recipient refers to it
+	source := &models.MessageSource{Raw: string(body)}
+	if err := s.backend.db.Create(source).Error; err != nil {
+		s.backend.logger.Printf("SMTP: failed to store message source: %v", err)
+		return err
+	}
 	
 	// Store each recipient as a separate message
 	for _, recipient := range s.to {
@@ -99,7 +129,9 @@ func (s *Session) Data(r io.Reader) error {
 			From:      s.from,
 			Subject:   subject,
 			Body:      messageBody,
-			Processed: false,
+			MessageID: messageID,
+			Auth:      auth,
+			SourceID:  &source.ID,
 		}
 		
 		if err := s.backend.db.Create(msg).Error; err != nil {
@@ -110,6 +142,11 @@ func (s *Session) Data(r io.Reader) error {
 		s.backend.logger.Printf("SMTP: stored message from %s to %s (subject: %s)", s.from, recipient, subject)
 	}
 	
+	// Wake the worker up, it falls back to polling if the notification gets lost
+	if err := s.backend.notifier.Notify(context.Background()); err != nil {
+		s.backend.logger.Printf("SMTP: failed to notify worker: %v", err)
+	}
+
 	return nil
 }
 
@@ -136,6 +173,15 @@ func extractSubject(message string) string {
 	return "(no subject)"
 }
 
+// extractMessageID extracts the Message-ID header, empty when the message has none
+func extractMessageID(message string) string {
+	msg, err := mail.ReadMessage(strings.NewReader(message))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(msg.Header.Get("Message-Id"))
+}
+
 // extractBody extracts the body from the email message
 func extractBody(message string) string {
 	// Find the blank line that separates headers from body
@@ -0,0 +1,54 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/notify"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type testLogger struct{}
+
+func (testLogger) Printf(format string, args ...interface{}) {}
+func (testLogger) Println(args ...interface{})               {}
+
+func TestSession_DataStoresSourceOnce(t *testing.T) {
+	gdb, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	db := models.NewDB(gdb)
+	if err := db.AutoMigrate(); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+
+	backend := NewBackend(db, "example.com", notify.NewNotifier("sqlite3", nil, ""), testLogger{})
+	backend.SetResolver(fakeResolver{})
+	session := &Session{backend: backend, from: "alice@example.org", to: []string{"a@example.com", "b@example.com"}}
+
+	if err := session.Data(strings.NewReader(forgedEmail)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var sources int64
+	db.Model(&models.MessageSource{}).Count(&sources)
+	if sources != 1 {
+		t.Errorf("expected the source to be stored once, got %d", sources)
+	}
+
+	var messages []models.SMTPMessage
+	if err := db.Preload("Source").Order("id").Find(&messages).Error; err != nil {
+		t.Fatalf("failed to load messages: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected a message per recipient, got %d", len(messages))
+	}
+	for _, msg := range messages {
+		if msg.Raw != "" || msg.RawSource() != forgedEmail {
+			t.Errorf("expected message %d to refer to the shared source, got %+v", msg.ID, msg)
+		}
+	}
+}
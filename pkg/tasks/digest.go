@@ -0,0 +1,53 @@
+package tasks
+
+import (
+	"context"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/services"
+)
+
+// digestQueue is the queue of digest tasks, kept apart from the web server's tasks which the worker doesn't run
+const digestQueue = "digests"
+
+// DigestTask closes the window of a job's digest, the worker then delivers it.
+// It is queued and run by the worker, on a task client of its own made by NewDigestTaskClient.
+type DigestTask struct {
+	DigestID int
+}
+
+// Name satisfies the services.Task interface
+func (t DigestTask) Name() string {
+	return "digest_close"
+}
+
+// NewDigestTaskQueue provides a Queue that closes the digests of DigestTask tasks
+func NewDigestTaskQueue(c *services.Container) services.Queue {
+	return services.NewQueue[DigestTask](func(ctx context.Context, task DigestTask) error {
+		return c.ORM.CloseDigest(ctx, task.DigestID)
+	})
+}
+
+// NewDigestTaskClient provides a task client running only digest tasks
+func NewDigestTaskClient(c *services.Container) (*services.TaskClient, error) {
+	client, err := services.NewNamedTaskClient(c.Config.Tasks, c.QueueDatabase, digestQueue)
+	if err != nil {
+		return nil, err
+	}
+	client.Register(NewDigestTaskQueue(c))
+	return client, nil
+}
+
+// DigestScheduler queues a DigestTask for the end of the window of each digest the worker opens
+type DigestScheduler struct {
+	tasks *services.TaskClient
+}
+
+func NewDigestScheduler(tasks *services.TaskClient) *DigestScheduler {
+	return &DigestScheduler{tasks: tasks}
+}
+
+// ScheduleDigest closes a digest at the given time
+func (s *DigestScheduler) ScheduleDigest(digestID int, at time.Time) error {
+	return s.tasks.New(DigestTask{DigestID: digestID}).At(at).Save()
+}
@@ -0,0 +1,78 @@
+package worker
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// maxActionBody bounds the webhook answers read for response actions
+const maxActionBody = 64 << 10
+
+// maxForwardRecipients bounds the mailboxes a webhook answer can forward a message to
+const maxForwardRecipients = 10
+
+// ResponseAction is what the JSON answer of a webhook asks the worker to do once the message is delivered:
+//
+//	{"reply": {"subject": "Your ticket", "body": "Ticket #42 was opened"}}
+//	{"forward_to": ["support@example.com"]}
+//	{"suppress_reply": true}
+//
+// A reply replaces the job's auto-reply, and suppress_reply drops it.
+type ResponseAction struct {
+	Reply         *ActionReply `json:"reply"`
+	ForwardTo     addressList  `json:"forward_to"`
+	SuppressReply bool         `json:"suppress_reply"`
+}
+
+// ActionReply is a reply to the sender answered by a webhook, the subject defaults to the job's auto-reply one
+type ActionReply struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// addressList accepts a single address as well as a list of them
+type addressList []string
+
+func (l *addressList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = addressList{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// parseResponseAction reads the action of a webhook answer. Answers that aren't JSON objects, or
+// don't ask for anything, have none.
+func parseResponseAction(contentType string, body []byte) *ResponseAction {
+	if !isJSONContentType(contentType) {
+		return nil
+	}
+
+	var action ResponseAction
+	if err := json.Unmarshal(body, &action); err != nil {
+		return nil
+	}
+
+	if action.Reply != nil {
+		// The subject ends up in a header, it must stay on one line
+		action.Reply.Subject = strings.Join(strings.Fields(action.Reply.Subject), " ")
+		if strings.TrimSpace(action.Reply.Body) == "" {
+			action.Reply = nil
+		}
+	}
+	if len(action.ForwardTo) > maxForwardRecipients {
+		action.ForwardTo = action.ForwardTo[:maxForwardRecipients]
+	}
+
+	if action.Reply == nil && len(action.ForwardTo) == 0 && !action.SuppressReply {
+		return nil
+	}
+	return &action
+}
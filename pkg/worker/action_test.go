@@ -0,0 +1,33 @@
+package worker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseResponseAction(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        *ResponseAction
+	}{
+		{"not JSON", "text/plain", `{"suppress_reply": true}`, nil},
+		{"no action", "application/json", `{"ok": true}`, nil},
+		{"not an object", "application/json", `[1, 2]`, nil},
+		{"empty reply", "application/json", `{"reply": {"subject": "Hi"}}`, nil},
+		{"reply", "application/json; charset=utf-8", `{"reply": {"subject": "Your\r\nBcc: x@example.org", "body": "Done"}}`,
+			&ResponseAction{Reply: &ActionReply{Subject: "Your Bcc: x@example.org", Body: "Done"}}},
+		{"forward list", "application/json", `{"forward_to": ["a@example.com", "b@example.com"]}`,
+			&ResponseAction{ForwardTo: addressList{"a@example.com", "b@example.com"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseResponseAction(tt.contentType, []byte(tt.body))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
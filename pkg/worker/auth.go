@@ -0,0 +1,199 @@
+package worker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/secrets"
+)
+
+// ErrInvalidAuth is returned for jobs whose credentials can't be used, retrying won't help
+var ErrInvalidAuth = errors.New("invalid webhook authentication")
+
+// tokenExpiryMargin is how long before they expire access tokens get refreshed
+const tokenExpiryMargin = 30 * time.Second
+
+// Authenticator adds the credentials of jobs to their webhook calls, and keeps the OAuth2 access tokens
+// it fetches with the client credentials grant until they are about to expire
+type Authenticator struct {
+	box    *secrets.Box
+	logger Logger
+	now    func() time.Time
+
+	mu     sync.Mutex
+	tokens map[string]accessToken
+}
+
+type accessToken struct {
+	value     string
+	expiresAt time.Time // Zero for tokens without a lifetime, kept until the endpoint rejects them
+}
+
+type tokenResponse struct {
+	AccessToken string      `json:"access_token"`
+	TokenType   string      `json:"token_type"`
+	ExpiresIn   json.Number `json:"expires_in"`
+}
+
+func NewAuthenticator(box *secrets.Box, logger Logger) *Authenticator {
+	return &Authenticator{
+		box:    box,
+		logger: logger,
+		now:    time.Now,
+		tokens: make(map[string]accessToken),
+	}
+}
+
+// Authorize sets the credentials of auth on req, fetching access tokens with client when needed
+func (a *Authenticator) Authorize(ctx context.Context, client HTTPClient, req *http.Request, auth *models.WebhookAuth) error {
+	secret, err := a.box.Open(auth.Secret)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAuth, err)
+	}
+
+	switch auth.Type {
+	case models.AuthBasic:
+		req.SetBasicAuth(auth.Username, secret)
+	case models.AuthBearer:
+		req.Header.Set("Authorization", "Bearer "+secret)
+	case models.AuthOAuth2:
+		token, err := a.token(ctx, client, auth, secret)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidAuth, auth.Type)
+	}
+	return nil
+}
+
+// Expire drops the cached access token of auth, telling whether there was one to fetch again
+func (a *Authenticator) Expire(auth *models.WebhookAuth) bool {
+	if auth.Type != models.AuthOAuth2 {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := tokenKey(auth)
+	if _, ok := a.tokens[key]; !ok {
+		return false
+	}
+	delete(a.tokens, key)
+	return true
+}
+
+func (a *Authenticator) token(ctx context.Context, client HTTPClient, auth *models.WebhookAuth, secret string) (string, error) {
+	key := tokenKey(auth)
+
+	// Holding the lock during the request keeps concurrent deliveries from fetching the same token
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if token, ok := a.tokens[key]; ok && (token.expiresAt.IsZero() || a.now().Before(token.expiresAt)) {
+		return token.value, nil
+	}
+
+	token, err := a.fetch(ctx, client, auth, secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to get an access token from %s: %w", auth.TokenURL, err)
+	}
+	a.tokens[key] = token
+	a.logger.Printf("fetched an access token for client %s from %s", auth.Username, auth.TokenURL)
+	return token.value, nil
+}
+
+// fetch requests an access token with the client credentials grant of RFC 6749
+func (a *Authenticator) fetch(ctx context.Context, client HTTPClient, auth *models.WebhookAuth, secret string) (accessToken, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if auth.Scope != "" {
+		form.Set("scope", auth.Scope)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, auth.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return accessToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(auth.Username), url.QueryEscape(secret))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return accessToken{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return accessToken{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return accessToken{}, fmt.Errorf("token endpoint returned status %d: %s", resp.StatusCode, truncate(string(body), 200))
+	}
+
+	var parsed tokenResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return accessToken{}, fmt.Errorf("invalid token response: %w", err)
+	}
+	if parsed.AccessToken == "" {
+		return accessToken{}, errors.New("token response has no access_token")
+	}
+	if parsed.TokenType != "" && !strings.EqualFold(parsed.TokenType, "bearer") {
+		return accessToken{}, fmt.Errorf("unsupported token type %q", parsed.TokenType)
+	}
+
+	token := accessToken{value: parsed.AccessToken}
+	if seconds, err := parsed.ExpiresIn.Int64(); err == nil && seconds > 0 {
+		lifetime := time.Duration(seconds) * time.Second
+		token.expiresAt = a.now().Add(lifetime - min(tokenExpiryMargin, lifetime/2))
+	}
+	return token, nil
+}
+
+// ValidateAuth checks webhook credentials before the secret gets sealed
+func ValidateAuth(auth models.WebhookAuth) error {
+	switch auth.Type {
+	case models.AuthBasic:
+		if auth.Username == "" {
+			return &JobError{Field: "AuthUsername", Err: errors.New("basic auth needs a username")}
+		}
+	case models.AuthBearer:
+		if auth.Secret == "" {
+			return &JobError{Field: "AuthSecret", Err: errors.New("bearer auth needs a token")}
+		}
+	case models.AuthOAuth2:
+		if auth.Username == "" {
+			return &JobError{Field: "AuthUsername", Err: errors.New("OAuth2 needs a client ID")}
+		}
+		if auth.Secret == "" {
+			return &JobError{Field: "AuthSecret", Err: errors.New("OAuth2 needs a client secret")}
+		}
+		u, err := url.Parse(auth.TokenURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return &JobError{Field: "AuthTokenURL", Err: errors.New("OAuth2 needs an http or https token URL")}
+		}
+	default:
+		return &JobError{Field: "AuthType", Err: fmt.Errorf("unknown authentication type %q", auth.Type)}
+	}
+	return nil
+}
+
+// tokenKey identifies the access tokens of a client
+func tokenKey(auth *models.WebhookAuth) string {
+	sum := sha256.Sum256([]byte(auth.TokenURL + "\x00" + auth.Username + "\x00" + auth.Scope + "\x00" + auth.Secret))
+	return hex.EncodeToString(sum[:])
+}
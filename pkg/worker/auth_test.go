@@ -0,0 +1,181 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/secrets"
+)
+
+func testAuthSender(t *testing.T) (*WebhookSender, *Authenticator, *secrets.Box) {
+	t.Helper()
+	box, err := secrets.New("test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := NewAuthenticator(box, &mockLogger{})
+	sender := NewWebhookSender(http.DefaultClient, &mockLogger{}, Config{})
+	sender.SetAuthenticator(auth)
+	return sender, auth, box
+}
+
+func TestWebhookSender_StaticAuth(t *testing.T) {
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+
+	sender, _, box := testAuthSender(t)
+	password, _ := box.Seal("s3cret")
+	token, _ := box.Seal("static-token")
+
+	for _, auth := range []*models.WebhookAuth{
+		{Type: models.AuthBasic, Username: "gossiper", Secret: password},
+		{Type: models.AuthBearer, Secret: token},
+	} {
+		result := sender.SendWebhook(context.Background(), ProcessResult{JobID: 1, URL: server.URL, Method: "POST", Job: &models.Job{Auth: auth}})
+		if result.Error != nil {
+			t.Fatalf("unexpected error: %v", result.Error)
+		}
+	}
+
+	want := []string{"Basic Z29zc2lwZXI6czNjcmV0", "Bearer static-token"}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// Secrets stored without sealing are refused rather than sent
+	result := sender.SendWebhook(context.Background(), ProcessResult{JobID: 1, URL: server.URL, Method: "POST",
+		Job: &models.Job{Auth: &models.WebhookAuth{Type: models.AuthBearer, Secret: "static-token"}}})
+	if !errors.Is(result.Error, ErrInvalidAuth) || retryable(ProcessResult{}, result) {
+		t.Errorf("expected invalid credentials that aren't retried, got %+v", result)
+	}
+	if len(got) != 2 {
+		t.Errorf("expected the endpoint not to be called, got %d calls", len(got))
+	}
+}
+
+func TestWebhookSender_OAuth2ClientCredentials(t *testing.T) {
+	var issued int
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "client" || secret != "client-secret" || r.FormValue("grant_type") != "client_credentials" || r.FormValue("scope") != "hooks" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		issued++
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "token-" + string(rune('0'+issued)),
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	defer tokens.Close()
+
+	// The endpoint revokes the first token after its first use
+	var got []string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		got = append(got, authorization)
+		if authorization == "Bearer token-1" && len(got) > 2 {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer hook.Close()
+
+	sender, auth, box := testAuthSender(t)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	auth.now = func() time.Time { return now }
+	secret, _ := box.Seal("client-secret")
+	credentials := &models.WebhookAuth{Type: models.AuthOAuth2, Username: "client", Secret: secret, TokenURL: tokens.URL, Scope: "hooks"}
+
+	send := func() WebhookResult {
+		return sender.SendWebhook(context.Background(), ProcessResult{JobID: 1, URL: hook.URL, Method: "POST", Job: &models.Job{Auth: credentials}})
+	}
+
+	// The token is fetched once and reused
+	send()
+	send()
+	if issued != 1 || got[0] != "Bearer token-1" || got[1] != "Bearer token-1" {
+		t.Fatalf("expected the token to be reused, issued %d, got %v", issued, got)
+	}
+
+	// A rejected token is fetched again and the call made once more
+	if result := send(); result.StatusCode != http.StatusOK || issued != 2 || got[len(got)-1] != "Bearer token-2" {
+		t.Fatalf("expected a retry with a new token, got %+v, issued %d, calls %v", result, issued, got)
+	}
+
+	// Tokens are refreshed before they expire
+	now = now.Add(time.Hour - 10*time.Second)
+	send()
+	if issued != 3 || got[len(got)-1] != "Bearer token-3" {
+		t.Errorf("expected the token to be refreshed, issued %d, got %v", issued, got)
+	}
+
+	// Failing to get a token is worth retrying, the token endpoint may be down
+	wrong, _ := box.Seal("wrong")
+	credentials = &models.WebhookAuth{Type: models.AuthOAuth2, Username: "client", Secret: wrong, TokenURL: tokens.URL}
+	calls := len(got)
+	if result := send(); result.Error == nil || !retryable(ProcessResult{}, result) || len(got) != calls {
+		t.Errorf("expected a retryable token error without calling the endpoint, got %+v", result)
+	}
+}
+
+func TestMessageProcessor_AuthOnlyForHTTPDestinations(t *testing.T) {
+	auth := &models.WebhookAuth{Type: models.AuthBearer, Secret: "sealed"}
+	repo := &mockJobRepository{jobs: map[string][]*models.Job{
+		"hook@example.com": {{
+			ID: 1, Email: "hook@example.com", FromRegex: ".*", Auth: auth,
+			Destinations: []models.Destination{
+				{ID: 1, Name: "http", Type: models.DestinationTypeHTTP, URL: "https://example.com/hook", Method: "POST"},
+				{ID: 2, Name: "slack", Type: models.DestinationTypeSlack, URL: "https://hooks.slack.com/services/x"},
+			},
+		}},
+	}}
+	processor := NewMessageProcessor(repo, &mockLogger{}, nil, "example.com")
+
+	results, err := processor.ProcessMessage(context.Background(), Message{ID: 1, To: "hook@example.com", From: "a@example.org", Subject: "Hi", Body: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].auth() != auth || results[1].auth() != nil {
+		t.Errorf("expected the credentials on the HTTP destination only, got %+v", results)
+	}
+}
+
+func TestValidateAuth(t *testing.T) {
+	tests := []struct {
+		name  string
+		auth  models.WebhookAuth
+		field string
+	}{
+		{"basic", models.WebhookAuth{Type: models.AuthBasic, Username: "user"}, ""},
+		{"basic without user", models.WebhookAuth{Type: models.AuthBasic, Secret: "x"}, "AuthUsername"},
+		{"bearer", models.WebhookAuth{Type: models.AuthBearer, Secret: "x"}, ""},
+		{"bearer without token", models.WebhookAuth{Type: models.AuthBearer}, "AuthSecret"},
+		{"oauth2", models.WebhookAuth{Type: models.AuthOAuth2, Username: "id", Secret: "x", TokenURL: "https://auth.example.com/token"}, ""},
+		{"oauth2 without secret", models.WebhookAuth{Type: models.AuthOAuth2, Username: "id", TokenURL: "https://auth.example.com/token"}, "AuthSecret"},
+		{"oauth2 without token URL", models.WebhookAuth{Type: models.AuthOAuth2, Username: "id", Secret: "x"}, "AuthTokenURL"},
+		{"unknown", models.WebhookAuth{Type: "digest"}, "AuthType"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateAuth(tt.auth)
+			var jobErr *JobError
+			switch {
+			case tt.field == "" && err != nil:
+				t.Errorf("expected valid credentials, got %v", err)
+			case tt.field != "" && (!errors.As(err, &jobErr) || jobErr.Field != tt.field):
+				t.Errorf("expected an error on %s, got %v", tt.field, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package worker
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"github.com/nats-io/nats.go"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/redis/go-redis/v9"
+)
+
+// brokerPublisher is a connection to a message broker
+type brokerPublisher interface {
+	Publish(ctx context.Context, result ProcessResult) error
+	Close() error
+}
+
+// brokerDialTimeout bounds connecting to a broker, handshakes included
+const brokerDialTimeout = 10 * time.Second
+
+// BrokerDestination publishes rendered payloads to NATS subjects, AMQP exchanges and Redis streams.
+// Connections are opened on first use and shared by every destination with the same settings.
+type BrokerDestination struct {
+	mu         sync.Mutex
+	publishers map[string]brokerPublisher
+	dial       func(ctx context.Context, destType, url, token string) (brokerPublisher, error)
+	dialer     *net.Dialer
+	logger     Logger
+}
+
+// NewBrokerDestination creates a destination for the NATS, AMQP and Redis types
+func NewBrokerDestination(logger Logger) *BrokerDestination {
+	b := &BrokerDestination{
+		publishers: make(map[string]brokerPublisher),
+		dialer:     &net.Dialer{Timeout: brokerDialTimeout},
+		logger:     logger,
+	}
+	b.dial = b.dialBroker
+	return b
+}
+
+// SetNetworkGuard makes the destination connect to brokers through the guard, reconnections included
+func (b *BrokerDestination) SetNetworkGuard(guard *NetworkGuard) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dialer = guard.Dialer(brokerDialTimeout)
+}
+
+func (b *BrokerDestination) Deliver(ctx context.Context, result ProcessResult) WebhookResult {
+	webhookResult := WebhookResult{
+		JobID:         result.JobID,
+		DestinationID: result.DestinationID,
+	}
+
+	if result.Error != nil {
+		webhookResult.Error = result.Error
+		b.logger.Printf("skipping publish for job %d due to processing error: %v", result.JobID, result.Error)
+		return webhookResult
+	}
+
+	publisher, err := b.publisher(ctx, result)
+	if err != nil {
+		webhookResult.Error = fmt.Errorf("failed to connect to %s: %w", result.Type, err)
+		b.logger.Printf("failed to connect to %s for job %d: %v", result.Type, result.JobID, err)
+		return webhookResult
+	}
+
+	if err := publisher.Publish(ctx, result); err != nil {
+		// Reconnect on the next delivery, the connection may be what failed
+		b.drop(result, publisher)
+		webhookResult.Error = fmt.Errorf("failed to publish: %w", err)
+		b.logger.Printf("failed to publish to %s for job %d: %v", result.Type, result.JobID, err)
+		return webhookResult
+	}
+
+	b.logger.Printf("published message for job %d to %s", result.JobID, result.Type)
+	return webhookResult
+}
+
+// Close closes every open broker connection
+func (b *BrokerDestination) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var errs []error
+	for key, publisher := range b.publishers {
+		errs = append(errs, publisher.Close())
+		delete(b.publishers, key)
+	}
+	return errors.Join(errs...)
+}
+
+func brokerKey(result ProcessResult) string {
+	return result.Type + "\x00" + result.URL + "\x00" + result.Token
+}
+
+// publisher returns the open connection for the result's settings, dialing it when needed
+func (b *BrokerDestination) publisher(ctx context.Context, result ProcessResult) (brokerPublisher, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := brokerKey(result)
+	if publisher, ok := b.publishers[key]; ok {
+		return publisher, nil
+	}
+
+	publisher, err := b.dial(ctx, result.Type, result.URL, result.Token)
+	if err != nil {
+		return nil, err
+	}
+	b.publishers[key] = publisher
+
+	return publisher, nil
+}
+
+func (b *BrokerDestination) drop(result ProcessResult, publisher brokerPublisher) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := brokerKey(result)
+	if b.publishers[key] == publisher {
+		delete(b.publishers, key)
+		_ = publisher.Close()
+	}
+}
+
+// dialBroker connects to a broker with the destination's dialer, called with the lock held
+func (b *BrokerDestination) dialBroker(ctx context.Context, destType, url, token string) (brokerPublisher, error) {
+	dialer := b.dialer
+
+	switch destType {
+	case models.DestinationTypeNATS:
+		opts := []nats.Option{nats.Name("gossiper"), nats.Timeout(brokerDialTimeout), nats.SetCustomDialer(dialer)}
+		if token != "" {
+			opts = append(opts, nats.Token(token))
+		}
+		return dialContext(ctx, func() (brokerPublisher, error) {
+			conn, err := nats.Connect(url, opts...)
+			if err != nil {
+				return nil, err
+			}
+			return &natsPublisher{conn: conn}, nil
+		})
+
+	case models.DestinationTypeAMQP:
+		config := amqp.Config{Dial: func(network, addr string) (net.Conn, error) {
+			conn, err := dialer.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			// Like amqp.DefaultDial, handshakes get a deadline which is cleared once connected
+			if err := conn.SetDeadline(time.Now().Add(brokerDialTimeout)); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}}
+		return dialContext(ctx, func() (brokerPublisher, error) {
+			conn, err := amqp.DialConfig(url, config)
+			if err != nil {
+				return nil, err
+			}
+			ch, err := conn.Channel()
+			if err == nil {
+				// Publisher confirms tell us the broker took the message
+				err = ch.Confirm(false)
+			}
+			if err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			return &amqpPublisher{conn: conn, ch: ch}, nil
+		})
+
+	case models.DestinationTypeRedis:
+		opts, err := redis.ParseURL(url)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			opts.Password = token
+		}
+		tlsConfig := opts.TLSConfig
+		opts.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if tlsConfig == nil {
+				return dialer.DialContext(ctx, network, addr)
+			}
+			return (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, network, addr)
+		}
+		client := redis.NewClient(opts)
+		if err := client.Ping(ctx).Err(); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+		return &redisPublisher{client: client}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported broker type %q", destType)
+}
+
+// dialContext gives up on dial once ctx is done, for the clients that connect without a context.
+// A connection opened after that is closed.
+func dialContext(ctx context.Context, dial func() (brokerPublisher, error)) (brokerPublisher, error) {
+	type dialed struct {
+		publisher brokerPublisher
+		err       error
+	}
+	done := make(chan dialed, 1)
+	go func() {
+		publisher, err := dial()
+		done <- dialed{publisher, err}
+	}()
+
+	select {
+	case d := <-done:
+		return d.publisher, d.err
+	case <-ctx.Done():
+		go func() {
+			if d := <-done; d.publisher != nil {
+				_ = d.publisher.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// brokerHeaders are the metadata published along with the payload
+func brokerHeaders(result ProcessResult) map[string]string {
+	headers := map[string]string{
+		"X-Gossiper-Job": strconv.Itoa(result.JobID),
+	}
+	if result.Destination != "" {
+		headers["X-Gossiper-Destination"] = result.Destination
+	}
+	if result.Message != nil && result.Message.SMTPID != 0 {
+		headers["X-Gossiper-Message"] = strconv.Itoa(result.Message.SMTPID)
+	}
+	for key, value := range result.Headers {
+		headers[key] = value
+	}
+	return headers
+}
+
+// contentType returns the configured content type of a result, JSON by default
+func contentType(result ProcessResult) string {
+	if ct := headerValue(result.Headers, "Content-Type"); ct != "" {
+		return ct
+	}
+	return "application/json"
+}
+
+// natsPublisher publishes to the "subject" option
+type natsPublisher struct {
+	conn *nats.Conn
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, result ProcessResult) error {
+	msg := nats.NewMsg(result.Options["subject"])
+	msg.Data = []byte(result.Payload)
+	for key, value := range brokerHeaders(result) {
+		msg.Header.Set(key, value)
+	}
+	msg.Header.Set("Content-Type", contentType(result))
+
+	if err := p.conn.PublishMsg(msg); err != nil {
+		return err
+	}
+	// Publishing is buffered, flushing surfaces connection errors
+	return p.conn.FlushWithContext(ctx)
+}
+
+func (p *natsPublisher) Close() error {
+	p.conn.Close()
+	return nil
+}
+
+// amqpPublisher publishes persistent messages to the "exchange" option with the "routing_key" option
+type amqpPublisher struct {
+	mu   sync.Mutex
+	conn *amqp.Connection
+	ch   *amqp.Channel
+}
+
+func (p *amqpPublisher) Publish(ctx context.Context, result ProcessResult) error {
+	headers := amqp.Table{}
+	for key, value := range brokerHeaders(result) {
+		headers[key] = value
+	}
+
+	// A channel isn't safe for concurrent publishing
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	confirm, err := p.ch.PublishWithDeferredConfirmWithContext(ctx,
+		result.Options["exchange"],
+		result.Options["routing_key"],
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:  contentType(result),
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    time.Now(),
+			AppId:        "gossiper",
+			Headers:      headers,
+			Body:         []byte(result.Payload),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("the broker rejected the message")
+	}
+	return nil
+}
+
+func (p *amqpPublisher) Close() error {
+	return p.conn.Close()
+}
+
+// redisPublisher appends entries to the "stream" option, trimmed to the optional "maxlen" option
+type redisPublisher struct {
+	client *redis.Client
+}
+
+func (p *redisPublisher) Publish(ctx context.Context, result ProcessResult) error {
+	values := map[string]any{
+		"payload":      result.Payload,
+		"content_type": contentType(result),
+	}
+	for key, value := range brokerHeaders(result) {
+		values[key] = value
+	}
+
+	args := &redis.XAddArgs{
+		Stream: result.Options["stream"],
+		Values: values,
+	}
+	if maxLen, err := strconv.ParseInt(result.Options["maxlen"], 10, 64); err == nil {
+		args.MaxLen = maxLen
+		args.Approx = true
+	}
+
+	return p.client.XAdd(ctx, args).Err()
+}
+
+func (p *redisPublisher) Close() error {
+	return p.client.Close()
+}
@@ -0,0 +1,189 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"github.com/alicebob/miniredis/v2"
+)
+
+type fakePublisher struct {
+	published []ProcessResult
+	err       error
+	closed    bool
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, result ProcessResult) error {
+	p.published = append(p.published, result)
+	return p.err
+}
+
+func (p *fakePublisher) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestBrokerDestination_Deliver(t *testing.T) {
+	var dials []string
+	publishers := []*fakePublisher{{err: errors.New("connection reset")}, {}}
+
+	b := NewBrokerDestination(&mockLogger{})
+	b.dial = func(ctx context.Context, destType, url, token string) (brokerPublisher, error) {
+		dials = append(dials, destType+" "+url)
+		publisher := publishers[0]
+		publishers = publishers[1:]
+		return publisher, nil
+	}
+
+	result := ProcessResult{
+		JobID:   1,
+		Type:    models.DestinationTypeNATS,
+		URL:     "nats://localhost:4222",
+		Payload: `{"subject":"hi"}`,
+		Options: map[string]string{"subject": "mail.in"},
+	}
+
+	failed := b.Deliver(context.Background(), result)
+	if failed.Error == nil || !strings.Contains(failed.Error.Error(), "connection reset") {
+		t.Fatalf("expected the publish error to be reported, got %v", failed.Error)
+	}
+
+	for range 2 {
+		if res := b.Deliver(context.Background(), result); res.Error != nil {
+			t.Fatalf("unexpected error: %v", res.Error)
+		}
+	}
+
+	if len(dials) != 2 {
+		t.Errorf("expected a reconnect after the failure only, got dials %v", dials)
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("unexpected close error: %v", err)
+	}
+	if len(b.publishers) != 0 {
+		t.Errorf("expected every connection to be closed")
+	}
+}
+
+func TestBrokerDestination_Deliver_DialError(t *testing.T) {
+	b := NewBrokerDestination(&mockLogger{})
+	b.dial = func(ctx context.Context, destType, url, token string) (brokerPublisher, error) {
+		return nil, errors.New("connection refused")
+	}
+
+	result := b.Deliver(context.Background(), ProcessResult{JobID: 1, DestinationID: 3, Type: models.DestinationTypeAMQP})
+	if result.Error == nil || result.DestinationID != 3 {
+		t.Errorf("expected a connection error for destination 3, got %+v", result)
+	}
+}
+
+func TestBrokerDestination_Redis(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireAuth("secret")
+
+	b := NewBrokerDestination(&mockLogger{})
+	defer b.Close()
+
+	result := ProcessResult{
+		JobID:       5,
+		Destination: "stream",
+		Type:        models.DestinationTypeRedis,
+		URL:         "redis://" + server.Addr() + "/0",
+		Token:       "secret",
+		Payload:     `{"subject":"Invoice"}`,
+		Options:     map[string]string{"stream": "mail", "maxlen": "100"},
+		Message:     &TemplateContext{SMTPID: 9},
+	}
+
+	if res := b.Deliver(context.Background(), result); res.Error != nil {
+		t.Fatalf("unexpected error: %v", res.Error)
+	}
+
+	entries, err := server.Stream("mail")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected 1 stream entry, got %v (%v)", entries, err)
+	}
+	values := map[string]string{}
+	for i := 0; i+1 < len(entries[0].Values); i += 2 {
+		values[entries[0].Values[i]] = entries[0].Values[i+1]
+	}
+	if values["payload"] != result.Payload || values["content_type"] != "application/json" {
+		t.Errorf("unexpected entry: %v", values)
+	}
+	if values["X-Gossiper-Job"] != "5" || values["X-Gossiper-Message"] != "9" {
+		t.Errorf("expected the Gossiper metadata, got %v", values)
+	}
+}
+
+func TestBrokerDestination_NetworkGuard(t *testing.T) {
+	server := miniredis.RunT(t)
+	result := ProcessResult{
+		JobID:   5,
+		Type:    models.DestinationTypeRedis,
+		URL:     "redis://" + server.Addr() + "/0",
+		Payload: `{}`,
+		Options: map[string]string{"stream": "mail"},
+	}
+
+	guard, err := NewNetworkGuard(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBrokerDestination(&mockLogger{})
+	b.SetNetworkGuard(guard)
+	defer b.Close()
+
+	for _, destType := range []string{models.DestinationTypeRedis, models.DestinationTypeNATS, models.DestinationTypeAMQP} {
+		blocked := result
+		blocked.Type = destType
+		if destType != models.DestinationTypeRedis {
+			blocked.URL = strings.ToLower(destType) + "://" + server.Addr()
+		}
+		if res := b.Deliver(context.Background(), blocked); !errors.Is(res.Error, ErrBlockedAddress) {
+			t.Errorf("expected %s to refuse the loopback address, got %v", destType, res.Error)
+		}
+	}
+
+	// Allowed networks reach the broker
+	allowed, err := NewNetworkGuard([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetNetworkGuard(allowed)
+	if res := b.Deliver(context.Background(), result); res.Error != nil {
+		t.Errorf("expected an allowed address to be reached, got %v", res.Error)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	release := make(chan struct{})
+	closed := make(chan struct{})
+
+	_, err := dialContext(ctx, func() (brokerPublisher, error) {
+		<-release
+		return &closingPublisher{fakePublisher: &fakePublisher{}, closed: closed}, nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the dial to be given up, got %v", err)
+	}
+
+	// The connection opened late is closed
+	close(release)
+	<-closed
+}
+
+// closingPublisher signals its closing
+type closingPublisher struct {
+	*fakePublisher
+	closed chan struct{}
+}
+
+func (p *closingPublisher) Close() error {
+	close(p.closed)
+	return p.fakePublisher.Close()
+}
@@ -0,0 +1,325 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+// CircuitOpenError is returned for deliveries to a host whose circuit is open, they weren't attempted
+type CircuitOpenError struct {
+	Host    string
+	RetryAt time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open for %s until %s", e.Host, e.RetryAt.Format(time.RFC3339))
+}
+
+// CircuitStore keeps the circuit states for the dashboard and across worker restarts
+type CircuitStore interface {
+	LoadCircuits(ctx context.Context) ([]models.CircuitBreaker, error)
+	SaveCircuit(ctx context.Context, circuit *models.CircuitBreaker) error
+}
+
+// CircuitNotifier is told when the circuit of a host opens
+type CircuitNotifier interface {
+	CircuitOpened(ctx context.Context, circuit models.CircuitBreaker)
+}
+
+// CircuitBreaker stops calling destination hosts after consecutive failures. An open circuit fails deliveries
+// fast until its cooldown is over, then lets a single probe through: the circuit closes if it succeeds and
+// opens again with twice the cooldown otherwise.
+type CircuitBreaker struct {
+	threshold   int
+	cooldown    time.Duration
+	maxCooldown time.Duration
+	store       CircuitStore
+	notifier    CircuitNotifier
+	logger      Logger
+	now         func() time.Time
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+
+	// saveMu orders the writes to the store, which happen outside of mu
+	saveMu sync.Mutex
+}
+
+type circuit struct {
+	models.CircuitBreaker
+	cooldown time.Duration
+	probing  bool
+}
+
+func NewCircuitBreaker(threshold int, cooldown, maxCooldown time.Duration, store CircuitStore, notifier CircuitNotifier, logger Logger) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold:   threshold,
+		cooldown:    cooldown,
+		maxCooldown: max(cooldown, maxCooldown),
+		store:       store,
+		notifier:    notifier,
+		logger:      logger,
+		now:         time.Now,
+		circuits:    make(map[string]*circuit),
+	}
+}
+
+// Load restores the circuits left open by a previous run
+func (b *CircuitBreaker) Load(ctx context.Context) error {
+	if b.store == nil {
+		return nil
+	}
+
+	stored, err := b.store.LoadCircuits(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load circuits: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, state := range stored {
+		c := &circuit{CircuitBreaker: state, cooldown: b.cooldown}
+		if state.State == models.CircuitHalfOpen {
+			// The probe was lost with the previous run
+			c.State = models.CircuitOpen
+		}
+		if c.State == models.CircuitOpen {
+			c.cooldown = min(max(state.RetryAt.Sub(state.OpenedAt), b.cooldown), b.maxCooldown)
+		}
+		b.circuits[state.Host] = c
+	}
+	return nil
+}
+
+// Allow tells whether a request to host may be made, or returns why not
+func (b *CircuitBreaker) Allow(ctx context.Context, host string) error {
+	b.mu.Lock()
+	c, ok := b.circuits[host]
+	if !ok || c.State == models.CircuitClosed {
+		b.mu.Unlock()
+		return nil
+	}
+
+	now := b.now()
+	if c.probing {
+		b.mu.Unlock()
+		// Wait for the probe in flight, it opens the circuit again for at least this long if it fails
+		return &CircuitOpenError{Host: host, RetryAt: now.Add(c.cooldown)}
+	}
+	if now.Before(c.RetryAt) {
+		b.mu.Unlock()
+		return &CircuitOpenError{Host: host, RetryAt: c.RetryAt}
+	}
+
+	c.State = models.CircuitHalfOpen
+	c.probing = true
+	b.mu.Unlock()
+
+	b.save(ctx, host)
+	return nil
+}
+
+// Record updates the circuit of host with the outcome of a request, failed tells whether the host looked down.
+// The store and the notifier are called once the lock is released, so a slow one doesn't hold up other hosts.
+func (b *CircuitBreaker) Record(ctx context.Context, host string, failed bool, detail string) {
+	changed, opened := b.record(host, failed, detail)
+	if changed {
+		b.save(ctx, host)
+	}
+	if opened != nil && b.notifier != nil {
+		b.notifier.CircuitOpened(ctx, *opened)
+	}
+}
+
+// record applies the outcome of a request to the circuit of host. It tells whether the state changed,
+// and returns a copy of the circuit when it just opened from closed.
+func (b *CircuitBreaker) record(host string, failed bool, detail string) (bool, *models.CircuitBreaker) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[host]
+	if !ok {
+		if !failed {
+			return false, nil
+		}
+		c = &circuit{CircuitBreaker: models.CircuitBreaker{Host: host, State: models.CircuitClosed}, cooldown: b.cooldown}
+		b.circuits[host] = c
+	}
+
+	if !failed {
+		c.Failures = 0
+		if c.State == models.CircuitClosed {
+			return false, nil
+		}
+		b.logger.Printf("circuit for %s closed", host)
+		c.State = models.CircuitClosed
+		c.cooldown = b.cooldown
+		c.probing = false
+		return true, nil
+	}
+
+	c.Failures++
+	c.LastError = detail
+
+	switch c.State {
+	case models.CircuitHalfOpen:
+		c.probing = false
+		c.cooldown = min(c.cooldown*2, b.maxCooldown)
+		b.open(c)
+		return true, nil
+	case models.CircuitClosed:
+		if c.Failures >= b.threshold {
+			b.open(c)
+			opened := c.CircuitBreaker
+			return true, &opened
+		}
+	}
+	return false, nil
+}
+
+// Release gives back the probe allowed for host when no request was made, the next request probes instead
+func (b *CircuitBreaker) Release(ctx context.Context, host string) {
+	b.mu.Lock()
+	c, ok := b.circuits[host]
+	if !ok || !c.probing {
+		b.mu.Unlock()
+		return
+	}
+	c.State = models.CircuitOpen
+	c.probing = false
+	b.mu.Unlock()
+
+	b.save(ctx, host)
+}
+
+func (b *CircuitBreaker) open(c *circuit) {
+	now := b.now()
+	c.State = models.CircuitOpen
+	c.OpenedAt = now
+	c.RetryAt = now.Add(c.cooldown)
+	b.logger.Printf("circuit for %s opened after %d failures, next probe at %s", c.Host, c.Failures, c.RetryAt.Format(time.RFC3339))
+}
+
+// save stores the current state of the circuit of host. It is called without holding mu, the state
+// is read once saveMu is held so the last write is always the latest state.
+func (b *CircuitBreaker) save(ctx context.Context, host string) {
+	if b.store == nil {
+		return
+	}
+
+	b.saveMu.Lock()
+	defer b.saveMu.Unlock()
+
+	b.mu.Lock()
+	c, ok := b.circuits[host]
+	if !ok {
+		b.mu.Unlock()
+		return
+	}
+	state := c.CircuitBreaker
+	b.mu.Unlock()
+
+	if err := b.store.SaveCircuit(ctx, &state); err != nil {
+		b.logger.Printf("failed to save circuit for %s: %v", host, err)
+	}
+}
+
+// GormCircuitStore stores circuit states in the database
+type GormCircuitStore struct {
+	client *models.DB
+}
+
+func NewGormCircuitStore(client *models.DB) *GormCircuitStore {
+	return &GormCircuitStore{
+		client: client,
+	}
+}
+
+func (s *GormCircuitStore) LoadCircuits(ctx context.Context) ([]models.CircuitBreaker, error) {
+	var circuits []models.CircuitBreaker
+	err := s.client.WithContext(ctx).Where("state <> ?", models.CircuitClosed).Find(&circuits).Error
+	return circuits, err
+}
+
+func (s *GormCircuitStore) SaveCircuit(ctx context.Context, circuit *models.CircuitBreaker) error {
+	return s.client.WithContext(ctx).Save(circuit).Error
+}
+
+// CircuitMailer tells the owners of the jobs delivering to a host that its circuit opened
+type CircuitMailer struct {
+	client *models.DB
+	mailer Mailer
+	logger Logger
+}
+
+// Mailer sends a notice to a user
+type Mailer interface {
+	SendNotice(to, subject, body string) error
+}
+
+func NewCircuitMailer(client *models.DB, mailer Mailer, logger Logger) *CircuitMailer {
+	return &CircuitMailer{
+		client: client,
+		mailer: mailer,
+		logger: logger,
+	}
+}
+
+func (m *CircuitMailer) CircuitOpened(ctx context.Context, circuit models.CircuitBreaker) {
+	owners, err := m.owners(ctx, circuit.Host)
+	if err != nil {
+		m.logger.Printf("failed to find the owners of %s: %v", circuit.Host, err)
+		return
+	}
+
+	subject := fmt.Sprintf("Deliveries to %s are paused", circuit.Host)
+	body := fmt.Sprintf("The last %d deliveries to %s failed, the latest with:\r\n\r\n%s\r\n\r\n"+
+		"Messages for it are held back and retried from %s. Deliveries resume once the endpoint answers again.\r\n",
+		circuit.Failures, circuit.Host, circuit.LastError, circuit.RetryAt.Format(time.RFC1123))
+	for _, owner := range owners {
+		if err := m.mailer.SendNotice(owner, subject, body); err != nil {
+			m.logger.Printf("failed to notify %s of the circuit for %s: %v", owner, circuit.Host, err)
+		}
+	}
+}
+
+// owners returns the emails of the users with a job or destination calling host
+func (m *CircuitMailer) owners(ctx context.Context, host string) ([]string, error) {
+	pattern := "%://" + host + "%"
+
+	var jobs []models.Job
+	err := m.client.WithContext(ctx).
+		Preload("User").
+		Preload("Destinations").
+		Where("url LIKE ? OR id IN (?)", pattern,
+			m.client.Model(&models.Destination{}).Select("job_id").Where("url LIKE ?", pattern)).
+		Find(&jobs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// LIKE also matches longer hosts and paths, compare the parsed hosts
+	calls := func(raw string) bool {
+		u, err := url.Parse(raw)
+		return err == nil && u.Host == host
+	}
+
+	var owners []string
+	seen := make(map[int]bool)
+	for _, job := range jobs {
+		match := calls(job.URL)
+		for _, dest := range job.Destinations {
+			match = match || calls(dest.URL)
+		}
+		if match && !seen[job.UserID] {
+			seen[job.UserID] = true
+			owners = append(owners, job.User.Email)
+		}
+	}
+	return owners, nil
+}
@@ -0,0 +1,261 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+type mockMailer struct {
+	sent []string
+}
+
+func (m *mockMailer) SendNotice(to, subject, body string) error {
+	m.sent = append(m.sent, to)
+	return nil
+}
+
+type recordingNotifier struct {
+	opened []models.CircuitBreaker
+}
+
+func (n *recordingNotifier) CircuitOpened(ctx context.Context, circuit models.CircuitBreaker) {
+	n.opened = append(n.opened, circuit)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	notifier := &recordingNotifier{}
+	breaker := NewCircuitBreaker(2, time.Minute, 3*time.Minute, NewGormCircuitStore(db), notifier, &mockLogger{})
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	breaker.now = func() time.Time { return now }
+
+	stored := func() models.CircuitBreaker {
+		var circuit models.CircuitBreaker
+		if err := db.First(&circuit, "host = ?", "example.com").Error; err != nil {
+			t.Fatalf("failed to load circuit: %v", err)
+		}
+		return circuit
+	}
+
+	breaker.Record(ctx, "example.com", true, "endpoint returned status 503")
+	if err := breaker.Allow(ctx, "example.com"); err != nil {
+		t.Fatalf("expected the circuit to stay closed below the threshold, got %v", err)
+	}
+
+	breaker.Record(ctx, "example.com", true, "endpoint returned status 503")
+	var open *CircuitOpenError
+	if err := breaker.Allow(ctx, "example.com"); !errors.As(err, &open) || !open.RetryAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expected the circuit to open for a minute, got %v", err)
+	}
+	if err := breaker.Allow(ctx, "other.example.com"); err != nil {
+		t.Errorf("expected other hosts to be called, got %v", err)
+	}
+	if len(notifier.opened) != 1 || notifier.opened[0].LastError != "endpoint returned status 503" {
+		t.Errorf("expected the owners to be notified once, got %+v", notifier.opened)
+	}
+	if circuit := stored(); circuit.State != models.CircuitOpen || circuit.Failures != 2 {
+		t.Errorf("expected the open circuit to be stored, got %+v", circuit)
+	}
+
+	// A single probe goes through once the cooldown is over, and its failure doubles the cooldown
+	now = now.Add(time.Minute)
+	if err := breaker.Allow(ctx, "example.com"); err != nil {
+		t.Fatalf("expected a probe, got %v", err)
+	}
+	if stored().State != models.CircuitHalfOpen {
+		t.Errorf("expected the circuit to be half open during the probe")
+	}
+	if err := breaker.Allow(ctx, "example.com"); err == nil {
+		t.Fatal("expected a single probe at a time")
+	}
+	breaker.Record(ctx, "example.com", true, "failed to send request: connection refused")
+	if err := breaker.Allow(ctx, "example.com"); !errors.As(err, &open) || !open.RetryAt.Equal(now.Add(2*time.Minute)) {
+		t.Fatalf("expected the circuit to open again for 2 minutes, got %v", err)
+	}
+	if len(notifier.opened) != 1 {
+		t.Errorf("expected failed probes not to notify again, got %d notices", len(notifier.opened))
+	}
+
+	// The cooldown is capped
+	now = now.Add(2 * time.Minute)
+	breaker.Allow(ctx, "example.com")
+	breaker.Record(ctx, "example.com", true, "failed to send request: connection refused")
+	if err := breaker.Allow(ctx, "example.com"); !errors.As(err, &open) || !open.RetryAt.Equal(now.Add(3*time.Minute)) {
+		t.Fatalf("expected the cooldown to be capped at 3 minutes, got %v", err)
+	}
+
+	// A restarted worker keeps the circuit open
+	restarted := NewCircuitBreaker(2, time.Minute, 3*time.Minute, NewGormCircuitStore(db), notifier, &mockLogger{})
+	restarted.now = breaker.now
+	if err := restarted.Load(ctx); err != nil {
+		t.Fatalf("failed to load circuits: %v", err)
+	}
+	if err := restarted.Allow(ctx, "example.com"); err == nil {
+		t.Fatal("expected the circuit to be restored open")
+	}
+
+	// A probe released without a request lets the next request probe
+	now = now.Add(3 * time.Minute)
+	if err := breaker.Allow(ctx, "example.com"); err != nil {
+		t.Fatalf("expected a probe, got %v", err)
+	}
+	breaker.Release(ctx, "example.com")
+	if stored().State != models.CircuitOpen {
+		t.Errorf("expected the released circuit to be open again")
+	}
+
+	// A successful probe closes it
+	if err := breaker.Allow(ctx, "example.com"); err != nil {
+		t.Fatalf("expected a probe, got %v", err)
+	}
+	breaker.Record(ctx, "example.com", false, "")
+	if err := breaker.Allow(ctx, "example.com"); err != nil {
+		t.Errorf("expected the circuit to close, got %v", err)
+	}
+	if circuit := stored(); circuit.State != models.CircuitClosed || circuit.Failures != 0 {
+		t.Errorf("expected the closed circuit to be stored, got %+v", circuit)
+	}
+}
+
+// blockingNotifier calls back into the breaker, which deadlocks if the breaker notifies under its lock
+type blockingNotifier struct {
+	breaker *CircuitBreaker
+	allowed error
+}
+
+func (n *blockingNotifier) CircuitOpened(ctx context.Context, circuit models.CircuitBreaker) {
+	n.allowed = n.breaker.Allow(ctx, "other.example.com")
+}
+
+func TestCircuitBreaker_NotifiesWithoutLock(t *testing.T) {
+	notifier := &blockingNotifier{}
+	breaker := NewCircuitBreaker(1, time.Minute, time.Hour, nil, notifier, &mockLogger{})
+	notifier.breaker = breaker
+
+	done := make(chan struct{})
+	go func() {
+		breaker.Record(context.Background(), "example.com", true, "endpoint returned status 503")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected other hosts to be usable while the owners are notified")
+	}
+	if notifier.allowed != nil {
+		t.Errorf("expected other hosts to be called, got %v", notifier.allowed)
+	}
+}
+
+func TestWebhookSender_CircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	client := &sequenceHTTPClient{statuses: []int{503, 404, 503, 503}}
+	sender := NewWebhookSender(client, &mockLogger{}, Config{})
+	sender.SetCircuitBreaker(NewCircuitBreaker(2, time.Minute, time.Hour, nil, nil, &mockLogger{}))
+
+	result := ProcessResult{JobID: 1, URL: "https://example.com/hook", Method: "POST"}
+
+	// Client errors show the endpoint is up and reset the count
+	for i := 0; i < 4; i++ {
+		sender.SendWebhook(ctx, result)
+	}
+	if client.requests != 4 {
+		t.Fatalf("expected every call to be made, got %d", client.requests)
+	}
+
+	got := sender.SendWebhook(ctx, result)
+	var open *CircuitOpenError
+	if !errors.As(got.Error, &open) || open.Host != "example.com" {
+		t.Fatalf("expected the call to fail fast, got %+v", got)
+	}
+	if client.requests != 4 {
+		t.Errorf("expected no request while the circuit is open, got %d", client.requests)
+	}
+
+	// Other hosts are unaffected
+	other := result
+	other.URL = "https://example.org/hook"
+	if got := sender.SendWebhook(ctx, other); got.Error != nil {
+		t.Errorf("expected other hosts to be called, got %v", got.Error)
+	}
+}
+
+func TestSMTPMessagePoller_OpenCircuitDefersDeliveries(t *testing.T) {
+	db := newTestDB(t)
+	client := &sequenceHTTPClient{statuses: []int{503}}
+	poller := newTestPoller(t, db, client)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	poller.now = func() time.Time { return now }
+
+	// The breaker has its own clock, the circuit stays open until it moves
+	opened := now
+	breaker := NewCircuitBreaker(1, 10*time.Minute, time.Hour, nil, nil, &mockLogger{})
+	breaker.now = func() time.Time { return opened }
+	breaker.Record(context.Background(), "example.com", true, "endpoint returned status 503")
+	poller.dispatcher.destinations[models.DestinationTypeHTTP].(*WebhookSender).SetCircuitBreaker(breaker)
+
+	msg := models.SMTPMessage{To: "hook@example.com", From: "a@example.org", Subject: "Hi", Body: "Hello", CreatedAt: now}
+	if err := db.Create(&msg).Error; err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+
+	poller.drain(context.Background())
+	stored := message(t, db, msg.ID)
+	if stored.Status != models.MessageStatusRetrying || !stored.NextAttemptAt.Equal(opened.Add(10*time.Minute)) {
+		t.Fatalf("expected the message to wait for the circuit, got %+v", stored)
+	}
+
+	// Deferrals don't use up the retries
+	for i := 0; i < 4; i++ {
+		now = message(t, db, msg.ID).NextAttemptAt
+		poller.drain(context.Background())
+	}
+	if client.requests != 0 {
+		t.Fatalf("expected no request while the circuit is open, got %d", client.requests)
+	}
+	if stored := message(t, db, msg.ID); stored.Status != models.MessageStatusRetrying || stored.Attempts != 5 {
+		t.Fatalf("expected the message to still be retrying, got %+v", stored)
+	}
+
+	opened = opened.Add(10 * time.Minute)
+	client.statuses = []int{200}
+	poller.drain(context.Background())
+	if stored := message(t, db, msg.ID); stored.Status != models.MessageStatusDelivered || client.requests != 1 {
+		t.Errorf("expected the message to be delivered by the probe, got %+v", stored)
+	}
+}
+
+func TestCircuitMailer_NotifiesOwners(t *testing.T) {
+	db := newTestDB(t)
+	users := []models.User{
+		{Name: "a", Email: "a@example.org", Password: "x"},
+		{Name: "b", Email: "b@example.org", Password: "x"},
+		{Name: "c", Email: "c@example.org", Password: "x"},
+	}
+	if err := db.Create(&users).Error; err != nil {
+		t.Fatalf("failed to store users: %v", err)
+	}
+	jobs := []models.Job{
+		{Email: "1@example.com", URL: "https://hooks.example.com/a", UserID: users[0].ID},
+		{Email: "2@example.com", URL: "https://hooks.example.com/b", UserID: users[0].ID},
+		{Email: "3@example.com", URL: "https://other.example.com", UserID: users[1].ID,
+			Destinations: []models.Destination{{Name: "hooks", URL: "https://hooks.example.com/c"}}},
+		{Email: "4@example.com", URL: "https://hooks.example.com.evil.test/", UserID: users[2].ID},
+	}
+	if err := db.Create(&jobs).Error; err != nil {
+		t.Fatalf("failed to store jobs: %v", err)
+	}
+
+	mailer := &mockMailer{}
+	NewCircuitMailer(db, mailer, &mockLogger{}).CircuitOpened(context.Background(), models.CircuitBreaker{Host: "hooks.example.com"})
+
+	if len(mailer.sent) != 2 || mailer.sent[0] != "a@example.org" || mailer.sent[1] != "b@example.org" {
+		t.Errorf("expected a notice per owner, got %v", mailer.sent)
+	}
+}
@@ -0,0 +1,317 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+// JobError reports a job field that failed to compile
+type JobError struct {
+	Field string
+	Err   error
+}
+
+func (e *JobError) Error() string {
+	return fmt.Sprintf("invalid %s: %v", e.Field, e.Err)
+}
+
+func (e *JobError) Unwrap() error {
+	return e.Err
+}
+
+// compiledJob holds the parsed regex and template of a job so they aren't re-parsed for every message
+type compiledJob struct {
+	version    int64
+	email      string
+	fromRegex  *regexp.Regexp
+	extractors []extractor
+	match      *matchNode // nil when the job has no match rules
+	// destinations are the job's own URL when it has no destinations
+	destinations []compiledDestination
+
+	// used is when the cache last handed the job out
+	used time.Time
+}
+
+// compiledDestination is a destination with the job's defaults applied
+type compiledDestination struct {
+	models.Destination
+	format  string                        // The job's payload format, for HTTP destinations
+	payload *template.Template            // nil when neither the destination nor the job has a payload template
+	url     *template.Template            // nil when the URL has no template actions
+	headers map[string]*template.Template // The header values with template actions
+	match   *matchNode                    // nil when the destination has no match rules
+}
+
+// compileCacheIdle is how long a compiled job stays cached without being used. Jobs that were deleted or moved
+// to another address are no longer looked up under theirs, they are evicted once idle.
+const compileCacheIdle = time.Hour
+
+// compileCache caches compiled jobs keyed by job ID, an entry is replaced once the job's UpdatedAt changes
+type compileCache struct {
+	mu   sync.Mutex
+	jobs map[int]*compiledJob
+}
+
+// ValidateJob checks that the regex and templates of a job compile.
+// A failing field is reported as a *JobError.
+func ValidateJob(job *models.Job) error {
+	compiled, err := compileJob(job)
+	if err != nil {
+		return err
+	}
+	for _, cd := range compiled.destinations {
+		err := checkSample(job, cd)
+		if err != nil && len(job.Destinations) > 0 {
+			return &JobError{Field: "Destinations", Err: fmt.Errorf("%s: %w", cd.Name, err)}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compileJob(job *models.Job) (*compiledJob, error) {
+	fromRegex, err := regexp.Compile(job.FromRegex)
+	if err != nil {
+		return nil, &JobError{Field: "FromRegex", Err: err}
+	}
+
+	compiled := &compiledJob{
+		version:   job.UpdatedAt.UnixNano(),
+		email:     job.Email,
+		fromRegex: fromRegex,
+	}
+
+	if job.Match != nil {
+		compiled.match, err = compileMatchRule(*job.Match)
+		if err != nil {
+			return nil, &JobError{Field: "Match", Err: err}
+		}
+	}
+
+	if job.Digest != nil {
+		if err := validateDigest(job.Digest); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validateDedupWindow(job.DedupWindow); err != nil {
+		return nil, err
+	}
+
+	if job.RateLimit != nil {
+		if err := validateRateLimit(job.RateLimit); err != nil {
+			return nil, err
+		}
+	}
+
+	if job.Schedule != nil {
+		if job.Digest != nil {
+			return nil, &JobError{Field: "ScheduleDelay", Err: errors.New("digests are sent when their window closes, they can't be scheduled as well")}
+		}
+		if err := validateSchedule(job.Schedule); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validatePayloadFormat(job); err != nil {
+		return nil, &JobError{Field: "PayloadFormat", Err: err}
+	}
+
+	compiled.extractors, err = compileExtractors(job.Extract)
+	if err != nil {
+		return nil, &JobError{Field: "Extract", Err: err}
+	}
+
+	if len(job.Destinations) == 0 {
+		// The job's own fields make up its default destination
+		cd, err := compileDestination(job, models.Destination{Name: "default", URL: job.URL})
+		if err != nil {
+			return nil, err
+		}
+		compiled.destinations = []compiledDestination{cd}
+	}
+	for _, dest := range job.Destinations {
+		err := validateDestinationSettings(dest)
+		if err != nil {
+			return nil, &JobError{Field: "Destinations", Err: fmt.Errorf("%s: %w", dest.Name, err)}
+		}
+		cd, err := compileDestination(job, dest)
+		if err != nil {
+			return nil, &JobError{Field: "Destinations", Err: fmt.Errorf("%s: %w", dest.Name, err)}
+		}
+		compiled.destinations = append(compiled.destinations, cd)
+	}
+
+	return compiled, nil
+}
+
+// ValidateDestination checks the settings of a destination and that its template and match rules compile.
+// A failing field is reported as a *JobError.
+func ValidateDestination(job *models.Job, dest models.Destination) error {
+	if err := validateDestinationSettings(dest); err != nil {
+		return err
+	}
+	cd, err := compileDestination(job, dest)
+	if err != nil {
+		return err
+	}
+	return checkSample(job, cd)
+}
+
+func compileDestination(job *models.Job, dest models.Destination) (compiledDestination, error) {
+	cd := compiledDestination{Destination: dest}
+	if cd.Type == "" {
+		cd.Type = models.DestinationTypeHTTP
+	}
+	// Presets build their own requests, only HTTP destinations inherit the job's
+	if cd.Type == models.DestinationTypeHTTP {
+		if cd.Method == "" {
+			cd.Method = job.Method
+		}
+		if cd.Headers == nil {
+			cd.Headers = job.Headers
+		}
+		if cd.PayloadTemplate == "" {
+			cd.PayloadTemplate = job.PayloadTemplate
+		}
+		cd.format = job.PayloadFormat
+	}
+
+	var err error
+	if cd.PayloadTemplate != "" {
+		cd.payload, err = parsePayloadTemplate("payload", cd.PayloadTemplate)
+		if err != nil {
+			return cd, &JobError{Field: "PayloadTemplate", Err: err}
+		}
+	}
+
+	// The generic HTTP destination can route and label messages with their content
+	if cd.Type == models.DestinationTypeHTTP {
+		if isTemplate(cd.URL) {
+			// Messages pick the path and query, where they are delivered stays up to the job
+			if u, err := url.Parse(cd.URL); err != nil || isTemplate(u.Scheme+u.Host) {
+				return cd, &JobError{Field: "URL", Err: errors.New("templates can only fill the path and query of the URL")}
+			}
+			cd.url, err = parsePayloadTemplate("url", cd.URL)
+			if err != nil {
+				return cd, &JobError{Field: "URL", Err: err}
+			}
+		}
+		for key, value := range cd.Headers {
+			if !isTemplate(value) {
+				continue
+			}
+			tmpl, err := parsePayloadTemplate(key, value)
+			if err != nil {
+				return cd, &JobError{Field: "Headers", Err: fmt.Errorf("%s: %w", key, err)}
+			}
+			if cd.headers == nil {
+				cd.headers = make(map[string]*template.Template)
+			}
+			cd.headers[key] = tmpl
+		}
+	}
+
+	if dest.Match != nil {
+		cd.match, err = compileMatchRule(*dest.Match)
+		if err != nil {
+			return cd, &JobError{Field: "Match", Err: err}
+		}
+	}
+
+	return cd, nil
+}
+
+// checkSample tries the payload template of a destination whose headers say it sends JSON on a sample message.
+// It only runs when a job is saved, jobs already saved keep delivering the messages their template fits.
+// Digests render other data and are only checked when sent.
+func checkSample(job *models.Job, cd compiledDestination) error {
+	if cd.payload == nil || job.Digest != nil {
+		return nil
+	}
+	if _, err := renderPayload(cd.payload, sampleContext(job), headerValue(cd.Headers, "Content-Type")); err != nil {
+		return &JobError{Field: "PayloadTemplate", Err: fmt.Errorf("%w for a sample message", err)}
+	}
+	return nil
+}
+
+// sampleContext is the message payload templates are tried on when their job is saved.
+// The subject has quotes so values inserted without the json helper are caught.
+func sampleContext(job *models.Job) *TemplateContext {
+	tc := newTemplateContext(Message{
+		From:    "sender@example.org",
+		To:      job.Email,
+		Subject: `Sample "subject"`,
+		Body:    "Sample body",
+	}, nil).forJob(job)
+	// Numbers fit whether the template quotes the values or not
+	for _, rule := range job.Extract {
+		tc.Vars[rule.Name] = "0"
+	}
+	return tc
+}
+
+// isTemplate tells whether a URL or header value has template actions to render
+func isTemplate(text string) bool {
+	return strings.Contains(text, "{{")
+}
+
+// get returns the compiled job, compiling it when it isn't cached or has changed since
+func (c *compileCache) get(job *models.Job) (*compiledJob, error) {
+	// Unsaved jobs have no identity to cache them under
+	if job.ID == 0 {
+		return compileJob(job)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.jobs[job.ID]; ok && cached.version == job.UpdatedAt.UnixNano() {
+		cached.used = time.Now()
+		return cached, nil
+	}
+
+	compiled, err := compileJob(job)
+	if err != nil {
+		delete(c.jobs, job.ID)
+		return nil, err
+	}
+
+	if c.jobs == nil {
+		c.jobs = make(map[int]*compiledJob)
+	}
+	compiled.used = time.Now()
+	c.jobs[job.ID] = compiled
+
+	return compiled, nil
+}
+
+// prune evicts the cached jobs of an address that are no longer among its active jobs, and the jobs of any address
+// left idle
+func (c *compileCache) prune(email string, jobs []*models.Job) {
+	active := make(map[int]bool, len(jobs))
+	for _, job := range jobs {
+		active[job.ID] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	idle := time.Now().Add(-compileCacheIdle)
+	for id, cached := range c.jobs {
+		if (cached.email == email && !active[id]) || cached.used.Before(idle) {
+			delete(c.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+func TestValidateJob(t *testing.T) {
+	tests := []struct {
+		name          string
+		job           *models.Job
+		expectedField string
+	}{
+		{
+			name: "valid job",
+			job:  &models.Job{FromRegex: ".*@example.com", PayloadTemplate: `{"s": {{json .Subject}}}`},
+		},
+		{
+			name:          "invalid regex",
+			job:           &models.Job{FromRegex: "(unclosed"},
+			expectedField: "FromRegex",
+		},
+		{
+			name:          "invalid template",
+			job:           &models.Job{PayloadTemplate: "{{.Subject"},
+			expectedField: "PayloadTemplate",
+		},
+		{
+			name:          "unknown template function",
+			job:           &models.Job{PayloadTemplate: "{{nope .Subject}}"},
+			expectedField: "PayloadTemplate",
+		},
+		{
+			name: "templated URL and headers",
+			job:  &models.Job{URL: "https://example.com/tickets/{{pathEscape .Vars.ticket}}", Headers: map[string]string{"X-Subject": "{{.Subject}}"}},
+		},
+		{
+			name:          "invalid URL template",
+			job:           &models.Job{URL: "https://example.com/{{.Subject"},
+			expectedField: "URL",
+		},
+		{
+			name:          "templated URL host",
+			job:           &models.Job{URL: "https://{{.Vars.tenant}}.example.com/hook"},
+			expectedField: "URL",
+		},
+		{
+			name:          "invalid header template",
+			job:           &models.Job{Headers: map[string]string{"X-Subject": "{{.Subject"}},
+			expectedField: "Headers",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateJob(tt.job)
+
+			if tt.expectedField == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			var jobErr *JobError
+			if !errors.As(err, &jobErr) {
+				t.Fatalf("expected a *JobError, got %v", err)
+			}
+			if jobErr.Field != tt.expectedField {
+				t.Errorf("expected field %q, got %q", tt.expectedField, jobErr.Field)
+			}
+		})
+	}
+}
+
+func TestCompileCache(t *testing.T) {
+	var cache compileCache
+	job := &models.Job{ID: 1, Email: "hook@example.com", FromRegex: "a", UpdatedAt: time.Unix(100, 0)}
+
+	first, err := cache.get(job)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	second, _ := cache.get(job)
+	if first != second {
+		t.Error("expected the compiled job to be reused")
+	}
+
+	job.FromRegex = "b"
+	job.UpdatedAt = time.Unix(200, 0)
+	third, _ := cache.get(job)
+	if third == first {
+		t.Error("expected an updated job to be recompiled")
+	}
+	if !third.fromRegex.MatchString("b") {
+		t.Error("expected the recompiled regex to be used")
+	}
+
+	// Jobs still active for the address are kept, the others are evicted
+	cache.prune("other@example.com", nil)
+	if _, ok := cache.jobs[job.ID]; !ok {
+		t.Error("expected the job of another address to be kept")
+	}
+	cache.prune(job.Email, []*models.Job{job})
+	if _, ok := cache.jobs[job.ID]; !ok {
+		t.Error("expected an active job to be kept")
+	}
+	cache.prune(job.Email, nil)
+	if _, ok := cache.jobs[job.ID]; ok {
+		t.Error("expected an inactive job to be evicted")
+	}
+
+	// Jobs no longer looked up under their address, deleted or moved, are evicted once idle
+	cache.get(job)
+	cache.jobs[job.ID].used = time.Now().Add(-2 * compileCacheIdle)
+	cache.prune("other@example.com", nil)
+	if _, ok := cache.jobs[job.ID]; ok {
+		t.Error("expected an idle job to be evicted")
+	}
+}
+
+func TestMessageProcessor_ProcessMessage_InvalidJob(t *testing.T) {
+	job := &models.Job{ID: 1, Email: "test@example.com", FromRegex: "(unclosed", URL: "http://example.com"}
+	processor := &MessageProcessor{
+		jobRepo: &mockJobRepository{jobs: map[string][]*models.Job{job.Email: {job}}},
+		logger:  &mockLogger{},
+	}
+
+	results, err := processor.ProcessMessage(context.Background(), Message{To: job.Email, From: "sender@example.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 1 || results[0].Error == nil {
+		t.Fatalf("expected one result carrying the compile error, got %+v", results)
+	}
+}
@@ -0,0 +1,88 @@
+package worker
+
+import (
+	"net/mail"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+// TemplateContext is the data payload templates are rendered with.
+// Message is embedded so {{.From}}, {{.To}}, {{.Subject}} and {{.Body}} keep working.
+type TemplateContext struct {
+	Message
+
+	FromName    string
+	FromAddress string
+	Cc          []string
+	ReplyTo     string
+	MessageID   string
+	ReceivedAt  time.Time
+	SMTPID      int
+	Text        string
+	HTML        string
+	Headers     map[string]string
+	Attachments []Attachment
+	Auth        models.AuthResults // Verdicts of the SMTP server, Authentication-Results headers are not trusted
+	Size        int
+	Job         JobContext
+	Vars        map[string]string // Values found by the job's extraction rules
+}
+
+// JobContext describes the job a message is being delivered for
+type JobContext struct {
+	ID    int
+	Email string
+}
+
+// newTemplateContext builds the job independent part of the context from a message.
+// Messages without a raw source, or whose source can't be parsed, only expose the basic fields.
+func newTemplateContext(msg Message, logger Logger) *TemplateContext {
+	tc := &TemplateContext{
+		Message:     msg,
+		FromAddress: msg.From,
+		ReceivedAt:  msg.ReceivedAt,
+		SMTPID:      msg.ID,
+		Text:        msg.Body,
+		Headers:     map[string]string{},
+		Size:        len(msg.Raw),
+		Auth:        msg.Auth,
+	}
+
+	if msg.Raw == "" {
+		tc.Size = len(msg.Body)
+		return tc
+	}
+
+	parsed, err := parseEmail(msg.Raw)
+	if err != nil {
+		logger.Printf("failed to parse message %d, using basic fields only: %v", msg.ID, err)
+		return tc
+	}
+
+	if from, err := mail.ParseAddress(parsed.Header.Get("From")); err == nil {
+		tc.FromName = from.Name
+		tc.FromAddress = from.Address
+	}
+	if replyTo := parsed.addressList("Reply-To"); len(replyTo) > 0 {
+		tc.ReplyTo = replyTo[0]
+	}
+	tc.Cc = parsed.addressList("Cc")
+	tc.MessageID = parsed.Header.Get("Message-Id")
+	tc.Headers = parsed.headers()
+	tc.Attachments = parsed.Attachments
+	if parsed.Text != "" {
+		tc.Text = parsed.Text
+	}
+	tc.HTML = parsed.HTML
+
+	return tc
+}
+
+// forJob returns a copy of the context carrying the metadata of a job
+func (tc *TemplateContext) forJob(job *models.Job) *TemplateContext {
+	jobCtx := *tc
+	jobCtx.Job = JobContext{ID: job.ID, Email: job.Email}
+	jobCtx.Vars = map[string]string{}
+	return &jobCtx
+}
@@ -0,0 +1,123 @@
+package worker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+const multipartEmail = "From: =?UTF-8?Q?Ren=C3=A9_Sender?= <rene@example.org>\r\n" +
+	"To: hook@example.com\r\n" +
+	"Cc: a@example.org, B <b@example.org>\r\n" +
+	"Reply-To: support@example.org\r\n" +
+	"Subject: Invoice\r\n" +
+	"Message-ID: <abc123@example.org>\r\n" +
+	"Authentication-Results: mx.example.com; spf=pass smtp.mailfrom=example.org; dkim=fail header.d=example.org; dmarc=none\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Total: 10=E2=82=AC\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>Total: 10&euro;</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=invoice.pdf\r\n" +
+	"Content-Disposition: attachment; filename=invoice.pdf\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0x\r\n" +
+	"LjQK\r\n" +
+	"--outer--\r\n"
+
+func TestNewTemplateContext(t *testing.T) {
+	received := time.Date(2026, 1, 6, 20, 0, 0, 0, time.UTC)
+	msg := Message{
+		From:       "bounce@example.org",
+		To:         "hook@example.com",
+		Subject:    "Invoice",
+		Body:       "raw body",
+		ID:         42,
+		ReceivedAt: received,
+		Raw:        multipartEmail,
+		Auth:       models.AuthResults{SPF: "softfail", DKIM: "none", DMARC: "fail"},
+	}
+
+	tc := newTemplateContext(msg, &mockLogger{}).forJob(&models.Job{ID: 7, Email: "hook@example.com"})
+
+	if tc.From != "bounce@example.org" {
+		t.Errorf("expected the envelope sender to stay in From, got %q", tc.From)
+	}
+	if tc.FromName != "René Sender" || tc.FromAddress != "rene@example.org" {
+		t.Errorf("unexpected parsed From: %q <%q>", tc.FromName, tc.FromAddress)
+	}
+	if strings.Join(tc.Cc, ",") != "a@example.org,b@example.org" {
+		t.Errorf("unexpected Cc: %v", tc.Cc)
+	}
+	if tc.ReplyTo != "support@example.org" {
+		t.Errorf("unexpected Reply-To: %q", tc.ReplyTo)
+	}
+	if tc.MessageID != "<abc123@example.org>" {
+		t.Errorf("unexpected Message-ID: %q", tc.MessageID)
+	}
+	if tc.Text != "Total: 10€" {
+		t.Errorf("unexpected text body: %q", tc.Text)
+	}
+	if tc.HTML != "<p>Total: 10&euro;</p>" {
+		t.Errorf("unexpected HTML body: %q", tc.HTML)
+	}
+	if len(tc.Attachments) != 1 || tc.Attachments[0].Filename != "invoice.pdf" || tc.Attachments[0].Size != 9 {
+		t.Errorf("unexpected attachments: %+v", tc.Attachments)
+	}
+	// The verdicts of the SMTP server win over the Authentication-Results header of the sender
+	if tc.Auth != (models.AuthResults{SPF: "softfail", DKIM: "none", DMARC: "fail"}) {
+		t.Errorf("unexpected auth results: %+v", tc.Auth)
+	}
+	if tc.Headers["Subject"] != "Invoice" {
+		t.Errorf("expected headers to be exposed, got %v", tc.Headers)
+	}
+	if tc.SMTPID != 42 || !tc.ReceivedAt.Equal(received) {
+		t.Errorf("unexpected stored metadata: %d %v", tc.SMTPID, tc.ReceivedAt)
+	}
+	if tc.Job.ID != 7 || tc.Job.Email != "hook@example.com" {
+		t.Errorf("unexpected job metadata: %+v", tc.Job)
+	}
+}
+
+func TestNewTemplateContext_WithoutRaw(t *testing.T) {
+	msg := Message{From: "sender@example.com", Body: "Hello"}
+
+	tc := newTemplateContext(msg, &mockLogger{})
+
+	if tc.FromAddress != "sender@example.com" || tc.Text != "Hello" {
+		t.Errorf("expected basic fields to be used as fallbacks, got %+v", tc)
+	}
+}
+
+func TestMessageProcessor_ProcessMessage_RichContext(t *testing.T) {
+	msg := Message{From: "bounce@example.org", To: "hook@example.com", Subject: "Invoice", Raw: multipartEmail, Auth: models.AuthResults{SPF: "pass"}}
+	job := &models.Job{
+		ID:              3,
+		PayloadTemplate: `{{.From}}|{{.FromName}}|{{.Job.ID}}|{{range .Attachments}}{{.Filename}}{{end}}|{{.Auth.SPF}}`,
+	}
+
+	payload, err := renderJob(t, job, msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "bounce@example.org|René Sender|3|invoice.pdf|pass"
+	if payload != expected {
+		t.Errorf("expected %q, got %q", expected, payload)
+	}
+}
@@ -0,0 +1,66 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gorm.io/gorm/clause"
+)
+
+// MaxDedupWindow is the longest a job may look back for copies of a message, in seconds
+const MaxDedupWindow = 7 * 24 * 60 * 60
+
+// validateDedupWindow checks the deduplication window of a job
+func validateDedupWindow(window int) error {
+	if window < 0 || window > MaxDedupWindow {
+		return &JobError{Field: "DedupWindow", Err: fmt.Errorf("must be between 0 and %d seconds", MaxDedupWindow)}
+	}
+	return nil
+}
+
+// deduplicate skips the message for a job when the same address received a copy of it within the job's window,
+// with the same Message-ID or content, and the copy was delivered for the job. Copies that failed or were
+// rejected don't count, the message may be the one that goes through. The decision is recorded in the delivery log.
+func (p *SMTPMessagePoller) deduplicate(ctx context.Context, smtpMsg models.SMTPMessage, processed ProcessResult) (bool, error) {
+	if smtpMsg.MessageID == "" && smtpMsg.ContentHash == "" {
+		return false, nil
+	}
+
+	query := p.db.WithContext(ctx).
+		Joins("JOIN deliveries ON deliveries.smtp_message_id = smtp_messages.id").
+		Where("deliveries.job_id = ? AND deliveries.status IN ?", processed.JobID,
+			[]string{models.DeliveryStatusDelivered, models.DeliveryStatusReplayed}).
+		Where(clause.Eq{Column: clause.Column{Table: "smtp_messages", Name: "to"}, Value: smtpMsg.To}).
+		Where("smtp_messages.id < ? AND smtp_messages.created_at >= ?", smtpMsg.ID, smtpMsg.CreatedAt.Add(-time.Duration(processed.Job.DedupWindow)*time.Second))
+	switch {
+	case smtpMsg.MessageID == "":
+		query = query.Where("smtp_messages.content_hash = ?", smtpMsg.ContentHash)
+	case smtpMsg.ContentHash == "":
+		query = query.Where("smtp_messages.message_id = ?", smtpMsg.MessageID)
+	default:
+		query = query.Where("smtp_messages.message_id = ? OR smtp_messages.content_hash = ?", smtpMsg.MessageID, smtpMsg.ContentHash)
+	}
+
+	var earlier models.SMTPMessage
+	if err := query.Order("smtp_messages.id DESC").Limit(1).Find(&earlier).Error; err != nil {
+		return false, err
+	}
+	if earlier.ID == 0 {
+		return false, nil
+	}
+
+	reason := "same content"
+	if smtpMsg.MessageID != "" && earlier.MessageID == smtpMsg.MessageID {
+		reason = "same Message-ID"
+	}
+	p.logger.Printf("job %d skipped message %d as a copy of message %d", processed.JobID, smtpMsg.ID, earlier.ID)
+
+	return true, p.deliveryLog.Record(ctx, &models.Delivery{
+		JobID:         processed.JobID,
+		SMTPMessageID: smtpMsg.ID,
+		Status:        models.DeliveryStatusDuplicate,
+		Detail:        fmt.Sprintf("duplicate of message #%d, %s", earlier.ID, reason),
+	})
+}
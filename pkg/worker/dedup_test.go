@@ -0,0 +1,106 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+func TestSMTPMessagePoller_Deduplication(t *testing.T) {
+	db := newTestDB(t)
+	client := &recordingHTTPClient{}
+	poller := newTestPoller(t, db, client)
+	poller.processor.jobRepo.(*mockJobRepository).jobs["hook@example.com"][0].DedupWindow = 3600
+	now := time.Date(2026, 1, 6, 20, 0, 0, 0, time.UTC)
+	poller.now = func() time.Time { return now }
+
+	receive := func(messageID, subject string, at time.Time) models.SMTPMessage {
+		t.Helper()
+		msg := models.SMTPMessage{To: "hook@example.com", From: "alice@example.org", Subject: subject, Body: "Disk full", MessageID: messageID, CreatedAt: at}
+		if err := db.Create(&msg).Error; err != nil {
+			t.Fatalf("failed to store message: %v", err)
+		}
+		poller.drain(context.Background())
+		return message(t, db, msg.ID)
+	}
+
+	first := receive("<1@example.org>", "Alert", now.Add(-2*time.Hour))
+	if first.Status != models.MessageStatusDelivered {
+		t.Fatalf("expected the first message to be delivered, got %q", first.Status)
+	}
+
+	// Out of the window, the same message is delivered again
+	again := receive("<1@example.org>", "Alert", now.Add(-30*time.Minute))
+	if again.Status != models.MessageStatusDelivered {
+		t.Errorf("expected a copy out of the window to be delivered, got %q", again.Status)
+	}
+
+	// A retried SMTP delivery has the same Message-ID, a duplicate notification the same content
+	retried := receive("<1@example.org>", "Alert", now)
+	resent := receive("<2@example.org>", "Alert", now)
+	for _, msg := range []models.SMTPMessage{retried, resent} {
+		if msg.Status != models.MessageStatusDuplicate {
+			t.Errorf("expected message %d to be a duplicate, got %q", msg.ID, msg.Status)
+		}
+	}
+
+	other := receive("<3@example.org>", "Another alert", now)
+	if other.Status != models.MessageStatusDelivered {
+		t.Errorf("expected a different message to be delivered, got %q", other.Status)
+	}
+	if len(client.bodies) != 3 {
+		t.Errorf("expected 3 deliveries, got %d", len(client.bodies))
+	}
+
+	var skipped []models.Delivery
+	for _, delivery := range deliveries(t, db) {
+		if delivery.Status == models.DeliveryStatusDuplicate {
+			skipped = append(skipped, delivery)
+		}
+	}
+	if len(skipped) != 2 {
+		t.Fatalf("expected 2 duplicates in the delivery log, got %+v", skipped)
+	}
+	if want := "duplicate of message #2, same Message-ID"; skipped[0].Detail != want {
+		t.Errorf("expected %q, got %q", want, skipped[0].Detail)
+	}
+	if !strings.HasSuffix(skipped[1].Detail, "same content") {
+		t.Errorf("expected a copy by content, got %q", skipped[1].Detail)
+	}
+}
+
+func TestSMTPMessagePoller_DeduplicationIgnoresFailedCopies(t *testing.T) {
+	db := newTestDB(t)
+	client := &sequenceHTTPClient{statuses: []int{404, 200}}
+	poller := newTestPoller(t, db, client)
+	poller.processor.jobRepo.(*mockJobRepository).jobs["hook@example.com"][0].DedupWindow = 3600
+
+	for range 2 {
+		msg := models.SMTPMessage{To: "hook@example.com", From: "alice@example.org", Subject: "Alert", Body: "Disk full", MessageID: "<1@example.org>"}
+		if err := db.Create(&msg).Error; err != nil {
+			t.Fatalf("failed to store message: %v", err)
+		}
+		poller.drain(context.Background())
+	}
+
+	if client.requests != 2 {
+		t.Errorf("expected the copy of a failed message to be delivered, got %d requests", client.requests)
+	}
+	if got := deliveries(t, db); len(got) != 2 || got[1].Status != models.DeliveryStatusDelivered {
+		t.Errorf("expected the copy to be delivered, got %+v", got)
+	}
+}
+
+func TestValidateDedupWindow(t *testing.T) {
+	var jobErr *JobError
+	if err := ValidateJob(&models.Job{DedupWindow: 3600}); err != nil {
+		t.Errorf("expected a valid job, got %v", err)
+	}
+	if err := ValidateJob(&models.Job{DedupWindow: -1}); !errors.As(err, &jobErr) || jobErr.Field != "DedupWindow" {
+		t.Errorf("expected an error on DedupWindow, got %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/secrets"
+)
+
+// Destination delivers processed messages to one type of endpoint
+type Destination interface {
+	Deliver(ctx context.Context, result ProcessResult) WebhookResult
+}
+
+// Dispatcher hands every result to the destination registered for its type
+type Dispatcher struct {
+	destinations map[string]Destination
+	box          *secrets.Box
+	logger       Logger
+}
+
+// NewDispatcher creates a dispatcher delivering the generic HTTP type and the chat and push presets through sender
+func NewDispatcher(sender *WebhookSender, logger Logger) *Dispatcher {
+	d := &Dispatcher{
+		destinations: make(map[string]Destination),
+		logger:       logger,
+	}
+
+	d.Register(models.DestinationTypeHTTP, sender)
+	for destType, build := range presets {
+		d.Register(destType, &presetDestination{sender: sender, build: build})
+	}
+
+	return d
+}
+
+// Register sets the destination delivering results of a type, replacing any previous one
+func (d *Dispatcher) Register(destType string, dest Destination) {
+	d.destinations[destType] = dest
+}
+
+// SetSecrets makes the dispatcher open the destination tokens sealed by the web server
+func (d *Dispatcher) SetSecrets(box *secrets.Box) {
+	d.box = box
+}
+
+// Deliver sends a result to its destination
+func (d *Dispatcher) Deliver(ctx context.Context, result ProcessResult) WebhookResult {
+	destType := result.Type
+	if destType == "" {
+		destType = models.DestinationTypeHTTP
+	}
+
+	dest, ok := d.destinations[destType]
+	if !ok {
+		d.logger.Printf("no destination of type %q for job %d", destType, result.JobID)
+		return WebhookResult{
+			JobID:         result.JobID,
+			DestinationID: result.DestinationID,
+			Error:         fmt.Errorf("unsupported destination type %q", destType),
+		}
+	}
+
+	if d.box != nil && secrets.IsSealed(result.Token) {
+		token, err := d.box.Open(result.Token)
+		if err != nil {
+			return WebhookResult{
+				JobID:         result.JobID,
+				DestinationID: result.DestinationID,
+				Error:         fmt.Errorf("failed to open the destination token: %w", err),
+			}
+		}
+		result.Token = token
+	}
+
+	return dest.Deliver(ctx, result)
+}
+
+// DeliverAll sends every result to its destination, in order
+func (d *Dispatcher) DeliverAll(ctx context.Context, results []ProcessResult) []WebhookResult {
+	webhookResults := make([]WebhookResult, 0, len(results))
+	for _, result := range results {
+		webhookResults = append(webhookResults, d.Deliver(ctx, result))
+	}
+	return webhookResults
+}
+
+// destinationSchemes lists the URL schemes each type with a URL accepts
+var destinationSchemes = map[string][]string{
+	models.DestinationTypeHTTP:     {"http", "https"},
+	models.DestinationTypeSlack:    {"http", "https"},
+	models.DestinationTypeDiscord:  {"http", "https"},
+	models.DestinationTypeTeams:    {"http", "https"},
+	models.DestinationTypeMatrix:   {"http", "https"},
+	models.DestinationTypeTelegram: {"http", "https"},
+	models.DestinationTypeNtfy:     {"http", "https"},
+	models.DestinationTypeEmail:    nil,
+	models.DestinationTypeNATS:     {"nats", "tls"},
+	models.DestinationTypeAMQP:     {"amqp", "amqps"},
+	models.DestinationTypeRedis:    {"redis", "rediss"},
+	models.DestinationTypePull:     nil,
+}
+
+// validateDestinationSettings checks that a destination has the settings its type needs
+func validateDestinationSettings(dest models.Destination) error {
+	destType := dest.Type
+	if destType == "" {
+		destType = models.DestinationTypeHTTP
+	}
+
+	missing := func(field, what string) error {
+		return &JobError{Field: field, Err: fmt.Errorf("%s destinations need %s", destType, what)}
+	}
+
+	schemes, ok := destinationSchemes[destType]
+	if !ok {
+		return &JobError{Field: "Type", Err: fmt.Errorf("unknown destination type %q", dest.Type)}
+	}
+	if dest.URL != "" {
+		u, err := url.Parse(dest.URL)
+		if err != nil || !slices.Contains(schemes, u.Scheme) || u.Host == "" {
+			return &JobError{Field: "URL", Err: fmt.Errorf("%s destinations need a %s URL", destType, schemes)}
+		}
+	}
+
+	switch destType {
+	case models.DestinationTypeHTTP, models.DestinationTypeSlack, models.DestinationTypeDiscord, models.DestinationTypeTeams, models.DestinationTypeNtfy:
+		if dest.URL == "" {
+			return missing("URL", "a URL")
+		}
+	case models.DestinationTypeMatrix:
+		switch {
+		case dest.URL == "":
+			return missing("URL", "the homeserver URL")
+		case dest.Token == "":
+			return missing("Token", "an access token")
+		case dest.Options["room"] == "":
+			return missing("Options", `a "room" option`)
+		}
+	case models.DestinationTypeTelegram:
+		switch {
+		case dest.Token == "":
+			return missing("Token", "a bot token")
+		case dest.Options["chat_id"] == "":
+			return missing("Options", `a "chat_id" option`)
+		}
+	case models.DestinationTypeEmail:
+		if dest.Options["to"] == "" {
+			return missing("Options", `a "to" option listing the mailboxes`)
+		}
+		if _, err := parseRecipients(dest.Options["to"]); err != nil {
+			return &JobError{Field: "Options", Err: fmt.Errorf("invalid recipients: %w", err)}
+		}
+	case models.DestinationTypeNATS:
+		switch {
+		case dest.URL == "":
+			return missing("URL", "a server URL")
+		case dest.Options["subject"] == "":
+			return missing("Options", `a "subject" option`)
+		}
+	case models.DestinationTypeAMQP:
+		switch {
+		case dest.URL == "":
+			return missing("URL", "a server URL")
+		case dest.Options["exchange"] == "" && dest.Options["routing_key"] == "":
+			return missing("Options", `an "exchange" or "routing_key" option`)
+		}
+	case models.DestinationTypeRedis:
+		switch {
+		case dest.URL == "":
+			return missing("URL", "a server URL")
+		case dest.Options["stream"] == "":
+			return missing("Options", `a "stream" option`)
+		}
+		if maxLen, ok := dest.Options["maxlen"]; ok {
+			if _, err := strconv.ParseInt(maxLen, 10, 64); err != nil {
+				return &JobError{Field: "Options", Err: fmt.Errorf("invalid maxlen %q", maxLen)}
+			}
+		}
+	case models.DestinationTypePull:
+		if len(dest.Token) < 16 {
+			return missing("Token", "an API token of at least 16 characters")
+		}
+	}
+
+	return nil
+}
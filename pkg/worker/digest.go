@@ -0,0 +1,449 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MaxDigestWindow is the longest a digest may collect messages for, in seconds
+const MaxDigestWindow = 7 * 24 * 60 * 60
+
+// DigestScheduler closes digests once their window is over, so the poller delivers them
+type DigestScheduler interface {
+	ScheduleDigest(digestID int, at time.Time) error
+}
+
+// DigestContext is what the templates of a digest job render, instead of a single message
+type DigestContext struct {
+	ID       int
+	Job      JobContext
+	Messages []*TemplateContext
+	Count    int
+}
+
+// digestPayload is the default JSON payload of a digest
+type digestPayload struct {
+	Job      JobContext
+	Count    int
+	Messages []Message
+}
+
+// validateDigest checks the digest options of a job
+func validateDigest(opts *models.DigestOptions) error {
+	if opts.Window <= 0 || opts.Window > MaxDigestWindow {
+		return &JobError{Field: "DigestWindow", Err: fmt.Errorf("must be between 1 and %d seconds", MaxDigestWindow)}
+	}
+	if opts.MaxItems < 0 {
+		return &JobError{Field: "DigestMaxItems", Err: errors.New("can't be negative")}
+	}
+	return nil
+}
+
+// ProcessDigest renders a closed digest of a job for each of its destinations. The messages a
+// destination's match rules turn down are left out, destinations left without any are skipped.
+func (p *MessageProcessor) ProcessDigest(ctx context.Context, digest models.Digest, messages []Message) ([]ProcessResult, error) {
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	// Every message of a digest was sent to the job's address
+	jobs, err := p.jobRepo.GetActiveJobs(ctx, messages[0].To)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get active jobs: %w", err)
+	}
+
+	var job *models.Job
+	for _, candidate := range jobs {
+		if candidate.ID == digest.JobID {
+			job = candidate
+		}
+	}
+	if job == nil {
+		return nil, nil
+	}
+
+	compiled, err := p.compiled.get(job)
+	if err != nil {
+		return []ProcessResult{{JobID: job.ID, URL: job.URL, Method: job.Method, Job: job, Error: err}}, nil
+	}
+
+	contexts := make([]*TemplateContext, 0, len(messages))
+	for _, msg := range messages {
+		tc := newTemplateContext(msg, p.logger).forJob(job)
+		tc.Vars, _ = extractVars(compiled.extractors, tc)
+		contexts = append(contexts, tc)
+	}
+
+	var results []ProcessResult
+	for i := range compiled.destinations {
+		dest := &compiled.destinations[i]
+
+		var included []*TemplateContext
+		for _, tc := range contexts {
+			if dest.match == nil {
+				included = append(included, tc)
+			} else if ok, _ := dest.match.eval(tc); ok {
+				included = append(included, tc)
+			}
+		}
+		if len(included) == 0 {
+			continue
+		}
+
+		dc := &DigestContext{
+			ID:       digest.ID,
+			Job:      JobContext{ID: job.ID, Email: job.Email},
+			Messages: included,
+			Count:    len(included),
+		}
+
+		result := ProcessResult{
+			JobID:         job.ID,
+			DestinationID: dest.ID,
+			Destination:   dest.Name,
+			Type:          dest.Type,
+			URL:           dest.URL,
+			Method:        dest.Method,
+			Headers:       dest.Headers,
+			Token:         dest.Token,
+			Options:       dest.Options,
+			Message:       dc.summary(),
+			Job:           job,
+		}
+
+		if dest.Type == "" || dest.Type == models.DestinationTypeHTTP {
+			result.IdempotencyKey = idempotencyKey("digest", digest.ID, job.ID, dest.ID)
+		}
+
+		// Overflow digests are of jobs whose templates are written for single messages,
+		// they render the summary of the digest instead
+		var data any = dc
+		if digest.Overflow {
+			data = result.Message
+		}
+		if err := p.renderRequest(&result, dest, data); err != nil {
+			result.Error = err
+			results = append(results, result)
+			continue
+		}
+
+		payload, err := p.renderDigest(dest, dc, data)
+		if err == nil {
+			payload, result.Headers, err = encodePayload(dest.format, result.Message, payload, result.Headers)
+		}
+		if err != nil {
+			result.Error = fmt.Errorf("failed to generate payload: %w", err)
+		}
+		result.Payload = payload
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// renderDigest renders the destination's payload template with data, or the digest as JSON when it has none.
+// Chat, push and email destinations show the summary of the digest, unless given a template.
+func (p *MessageProcessor) renderDigest(dest *compiledDestination, dc *DigestContext, data any) (string, error) {
+	if dest.payload != nil {
+		return renderPayload(dest.payload, data, headerValue(dest.Headers, "Content-Type"))
+	}
+	if _, ok := presets[dest.Type]; ok || dest.Type == models.DestinationTypeEmail {
+		return "", nil
+	}
+
+	payload := digestPayload{Job: dc.Job, Count: dc.Count}
+	for _, tc := range dc.Messages {
+		payload.Messages = append(payload.Messages, tc.Message)
+	}
+	jsonBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal digest to JSON: %w", err)
+	}
+
+	return string(jsonBytes), nil
+}
+
+// summary describes the digest as a message of its own, for the destinations that format messages themselves
+func (dc *DigestContext) summary() *TemplateContext {
+	var text strings.Builder
+	for _, tc := range dc.Messages {
+		fmt.Fprintf(&text, "- %s (%s)\n", tc.Subject, tc.FromAddress)
+	}
+
+	subject := fmt.Sprintf("%d messages to %s", dc.Count, dc.Job.Email)
+	return &TemplateContext{
+		Message: Message{
+			From:       dc.Job.Email,
+			To:         dc.Job.Email,
+			Subject:    subject,
+			Body:       text.String(),
+			ReceivedAt: dc.Messages[len(dc.Messages)-1].ReceivedAt,
+		},
+		FromAddress: dc.Job.Email,
+		MessageID:   fmt.Sprintf("digest-%d", dc.ID),
+		ReceivedAt:  dc.Messages[len(dc.Messages)-1].ReceivedAt,
+		Text:        text.String(),
+		Headers:     map[string]string{},
+		Job:         dc.Job,
+		Vars:        map[string]string{},
+	}
+}
+
+// digestCloseGrace is how long after their window open digests wait for the scheduler before the poller sends them
+const digestCloseGrace = time.Minute
+
+// collect adds a message to the open digest of its job, opening one with opts when there is none. Overflow
+// digests of the messages over the job's rate limit are kept apart from its regular ones. Digests reaching
+// their size limit are closed straight away, the scheduler closes the others when their window is over.
+func (p *SMTPMessagePoller) collect(ctx context.Context, smtpMsg models.SMTPMessage, processed ProcessResult, opts *models.DigestOptions, overflow bool, attempt int) error {
+	var digest models.Digest
+	opened := false
+
+	err := p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("job_id = ? AND status = ? AND overflow = ?", processed.JobID, models.DigestStatusOpen, overflow).Order("id DESC").Limit(1).Find(&digest).Error
+		if err == nil && digest.ID == 0 {
+			digest = models.Digest{
+				JobID:    processed.JobID,
+				Status:   models.DigestStatusOpen,
+				ClosesAt: p.now().Add(time.Duration(opts.Window) * time.Second),
+				Overflow: overflow,
+			}
+			err, opened = tx.Create(&digest).Error, true
+		}
+		if err != nil {
+			return err
+		}
+
+		// Retries and replays may bring a message back, it is collected once
+		added := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.DigestItem{DigestID: digest.ID, SMTPMessageID: smtpMsg.ID})
+		if added.Error != nil {
+			return added.Error
+		}
+		digest.Count += int(added.RowsAffected)
+		updates := map[string]any{"count": digest.Count}
+		if opts.MaxItems > 0 && digest.Count >= opts.MaxItems {
+			updates["status"] = models.DigestStatusClosed
+		}
+		if err := tx.Model(&digest).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&models.Delivery{
+			JobID:         processed.JobID,
+			SMTPMessageID: smtpMsg.ID,
+			DigestID:      digest.ID,
+			Status:        models.DeliveryStatusDigested,
+			Attempts:      attempt,
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	if opened && p.digests != nil {
+		if err := p.digests.ScheduleDigest(digest.ID, digest.ClosesAt); err != nil {
+			// The poller still picks it up once the grace period is over
+			p.logger.Printf("failed to schedule digest %d: %v", digest.ID, err)
+		}
+	}
+	return nil
+}
+
+// sendDigests delivers the closed digests and the retries that are due, returning how many were fetched.
+// Open digests past their window and the grace period are sent too, should their scheduled close be lost.
+func (p *SMTPMessagePoller) sendDigests(ctx context.Context) (int, error) {
+	now := p.now()
+
+	var digests []models.Digest
+	err := p.db.WithContext(ctx).
+		Where("status = ? OR (status = ? AND next_attempt_at <= ?) OR (status = ? AND closes_at <= ?)",
+			models.DigestStatusClosed, models.DigestStatusRetrying, now, models.DigestStatusOpen, now.Add(-digestCloseGrace)).
+		Order("id ASC").
+		Limit(p.batchSize).
+		Find(&digests).Error
+	if err != nil {
+		return 0, err
+	}
+
+	for _, digest := range digests {
+		if err := p.sendDigest(ctx, digest); err != nil {
+			p.logger.Printf("error sending digest %d: %v", digest.ID, err)
+		}
+	}
+	return len(digests), nil
+}
+
+// sendDigest delivers a digest to every destination on its first attempt, and then only to those
+// that failed in a way worth retrying
+func (p *SMTPMessagePoller) sendDigest(ctx context.Context, digest models.Digest) error {
+	attempt := digest.Attempts + 1
+	next := p.now().Add(p.backoff(attempt))
+
+	results, err := p.processDigest(ctx, digest)
+	if err != nil {
+		updates := map[string]any{"status": models.DigestStatusRetrying, "attempts": attempt, "last_error": err.Error(), "next_attempt_at": next}
+		if attempt > p.maxRetries {
+			updates["status"] = models.DigestStatusFailed
+		}
+		if updateErr := p.db.WithContext(ctx).Model(&digest).Updates(updates).Error; updateErr != nil {
+			return updateErr
+		}
+		return err
+	}
+
+	if digest.Status == models.DigestStatusRetrying {
+		pending, err := p.pendingDestinations(ctx, digest)
+		if err != nil {
+			return err
+		}
+		var retried []ProcessResult
+		for _, result := range results {
+			if pending[result.DestinationID] {
+				retried = append(retried, result)
+			}
+		}
+		results = retried
+	}
+
+	var lastError string
+	retry := false
+	for _, processed := range results {
+		result := p.dispatcher.Deliver(ctx, processed)
+		status := p.deliveryStatus(processed, result, attempt, &next)
+		if failed(result) {
+			lastError = failure(result)
+			p.logger.Printf("digest %d error for job %d: %v", digest.ID, result.JobID, result.Error)
+		}
+		if status == models.DeliveryStatusFailed {
+			retry = true
+		}
+		p.recordDelivery(ctx, models.Delivery{DigestID: digest.ID}, result, status, attempt)
+	}
+
+	updates := map[string]any{"attempts": attempt, "last_error": lastError}
+	switch {
+	case retry:
+		updates["status"] = models.DigestStatusRetrying
+		updates["next_attempt_at"] = next
+	case len(results) == 0 && digest.Status != models.DigestStatusRetrying:
+		updates["status"] = models.DigestStatusFailed
+		updates["last_error"] = "the job no longer delivers this digest"
+	default:
+		updates["status"], err = p.settledDigestStatus(ctx, digest.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return p.db.WithContext(ctx).Model(&digest).Updates(updates).Error
+}
+
+// processDigest loads the messages of a digest and renders it for the destinations of its job
+func (p *SMTPMessagePoller) processDigest(ctx context.Context, digest models.Digest) ([]ProcessResult, error) {
+	var smtpMsgs []models.SMTPMessage
+	err := p.db.WithContext(ctx).
+		Joins("JOIN digest_items ON digest_items.smtp_message_id = smtp_messages.id").
+		Where("digest_items.digest_id = ?", digest.ID).
+		Order("smtp_messages.id ASC").
+		Preload("Source").
+		Find(&smtpMsgs).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the messages of digest %d: %w", digest.ID, err)
+	}
+
+	messages := make([]Message, 0, len(smtpMsgs))
+	for _, smtpMsg := range smtpMsgs {
+		messages = append(messages, messageFromSMTP(smtpMsg))
+	}
+	return p.processor.ProcessDigest(ctx, digest, messages)
+}
+
+// pendingDestinations returns the destinations whose last attempt at a digest failed and should be retried
+func (p *SMTPMessagePoller) pendingDestinations(ctx context.Context, digest models.Digest) (map[int]bool, error) {
+	var ids []int
+	err := p.db.WithContext(ctx).
+		Model(&models.Delivery{}).
+		Where("digest_id = ? AND smtp_message_id = 0 AND status = ? AND attempts = ?", digest.ID, models.DeliveryStatusFailed, digest.Attempts).
+		Pluck("destination_id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		pending[id] = true
+	}
+	return pending, nil
+}
+
+// settledDigestStatus derives the status of a digest from the final outcome of its deliveries
+func (p *SMTPMessagePoller) settledDigestStatus(ctx context.Context, digestID int) (string, error) {
+	var dead int64
+	err := p.db.WithContext(ctx).
+		Model(&models.Delivery{}).
+		Where("digest_id = ? AND smtp_message_id = 0 AND status IN ?", digestID, []string{models.DeliveryStatusDead, models.DeliveryStatusReplaying}).
+		Count(&dead).Error
+	if err != nil {
+		return "", err
+	}
+
+	if dead > 0 {
+		return models.DigestStatusFailed, nil
+	}
+	return models.DigestStatusSent, nil
+}
+
+// replayDigest sends a digest again to the destination of a dead delivery queued for replay
+func (p *SMTPMessagePoller) replayDigest(ctx context.Context, delivery models.Delivery) {
+	status, detail := models.DeliveryStatusReplayed, ""
+
+	var digest models.Digest
+	err := p.db.WithContext(ctx).First(&digest, delivery.DigestID).Error
+	if err == nil {
+		var results []ProcessResult
+		results, err = p.processDigest(ctx, digest)
+		replayed := false
+		for _, processed := range results {
+			if processed.DestinationID != delivery.DestinationID {
+				continue
+			}
+			replayed = true
+			result := p.dispatcher.Deliver(ctx, processed)
+			status := models.DeliveryStatusDelivered
+			if failed(result) {
+				status = models.DeliveryStatusDead
+			}
+			p.recordDelivery(ctx, models.Delivery{DigestID: digest.ID}, result, status, 1)
+		}
+		if !replayed && err == nil {
+			detail = "replay: the job no longer delivers this digest"
+		}
+	}
+	if err != nil {
+		// Back to the dead letters with the reason the replay didn't happen
+		status, detail = models.DeliveryStatusDead, fmt.Sprintf("replay: %v", err)
+	}
+
+	updates := map[string]any{"status": status}
+	if detail != "" {
+		updates["detail"] = detail
+	}
+	if err := p.db.WithContext(ctx).Model(&delivery).Updates(updates).Error; err != nil {
+		p.logger.Printf("failed to update replayed delivery %d: %v", delivery.ID, err)
+	}
+
+	if digest.ID != 0 && digest.Status != models.DigestStatusOpen {
+		if settled, err := p.settledDigestStatus(ctx, digest.ID); err != nil {
+			p.logger.Printf("failed to settle digest %d: %v", digest.ID, err)
+		} else if err := p.db.WithContext(ctx).Model(&digest).Update("status", settled).Error; err != nil {
+			p.logger.Printf("failed to update digest %d: %v", digest.ID, err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+// recordingHTTPClient accepts requests and keeps their bodies
+type recordingHTTPClient struct {
+	bodies []string
+}
+
+func (c *recordingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	body, _ := io.ReadAll(req.Body)
+	c.bodies = append(c.bodies, string(body))
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+// recordingScheduler keeps the digests it is asked to close
+type recordingScheduler struct {
+	scheduled map[int]time.Time
+}
+
+func (s *recordingScheduler) ScheduleDigest(digestID int, at time.Time) error {
+	s.scheduled[digestID] = at
+	return nil
+}
+
+func TestSMTPMessagePoller_Digests(t *testing.T) {
+	db := newTestDB(t)
+	client := &recordingHTTPClient{}
+	poller := newTestPoller(t, db, client)
+	poller.processor.jobRepo.(*mockJobRepository).jobs["hook@example.com"][0].Digest = &models.DigestOptions{Window: 60, MaxItems: 2}
+	scheduler := &recordingScheduler{scheduled: map[int]time.Time{}}
+	poller.digests = scheduler
+	now := time.Date(2026, 1, 6, 20, 0, 0, 0, time.UTC)
+	poller.now = func() time.Time { return now }
+
+	receive := func(subject string) {
+		t.Helper()
+		msg := models.SMTPMessage{To: "hook@example.com", From: "alice@example.org", Subject: subject, Body: "Hello", CreatedAt: now}
+		if err := db.Create(&msg).Error; err != nil {
+			t.Fatalf("failed to store message: %v", err)
+		}
+		poller.drain(context.Background())
+	}
+
+	// The first message opens a digest and schedules its close, it isn't delivered on its own
+	receive("First")
+	if len(client.bodies) != 0 {
+		t.Fatalf("expected no delivery yet, got %v", client.bodies)
+	}
+	if at, ok := scheduler.scheduled[1]; !ok || !at.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected digest 1 to be scheduled at the end of its window, got %v", scheduler.scheduled)
+	}
+
+	// Reaching the size limit sends it straight away
+	receive("Second")
+	if len(client.bodies) != 1 {
+		t.Fatalf("expected the digest to be delivered, got %v", client.bodies)
+	}
+	var payload digestPayload
+	if err := json.Unmarshal([]byte(client.bodies[0]), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Count != 2 || len(payload.Messages) != 2 || payload.Messages[0].Subject != "First" || payload.Messages[1].Subject != "Second" {
+		t.Errorf("unexpected digest payload: %+v", payload)
+	}
+
+	// The next message opens a new digest, sent when the scheduled task closes it
+	receive("Third")
+	if _, ok := scheduler.scheduled[2]; !ok {
+		t.Fatalf("expected digest 2 to be scheduled, got %v", scheduler.scheduled)
+	}
+	poller.drain(context.Background())
+	if len(client.bodies) != 1 {
+		t.Fatalf("expected the open digest to wait, got %v", client.bodies)
+	}
+	if err := db.CloseDigest(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	poller.drain(context.Background())
+	if len(client.bodies) != 2 || !strings.Contains(client.bodies[1], `"Subject":"Third"`) {
+		t.Fatalf("expected the second digest to be delivered, got %v", client.bodies)
+	}
+
+	// Should the task be lost, the poller sends the digest once its window and the grace period are over
+	receive("Fourth")
+	now = now.Add(time.Minute)
+	poller.drain(context.Background())
+	if len(client.bodies) != 2 {
+		t.Fatalf("expected the open digest to wait for the grace period, got %v", client.bodies)
+	}
+	now = now.Add(digestCloseGrace)
+	poller.drain(context.Background())
+	if len(client.bodies) != 3 {
+		t.Fatalf("expected the third digest to be delivered, got %v", client.bodies)
+	}
+
+	var digests []models.Digest
+	if err := db.Order("id ASC").Find(&digests).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, digest := range digests {
+		if digest.Status != models.DigestStatusSent {
+			t.Errorf("expected digest %d to be sent, got %q", digest.ID, digest.Status)
+		}
+	}
+
+	// Each message is recorded as digested, and each digest as delivered
+	var digested, delivered int
+	for _, delivery := range deliveries(t, db) {
+		switch {
+		case delivery.Status == models.DeliveryStatusDigested && delivery.SMTPMessageID != 0:
+			digested++
+		case delivery.Status == models.DeliveryStatusDelivered && delivery.SMTPMessageID == 0 && delivery.DigestID != 0:
+			delivered++
+		default:
+			t.Errorf("unexpected delivery: %+v", delivery)
+		}
+	}
+	if digested != 4 || delivered != 3 {
+		t.Errorf("expected 4 digested messages and 3 digest deliveries, got %d and %d", digested, delivered)
+	}
+}
+
+func TestValidateDigest(t *testing.T) {
+	tests := []struct {
+		name   string
+		digest models.DigestOptions
+		field  string
+	}{
+		{"valid", models.DigestOptions{Window: 3600, MaxItems: 50}, ""},
+		{"no window", models.DigestOptions{MaxItems: 50}, "DigestWindow"},
+		{"too long", models.DigestOptions{Window: MaxDigestWindow + 1}, "DigestWindow"},
+		{"negative size", models.DigestOptions{Window: 60, MaxItems: -1}, "DigestMaxItems"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateJob(&models.Job{Digest: &tt.digest})
+			var jobErr *JobError
+			switch {
+			case tt.field == "" && err != nil:
+				t.Errorf("expected a valid job, got %v", err)
+			case tt.field != "" && (!errors.As(err, &jobErr) || jobErr.Field != tt.field):
+				t.Errorf("expected an error on %s, got %v", tt.field, err)
+			}
+		})
+	}
+}
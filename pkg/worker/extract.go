@@ -0,0 +1,121 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+// urlPattern matches http(s) links in plain text or HTML attributes
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"'()\[\]]+`)
+
+// extractor is a compiled models.ExtractRule
+type extractor struct {
+	rule   models.ExtractRule
+	re     *regexp.Regexp
+	filter *regexp.Regexp // optional link filter of "url" rules
+}
+
+func compileExtractors(rules []models.ExtractRule) ([]extractor, error) {
+	extractors := make([]extractor, 0, len(rules))
+	seen := make(map[string]bool, len(rules))
+
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return nil, errors.New("every rule needs a name")
+		}
+		if seen[rule.Name] {
+			return nil, fmt.Errorf("rule %q is defined twice", rule.Name)
+		}
+		seen[rule.Name] = true
+
+		switch rule.Source {
+		case "", "body", "subject", "html":
+		default:
+			return nil, fmt.Errorf("rule %q: unknown source %q", rule.Name, rule.Source)
+		}
+
+		e := extractor{rule: rule}
+		var err error
+
+		switch rule.Kind {
+		case "", "regex":
+			if rule.Pattern == "" {
+				return nil, fmt.Errorf("rule %q: a pattern is required", rule.Name)
+			}
+			e.re, err = regexp.Compile(rule.Pattern)
+		case "url":
+			e.re = urlPattern
+			if rule.Pattern != "" {
+				e.filter, err = regexp.Compile(rule.Pattern)
+			}
+		case "code":
+			length := rule.Length
+			if length <= 0 {
+				length = 6
+			}
+			e.re = regexp.MustCompile(fmt.Sprintf(`\b(\d{%d})\b`, length))
+		default:
+			return nil, fmt.Errorf("rule %q: unknown kind %q", rule.Name, rule.Kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+
+		extractors = append(extractors, e)
+	}
+
+	return extractors, nil
+}
+
+// extractVars runs the extractors against a message. It returns the extracted values and the
+// name of the first required rule that found nothing, if any.
+func extractVars(extractors []extractor, tc *TemplateContext) (map[string]string, string) {
+	vars := make(map[string]string, len(extractors))
+	missing := ""
+
+	for _, e := range extractors {
+		value := e.find(e.source(tc))
+		// Links are often only present in the HTML part
+		if value == "" && e.rule.Kind == "url" && (e.rule.Source == "" || e.rule.Source == "body") {
+			value = e.find(tc.HTML)
+		}
+
+		if value == "" {
+			if e.rule.Required && missing == "" {
+				missing = e.rule.Name
+			}
+			continue
+		}
+		vars[e.rule.Name] = value
+	}
+
+	return vars, missing
+}
+
+func (e extractor) source(tc *TemplateContext) string {
+	switch e.rule.Source {
+	case "subject":
+		return tc.Subject
+	case "html":
+		return tc.HTML
+	default:
+		return tc.Text
+	}
+}
+
+// find returns the first capture group of the first acceptable match, or the whole match
+func (e extractor) find(text string) string {
+	for _, match := range e.re.FindAllStringSubmatch(text, -1) {
+		if e.filter != nil && !e.filter.MatchString(match[0]) {
+			continue
+		}
+		if len(match) > 1 {
+			return match[1]
+		}
+		return match[0]
+	}
+	return ""
+}
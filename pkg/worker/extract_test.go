@@ -0,0 +1,119 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+func TestExtractVars(t *testing.T) {
+	tc := &TemplateContext{
+		Message: Message{Subject: "Order #A-1234 shipped"},
+		Text:    "Your code is 482913. Track it at https://track.example.com/p/1234 or https://example.com/help.",
+		HTML:    `<a href="https://example.com/confirm?t=abc">Confirm</a>`,
+	}
+
+	rules := []models.ExtractRule{
+		{Name: "order", Source: "subject", Pattern: `#([A-Z]-\d+)`},
+		{Name: "code", Kind: "code"},
+		{Name: "short", Kind: "code", Length: 4},
+		{Name: "tracking", Kind: "url", Pattern: `track\.`},
+		{Name: "link", Kind: "url"},
+		{Name: "confirm", Kind: "url", Pattern: `confirm`},
+		{Name: "missing", Pattern: `nothing here`},
+	}
+
+	extractors, err := compileExtractors(rules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	vars, missing := extractVars(extractors, tc)
+	if missing != "" {
+		t.Errorf("expected no missing required variable, got %q", missing)
+	}
+
+	expected := map[string]string{
+		"order":    "A-1234",
+		"code":     "482913",
+		"short":    "1234",
+		"tracking": "https://track.example.com/p/1234",
+		"link":     "https://track.example.com/p/1234",
+		"confirm":  "https://example.com/confirm?t=abc",
+	}
+	for name, value := range expected {
+		if vars[name] != value {
+			t.Errorf("%s: expected %q, got %q", name, value, vars[name])
+		}
+	}
+	if _, ok := vars["missing"]; ok {
+		t.Error("expected unmatched rules to be left out")
+	}
+}
+
+func TestExtractVars_RequiredMissing(t *testing.T) {
+	extractors, err := compileExtractors([]models.ExtractRule{
+		{Name: "code", Kind: "code", Required: true},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, missing := extractVars(extractors, &TemplateContext{Text: "no digits"})
+	if missing != "code" {
+		t.Errorf("expected the code rule to be reported missing, got %q", missing)
+	}
+}
+
+func TestCompileExtractors_Invalid(t *testing.T) {
+	tests := map[string][]models.ExtractRule{
+		"missing name":    {{Pattern: "a"}},
+		"duplicate name":  {{Name: "a", Pattern: "a"}, {Name: "a", Pattern: "b"}},
+		"missing pattern": {{Name: "a"}},
+		"bad pattern":     {{Name: "a", Pattern: "("}},
+		"unknown kind":    {{Name: "a", Kind: "magic"}},
+		"unknown source":  {{Name: "a", Source: "footer", Pattern: "a"}},
+	}
+
+	for name, rules := range tests {
+		t.Run(name, func(t *testing.T) {
+			var jobErr *JobError
+			err := ValidateJob(&models.Job{Extract: rules})
+			if !errors.As(err, &jobErr) || jobErr.Field != "Extract" {
+				t.Errorf("expected an Extract error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMessageProcessor_ProcessMessage_Vars(t *testing.T) {
+	job := &models.Job{
+		ID:              1,
+		Email:           "otp@example.com",
+		URL:             "http://example.com/webhook",
+		PayloadTemplate: `{"otp": {{json .Vars.code}}}`,
+		Extract:         []models.ExtractRule{{Name: "code", Kind: "code", Required: true}},
+	}
+	processor := &MessageProcessor{
+		jobRepo: &mockJobRepository{jobs: map[string][]*models.Job{job.Email: {job}}},
+		logger:  &mockLogger{},
+	}
+
+	results, err := processor.ProcessMessage(context.Background(), Message{To: job.Email, Body: "Use 123456 to sign in"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 1 || results[0].Payload != `{"otp": "123456"}` {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+
+	results, err = processor.ProcessMessage(context.Background(), Message{To: job.Email, Body: "No code today"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 1 || results[0].Rejected != `required variable "code" not found` {
+		t.Errorf("expected the delivery to be skipped, got %+v", results)
+	}
+}
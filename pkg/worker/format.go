@@ -0,0 +1,203 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+// cloudEventType is the type of the CloudEvents a received message is delivered as
+const cloudEventType = "net.v3m.gossiper.message.received"
+
+// validatePayloadFormat checks that a job's payload format is known, and doesn't come with a
+// payload template it would ignore. CloudEvents carry the template output as their data.
+func validatePayloadFormat(job *models.Job) error {
+	switch job.PayloadFormat {
+	case "", models.PayloadFormatJSON, models.PayloadFormatCloudEvents, models.PayloadFormatCloudEventsBinary:
+		return nil
+	case models.PayloadFormatForm, models.PayloadFormatMultipart, models.PayloadFormatRFC822:
+		if job.Digest != nil || (job.RateLimit != nil && job.RateLimit.Overflow == models.OverflowDigest) {
+			return fmt.Errorf("the %s format encodes a single message, digests are sent as JSON or CloudEvents", job.PayloadFormat)
+		}
+		if job.PayloadTemplate != "" {
+			return fmt.Errorf("the %s format builds the payload itself, it can't be used with a payload template", job.PayloadFormat)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown payload format %q, expected one of %s", job.PayloadFormat, strings.Join(models.PayloadFormats, ", "))
+	}
+}
+
+// encodePayload encodes the message in a payload format. payload is the rendered template or the
+// message JSON, and headers those of the destination. The returned headers are a copy carrying
+// the content type of the format, and the event attributes in the CloudEvents binary mode.
+func encodePayload(format string, tc *TemplateContext, payload string, headers map[string]string) (string, map[string]string, error) {
+	var body, contentType string
+	extra := map[string]string{}
+
+	switch format {
+	case "", models.PayloadFormatJSON:
+		return payload, headers, nil
+	case models.PayloadFormatForm:
+		body, contentType = formFields(tc).Encode(), "application/x-www-form-urlencoded"
+	case models.PayloadFormatMultipart:
+		var err error
+		body, contentType, err = encodeMultipart(tc)
+		if err != nil {
+			return "", nil, err
+		}
+	case models.PayloadFormatCloudEvents:
+		var err error
+		body, err = encodeCloudEvent(tc, payload, dataContentType(headers))
+		if err != nil {
+			return "", nil, err
+		}
+		contentType = "application/cloudevents+json"
+	case models.PayloadFormatCloudEventsBinary:
+		body, contentType = payload, dataContentType(headers)
+		for name, value := range cloudEventAttributes(tc) {
+			extra["ce-"+name] = percentEncode(value)
+		}
+	case models.PayloadFormatRFC822:
+		if tc.Raw == "" {
+			return "", nil, errors.New("the message has no raw source to deliver")
+		}
+		body, contentType = tc.Raw, "message/rfc822"
+	default:
+		return "", nil, fmt.Errorf("unknown payload format %q", format)
+	}
+
+	encoded := make(map[string]string, len(headers)+len(extra)+1)
+	for key, value := range headers {
+		if !strings.EqualFold(key, "Content-Type") {
+			encoded[key] = value
+		}
+	}
+	for key, value := range extra {
+		encoded[key] = value
+	}
+	encoded["Content-Type"] = contentType
+
+	return body, encoded, nil
+}
+
+// formFields holds the message fields under the names of its JSON payload
+func formFields(tc *TemplateContext) url.Values {
+	return url.Values{
+		"From":    {tc.From},
+		"To":      {tc.To},
+		"Subject": {tc.Subject},
+		"Body":    {tc.Body},
+	}
+}
+
+// encodeMultipart writes the message fields as form fields, and each attachment as a file part
+func encodeMultipart(tc *TemplateContext) (string, string, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	fields := formFields(tc)
+	for _, name := range []string{"From", "To", "Subject", "Body"} {
+		if err := writer.WriteField(name, fields.Get(name)); err != nil {
+			return "", "", err
+		}
+	}
+
+	for _, attachment := range tc.Attachments {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": "attachments", "filename": attachment.Filename}))
+		contentType := attachment.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		header.Set("Content-Type", contentType)
+
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return "", "", err
+		}
+		if _, err := part.Write(attachment.data); err != nil {
+			return "", "", err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", "", err
+	}
+	return buf.String(), writer.FormDataContentType(), nil
+}
+
+// cloudEventAttributes are the context attributes of the CloudEvents 1.0 event of a message
+func cloudEventAttributes(tc *TemplateContext) map[string]string {
+	id := strings.Trim(tc.MessageID, "<>")
+	if id == "" {
+		id = strconv.Itoa(tc.SMTPID)
+	}
+
+	attributes := map[string]string{
+		"specversion": "1.0",
+		"id":          id,
+		"source":      "mailto:" + tc.To,
+		"type":        cloudEventType,
+	}
+	if tc.Subject != "" {
+		attributes["subject"] = tc.Subject
+	}
+	if !tc.ReceivedAt.IsZero() {
+		attributes["time"] = tc.ReceivedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return attributes
+}
+
+// encodeCloudEvent writes the event of a message in the structured JSON mode.
+// JSON data is embedded as is, other data as a string.
+func encodeCloudEvent(tc *TemplateContext, data, contentType string) (string, error) {
+	event := map[string]any{}
+	for name, value := range cloudEventAttributes(tc) {
+		event[name] = value
+	}
+	event["datacontenttype"] = contentType
+	if isJSONContentType(contentType) && json.Valid([]byte(data)) {
+		event["data"] = json.RawMessage(data)
+	} else {
+		event["data"] = data
+	}
+
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode CloudEvent: %w", err)
+	}
+	return string(encoded), nil
+}
+
+// dataContentType is the content type of the rendered payload, JSON unless the headers say otherwise
+func dataContentType(headers map[string]string) string {
+	if contentType := headerValue(headers, "Content-Type"); contentType != "" {
+		return contentType
+	}
+	return "application/json"
+}
+
+// percentEncode escapes a CloudEvents attribute for an HTTP header, as the HTTP binding requires
+// for the space, double quote, percent sign and anything outside printable ASCII
+func percentEncode(value string) string {
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		if c <= ' ' || c >= 0x7f || c == '"' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,169 @@
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+func formatContext() *TemplateContext {
+	return newTemplateContext(Message{
+		From:       "bounce@example.org",
+		To:         "hook@example.com",
+		Subject:    "Invoice 42",
+		Body:       "Total: 10",
+		ID:         42,
+		ReceivedAt: time.Date(2026, 1, 6, 20, 0, 0, 0, time.UTC),
+		Raw:        multipartEmail,
+	}, &mockLogger{})
+}
+
+func TestEncodePayload_Form(t *testing.T) {
+	body, headers, err := encodePayload(models.PayloadFormatForm, formatContext(), "{}", map[string]string{"content-type": "application/json", "X-Job": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if headers["Content-Type"] != "application/x-www-form-urlencoded" || headers["content-type"] != "" || headers["X-Job"] != "1" {
+		t.Errorf("unexpected headers: %v", headers)
+	}
+	values, err := url.ParseQuery(body)
+	if err != nil || values.Get("Subject") != "Invoice 42" || values.Get("From") != "bounce@example.org" || values.Get("Body") != "Total: 10" {
+		t.Errorf("unexpected form body %q: %v", body, err)
+	}
+}
+
+func TestEncodePayload_Multipart(t *testing.T) {
+	body, headers, err := encodePayload(models.PayloadFormatMultipart, formatContext(), "{}", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(headers["Content-Type"])
+	if err != nil || mediaType != "multipart/form-data" {
+		t.Fatalf("unexpected content type %q: %v", headers["Content-Type"], err)
+	}
+
+	fields := map[string]string{}
+	reader := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(part)
+		if part.FileName() != "" {
+			fields[part.FormName()+"/"+part.FileName()+"/"+part.Header.Get("Content-Type")] = string(data)
+			continue
+		}
+		fields[part.FormName()] = string(data)
+	}
+
+	if fields["Subject"] != "Invoice 42" || fields["To"] != "hook@example.com" {
+		t.Errorf("expected the message fields, got %v", fields)
+	}
+	if fields["attachments/invoice.pdf/application/pdf"] != "%PDF-1.4\n" {
+		t.Errorf("expected the attachment as a file part, got %v", fields)
+	}
+}
+
+func TestEncodePayload_CloudEvents(t *testing.T) {
+	tc := formatContext()
+
+	body, headers, err := encodePayload(models.PayloadFormatCloudEvents, tc, `{"subject": "Invoice 42"}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers["Content-Type"] != "application/cloudevents+json" {
+		t.Errorf("unexpected content type %q", headers["Content-Type"])
+	}
+
+	var event map[string]any
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"specversion":     "1.0",
+		"id":              "abc123@example.org",
+		"source":          "mailto:hook@example.com",
+		"type":            cloudEventType,
+		"subject":         "Invoice 42",
+		"time":            "2026-01-06T20:00:00Z",
+		"datacontenttype": "application/json",
+	}
+	for name, value := range want {
+		if event[name] != value {
+			t.Errorf("expected %s to be %v, got %v", name, value, event[name])
+		}
+	}
+	if data, ok := event["data"].(map[string]any); !ok || data["subject"] != "Invoice 42" {
+		t.Errorf("expected the JSON data to be embedded, got %v", event["data"])
+	}
+
+	// The binary mode sends the data as the body and the attributes as headers
+	body, headers, err = encodePayload(models.PayloadFormatCloudEventsBinary, tc, "Total: 10", map[string]string{"Content-Type": "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "Total: 10" || headers["Content-Type"] != "text/plain" {
+		t.Errorf("unexpected binary event: %q %v", body, headers)
+	}
+	if headers["ce-specversion"] != "1.0" || headers["ce-id"] != "abc123@example.org" || headers["ce-subject"] != "Invoice%2042" {
+		t.Errorf("unexpected attribute headers: %v", headers)
+	}
+}
+
+func TestEncodePayload_RFC822(t *testing.T) {
+	tc := formatContext()
+
+	body, headers, err := encodePayload(models.PayloadFormatRFC822, tc, "{}", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != multipartEmail || headers["Content-Type"] != "message/rfc822" {
+		t.Errorf("expected the raw message, got %q %v", body, headers)
+	}
+
+	tc.Raw = ""
+	if _, _, err := encodePayload(models.PayloadFormatRFC822, tc, "{}", nil); err == nil {
+		t.Error("expected an error for a message without its source")
+	}
+}
+
+func TestValidatePayloadFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		job     models.Job
+		invalid bool
+	}{
+		{"default", models.Job{}, false},
+		{"cloudevents with a template", models.Job{PayloadFormat: models.PayloadFormatCloudEvents, PayloadTemplate: `{"s": {{json .Subject}}}`}, false},
+		{"form", models.Job{PayloadFormat: models.PayloadFormatForm}, false},
+		{"form with a template", models.Job{PayloadFormat: models.PayloadFormatForm, PayloadTemplate: "{{.Subject}}"}, true},
+		{"unknown", models.Job{PayloadFormat: "xml"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateJob(&tt.job)
+			var jobErr *JobError
+			switch {
+			case !tt.invalid && err != nil:
+				t.Errorf("expected a valid job, got %v", err)
+			case tt.invalid && (!errors.As(err, &jobErr) || jobErr.Field != "PayloadFormat"):
+				t.Errorf("expected an error on PayloadFormat, got %v", err)
+			}
+		})
+	}
+}
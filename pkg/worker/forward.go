@@ -0,0 +1,237 @@
+package worker
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// EmailForwarder relays the original message to mailboxes through the outbound mail server.
+// The envelope sender is rewritten with SRS so the relayed mail passes SPF at the recipient,
+// and the bounces sent back to the rewritten address are relayed to the original sender.
+type EmailForwarder struct {
+	smtpHost     string
+	smtpPort     int
+	smtpUser     string
+	smtpPassword string
+	srsDomain    string
+	srsKey       []byte
+	logger       Logger
+	sendMail     func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+	now          func() time.Time
+}
+
+// NewEmailForwarder creates a forwarder rewriting envelope senders to srsDomain, signed with srsKey
+func NewEmailForwarder(host string, port int, user, password, srsDomain string, srsKey []byte, logger Logger) *EmailForwarder {
+	return &EmailForwarder{
+		smtpHost:     host,
+		smtpPort:     port,
+		smtpUser:     user,
+		smtpPassword: password,
+		srsDomain:    srsDomain,
+		srsKey:       srsKey,
+		logger:       logger,
+		sendMail:     smtp.SendMail,
+		now:          time.Now,
+	}
+}
+
+// parseRecipients reads the comma separated "to" option of email destinations
+func parseRecipients(to string) ([]string, error) {
+	list, err := mail.ParseAddressList(to)
+	if err != nil {
+		return nil, err
+	}
+
+	recipients := make([]string, 0, len(list))
+	for _, addr := range list {
+		recipients = append(recipients, addr.Address)
+	}
+	return recipients, nil
+}
+
+func (f *EmailForwarder) Deliver(ctx context.Context, result ProcessResult) WebhookResult {
+	webhookResult := WebhookResult{
+		JobID:         result.JobID,
+		DestinationID: result.DestinationID,
+	}
+
+	if result.Error != nil {
+		webhookResult.Error = result.Error
+		f.logger.Printf("skipping forward for job %d due to processing error: %v", result.JobID, result.Error)
+		return webhookResult
+	}
+
+	recipients, err := parseRecipients(result.Options["to"])
+	if err != nil {
+		webhookResult.Error = fmt.Errorf("invalid recipients: %w", err)
+		return webhookResult
+	}
+
+	sender := ""
+	if result.Message != nil {
+		sender = f.srsForward(result.Message.From)
+	}
+
+	var auth smtp.Auth
+	if f.smtpUser != "" {
+		auth = smtp.PlainAuth("", f.smtpUser, f.smtpPassword, f.smtpHost)
+	}
+
+	addr := fmt.Sprintf("%s:%d", f.smtpHost, f.smtpPort)
+	if err := f.sendMail(addr, auth, sender, recipients, forwardedMessage(result)); err != nil {
+		webhookResult.Error = fmt.Errorf("failed to forward email: %w", err)
+		f.logger.Printf("failed to forward message for job %d: %v", result.JobID, err)
+		return webhookResult
+	}
+
+	f.logger.Printf("forwarded message for job %d to %s", result.JobID, strings.Join(recipients, ", "))
+	return webhookResult
+}
+
+// forwardedMessage prepends the Gossiper headers to the original message, attachments and signatures untouched.
+// Messages received without their source are rebuilt from the parsed fields.
+func forwardedMessage(result ProcessResult) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "X-Gossiper-Job: %d\r\n", result.JobID)
+	if result.Destination != "" {
+		fmt.Fprintf(&b, "X-Gossiper-Destination: %s\r\n", mime.QEncoding.Encode("utf-8", result.Destination))
+	}
+
+	tc := result.Message
+	if tc == nil {
+		b.WriteString("\r\n")
+		return []byte(b.String())
+	}
+
+	if tc.Job.Email != "" {
+		fmt.Fprintf(&b, "X-Gossiper-Job-Address: %s\r\n", tc.Job.Email)
+	}
+
+	if tc.Raw != "" {
+		b.WriteString(tc.Raw)
+		return []byte(b.String())
+	}
+
+	fmt.Fprintf(&b, "From: %s\r\n", tc.From)
+	fmt.Fprintf(&b, "To: %s\r\n", tc.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", tc.Subject))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(tc.Body, "\n", "\r\n"))
+
+	return []byte(b.String())
+}
+
+// srsForward rewrites an envelope sender to an SRS0 address of our domain:
+//
+//	SRS0=HHHH=TT=example.org=alice@srs.domain
+//
+// where TT is the day the address was issued and HHHH a truncated HMAC of it, so only we can
+// have issued it. Bounces (empty senders) and addresses already on our domain are kept as is.
+func (f *EmailForwarder) srsForward(sender string) string {
+	at := strings.LastIndex(sender, "@")
+	if sender == "" || at < 0 || strings.EqualFold(sender[at+1:], f.srsDomain) {
+		return sender
+	}
+	local, domain := sender[:at], sender[at+1:]
+
+	day := f.today()
+	timestamp := string([]byte{srsAlphabet[day>>5], srsAlphabet[day&31]})
+
+	return "SRS0=" + f.srsHash(timestamp, domain, local) + "=" + timestamp + "=" + domain + "=" + local + "@" + f.srsDomain
+}
+
+// srsReverse returns the original sender of an SRS0 address issued by srsForward. It fails for addresses
+// we didn't issue, or issued more than srsMaxAge days ago, so the relay can't be used to send mail anywhere.
+func (f *EmailForwarder) srsReverse(address string) (string, error) {
+	at := strings.LastIndex(address, "@")
+	if at < 0 || !strings.EqualFold(address[at+1:], f.srsDomain) {
+		return "", errNotSRS
+	}
+	parts := strings.SplitN(address[:at], "=", 5)
+	if len(parts) != 5 || !strings.EqualFold(parts[0], "SRS0") {
+		return "", errNotSRS
+	}
+	hash, timestamp, domain, local := parts[1], strings.ToUpper(parts[2]), parts[3], parts[4]
+
+	if len(timestamp) != 2 || domain == "" || local == "" {
+		return "", errors.New("malformed SRS address")
+	}
+	high, low := strings.IndexByte(srsAlphabet, timestamp[0]), strings.IndexByte(srsAlphabet, timestamp[1])
+	if high < 0 || low < 0 {
+		return "", errors.New("malformed SRS address")
+	}
+	if (f.today()-int64(high<<5|low)+1024)%1024 > srsMaxAge {
+		return "", errors.New("expired SRS address")
+	}
+
+	// Hashes are compared regardless of case, mail servers on the way may have changed it
+	expected := f.srsHash(timestamp, domain, local)
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(hash)), []byte(strings.ToLower(expected))) != 1 {
+		return "", errors.New("invalid SRS hash")
+	}
+
+	return local + "@" + domain, nil
+}
+
+// RelayBounce relays a message sent to an address rewritten by srsForward to the original sender, with an empty
+// envelope sender as bounces have. Messages to other addresses aren't handled, bounces to forged or expired
+// SRS addresses are dropped with an ErrBounceDropped error.
+func (f *EmailForwarder) RelayBounce(ctx context.Context, to string, raw []byte) (bool, error) {
+	sender, err := f.srsReverse(to)
+	if errors.Is(err, errNotSRS) {
+		return false, nil
+	}
+	if err != nil {
+		f.logger.Printf("dropping bounce to %s: %v", to, err)
+		return true, fmt.Errorf("%w: %v", ErrBounceDropped, err)
+	}
+
+	var auth smtp.Auth
+	if f.smtpUser != "" {
+		auth = smtp.PlainAuth("", f.smtpUser, f.smtpPassword, f.smtpHost)
+	}
+
+	addr := fmt.Sprintf("%s:%d", f.smtpHost, f.smtpPort)
+	if err := f.sendMail(addr, auth, "", []string{sender}, raw); err != nil {
+		return true, fmt.Errorf("failed to relay bounce: %w", err)
+	}
+
+	f.logger.Printf("relayed bounce for %s to %s", to, sender)
+	return true, nil
+}
+
+// srsHash is the truncated HMAC of an SRS address, computed regardless of case
+func (f *EmailForwarder) srsHash(timestamp, domain, local string) string {
+	mac := hmac.New(sha1.New, f.srsKey)
+	mac.Write([]byte(strings.ToLower(timestamp + domain + local)))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:4]
+}
+
+// today is the day number SRS timestamps are written with, it wraps every 1024 days
+func (f *EmailForwarder) today() int64 {
+	return f.now().Unix() / 86400 % 1024
+}
+
+// ErrBounceDropped is returned for bounces that aren't relayed, they are never retried
+var ErrBounceDropped = errors.New("bounce dropped")
+
+// errNotSRS is returned when reversing an address that isn't an SRS0 address of our domain
+var errNotSRS = errors.New("not an SRS address")
+
+// srsMaxAge is how many days bounces to an SRS address are relayed for
+const srsMaxAge = 21
+
+// srsAlphabet is the base32 alphabet SRS timestamps are written in
+const srsAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
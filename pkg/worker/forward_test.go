@@ -0,0 +1,161 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"net/smtp"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+type sentMail struct {
+	addr string
+	from string
+	to   []string
+	msg  string
+}
+
+func newTestForwarder(sent *[]sentMail, err error) *EmailForwarder {
+	f := NewEmailForwarder("mail.example.com", 587, "", "", "gossip.example.com", []byte("secret"), &mockLogger{})
+	f.now = func() time.Time { return time.Date(2026, 1, 6, 20, 0, 0, 0, time.UTC) }
+	f.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		*sent = append(*sent, sentMail{addr: addr, from: from, to: to, msg: string(msg)})
+		return err
+	}
+	return f
+}
+
+func TestEmailForwarder_srsForward(t *testing.T) {
+	f := newTestForwarder(&[]sentMail{}, nil)
+
+	rewritten := f.srsForward("Alice@example.org")
+	if !regexp.MustCompile(`^SRS0=[A-Za-z0-9+/]{4}=[A-Z2-7]{2}=example\.org=Alice@gossip\.example\.com$`).MatchString(rewritten) {
+		t.Errorf("unexpected SRS address: %s", rewritten)
+	}
+	if f.srsForward("alice@example.org")[5:9] != rewritten[5:9] {
+		t.Errorf("expected the hash to ignore case")
+	}
+	if f.srsForward("bob@example.org")[5:9] == rewritten[5:9] {
+		t.Errorf("expected the hash to depend on the address")
+	}
+
+	for _, sender := range []string{"", "bounce@gossip.example.com"} {
+		if got := f.srsForward(sender); got != sender {
+			t.Errorf("expected %q to be kept, got %q", sender, got)
+		}
+	}
+}
+
+func TestEmailForwarder_srsReverse(t *testing.T) {
+	f := newTestForwarder(&[]sentMail{}, nil)
+	rewritten := f.srsForward("Alice@example.org")
+
+	// Mail servers on the way may change the case of the address
+	for _, address := range []string{rewritten, strings.ToLower(rewritten)} {
+		if sender, err := f.srsReverse(address); err != nil || !strings.EqualFold(sender, "alice@example.org") {
+			t.Errorf("expected %s to reverse to the original sender, got %q, %v", address, sender, err)
+		}
+	}
+
+	forged := "SRS0=AAAA" + rewritten[9:]
+	if _, err := f.srsReverse(forged); err == nil {
+		t.Error("expected a forged hash to be refused")
+	}
+	for _, address := range []string{"hook@gossip.example.com", "SRS0=abcd=AA=example.org=alice@other.example.com"} {
+		if _, err := f.srsReverse(address); !errors.Is(err, errNotSRS) {
+			t.Errorf("expected %s not to be an SRS address, got %v", address, err)
+		}
+	}
+
+	now := f.now()
+	f.now = func() time.Time { return now.AddDate(0, 0, srsMaxAge+1) }
+	if _, err := f.srsReverse(rewritten); err == nil {
+		t.Error("expected an expired address to be refused")
+	}
+}
+
+func TestEmailForwarder_RelayBounce(t *testing.T) {
+	var sent []sentMail
+	f := newTestForwarder(&sent, nil)
+	bounce := []byte("From: MAILER-DAEMON@example.com\r\nSubject: Undelivered Mail\r\n\r\nUser unknown\r\n")
+
+	handled, err := f.RelayBounce(context.Background(), f.srsForward("alice@example.org"), bounce)
+	if !handled || err != nil {
+		t.Fatalf("expected the bounce to be relayed, got %v, %v", handled, err)
+	}
+	if len(sent) != 1 || sent[0].from != "" || strings.Join(sent[0].to, ",") != "alice@example.org" || sent[0].msg != string(bounce) {
+		t.Errorf("expected the bounce to go back to the original sender with an empty sender, got %+v", sent)
+	}
+
+	if handled, _ := f.RelayBounce(context.Background(), "hook@gossip.example.com", bounce); handled {
+		t.Error("expected messages to job addresses to be left to the jobs")
+	}
+	handled, err = f.RelayBounce(context.Background(), "SRS0=AAAA=AA=example.org=alice@gossip.example.com", bounce)
+	if !handled || !errors.Is(err, ErrBounceDropped) || len(sent) != 1 {
+		t.Errorf("expected a forged bounce to be dropped, got %v, %v", handled, err)
+	}
+}
+
+func TestEmailForwarder_Deliver(t *testing.T) {
+	var sent []sentMail
+	f := newTestForwarder(&sent, nil)
+
+	result := ProcessResult{
+		JobID:       4,
+		Destination: "archive",
+		Type:        models.DestinationTypeEmail,
+		Options:     map[string]string{"to": "Team <team@example.com>, ops@example.com"},
+		Message: &TemplateContext{
+			Message: Message{From: "alice@example.org", Raw: multipartEmail},
+			Job:     JobContext{ID: 4, Email: "hook@gossip.example.com"},
+		},
+	}
+
+	webhookResult := f.Deliver(context.Background(), result)
+	if webhookResult.Error != nil {
+		t.Fatalf("unexpected error: %v", webhookResult.Error)
+	}
+
+	if len(sent) != 1 {
+		t.Fatalf("expected 1 email, got %d", len(sent))
+	}
+	mail := sent[0]
+	if mail.addr != "mail.example.com:587" {
+		t.Errorf("unexpected server: %s", mail.addr)
+	}
+	if !strings.HasPrefix(mail.from, "SRS0=") {
+		t.Errorf("expected the envelope sender to be rewritten, got %s", mail.from)
+	}
+	if strings.Join(mail.to, ",") != "team@example.com,ops@example.com" {
+		t.Errorf("unexpected recipients: %v", mail.to)
+	}
+	expectedHeaders := "X-Gossiper-Job: 4\r\nX-Gossiper-Destination: archive\r\nX-Gossiper-Job-Address: hook@gossip.example.com\r\n"
+	if !strings.HasPrefix(mail.msg, expectedHeaders) {
+		t.Errorf("expected the Gossiper headers first, got %q", mail.msg[:100])
+	}
+	if !strings.HasSuffix(mail.msg, multipartEmail) {
+		t.Errorf("expected the original message, attachments included, to be relayed")
+	}
+}
+
+func TestEmailForwarder_Deliver_Error(t *testing.T) {
+	var sent []sentMail
+	f := newTestForwarder(&sent, errors.New("relay denied"))
+
+	result := f.Deliver(context.Background(), ProcessResult{
+		JobID:   1,
+		Options: map[string]string{"to": "team@example.com"},
+		Message: &TemplateContext{Message: Message{From: "a@example.org", Subject: "Hi", Body: "Hello"}},
+	})
+
+	if result.Error == nil || !strings.Contains(result.Error.Error(), "relay denied") {
+		t.Errorf("expected the SMTP error to be reported, got %v", result.Error)
+	}
+	if !strings.Contains(sent[0].msg, "Subject: Hi\r\n") {
+		t.Errorf("expected a message to be rebuilt without the source, got %q", sent[0].msg)
+	}
+}
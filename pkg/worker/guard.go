@@ -0,0 +1,107 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrBlockedAddress is returned when a delivery would connect to an internal address
+var ErrBlockedAddress = errors.New("destination address is not allowed")
+
+// blockedPrefixes are the loopback, private, link-local, metadata and other non-public ranges
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // Carrier-grade NAT
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"), // Link-local, cloud metadata services included
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("64:ff9b::/96"), // NAT64, embeds IPv4 addresses
+	netip.MustParsePrefix("fc00::/7"),     // Unique local, the AWS metadata service included
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// NetworkGuard keeps deliveries from reaching the network the worker runs in. It checks the address each
+// connection is actually made to, after DNS resolution and for every redirect.
+type NetworkGuard struct {
+	allowed []netip.Prefix
+}
+
+// NewNetworkGuard creates a guard letting through the internal addresses or CIDR ranges in allowed
+func NewNetworkGuard(allowed []string) (*NetworkGuard, error) {
+	g := &NetworkGuard{}
+	for _, entry := range allowed {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid allowed network %q: expected an address or CIDR range", entry)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		g.allowed = append(g.allowed, prefix.Masked())
+	}
+	return g, nil
+}
+
+// Check returns ErrBlockedAddress unless addr is public or allowed
+func (g *NetworkGuard) Check(addr netip.Addr) error {
+	addr = addr.Unmap()
+	for _, prefix := range g.allowed {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return fmt.Errorf("%w: %s is internal", ErrBlockedAddress, addr)
+		}
+	}
+	return nil
+}
+
+// Control is a net.Dialer Control function checking the resolved address before connecting
+func (g *NetworkGuard) Control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: unexpected address %q", ErrBlockedAddress, address)
+	}
+	return g.Check(addrPort.Addr())
+}
+
+// Transport returns an HTTP transport dialing through the guard, with the defaults of http.DefaultTransport.
+// Proxies from the environment are ignored, the guard would only see the address of the proxy.
+func (g *NetworkGuard) Transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = g.Dialer(30 * time.Second).DialContext
+	return transport
+}
+
+// Dialer returns a dialer connecting through the guard, for the deliveries made over plain connections
+func (g *NetworkGuard) Dialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control:   g.Control,
+	}
+}
@@ -0,0 +1,114 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+func TestNetworkGuard_Check(t *testing.T) {
+	guard, err := NewNetworkGuard([]string{"10.1.2.0/24", "192.168.1.7"})
+	if err != nil {
+		t.Fatalf("failed to create guard: %v", err)
+	}
+
+	tests := []struct {
+		addr    string
+		blocked bool
+	}{
+		{"93.184.216.34", false},
+		{"2606:2800:220:1:248:1893:25c8:1946", false},
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"169.254.169.254", true},
+		{"fd00:ec2::254", true},
+		{"10.0.0.1", true},
+		{"172.16.5.4", true},
+		{"192.168.1.1", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"fe80::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"10.1.2.3", false},
+		{"192.168.1.7", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			err := guard.Check(netip.MustParseAddr(tt.addr))
+			if blocked := errors.Is(err, ErrBlockedAddress); blocked != tt.blocked {
+				t.Errorf("expected blocked=%v, got %v", tt.blocked, err)
+			}
+		})
+	}
+}
+
+func TestNewNetworkGuard_InvalidEntry(t *testing.T) {
+	if _, err := NewNetworkGuard([]string{"internal.example.com"}); err == nil {
+		t.Error("expected host names to be rejected")
+	}
+}
+
+func TestNetworkGuard_Transport(t *testing.T) {
+	var calls int
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path == "/redirect" {
+			// Loopback over IPv6 isn't allowed, whatever listens there
+			http.Redirect(w, r, "http://[::1]:1/", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer target.Close()
+
+	send := func(guard *NetworkGuard, url string) WebhookResult {
+		sender := NewWebhookSender(&http.Client{Transport: guard.Transport()}, &mockLogger{}, Config{})
+		return sender.SendWebhook(context.Background(), ProcessResult{JobID: 1, URL: url, Method: "POST"})
+	}
+
+	blocking, _ := NewNetworkGuard(nil)
+	for _, url := range []string{target.URL, strings.Replace(target.URL, "127.0.0.1", "localhost", 1)} {
+		if result := send(blocking, url); !errors.Is(result.Error, ErrBlockedAddress) {
+			t.Errorf("expected %s to be blocked, got %+v", url, result)
+		}
+	}
+	if calls != 0 {
+		t.Fatalf("expected the server not to be called, got %d calls", calls)
+	}
+
+	allowing, _ := NewNetworkGuard([]string{"127.0.0.1"})
+	if result := send(allowing, target.URL); result.Error != nil || result.StatusCode != http.StatusNoContent {
+		t.Errorf("expected the allowed address to be called, got %+v", result)
+	}
+	if result := send(allowing, target.URL+"/redirect"); !errors.Is(result.Error, ErrBlockedAddress) {
+		t.Errorf("expected the redirect to be blocked, got %+v", result)
+	}
+}
+
+func TestSMTPMessagePoller_BlockedAddressesAreNotRetried(t *testing.T) {
+	db := newTestDB(t)
+	guard, _ := NewNetworkGuard(nil)
+	poller := newTestPoller(t, db, &http.Client{Transport: guard.Transport()})
+	repo := poller.processor.jobRepo.(*mockJobRepository)
+	repo.jobs["hook@example.com"][0].URL = "http://169.254.169.254/latest/meta-data/"
+
+	if err := db.Create(&models.SMTPMessage{To: "hook@example.com", From: "a@example.org", Subject: "Hi", Body: "Hello"}).Error; err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+
+	poller.drain(context.Background())
+
+	got := deliveries(t, db)
+	if len(got) != 1 || got[0].Status != models.DeliveryStatusDead || !strings.Contains(got[0].Detail, "169.254.169.254 is internal") {
+		t.Errorf("expected a dead delivery, got %+v", got)
+	}
+}
@@ -0,0 +1,179 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+// matchNode is a compiled models.MatchRule
+type matchNode struct {
+	rule     models.MatchRule
+	children []*matchNode // operands of And and Or
+	not      *matchNode
+	re       *regexp.Regexp
+	size     int
+}
+
+func compileMatchRule(rule models.MatchRule) (*matchNode, error) {
+	node := &matchNode{rule: rule}
+
+	kinds := 0
+	for _, set := range []bool{len(rule.And) > 0, len(rule.Or) > 0, rule.Not != nil, rule.Type != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return nil, errors.New("a rule must have exactly one of and, or, not or type")
+	}
+
+	var err error
+	switch {
+	case len(rule.And) > 0 || len(rule.Or) > 0:
+		for _, child := range append(rule.And, rule.Or...) {
+			compiled, err := compileMatchRule(child)
+			if err != nil {
+				return nil, err
+			}
+			node.children = append(node.children, compiled)
+		}
+		return node, nil
+	case rule.Not != nil:
+		node.not, err = compileMatchRule(*rule.Not)
+		return node, err
+	}
+
+	switch rule.Type {
+	case models.MatchRuleSubjectRegex, models.MatchRuleBodyRegex:
+		node.re, err = regexp.Compile(rule.Value)
+	case models.MatchRuleHeaderRegex:
+		if rule.Header == "" {
+			return nil, fmt.Errorf("%s needs a header", rule.Type)
+		}
+		node.re, err = regexp.Compile(rule.Value)
+	case models.MatchRuleHeaderEquals:
+		if rule.Header == "" {
+			return nil, fmt.Errorf("%s needs a header", rule.Type)
+		}
+	case models.MatchRuleBodyContains:
+		if rule.Value == "" {
+			return nil, fmt.Errorf("%s needs a value", rule.Type)
+		}
+	case models.MatchRuleSizeAbove, models.MatchRuleSizeBelow:
+		node.size, err = strconv.Atoi(rule.Value)
+	case models.MatchRuleAuth:
+		switch strings.ToLower(rule.Header) {
+		case "spf", "dkim", "dmarc":
+		default:
+			return nil, fmt.Errorf("%s needs spf, dkim or dmarc as header", rule.Type)
+		}
+	case models.MatchRuleHasAttachment:
+	default:
+		return nil, fmt.Errorf("unknown rule type %q", rule.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", rule.Type, err)
+	}
+
+	return node, nil
+}
+
+// eval reports whether the message satisfies the rule, and otherwise describes the rule that rejected it
+func (n *matchNode) eval(tc *TemplateContext) (bool, string) {
+	switch {
+	case len(n.rule.And) > 0:
+		for _, child := range n.children {
+			if ok, reason := child.eval(tc); !ok {
+				return false, reason
+			}
+		}
+		return true, ""
+
+	case len(n.rule.Or) > 0:
+		reasons := make([]string, 0, len(n.children))
+		for _, child := range n.children {
+			ok, reason := child.eval(tc)
+			if ok {
+				return true, ""
+			}
+			reasons = append(reasons, reason)
+		}
+		return false, "none of [" + strings.Join(reasons, "; ") + "]"
+
+	case n.not != nil:
+		if ok, _ := n.not.eval(tc); ok {
+			return false, "not " + n.not.describe()
+		}
+		return true, ""
+	}
+
+	if n.matches(tc) {
+		return true, ""
+	}
+	return false, n.describe()
+}
+
+// matches evaluates a single condition
+func (n *matchNode) matches(tc *TemplateContext) bool {
+	switch n.rule.Type {
+	case models.MatchRuleSubjectRegex:
+		return n.re.MatchString(tc.Subject)
+	case models.MatchRuleBodyContains:
+		return strings.Contains(tc.Text, n.rule.Value) || strings.Contains(tc.HTML, n.rule.Value)
+	case models.MatchRuleBodyRegex:
+		return n.re.MatchString(tc.Text) || n.re.MatchString(tc.HTML)
+	case models.MatchRuleHeaderEquals:
+		return tc.Headers[textproto.CanonicalMIMEHeaderKey(n.rule.Header)] == n.rule.Value
+	case models.MatchRuleHeaderRegex:
+		value, ok := tc.Headers[textproto.CanonicalMIMEHeaderKey(n.rule.Header)]
+		return ok && n.re.MatchString(value)
+	case models.MatchRuleHasAttachment:
+		return len(tc.Attachments) > 0
+	case models.MatchRuleSizeAbove:
+		return tc.Size > n.size
+	case models.MatchRuleSizeBelow:
+		return tc.Size < n.size
+	case models.MatchRuleAuth:
+		var result string
+		switch strings.ToLower(n.rule.Header) {
+		case "spf":
+			result = tc.Auth.SPF
+		case "dkim":
+			result = tc.Auth.DKIM
+		case "dmarc":
+			result = tc.Auth.DMARC
+		}
+		return strings.EqualFold(result, n.rule.Value)
+	}
+	return false
+}
+
+// describe renders the rule in a short human readable form for the delivery log
+func (n *matchNode) describe() string {
+	switch {
+	case len(n.rule.And) > 0 || len(n.rule.Or) > 0:
+		op := "and"
+		if len(n.rule.Or) > 0 {
+			op = "or"
+		}
+		parts := make([]string, 0, len(n.children))
+		for _, child := range n.children {
+			parts = append(parts, child.describe())
+		}
+		return op + " [" + strings.Join(parts, "; ") + "]"
+	case n.not != nil:
+		return "not " + n.not.describe()
+	case n.rule.Type == models.MatchRuleHasAttachment:
+		return n.rule.Type
+	case n.rule.Header != "":
+		return fmt.Sprintf("%s %s=%q", n.rule.Type, n.rule.Header, n.rule.Value)
+	default:
+		return fmt.Sprintf("%s %q", n.rule.Type, n.rule.Value)
+	}
+}
@@ -0,0 +1,198 @@
+package worker
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+func TestMatchRule_Eval(t *testing.T) {
+	auth := models.AuthResults{SPF: "pass", DKIM: "fail", DMARC: "none"}
+	tc := newTemplateContext(Message{From: "bounce@example.org", Subject: "Invoice", Raw: multipartEmail, Auth: auth}, &mockLogger{})
+
+	tests := []struct {
+		name   string
+		rule   models.MatchRule
+		match  bool
+		reason string
+	}{
+		{
+			name:  "subject regex",
+			rule:  models.MatchRule{Type: models.MatchRuleSubjectRegex, Value: "(?i)^invoice$"},
+			match: true,
+		},
+		{
+			name:  "body contains searches the text part",
+			rule:  models.MatchRule{Type: models.MatchRuleBodyContains, Value: "Total: 10€"},
+			match: true,
+		},
+		{
+			name:  "header equals is case insensitive on the name",
+			rule:  models.MatchRule{Type: models.MatchRuleHeaderEquals, Header: "reply-to", Value: "support@example.org"},
+			match: true,
+		},
+		{
+			name:   "missing header",
+			rule:   models.MatchRule{Type: models.MatchRuleHeaderRegex, Header: "X-Spam", Value: ".*"},
+			reason: `header_regex X-Spam=".*"`,
+		},
+		{
+			name: "and with not",
+			rule: models.MatchRule{And: []models.MatchRule{
+				{Type: models.MatchRuleHasAttachment},
+				{Not: &models.MatchRule{Type: models.MatchRuleAuth, Header: "dkim", Value: "fail"}},
+			}},
+			reason: `not auth dkim="fail"`,
+		},
+		{
+			name: "or",
+			rule: models.MatchRule{Or: []models.MatchRule{
+				{Type: models.MatchRuleSizeBelow, Value: "10"},
+				{Type: models.MatchRuleAuth, Header: "spf", Value: "PASS"},
+			}},
+			match: true,
+		},
+		{
+			name: "or without any match lists every reason",
+			rule: models.MatchRule{Or: []models.MatchRule{
+				{Type: models.MatchRuleSizeBelow, Value: "10"},
+				{Type: models.MatchRuleSizeAbove, Value: "100000"},
+			}},
+			reason: `none of [size_below "10"; size_above "100000"]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := compileMatchRule(tt.rule)
+			if err != nil {
+				t.Fatalf("unexpected compile error: %v", err)
+			}
+
+			ok, reason := node.eval(tc)
+			if ok != tt.match {
+				t.Errorf("expected match %v, got %v (%s)", tt.match, ok, reason)
+			}
+			if reason != tt.reason {
+				t.Errorf("expected reason %q, got %q", tt.reason, reason)
+			}
+		})
+	}
+}
+
+func TestMatchRule_Eval_Auth(t *testing.T) {
+	node, err := compileMatchRule(models.MatchRule{Type: models.MatchRuleAuth, Header: "spf", Value: "pass"})
+	if err != nil {
+		t.Fatalf("unexpected compile error: %v", err)
+	}
+
+	// multipartEmail claims spf=pass in an Authentication-Results header the sender wrote itself
+	forged := newTemplateContext(Message{Raw: multipartEmail, Auth: models.AuthResults{SPF: "fail"}}, &mockLogger{})
+	if ok, _ := node.eval(forged); ok {
+		t.Error("expected a forged Authentication-Results header not to satisfy the rule")
+	}
+	unchecked := newTemplateContext(Message{Raw: multipartEmail}, &mockLogger{})
+	if ok, _ := node.eval(unchecked); ok {
+		t.Error("expected a message the SMTP server didn't check not to satisfy the rule")
+	}
+	checked := newTemplateContext(Message{Raw: multipartEmail, Auth: models.AuthResults{SPF: "pass"}}, &mockLogger{})
+	if ok, reason := node.eval(checked); !ok {
+		t.Errorf("expected the verdict of the SMTP server to satisfy the rule, got %s", reason)
+	}
+}
+
+func TestCompileMatchRule_Invalid(t *testing.T) {
+	rules := []models.MatchRule{
+		{},
+		{Type: "nope"},
+		{Type: models.MatchRuleSubjectRegex, Value: "("},
+		{Type: models.MatchRuleHeaderEquals, Value: "x"},
+		{Type: models.MatchRuleSizeAbove, Value: "big"},
+		{Type: models.MatchRuleAuth, Header: "arc", Value: "pass"},
+		{Type: models.MatchRuleHasAttachment, Not: &models.MatchRule{Type: models.MatchRuleHasAttachment}},
+		{And: []models.MatchRule{{Type: "nope"}}},
+	}
+
+	for _, rule := range rules {
+		if _, err := compileMatchRule(rule); err == nil {
+			t.Errorf("expected %+v to be rejected", rule)
+		}
+	}
+}
+
+func TestMessageProcessor_ProcessMessage_Rejections(t *testing.T) {
+	repo := &mockJobRepository{
+		jobs: map[string][]*models.Job{
+			"user@example.com": {
+				{ID: 1, FromRegex: ".*", Match: &models.MatchRule{Type: models.MatchRuleSubjectRegex, Value: "^Alert"}},
+				{ID: 2, FromRegex: ".*", Match: &models.MatchRule{Type: models.MatchRuleSubjectRegex, Value: "^Invoice"}},
+				{ID: 3, FromRegex: "^nobody@"},
+			},
+		},
+	}
+	processor := NewMessageProcessor(repo, &mockLogger{}, nil, "example.com")
+
+	results, err := processor.ProcessMessage(context.Background(), Message{
+		ID:      9,
+		To:      "user@example.com",
+		From:    "sender@example.org",
+		Subject: "Invoice 42",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	accepted, rejected := splitRejections(results)
+	if len(accepted) != 1 || accepted[0].JobID != 2 {
+		t.Fatalf("expected only job 2 to match, got %+v", accepted)
+	}
+
+	if len(rejected) != 2 {
+		t.Fatalf("expected 2 rejections, got %d", len(rejected))
+	}
+	if first := rejected[0]; first.JobID != 1 || first.Rejected != `subject_regex "^Alert"` {
+		t.Errorf("unexpected rejection: %+v", first)
+	}
+	if rejected[1].Rejected != `from_regex "^nobody@"` {
+		t.Errorf("unexpected rejection reason: %q", rejected[1].Rejected)
+	}
+}
+
+func TestSMTPMessagePoller_RecordsRejectionsOnce(t *testing.T) {
+	db := newTestDB(t)
+	client := &sequenceHTTPClient{statuses: []int{http.StatusInternalServerError, http.StatusOK}}
+	poller := newTestPoller(t, db, client)
+	job := poller.processor.jobRepo.(*mockJobRepository).jobs["hook@example.com"][0]
+	job.Destinations = []models.Destination{
+		{ID: 10, Name: "alerts", URL: "https://example.com/alerts"},
+		{ID: 11, Name: "invoices", URL: "https://example.com/invoices",
+			Match: &models.MatchRule{Type: models.MatchRuleSubjectRegex, Value: "^Invoice"}},
+	}
+
+	msg := models.SMTPMessage{To: "hook@example.com", From: "a@example.org", Subject: "Alert", Body: "Disk full"}
+	if err := db.Create(&msg).Error; err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+	poller.drain(context.Background())
+
+	// The retry of the alerts destination doesn't record the rejection of the invoices one again
+	later := time.Now().Add(time.Hour)
+	poller.now = func() time.Time { return later }
+	poller.drain(context.Background())
+	if stored := message(t, db, msg.ID); stored.Status != models.MessageStatusDelivered {
+		t.Fatalf("expected the retry to deliver the message, got %q", stored.Status)
+	}
+
+	var rejections []models.Delivery
+	for _, delivery := range deliveries(t, db) {
+		if delivery.Status == models.DeliveryStatusRejected {
+			rejections = append(rejections, delivery)
+		}
+	}
+	if len(rejections) != 1 || rejections[0].DestinationID != 11 || rejections[0].Attempts != 1 {
+		t.Errorf("expected a single rejection by the invoices destination, got %+v", rejections)
+	}
+}
@@ -0,0 +1,168 @@
+package worker
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// ParsedEmail is the MIME structure of a raw message
+type ParsedEmail struct {
+	Header      mail.Header
+	Text        string
+	HTML        string
+	Attachments []Attachment
+}
+
+// Attachment describes a file attached to a message
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+
+	data []byte
+}
+
+var headerDecoder = &mime.WordDecoder{}
+
+// parseEmail parses a raw RFC 5322 message, walking multipart bodies for text, HTML and attachments
+func parseEmail(raw string) (*ParsedEmail, error) {
+	m, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+
+	parsed := &ParsedEmail{Header: m.Header}
+	if err := parsed.walk(textproto.MIMEHeader(m.Header), m.Body); err != nil {
+		return nil, err
+	}
+
+	return parsed, nil
+}
+
+// walk visits a MIME part, recursing into multipart containers
+func (p *ParsedEmail) walk(header textproto.MIMEHeader, body io.Reader) error {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "application/octet-stream"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read multipart body: %w", err)
+			}
+			if err := p.walk(part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := io.ReadAll(decodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return fmt.Errorf("failed to decode %s part: %w", mediaType, err)
+	}
+
+	disposition, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := decodeHeader(dispParams["filename"])
+	if filename == "" {
+		filename = decodeHeader(params["name"])
+	}
+
+	switch {
+	case disposition != "attachment" && filename == "" && mediaType == "text/plain" && p.Text == "":
+		p.Text = string(data)
+	case disposition != "attachment" && filename == "" && mediaType == "text/html" && p.HTML == "":
+		p.HTML = string(data)
+	default:
+		p.Attachments = append(p.Attachments, Attachment{
+			Filename:    filename,
+			ContentType: mediaType,
+			Size:        len(data),
+			data:        data,
+		})
+	}
+
+	return nil
+}
+
+// decodeTransfer undoes the Content-Transfer-Encoding of a part
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, newlineStripper{r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// newlineStripper drops line breaks so wrapped base64 can be decoded
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (n newlineStripper) Read(p []byte) (int, error) {
+	for {
+		read, err := n.r.Read(p)
+		kept := 0
+		for _, b := range p[:read] {
+			if b != '\r' && b != '\n' {
+				p[kept] = b
+				kept++
+			}
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+// decodeHeader decodes RFC 2047 encoded words, returning the input untouched when it can't
+func decodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// headers flattens the header to its first, decoded value per key
+func (p *ParsedEmail) headers() map[string]string {
+	headers := make(map[string]string, len(p.Header))
+	for key, values := range p.Header {
+		if len(values) > 0 {
+			headers[key] = decodeHeader(values[0])
+		}
+	}
+	return headers
+}
+
+// addressList parses an address header into plain addresses
+func (p *ParsedEmail) addressList(key string) []string {
+	list, err := p.Header.AddressList(key)
+	if err != nil {
+		return nil
+	}
+	addresses := make([]string, 0, len(list))
+	for _, addr := range list {
+		addresses = append(addresses, addr.Address)
+	}
+	return addresses
+}
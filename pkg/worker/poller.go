@@ -2,34 +2,94 @@ package worker
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
 	"time"
 
 	"gitea.v3m.net/idriss/gossiper/pkg/models"
 )
 
-// SMTPMessagePoller polls for unprocessed SMTP messages
+// SMTPMessagePoller polls for SMTP messages due for a delivery attempt
 type SMTPMessagePoller struct {
-	db              *models.DB
-	processor       *MessageProcessor
-	webhookSender   *WebhookSender
-	emailReplier    *EmailReplier
-	logger          Logger
-	pollInterval    time.Duration
-	batchSize       int
-	shutdownChan    chan struct{}
+	db            *models.DB
+	processor     *MessageProcessor
+	dispatcher    *Dispatcher
+	emailReplier  *EmailReplier
+	digests       DigestScheduler
+	limiter       *RateLimiter
+	userRateLimit models.RateLimit
+	deliveryLog   DeliveryLog
+	logger        Logger
+	pollInterval  time.Duration
+	wakeup        <-chan struct{}
+	batchSize     int
+	maxRetries    int
+	retryBackoff  time.Duration
+	now           func() time.Time
+	shutdownChan  chan struct{}
+
+	// bounces relays the bounces of forwarded mail, nil when nothing is forwarded
+	bounces BounceRelay
+}
+
+type PollerDependencies struct {
+	DB           *models.DB
+	Processor    *MessageProcessor
+	Dispatcher   *Dispatcher
+	EmailReplier *EmailReplier
+	DeliveryLog  DeliveryLog
+	Logger       Logger
+	// PollInterval is the fallback interval, messages are normally picked up on Wakeup.
+	// It defaults to defaultPollInterval when unset.
+	PollInterval time.Duration
+	// Wakeup signals that new messages were stored, it may be nil to rely on polling only
+	Wakeup <-chan struct{}
+	// MaxRetries is how many times a failed delivery is retried before it goes to the dead letters
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry, doubled for each following one.
+	// Retries are picked up by the first poll after they are due.
+	RetryBackoff time.Duration
+	// Digests closes the digests of jobs once their window is over, it may be nil to have them sent late on polling only
+	Digests DigestScheduler
+	// UserRateLimit caps the messages delivered for the jobs of each user, on top of the limits of each job
+	UserRateLimit models.RateLimit
+	// RateLimiter counts the deliveries of jobs and users, it defaults to one kept in memory only
+	RateLimiter *RateLimiter
+	// Bounces relays messages sent to the rewritten senders of forwarded mail, it may be nil
+	Bounces BounceRelay
 }
 
+// defaultPollInterval is the fallback interval of pollers configured without one
+const defaultPollInterval = 30 * time.Second
+
 // NewSMTPMessagePoller creates a new poller
-func NewSMTPMessagePoller(db *models.DB, processor *MessageProcessor, webhookSender *WebhookSender, emailReplier *EmailReplier, logger Logger, pollInterval time.Duration) *SMTPMessagePoller {
+func NewSMTPMessagePoller(deps PollerDependencies) *SMTPMessagePoller {
+	if deps.PollInterval <= 0 {
+		deps.PollInterval = defaultPollInterval
+	}
+	if deps.RateLimiter == nil {
+		deps.RateLimiter = NewRateLimiter()
+	}
 	return &SMTPMessagePoller{
-		db:            db,
-		processor:     processor,
-		webhookSender: webhookSender,
-		emailReplier:  emailReplier,
-		logger:        logger,
-		pollInterval:  pollInterval,
+		db:            deps.DB,
+		processor:     deps.Processor,
+		dispatcher:    deps.Dispatcher,
+		emailReplier:  deps.EmailReplier,
+		digests:       deps.Digests,
+		limiter:       deps.RateLimiter,
+		userRateLimit: deps.UserRateLimit,
+		deliveryLog:   deps.DeliveryLog,
+		logger:        deps.Logger,
+		pollInterval:  deps.PollInterval,
+		wakeup:        deps.Wakeup,
 		batchSize:     10,
+		maxRetries:    deps.MaxRetries,
+		retryBackoff:  deps.RetryBackoff,
+		now:           time.Now,
 		shutdownChan:  make(chan struct{}),
+		bounces:       deps.Bounces,
 	}
 }
 
@@ -39,6 +99,9 @@ func (p *SMTPMessagePoller) Start(ctx context.Context) error {
 	ticker := time.NewTicker(p.pollInterval)
 	defer ticker.Stop()
 
+	// Pick up whatever was stored while the worker was down
+	p.drain(ctx)
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -49,79 +112,695 @@ func (p *SMTPMessagePoller) Start(ctx context.Context) error {
 			p.logger.Println("poller stopping due to shutdown signal")
 			return nil
 
+		case <-p.wakeup:
+			p.drain(ctx)
+
 		case <-ticker.C:
-			if err := p.pollAndProcess(ctx); err != nil {
-				p.logger.Printf("error processing messages: %v", err)
-			}
+			p.drain(ctx)
+		}
+	}
+}
+
+// drain processes batches until no message is due, sends the digests and scheduled deliveries that are due,
+// then replays the dead letters queued for it
+func (p *SMTPMessagePoller) drain(ctx context.Context) {
+	for ctx.Err() == nil {
+		n, err := p.pollAndProcess(ctx)
+		if err != nil {
+			// Messages that failed stay due, they wait for the next poll rather than being fetched again right away
+			p.logger.Printf("error processing messages: %v", err)
+			break
+		}
+		if n < p.batchSize {
+			break
+		}
+	}
+
+	for ctx.Err() == nil {
+		n, err := p.sendDigests(ctx)
+		if err != nil {
+			p.logger.Printf("error sending digests: %v", err)
+			break
+		}
+		if n < p.batchSize {
+			break
+		}
+	}
+
+	for ctx.Err() == nil {
+		n, err := p.sendScheduled(ctx)
+		if err != nil {
+			p.logger.Printf("error sending scheduled deliveries: %v", err)
+			break
+		}
+		if n < p.batchSize {
+			break
+		}
+	}
+
+	for ctx.Err() == nil {
+		n, err := p.replay(ctx)
+		if err != nil {
+			p.logger.Printf("error replaying dead letters: %v", err)
+			return
+		}
+		if n < p.batchSize {
+			return
 		}
 	}
 }
 
-// pollAndProcess fetches and processes unprocessed messages
-func (p *SMTPMessagePoller) pollAndProcess(ctx context.Context) error {
+// pollAndProcess fetches and processes the messages due for an attempt, returning how many were fetched
+func (p *SMTPMessagePoller) pollAndProcess(ctx context.Context) (int, error) {
 	var messages []models.SMTPMessage
 
-	// Fetch unprocessed messages
+	// Fetch new messages and retries that are due
 	err := p.db.WithContext(ctx).
-		Where("processed = ?", false).
-		Order("created_at ASC").
+		Where("status IN ? AND next_attempt_at <= ?", []string{models.MessageStatusPending, models.MessageStatusRetrying}, p.now()).
+		Order("next_attempt_at ASC, id ASC").
 		Limit(p.batchSize).
+		Preload("Source").
 		Find(&messages).Error
 
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	if len(messages) == 0 {
-		return nil
+		return 0, nil
 	}
 
 	p.logger.Printf("processing %d messages", len(messages))
 
+	failures := 0
 	for _, smtpMsg := range messages {
-		// Convert to worker.Message format
-		msg := Message{
-			To:      smtpMsg.To,
-			From:    smtpMsg.From,
-			Subject: smtpMsg.Subject,
-			Body:    smtpMsg.Body,
+		if err := p.attempt(ctx, smtpMsg); err != nil {
+			p.logger.Printf("error processing message ID %d: %v", smtpMsg.ID, err)
+			failures++
 		}
+	}
+	if failures > 0 {
+		return len(messages), fmt.Errorf("%d of %d messages failed", failures, len(messages))
+	}
+
+	return len(messages), nil
+}
+
+// attemptState is what the deliveries of one attempt at a message share: the checks made once per job,
+// the jobs that replied already, and how the attempt went
+type attemptState struct {
+	msg        models.SMTPMessage
+	number     int
+	fresh      bool // The message is processed from scratch, rather than retried for the deliveries that failed
+	replied    map[int]bool
+	duplicates map[int]bool
+	limits     map[int]*RateLimitError
+	next       time.Time // When the message is retried, pushed back by circuits and rate limits
+	retry      bool
+	lastError  string
+}
+
+// attempt processes a message and delivers it, to every destination on its first attempt,
+// and then only to those that failed in a way worth retrying
+func (p *SMTPMessagePoller) attempt(ctx context.Context, smtpMsg models.SMTPMessage) error {
+	fresh, pending, err := p.pendingDeliveries(ctx, smtpMsg)
+	if err != nil {
+		return err
+	}
+	attempt := smtpMsg.Attempts + 1
+
+	// Bounces of forwarded mail go back to the original sender, they aren't for any job
+	if fresh && p.bounces != nil {
+		if relayed, err := p.relayBounce(ctx, smtpMsg, attempt); relayed {
+			return err
+		}
+	}
+
+	results, err := p.process(ctx, smtpMsg, fresh, pending)
+	if err != nil {
+		return p.reschedule(ctx, smtpMsg, pending, err)
+	}
+	results = p.recordRejections(ctx, smtpMsg, results, attempt)
+
+	if len(results) == 0 && fresh {
+		p.logger.Printf("no matching jobs found for message to: %s", smtpMsg.To)
+		return p.update(ctx, smtpMsg, map[string]any{
+			"status":   models.MessageStatusNoMatch,
+			"attempts": attempt,
+		})
+	}
+
+	// Auto-replies go out once per job however many of its destinations were called, over every attempt
+	replied, err := p.repliedJobs(ctx, smtpMsg.ID)
+	if err != nil {
+		return err
+	}
 
-		// Process the message
-		results, err := p.processor.ProcessMessage(ctx, msg)
+	state := &attemptState{
+		msg:        smtpMsg,
+		number:     attempt,
+		fresh:      fresh,
+		replied:    replied,
+		duplicates: map[int]bool{},
+		limits:     map[int]*RateLimitError{},
+		next:       p.now().Add(p.backoff(attempt)),
+	}
+	for _, processed := range results {
+		if result, ok := p.route(ctx, state, processed); ok {
+			p.recordResult(ctx, state, processed, result)
+		}
+	}
+
+	return p.finish(ctx, state)
+}
+
+// pendingDeliveries tells whether a message is processed from scratch, on its first attempt and on retries as long
+// as it never was, or else returns the deliveries of the last attempt to retry
+func (p *SMTPMessagePoller) pendingDeliveries(ctx context.Context, smtpMsg models.SMTPMessage) (bool, []models.Delivery, error) {
+	if smtpMsg.Status == models.MessageStatusPending {
+		return true, nil, nil
+	}
+
+	var pending []models.Delivery
+	err := p.db.WithContext(ctx).
+		Where("smtp_message_id = ? AND status = ? AND attempts = ?", smtpMsg.ID, models.DeliveryStatusFailed, smtpMsg.Attempts).
+		Find(&pending).Error
+	if err != nil {
+		return false, nil, err
+	}
+	if len(pending) > 0 {
+		return false, pending, nil
+	}
+
+	fresh, err := p.unprocessed(ctx, smtpMsg.ID)
+	return fresh, nil, err
+}
+
+// relayBounce relays a message that bounced off forwarded mail, returning false when it is no such bounce
+func (p *SMTPMessagePoller) relayBounce(ctx context.Context, smtpMsg models.SMTPMessage, attempt int) (bool, error) {
+	handled, err := p.bounces.RelayBounce(ctx, smtpMsg.To, []byte(smtpMsg.RawSource()))
+	switch {
+	case errors.Is(err, ErrBounceDropped):
+		return true, p.update(ctx, smtpMsg, map[string]any{
+			"status":     models.MessageStatusDead,
+			"attempts":   attempt,
+			"last_error": err.Error(),
+		})
+	case err != nil:
+		return true, p.reschedule(ctx, smtpMsg, nil, err)
+	case handled:
+		return true, p.update(ctx, smtpMsg, map[string]any{
+			"status":   models.MessageStatusDelivered,
+			"attempts": attempt,
+		})
+	}
+	return false, nil
+}
+
+// process runs a message through the jobs of its address, or only through the destinations it is retried for
+func (p *SMTPMessagePoller) process(ctx context.Context, smtpMsg models.SMTPMessage, fresh bool, pending []models.Delivery) ([]ProcessResult, error) {
+	msg := messageFromSMTP(smtpMsg)
+	if fresh {
+		return p.processor.ProcessMessage(ctx, msg)
+	}
+
+	var results []ProcessResult
+	for _, delivery := range pending {
+		retried, err := p.processor.ReprocessMessage(ctx, msg, delivery.JobID, delivery.DestinationID)
 		if err != nil {
-			p.logger.Printf("error processing message ID %d: %v", smtpMsg.ID, err)
+			return nil, err
+		}
+		results = append(results, retried...)
+	}
+	return results, nil
+}
+
+// route applies the policies of the job to a processed message: copies are skipped, digests collect it, schedules
+// hold it back and rate limits apply the job's overflow policy. It delivers what is left and returns the result,
+// or false when the message went no further.
+func (p *SMTPMessagePoller) route(ctx context.Context, state *attemptState, processed ProcessResult) (WebhookResult, bool) {
+	job := processed.Job
+
+	// Copies are spotted on the first attempt, retries only bring back deliveries that went ahead
+	if job.DedupWindow > 0 && state.fresh {
+		duplicate, checked := state.duplicates[job.ID]
+		if !checked {
+			var err error
+			if duplicate, err = p.deduplicate(ctx, state.msg, processed); err != nil {
+				p.logger.Printf("failed to look for copies of message %d: %v", state.msg.ID, err)
+			}
+			state.duplicates[job.ID] = duplicate
+		}
+		if duplicate {
+			return WebhookResult{}, false
+		}
+	}
+
+	switch {
+	case processed.Collected:
+		err := p.collect(ctx, state.msg, processed, job.Digest, false, state.number)
+		if err == nil {
+			return WebhookResult{}, false
+		}
+		return WebhookResult{JobID: processed.JobID, Error: fmt.Errorf("failed to collect the message in a digest: %w", err)}, true
+	case job.Schedule != nil:
+		// Retries wait for the window as well, should it have closed in the meantime
+		scheduled, err := p.schedule(ctx, state.msg, processed)
+		if err != nil {
+			return WebhookResult{JobID: processed.JobID, DestinationID: processed.DestinationID, Error: fmt.Errorf("failed to schedule the delivery: %w", err)}, true
+		}
+		if scheduled {
+			return WebhookResult{}, false
+		}
+	}
+
+	// Messages over the rate limit of their job or user go the way of the job's overflow policy
+	limited, checked := state.limits[job.ID]
+	if !checked {
+		limited = p.throttle(processed)
+		state.limits[job.ID] = limited
+	}
+	if limited == nil {
+		return p.dispatcher.Deliver(ctx, processed), true
+	}
+	overflowed := p.overflow(ctx, state.msg, processed, limited, state.number)
+	if overflowed == nil {
+		return WebhookResult{}, false
+	}
+	return *overflowed, true
+}
+
+// recordResult records the outcome of a delivery and follows up on it once delivered
+func (p *SMTPMessagePoller) recordResult(ctx context.Context, state *attemptState, processed ProcessResult, result WebhookResult) {
+	status := p.deliveryStatus(processed, result, state.number, &state.next)
+	if failed(result) {
+		state.lastError = failure(result)
+	}
+	if status == models.DeliveryStatusFailed {
+		state.retry = true
+	}
+	p.recordDelivery(ctx, models.Delivery{SMTPMessageID: state.msg.ID}, result, status, state.number)
+
+	if result.Error != nil {
+		p.logger.Printf("webhook error for job %d: %v", result.JobID, result.Error)
+	}
+	if !failed(result) {
+		p.respond(ctx, state.msg, processed, result, state.replied, state.number)
+	}
+}
+
+// finish updates the message once the attempt is over, it is retried when a delivery failed in a way worth retrying
+func (p *SMTPMessagePoller) finish(ctx context.Context, state *attemptState) error {
+	updates := map[string]any{"attempts": state.number, "last_error": state.lastError}
+	if state.retry {
+		updates["status"] = models.MessageStatusRetrying
+		updates["next_attempt_at"] = state.next
+		p.logger.Printf("attempt %d for message %d failed, retrying at %s", state.number, state.msg.ID, state.next)
+		return p.update(ctx, state.msg, updates)
+	}
+
+	status, err := p.settledStatus(ctx, state.msg.ID)
+	if err != nil {
+		return err
+	}
+	updates["status"] = status
+	return p.update(ctx, state.msg, updates)
+}
+
+// recordRejections records in the delivery log the results of jobs turning the message down,
+// once per attempt, and returns the results left to deliver
+func (p *SMTPMessagePoller) recordRejections(ctx context.Context, smtpMsg models.SMTPMessage, results []ProcessResult, attempt int) []ProcessResult {
+	accepted, rejected := splitRejections(results)
+	for _, rejection := range rejected {
+		err := p.deliveryLog.Record(ctx, &models.Delivery{
+			JobID:         rejection.JobID,
+			DestinationID: rejection.DestinationID,
+			SMTPMessageID: smtpMsg.ID,
+			Status:        models.DeliveryStatusRejected,
+			Attempts:      attempt,
+			Detail:        rejection.Rejected,
+		})
+		if err != nil {
+			p.logger.Printf("failed to record rejection for job %d: %v", rejection.JobID, err)
+		}
+	}
+	return accepted
+}
+
+// respond follows up on a delivered message: it forwards the message where the endpoint answered to,
+// and sends the reply it answered with, or else the job's auto-reply, unless it asked for none.
+// Forwards are recorded in the delivery log as deliveries of their own.
+func (p *SMTPMessagePoller) respond(ctx context.Context, smtpMsg models.SMTPMessage, processed ProcessResult, result WebhookResult, replied map[int]bool, attempt int) {
+	action := result.Action
+	if action == nil {
+		action = &ResponseAction{}
+	}
+
+	if len(action.ForwardTo) > 0 {
+		forwarded := p.dispatcher.Deliver(ctx, ProcessResult{
+			JobID:         processed.JobID,
+			DestinationID: processed.DestinationID,
+			Destination:   processed.Destination,
+			Type:          models.DestinationTypeEmail,
+			Options:       map[string]string{"to": strings.Join(action.ForwardTo, ", ")},
+			Message:       processed.Message,
+		})
+		delivery := models.Delivery{
+			JobID:         processed.JobID,
+			DestinationID: processed.DestinationID,
+			SMTPMessageID: smtpMsg.ID,
+			Status:        models.DeliveryStatusForwarded,
+			Attempts:      attempt,
+			Detail:        "forwarded to " + strings.Join(action.ForwardTo, ", "),
+		}
+		if forwarded.Error != nil {
+			p.logger.Printf("failed to forward message %d for job %d: %v", smtpMsg.ID, result.JobID, forwarded.Error)
+			delivery.Status, delivery.Detail = models.DeliveryStatusForwardFailed, failure(forwarded)
+		}
+		if err := p.deliveryLog.Record(ctx, &delivery); err != nil {
+			p.logger.Printf("failed to record the forward of message %d for job %d: %v", smtpMsg.ID, result.JobID, err)
+		}
+	}
+
+	// Replies go out once per job, the first destination answering for one wins
+	if replied[result.JobID] || p.emailReplier == nil {
+		return
+	}
+	if action.SuppressReply {
+		replied[result.JobID] = true
+		return
+	}
+
+	var err error
+	switch {
+	case action.Reply != nil:
+		subject := action.Reply.Subject
+		if subject == "" {
+			subject = "Re: " + smtpMsg.Subject
+		}
+		replied[result.JobID] = true
+		err = p.emailReplier.Reply(smtpMsg.From, subject, action.Reply.Body)
+	case processed.Job != nil && processed.Job.Response != "":
+		replied[result.JobID] = true
+		err = p.emailReplier.SendReply(smtpMsg.From, smtpMsg.Subject, processed.Job.Response)
+	}
+	if err != nil {
+		p.logger.Printf("failed to send auto-reply for job %d: %v", result.JobID, err)
+	}
+}
+
+// deliveryStatus classifies the outcome of a delivery attempt. Failures worth retrying stay failed,
+// and the others are dead. Deliveries held back by an open circuit or a rate limit weren't tried, they
+// wait for it without using up retries, pushing next back to when it lets them through.
+func (p *SMTPMessagePoller) deliveryStatus(processed ProcessResult, result WebhookResult, attempt int, next *time.Time) string {
+	if !failed(result) {
+		return models.DeliveryStatusDelivered
+	}
+
+	var open *CircuitOpenError
+	if errors.As(result.Error, &open) {
+		if open.RetryAt.After(*next) {
+			*next = open.RetryAt
+		}
+		return models.DeliveryStatusFailed
+	}
+	var limited *RateLimitError
+	if errors.As(result.Error, &limited) {
+		if limited.RetryAt.After(*next) {
+			*next = limited.RetryAt
+		}
+		return models.DeliveryStatusFailed
+	}
+	if retryable(processed, result) && attempt <= p.maxRetries {
+		return models.DeliveryStatusFailed
+	}
+	return models.DeliveryStatusDead
+}
+
+// reschedule retries a message that couldn't be processed, such as when the jobs failed to load. The pending
+// deliveries are carried over to the next attempt, or to the dead letters once retries are used up. Messages
+// that were never processed are processed again, and die with a dead letter for each job of their address.
+func (p *SMTPMessagePoller) reschedule(ctx context.Context, smtpMsg models.SMTPMessage, pending []models.Delivery, cause error) error {
+	attempt := smtpMsg.Attempts + 1
+	updates := map[string]any{
+		"status":          models.MessageStatusRetrying,
+		"attempts":        attempt,
+		"last_error":      cause.Error(),
+		"next_attempt_at": p.now().Add(p.backoff(attempt)),
+	}
+	status := models.DeliveryStatusFailed
+	if attempt > p.maxRetries {
+		updates["status"], status = models.MessageStatusDead, models.DeliveryStatusDead
+
+		if len(pending) == 0 {
+			// Replaying a dead letter without a destination processes the message for all of the job's destinations
+			var jobIDs []int
+			err := p.db.WithContext(ctx).Model(&models.Job{}).Where("email = ? AND is_active = ?", smtpMsg.To, true).Pluck("id", &jobIDs).Error
+			if err != nil {
+				p.logger.Printf("failed to find the jobs of message %d: %v", smtpMsg.ID, err)
+			}
+			for _, id := range jobIDs {
+				pending = append(pending, models.Delivery{JobID: id})
+			}
+		}
+	}
+
+	for _, delivery := range pending {
+		result := WebhookResult{JobID: delivery.JobID, DestinationID: delivery.DestinationID, Error: cause}
+		p.recordDelivery(ctx, models.Delivery{SMTPMessageID: smtpMsg.ID}, result, status, attempt)
+	}
+
+	if err := p.update(ctx, smtpMsg, updates); err != nil {
+		return err
+	}
+	return cause
+}
+
+// unprocessed tells whether a message has no delivery recorded yet, such as when its jobs failed to load
+func (p *SMTPMessagePoller) unprocessed(ctx context.Context, messageID int) (bool, error) {
+	var count int64
+	err := p.db.WithContext(ctx).Model(&models.Delivery{}).Where("smtp_message_id = ?", messageID).Count(&count).Error
+	return count == 0, err
+}
+
+// maxRetryBackoff caps the wait between attempts, messages held back by an open circuit can be tried many times
+const maxRetryBackoff = time.Hour
+
+// backoff is the wait before the attempt following attempt, doubled each time
+func (p *SMTPMessagePoller) backoff(attempt int) time.Duration {
+	return min(p.retryBackoff<<min(attempt-1, 16), maxRetryBackoff)
+}
+
+func (p *SMTPMessagePoller) update(ctx context.Context, smtpMsg models.SMTPMessage, updates map[string]any) error {
+	err := p.db.WithContext(ctx).Model(&smtpMsg).Updates(updates).Error
+	if err != nil {
+		return fmt.Errorf("failed to update message %d: %w", smtpMsg.ID, err)
+	}
+	return nil
+}
+
+// repliedJobs returns the jobs which already delivered a message, and sent its auto-reply if they have one
+func (p *SMTPMessagePoller) repliedJobs(ctx context.Context, messageID int) (map[int]bool, error) {
+	var jobIDs []int
+	err := p.db.WithContext(ctx).
+		Model(&models.Delivery{}).
+		Where("smtp_message_id = ? AND status IN ?", messageID, []string{models.DeliveryStatusDelivered, models.DeliveryStatusReplayed}).
+		Distinct().
+		Pluck("job_id", &jobIDs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	replied := make(map[int]bool, len(jobIDs))
+	for _, id := range jobIDs {
+		replied[id] = true
+	}
+	return replied, nil
+}
+
+// settledStatus derives the status of a message from the final outcome of its deliveries
+func (p *SMTPMessagePoller) settledStatus(ctx context.Context, messageID int) (string, error) {
+	var counts []struct {
+		Status string
+		Count  int
+	}
+	err := p.db.WithContext(ctx).
+		Model(&models.Delivery{}).
+		Select("status, COUNT(*) AS count").
+		Where("smtp_message_id = ? AND status IN ?", messageID, []string{models.DeliveryStatusDelivered, models.DeliveryStatusDigested, models.DeliveryStatusDead, models.DeliveryStatusReplaying, models.DeliveryStatusScheduled, models.DeliveryStatusDuplicate, models.DeliveryStatusThrottled}).
+		Group("status").
+		Scan(&counts).Error
+	if err != nil {
+		return "", err
+	}
+
+	var delivered, dead, scheduled, duplicates, throttled int
+	for _, c := range counts {
+		switch c.Status {
+		case models.DeliveryStatusDelivered, models.DeliveryStatusDigested:
+			delivered += c.Count
+		case models.DeliveryStatusScheduled:
+			scheduled += c.Count
+		case models.DeliveryStatusDuplicate:
+			duplicates += c.Count
+		case models.DeliveryStatusThrottled:
+			throttled += c.Count
+		default:
+			dead += c.Count
+		}
+	}
+
+	switch {
+	case scheduled > 0:
+		return models.MessageStatusScheduled, nil
+	case dead == 0 && delivered == 0 && throttled > 0:
+		return models.MessageStatusThrottled, nil
+	case dead == 0 && delivered == 0 && duplicates > 0:
+		return models.MessageStatusDuplicate, nil
+	case dead == 0 && delivered == 0:
+		return models.MessageStatusNoMatch, nil
+	case dead == 0:
+		return models.MessageStatusDelivered, nil
+	case delivered == 0:
+		return models.MessageStatusDead, nil
+	default:
+		return models.MessageStatusPartiallyFailed, nil
+	}
+}
+
+// messageFromSMTP converts a stored message to the worker.Message format
+func messageFromSMTP(smtpMsg models.SMTPMessage) Message {
+	return Message{
+		To:         smtpMsg.To,
+		From:       smtpMsg.From,
+		Subject:    smtpMsg.Subject,
+		Body:       smtpMsg.Body,
+		ID:         smtpMsg.ID,
+		ReceivedAt: smtpMsg.CreatedAt,
+		Raw:        smtpMsg.RawSource(),
+		Auth:       smtpMsg.Auth,
+	}
+}
+
+// failed tells whether a delivery didn't go through
+func failed(result WebhookResult) bool {
+	return result.Error != nil || result.StatusCode >= 400
+}
+
+// failure describes why a delivery didn't go through
+func failure(result WebhookResult) string {
+	if result.Error != nil {
+		return result.Error.Error()
+	}
+	return fmt.Sprintf("endpoint returned status %d", result.StatusCode)
+}
+
+// retryable tells whether a failed delivery may go through if tried again.
+// Processing errors, blocked addresses, invalid transport options or credentials and client errors
+// other than rate limiting won't.
+func retryable(processed ProcessResult, result WebhookResult) bool {
+	switch {
+	case processed.Error != nil,
+		errors.Is(result.Error, ErrBlockedAddress),
+		errors.Is(result.Error, ErrInvalidTransport),
+		errors.Is(result.Error, ErrInvalidAuth):
+		return false
+	case result.Error != nil:
+		return true
+	default:
+		return result.StatusCode >= 500 || result.StatusCode == http.StatusTooManyRequests
+	}
+}
+
+// replay re-runs the dead deliveries queued for replay from the dashboard, with the job's current configuration,
+// returning how many were fetched. Replays are attempted once, failures go back to the dead letters.
+func (p *SMTPMessagePoller) replay(ctx context.Context) (int, error) {
+	var deliveries []models.Delivery
+	err := p.db.WithContext(ctx).
+		Where("status = ?", models.DeliveryStatusReplaying).
+		Order("id ASC").
+		Limit(p.batchSize).
+		Find(&deliveries).Error
+	if err != nil {
+		return 0, err
+	}
+
+	for _, delivery := range deliveries {
+		if delivery.DigestID != 0 && delivery.SMTPMessageID == 0 {
+			p.replayDigest(ctx, delivery)
 			continue
 		}
 
-		if len(results) > 0 {
-			// Send webhooks
-			webhookResults := p.webhookSender.SendWebhooks(ctx, results)
-			
-			// Check webhook results and send auto-replies for successful ones
-			for _, result := range webhookResults {
-				if result.Error != nil {
-					p.logger.Printf("webhook error for job %d: %v", result.JobID, result.Error)
-				} else if result.Response != "" {
-					// Webhook succeeded and auto-reply is configured
-					err := p.emailReplier.SendReply(smtpMsg.From, smtpMsg.Subject, result.Response)
-					if err != nil {
-						p.logger.Printf("failed to send auto-reply for job %d: %v", result.JobID, err)
+		status, detail := models.DeliveryStatusReplayed, ""
+
+		var smtpMsg models.SMTPMessage
+		err := p.db.WithContext(ctx).Preload("Source").First(&smtpMsg, delivery.SMTPMessageID).Error
+		if err == nil {
+			var results []ProcessResult
+			results, err = p.processor.ReprocessMessage(ctx, messageFromSMTP(smtpMsg), delivery.JobID, delivery.DestinationID)
+			var rejected []ProcessResult
+			results, rejected = splitRejections(results)
+			if len(results) == 0 && err == nil {
+				detail = "replay: the job no longer delivers this message"
+				if len(rejected) > 0 {
+					detail += ": " + rejected[0].Rejected
+				}
+			}
+			for _, processed := range results {
+				if processed.Collected {
+					// The job has since turned to digests, the message joins the open one
+					if err := p.collect(ctx, smtpMsg, processed, processed.Job.Digest, false, 1); err != nil {
+						p.logger.Printf("failed to collect replayed message %d in a digest: %v", smtpMsg.ID, err)
 					}
+					continue
 				}
+				result := p.dispatcher.Deliver(ctx, processed)
+				status := models.DeliveryStatusDelivered
+				if failed(result) {
+					status = models.DeliveryStatusDead
+				}
+				p.recordDelivery(ctx, models.Delivery{SMTPMessageID: smtpMsg.ID}, result, status, 1)
 			}
-		} else {
-			p.logger.Printf("no matching jobs found for message to: %s", msg.To)
+		}
+		if err != nil {
+			// Back to the dead letters with the reason the replay didn't happen
+			status, detail = models.DeliveryStatusDead, fmt.Sprintf("replay: %v", err)
 		}
 
-		// Mark as processed
-		smtpMsg.Processed = true
-		if err := p.db.WithContext(ctx).Save(&smtpMsg).Error; err != nil {
-			p.logger.Printf("failed to mark message %d as processed: %v", smtpMsg.ID, err)
+		updates := map[string]any{"status": status}
+		if detail != "" {
+			updates["detail"] = detail
+		}
+		if err := p.db.WithContext(ctx).Model(&delivery).Updates(updates).Error; err != nil {
+			p.logger.Printf("failed to update replayed delivery %d: %v", delivery.ID, err)
+		}
+
+		if smtpMsg.ID != 0 {
+			if settled, err := p.settledStatus(ctx, smtpMsg.ID); err != nil {
+				p.logger.Printf("failed to settle message %d: %v", smtpMsg.ID, err)
+			} else if err := p.update(ctx, smtpMsg, map[string]any{"status": settled}); err != nil {
+				p.logger.Printf("%v", err)
+			}
 		}
 	}
 
-	return nil
+	return len(deliveries), nil
+}
+
+// recordDelivery adds the outcome of a delivery attempt to the delivery log, for the message or digest set on delivery
+func (p *SMTPMessagePoller) recordDelivery(ctx context.Context, delivery models.Delivery, result WebhookResult, status string, attempts int) {
+	delivery.JobID = result.JobID
+	delivery.DestinationID = result.DestinationID
+	delivery.Status = status
+	delivery.StatusCode = result.StatusCode
+	delivery.Attempts = attempts
+	if failed(result) {
+		delivery.Detail = failure(result)
+	}
+
+	if err := p.deliveryLog.Record(ctx, &delivery); err != nil {
+		p.logger.Printf("failed to record delivery for job %d: %v", result.JobID, err)
+	}
 }
 
 // Shutdown signals the poller to stop
@@ -0,0 +1,505 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// sequenceHTTPClient answers requests with the given status codes in turn, repeating the last one
+type sequenceHTTPClient struct {
+	statuses []int
+	requests int
+}
+
+func (c *sequenceHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	status := c.statuses[min(c.requests, len(c.statuses)-1)]
+	c.requests++
+	return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+func newTestDB(t *testing.T) *models.DB {
+	t.Helper()
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	gdb, err := gorm.Open(sqlite.Open("file:"+name+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	db := models.NewDB(gdb)
+	if err := db.AutoMigrate(); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	return db
+}
+
+func newTestPoller(t *testing.T, db *models.DB, client HTTPClient) *SMTPMessagePoller {
+	t.Helper()
+	repo := &mockJobRepository{jobs: map[string][]*models.Job{
+		"hook@example.com": {{ID: 1, Email: "hook@example.com", URL: "https://example.com/hook", Method: "POST", FromRegex: ".*"}},
+	}}
+	deliveryLog := NewGormDeliveryLog(db)
+	processor := NewMessageProcessor(repo, &mockLogger{}, nil, "example.com")
+
+	return NewSMTPMessagePoller(PollerDependencies{
+		DB:          db,
+		Processor:   processor,
+		Dispatcher:  NewDispatcher(NewWebhookSender(client, &mockLogger{}, Config{}), &mockLogger{}),
+		DeliveryLog: deliveryLog,
+		Logger:      &mockLogger{},
+		MaxRetries:  2,
+	})
+}
+
+func deliveries(t *testing.T, db *models.DB) []models.Delivery {
+	t.Helper()
+	var all []models.Delivery
+	if err := db.Order("id ASC").Find(&all).Error; err != nil {
+		t.Fatalf("failed to load deliveries: %v", err)
+	}
+	return all
+}
+
+func message(t *testing.T, db *models.DB, id int) models.SMTPMessage {
+	t.Helper()
+	var msg models.SMTPMessage
+	if err := db.First(&msg, id).Error; err != nil {
+		t.Fatalf("failed to load message: %v", err)
+	}
+	return msg
+}
+
+func TestSMTPMessagePoller_DeadLetters(t *testing.T) {
+	db := newTestDB(t)
+	client := &sequenceHTTPClient{statuses: []int{503}}
+	poller := newTestPoller(t, db, client)
+
+	msg := models.SMTPMessage{To: "hook@example.com", From: "alice@example.org", Subject: "Hi", Body: "Hello"}
+	if err := db.Create(&msg).Error; err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+
+	// Each drain makes one attempt, retries are due straight away without a backoff
+	for i := 0; i < 4; i++ {
+		poller.drain(context.Background())
+	}
+
+	if client.requests != 3 {
+		t.Errorf("expected the first attempt and 2 retries, got %d requests", client.requests)
+	}
+	got := deliveries(t, db)
+	if len(got) != 3 {
+		t.Fatalf("expected a delivery per attempt, got %+v", got)
+	}
+	for i, delivery := range got[:2] {
+		if delivery.Status != models.DeliveryStatusFailed || delivery.Attempts != i+1 {
+			t.Errorf("expected attempt %d to be retried, got %+v", i+1, delivery)
+		}
+	}
+	dead := got[2]
+	if dead.Status != models.DeliveryStatusDead || dead.Attempts != 3 {
+		t.Fatalf("expected a dead delivery after 3 attempts, got %+v", dead)
+	}
+	if dead.Detail != "endpoint returned status 503" {
+		t.Errorf("expected the last error to be kept, got %q", dead.Detail)
+	}
+	if stored := message(t, db, msg.ID); stored.Status != models.MessageStatusDead || stored.Attempts != 3 || stored.LastError != dead.Detail {
+		t.Errorf("expected the message to be dead, got %+v", stored)
+	}
+
+	// Replaying from the dashboard delivers it again once the endpoint is back
+	client.statuses = []int{200}
+	db.Model(&dead).Update("status", models.DeliveryStatusReplaying)
+	poller.drain(context.Background())
+
+	got = deliveries(t, db)
+	if len(got) != 4 {
+		t.Fatalf("expected the replay to be recorded, got %+v", got)
+	}
+	if got[2].Status != models.DeliveryStatusReplayed {
+		t.Errorf("expected the dead letter to be marked replayed, got %s", got[2].Status)
+	}
+	if got[3].Status != models.DeliveryStatusDelivered || got[3].SMTPMessageID != msg.ID || got[3].Attempts != 1 {
+		t.Errorf("unexpected replayed delivery: %+v", got[3])
+	}
+	if stored := message(t, db, msg.ID); stored.Status != models.MessageStatusDelivered {
+		t.Errorf("expected the replayed message to be delivered, got %s", stored.Status)
+	}
+}
+
+func TestSMTPMessagePoller_ScheduledRetries(t *testing.T) {
+	db := newTestDB(t)
+	client := &sequenceHTTPClient{statuses: []int{500, 200}}
+	poller := newTestPoller(t, db, client)
+	poller.retryBackoff = time.Minute
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	poller.now = func() time.Time { return now }
+
+	msg := models.SMTPMessage{To: "hook@example.com", From: "a@example.org", Subject: "Hi", Body: "Hello", CreatedAt: now}
+	if err := db.Create(&msg).Error; err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+
+	poller.drain(context.Background())
+	stored := message(t, db, msg.ID)
+	if stored.Status != models.MessageStatusRetrying || stored.Attempts != 1 || !stored.NextAttemptAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expected a retry in a minute, got %+v", stored)
+	}
+
+	// Not due yet
+	poller.drain(context.Background())
+	if client.requests != 1 {
+		t.Fatalf("expected the retry to wait for its backoff, got %d requests", client.requests)
+	}
+
+	now = now.Add(time.Minute)
+	poller.drain(context.Background())
+	if client.requests != 2 {
+		t.Fatalf("expected the retry once due, got %d requests", client.requests)
+	}
+	if stored := message(t, db, msg.ID); stored.Status != models.MessageStatusDelivered || stored.Attempts != 2 || stored.LastError != "" {
+		t.Errorf("expected the message to be delivered on the second attempt, got %+v", stored)
+	}
+}
+
+func TestSMTPMessagePoller_NoMatch(t *testing.T) {
+	db := newTestDB(t)
+	client := &sequenceHTTPClient{statuses: []int{200}}
+	poller := newTestPoller(t, db, client)
+
+	msg := models.SMTPMessage{To: "nobody@example.com", From: "a@example.org", Subject: "Hi", Body: "Hello"}
+	if err := db.Create(&msg).Error; err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+
+	poller.drain(context.Background())
+
+	if client.requests != 0 {
+		t.Errorf("expected no delivery, got %d requests", client.requests)
+	}
+	if stored := message(t, db, msg.ID); stored.Status != models.MessageStatusNoMatch {
+		t.Errorf("expected the message to match no job, got %s", stored.Status)
+	}
+}
+
+func TestSMTPMessagePoller_RelaysBounces(t *testing.T) {
+	db := newTestDB(t)
+	client := &sequenceHTTPClient{statuses: []int{200}}
+	poller := newTestPoller(t, db, client)
+	var sent []sentMail
+	forwarder := newTestForwarder(&sent, nil)
+	forwarder.srsDomain = "example.com"
+	poller.bounces = forwarder
+
+	bounce := models.SMTPMessage{To: forwarder.srsForward("alice@example.org"), Subject: "Undelivered Mail", Raw: "Subject: Undelivered Mail\r\n\r\nUser unknown\r\n"}
+	if err := db.Create(&bounce).Error; err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+
+	poller.drain(context.Background())
+
+	if len(sent) != 1 || sent[0].to[0] != "alice@example.org" {
+		t.Errorf("expected the bounce to be relayed to the original sender, got %+v", sent)
+	}
+	if client.requests != 0 {
+		t.Errorf("expected no delivery, got %d requests", client.requests)
+	}
+	if stored := message(t, db, bounce.ID); stored.Status != models.MessageStatusDelivered {
+		t.Errorf("expected the bounce to be delivered, got %s", stored.Status)
+	}
+
+	forged := models.SMTPMessage{To: "SRS0=AAAA=AA=example.org=alice@example.com", Subject: "Undelivered Mail", Raw: bounce.Raw}
+	if err := db.Create(&forged).Error; err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+
+	poller.drain(context.Background())
+
+	if len(sent) != 1 {
+		t.Errorf("expected the forged bounce not to be relayed, got %+v", sent)
+	}
+	if stored := message(t, db, forged.ID); stored.Status != models.MessageStatusDead || !strings.Contains(stored.LastError, "bounce dropped") {
+		t.Errorf("expected the forged bounce to be dead with the reason, got %s %q", stored.Status, stored.LastError)
+	}
+}
+
+func TestSMTPMessagePoller_ClientErrorsAreNotRetried(t *testing.T) {
+	db := newTestDB(t)
+	client := &sequenceHTTPClient{statuses: []int{404}}
+	poller := newTestPoller(t, db, client)
+
+	if err := db.Create(&models.SMTPMessage{To: "hook@example.com", From: "a@example.org", Subject: "Hi", Body: "Hello"}).Error; err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+
+	poller.drain(context.Background())
+
+	if client.requests != 1 {
+		t.Errorf("expected a single attempt, got %d", client.requests)
+	}
+	if got := deliveries(t, db); len(got) != 1 || got[0].Status != models.DeliveryStatusDead {
+		t.Errorf("expected a dead delivery, got %+v", got)
+	}
+}
+
+func TestSMTPMessagePoller_ProcessingErrors(t *testing.T) {
+	db := newTestDB(t)
+	client := &sequenceHTTPClient{statuses: []int{200}}
+	poller := newTestPoller(t, db, client)
+	repo := poller.processor.jobRepo.(*mockJobRepository)
+	repo.err = errors.New("database is locked")
+
+	msg := models.SMTPMessage{To: "hook@example.com", From: "a@example.org", Subject: "Hi", Body: "Hello"}
+	if err := db.Create(&msg).Error; err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+
+	poller.drain(context.Background())
+	stored := message(t, db, msg.ID)
+	if stored.Status != models.MessageStatusRetrying || stored.Attempts != 1 {
+		t.Fatalf("expected the message to be retried, got %+v", stored)
+	}
+
+	// Once the jobs load again, the message is processed from scratch
+	repo.err = nil
+	poller.drain(context.Background())
+	if client.requests != 1 {
+		t.Errorf("expected the retry to deliver the message, got %d requests", client.requests)
+	}
+	if stored := message(t, db, msg.ID); stored.Status != models.MessageStatusDelivered || stored.Attempts != 2 {
+		t.Errorf("expected the message to be delivered on the second attempt, got %+v", stored)
+	}
+
+	// Messages that never got processed end up in the dead letters of the active jobs of their address
+	if err := db.Create(&models.Job{ID: 1, Email: "hook@example.com", URL: "https://example.com/hook"}).Error; err != nil {
+		t.Fatalf("failed to store job: %v", err)
+	}
+	other := models.SMTPMessage{To: "hook@example.com", From: "a@example.org", Subject: "Again", Body: "Hello"}
+	if err := db.Create(&other).Error; err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+	repo.err = errors.New("database is locked")
+	for i := 0; i < 3; i++ {
+		poller.drain(context.Background())
+	}
+	if stored := message(t, db, other.ID); stored.Status != models.MessageStatusDead {
+		t.Fatalf("expected the message to be dead, got %+v", stored)
+	}
+	got := deliveries(t, db)
+	dead := got[len(got)-1]
+	if dead.Status != models.DeliveryStatusDead || dead.JobID != 1 || dead.SMTPMessageID != other.ID || !strings.Contains(dead.Detail, "database is locked") {
+		t.Fatalf("expected a dead letter with the cause, got %+v", dead)
+	}
+
+
+	repo.err = nil
+	db.Model(&dead).Update("status", models.DeliveryStatusReplaying)
+	poller.drain(context.Background())
+	if stored := message(t, db, other.ID); stored.Status != models.MessageStatusDelivered {
+		t.Errorf("expected the replayed message to be delivered, got %s", stored.Status)
+	}
+
+	// Paused jobs get no dead letters
+	db.Model(&models.Job{}).Where("id = ?", 1).Update("is_active", false)
+	paused := models.SMTPMessage{To: "hook@example.com", From: "a@example.org", Subject: "Paused", Body: "Hello"}
+	if err := db.Create(&paused).Error; err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+	repo.err = errors.New("database is locked")
+	for i := 0; i < 3; i++ {
+		poller.drain(context.Background())
+	}
+	if stored := message(t, db, paused.ID); stored.Status != models.MessageStatusDead {
+		t.Fatalf("expected the message to be dead, got %+v", stored)
+	}
+	for _, d := range deliveries(t, db) {
+		if d.SMTPMessageID == paused.ID && d.Status == models.DeliveryStatusDead {
+			t.Errorf("expected no dead letter for the paused job, got %+v", d)
+		}
+	}
+}
+
+func TestSMTPMessagePoller_DrainStopsOnErrors(t *testing.T) {
+	db := newTestDB(t)
+	client := &sequenceHTTPClient{statuses: []int{200}}
+	poller := newTestPoller(t, db, client)
+	poller.batchSize = 1
+
+	for _, subject := range []string{"First", "Second"} {
+		msg := models.SMTPMessage{To: "hook@example.com", From: "a@example.org", Subject: subject, Body: "Hello"}
+		if err := db.Create(&msg).Error; err != nil {
+			t.Fatalf("failed to store message: %v", err)
+		}
+	}
+
+	// Messages that can't be settled stay due, the drain leaves them to the next poll instead of spinning
+	failUpdates := func(tx *gorm.DB) { tx.AddError(errors.New("database is locked")) }
+	if err := db.Callback().Update().Before("gorm:update").Register("test:fail", failUpdates); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		poller.drain(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the drain to stop on errors")
+	}
+	if client.requests != 1 {
+		t.Errorf("expected a single batch to be attempted, got %d requests", client.requests)
+	}
+}
+
+func TestNewSMTPMessagePoller_DefaultPollInterval(t *testing.T) {
+	poller := NewSMTPMessagePoller(PollerDependencies{Logger: &mockLogger{}})
+	if poller.pollInterval != defaultPollInterval {
+		t.Errorf("expected the default poll interval, got %v", poller.pollInterval)
+	}
+}
+
+func TestSMTPMessagePoller_ReplayOfRemovedMessage(t *testing.T) {
+	db := newTestDB(t)
+	poller := newTestPoller(t, db, &sequenceHTTPClient{statuses: []int{200}})
+
+	dead := models.Delivery{JobID: 1, SMTPMessageID: 42, Status: models.DeliveryStatusReplaying}
+	if err := db.Create(&dead).Error; err != nil {
+		t.Fatalf("failed to store delivery: %v", err)
+	}
+
+	poller.drain(context.Background())
+
+	got := deliveries(t, db)
+	if got[0].Status != models.DeliveryStatusDead || !strings.HasPrefix(got[0].Detail, "replay: ") {
+		t.Errorf("expected the delivery back in the dead letters with the reason, got %+v", got[0])
+	}
+}
+
+// answerHTTPClient answers requests with the given JSON bodies in turn
+type answerHTTPClient struct {
+	bodies   []string
+	requests int
+}
+
+func (c *answerHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	body := c.bodies[min(c.requests, len(c.bodies)-1)]
+	c.requests++
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}, nil
+}
+
+func TestSMTPMessagePoller_NoAutoReplyOnFailure(t *testing.T) {
+	db := newTestDB(t)
+	client := &sequenceHTTPClient{statuses: []int{503, 503, 200}}
+	poller := newTestPoller(t, db, client)
+	poller.processor.jobRepo.(*mockJobRepository).jobs["hook@example.com"][0].Response = "Thanks!"
+
+	replies := 0
+	replier := NewEmailReplier("localhost", 25, "", "", "noreply@example.com", &mockLogger{})
+	replier.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		replies++
+		return nil
+	}
+	poller.emailReplier = replier
+
+	msg := models.SMTPMessage{To: "hook@example.com", From: "alice@example.org", Subject: "Hi", Body: "Hello"}
+	if err := db.Create(&msg).Error; err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		poller.drain(context.Background())
+		if i < 2 && replies != 0 {
+			t.Fatalf("expected no auto-reply after failed attempt %d, got %d", i+1, replies)
+		}
+	}
+
+	if client.requests != 3 || replies != 1 {
+		t.Errorf("expected a single auto-reply once delivered, got %d after %d requests", replies, client.requests)
+	}
+}
+
+func TestSMTPMessagePoller_ResponseActions(t *testing.T) {
+	db := newTestDB(t)
+	client := &answerHTTPClient{bodies: []string{
+		`{"id": 1}`,
+		`{"reply": {"body": "Ticket #42 was opened"}}`,
+		`{"suppress_reply": true, "forward_to": "support@example.com"}`,
+	}}
+	poller := newTestPoller(t, db, client)
+	poller.processor.jobRepo.(*mockJobRepository).jobs["hook@example.com"][0].Response = "Thanks!"
+
+	type mail struct {
+		to  []string
+		msg string
+	}
+	var replies, forwards []mail
+	replier := NewEmailReplier("localhost", 25, "", "", "noreply@example.com", &mockLogger{})
+	replier.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		replies = append(replies, mail{to, string(msg)})
+		return nil
+	}
+	poller.emailReplier = replier
+	forwarder := NewEmailForwarder("localhost", 25, "", "", "", nil, &mockLogger{})
+	forwarder.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		forwards = append(forwards, mail{to, string(msg)})
+		return nil
+	}
+	poller.dispatcher.Register(models.DestinationTypeEmail, forwarder)
+
+	for _, subject := range []string{"Hi", "Help", "Spam"} {
+		msg := models.SMTPMessage{To: "hook@example.com", From: "alice@example.org", Subject: subject, Body: "Hello"}
+		if err := db.Create(&msg).Error; err != nil {
+			t.Fatalf("failed to store message: %v", err)
+		}
+		poller.drain(context.Background())
+	}
+
+	// An answer without an action gets the job's auto-reply, a reply in the answer replaces it
+	if len(replies) != 2 {
+		t.Fatalf("expected 2 replies, got %+v", replies)
+	}
+	if !strings.Contains(replies[0].msg, "Subject: Re: Hi\r\n") || !strings.HasSuffix(replies[0].msg, "Thanks!") {
+		t.Errorf("expected the auto-reply, got %q", replies[0].msg)
+	}
+	if !strings.Contains(replies[1].msg, "Subject: Re: Help\r\n") || !strings.HasSuffix(replies[1].msg, "Ticket #42 was opened") {
+		t.Errorf("expected the answered reply, got %q", replies[1].msg)
+	}
+
+	// The last answer forwards the message instead of replying
+	if len(forwards) != 1 || forwards[0].to[0] != "support@example.com" || !strings.Contains(forwards[0].msg, "Subject: Spam") {
+		t.Errorf("expected the message to be forwarded, got %+v", forwards)
+	}
+	got := deliveries(t, db)
+	if last := got[len(got)-1]; last.Status != models.DeliveryStatusForwarded || last.Detail != "forwarded to support@example.com" {
+		t.Errorf("expected the forward in the delivery log, got %+v", last)
+	}
+
+	// Forwards that fail are recorded too, without failing the message
+	forwarder.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		return errors.New("connection refused")
+	}
+	msg := models.SMTPMessage{To: "hook@example.com", From: "alice@example.org", Subject: "Spam", Body: "Hello"}
+	if err := db.Create(&msg).Error; err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+	poller.drain(context.Background())
+	got = deliveries(t, db)
+	if last := got[len(got)-1]; last.Status != models.DeliveryStatusForwardFailed || !strings.Contains(last.Detail, "connection refused") {
+		t.Errorf("expected the failed forward in the delivery log, got %+v", last)
+	}
+	if stored := message(t, db, msg.ID); stored.Status != models.MessageStatusDelivered {
+		t.Errorf("expected the message to stay delivered, got %s", stored.Status)
+	}
+}
@@ -0,0 +1,247 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+// presetDestination formats messages natively for a chat or push service and sends them over HTTP
+type presetDestination struct {
+	sender *WebhookSender
+	build  func(ctx context.Context, result ProcessResult) (*http.Request, error)
+}
+
+func (d *presetDestination) Deliver(ctx context.Context, result ProcessResult) WebhookResult {
+	return d.sender.send(ctx, result, d.build)
+}
+
+// presets builds the request of every chat and push destination type
+var presets = map[string]func(ctx context.Context, result ProcessResult) (*http.Request, error){
+	models.DestinationTypeSlack:    slackRequest,
+	models.DestinationTypeDiscord:  discordRequest,
+	models.DestinationTypeTeams:    teamsRequest,
+	models.DestinationTypeMatrix:   matrixRequest,
+	models.DestinationTypeTelegram: telegramRequest,
+	models.DestinationTypeNtfy:     ntfyRequest,
+}
+
+// notification is what chat and push services show of an email
+type notification struct {
+	Title      string
+	From       string
+	Text       string
+	ReceivedAt time.Time
+}
+
+// newNotification summarizes the message of a result, a rendered payload template replaces the email text
+func newNotification(result ProcessResult) notification {
+	n := notification{Title: "(no subject)", Text: result.Payload}
+
+	if tc := result.Message; tc != nil {
+		if tc.Subject != "" {
+			n.Title = tc.Subject
+		}
+		n.From = tc.FromAddress
+		if tc.FromName != "" {
+			n.From = fmt.Sprintf("%s <%s>", tc.FromName, tc.FromAddress)
+		}
+		if n.Text == "" {
+			n.Text = strings.TrimSpace(tc.Text)
+		}
+		n.ReceivedAt = tc.ReceivedAt
+	}
+
+	return n
+}
+
+// truncate shortens s to at most max runes
+func truncate(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max-1]) + "…"
+}
+
+func jsonRequest(ctx context.Context, method, url string, body any) (*http.Request, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return req, nil
+}
+
+// slackEscaper escapes the characters Slack treats as control sequences in mrkdwn
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slackRequest posts Block Kit blocks to a Slack incoming webhook
+func slackRequest(ctx context.Context, result ProcessResult) (*http.Request, error) {
+	n := newNotification(result)
+
+	blocks := []map[string]any{
+		{"type": "header", "text": map[string]any{"type": "plain_text", "text": truncate(n.Title, 150)}},
+		{"type": "context", "elements": []map[string]any{{"type": "mrkdwn", "text": "From " + slackEscaper.Replace(n.From)}}},
+	}
+	if n.Text != "" {
+		blocks = append(blocks, map[string]any{
+			"type": "section",
+			"text": map[string]any{"type": "mrkdwn", "text": slackEscaper.Replace(truncate(n.Text, 2900))},
+		})
+	}
+
+	return jsonRequest(ctx, http.MethodPost, result.URL, map[string]any{
+		"text":   fmt.Sprintf("%s (from %s)", n.Title, n.From),
+		"blocks": blocks,
+	})
+}
+
+// discordRequest posts an embed to a Discord webhook
+func discordRequest(ctx context.Context, result ProcessResult) (*http.Request, error) {
+	n := newNotification(result)
+
+	embed := map[string]any{
+		"title":       truncate(n.Title, 256),
+		"description": truncate(n.Text, 4096),
+		"author":      map[string]any{"name": truncate(n.From, 256)},
+	}
+	if !n.ReceivedAt.IsZero() {
+		embed["timestamp"] = n.ReceivedAt.UTC().Format(time.RFC3339)
+	}
+
+	return jsonRequest(ctx, http.MethodPost, result.URL, map[string]any{
+		"embeds": []map[string]any{embed},
+	})
+}
+
+// teamsRequest posts an Adaptive Card to a Microsoft Teams incoming webhook or workflow
+func teamsRequest(ctx context.Context, result ProcessResult) (*http.Request, error) {
+	n := newNotification(result)
+
+	body := []map[string]any{
+		{"type": "TextBlock", "text": n.Title, "weight": "Bolder", "size": "Medium", "wrap": true},
+		{"type": "TextBlock", "text": "From " + n.From, "isSubtle": true, "spacing": "None", "wrap": true},
+	}
+	if n.Text != "" {
+		body = append(body, map[string]any{"type": "TextBlock", "text": truncate(n.Text, 20000), "wrap": true})
+	}
+
+	return jsonRequest(ctx, http.MethodPost, result.URL, map[string]any{
+		"type": "message",
+		"attachments": []map[string]any{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": map[string]any{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.4",
+				"body":    body,
+			},
+		}},
+	})
+}
+
+// matrixRequest sends an m.text event to a Matrix room through the client-server API
+func matrixRequest(ctx context.Context, result ProcessResult) (*http.Request, error) {
+	n := newNotification(result)
+
+	// The transaction ID lets the homeserver drop duplicates of the same delivery
+	txnID := fmt.Sprintf("gossiper-%d-%d-%d", result.JobID, result.DestinationID, n.ReceivedAt.UnixNano())
+	if result.Message != nil && result.Message.SMTPID != 0 {
+		txnID = fmt.Sprintf("gossiper-%d-%d-%d", result.JobID, result.DestinationID, result.Message.SMTPID)
+	}
+
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		strings.TrimRight(result.URL, "/"), url.PathEscape(result.Options["room"]), url.PathEscape(txnID))
+
+	req, err := jsonRequest(ctx, http.MethodPut, endpoint, map[string]any{
+		"msgtype": "m.text",
+		"body":    fmt.Sprintf("%s\nFrom %s\n\n%s", n.Title, n.From, n.Text),
+		"format":  "org.matrix.custom.html",
+		"formatted_body": fmt.Sprintf("<strong>%s</strong><br><em>From %s</em><br><br>%s",
+			html.EscapeString(n.Title), html.EscapeString(n.From),
+			strings.ReplaceAll(html.EscapeString(n.Text), "\n", "<br>")),
+	})
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+result.Token)
+
+	return req, nil
+}
+
+// telegramRequest sends a message through the Telegram Bot API, the URL optionally overrides the API server
+func telegramRequest(ctx context.Context, result ProcessResult) (*http.Request, error) {
+	n := newNotification(result)
+
+	base := "https://api.telegram.org"
+	if result.URL != "" {
+		base = strings.TrimRight(result.URL, "/")
+	}
+	// The token goes in the URL, which errors about it quote, so it is only added to a valid one
+	if _, err := url.Parse(base); err != nil {
+		return nil, fmt.Errorf("invalid Telegram API URL: %w", err)
+	}
+
+	// Truncated before escaping so no entity is cut, leaving room for the markup within the 4096 limit
+	text := fmt.Sprintf("<b>%s</b>\n<i>From %s</i>\n\n%s",
+		html.EscapeString(truncate(n.Title, 200)), html.EscapeString(n.From), html.EscapeString(truncate(n.Text, 3000)))
+
+	return jsonRequest(ctx, http.MethodPost, base+"/bot"+result.Token+"/sendMessage", map[string]any{
+		"chat_id":    result.Options["chat_id"],
+		"text":       text,
+		"parse_mode": "HTML",
+	})
+}
+
+// redactToken keeps a token that is part of the request URL, like Telegram's, out of the error of a request
+func redactToken(err error, token string) error {
+	var urlErr *url.Error
+	if token == "" || !errors.As(err, &urlErr) || !strings.Contains(urlErr.URL, token) {
+		return err
+	}
+	return &url.Error{Op: urlErr.Op, URL: strings.ReplaceAll(urlErr.URL, token, "REDACTED"), Err: urlErr.Err}
+}
+
+// ntfyRequest publishes to an ntfy topic URL, the token is only needed for protected topics
+func ntfyRequest(ctx context.Context, result ProcessResult) (*http.Request, error) {
+	n := newNotification(result)
+
+	text := n.Text
+	if text == "" {
+		text = "From " + n.From
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, result.URL, strings.NewReader(truncate(text, 4096)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	if req.URL.Path == "" || req.URL.Path == "/" {
+		return nil, errors.New("the ntfy URL must include the topic")
+	}
+
+	// Headers must be ASCII, ntfy decodes RFC 2047 encoded words
+	req.Header.Set("Title", mime.QEncoding.Encode("utf-8", n.Title))
+	req.Header.Set("Tags", "envelope")
+	if result.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+result.Token)
+	}
+
+	return req, nil
+}
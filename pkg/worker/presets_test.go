@@ -0,0 +1,298 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/secrets"
+)
+
+func presetResult(destType string) ProcessResult {
+	return ProcessResult{
+		JobID:         1,
+		DestinationID: 2,
+		Type:          destType,
+		Message: &TemplateContext{
+			Message:     Message{Subject: "Invoice <42>"},
+			FromName:    "René",
+			FromAddress: "rene@example.org",
+			Text:        "Total: 10€ & more",
+			SMTPID:      7,
+			ReceivedAt:  time.Date(2026, 1, 6, 20, 0, 0, 0, time.UTC),
+		},
+	}
+}
+
+// decodeBody reads the JSON body of a request into a generic map
+func decodeBody(t *testing.T, req *http.Request) map[string]any {
+	t.Helper()
+	var body map[string]any
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	return body
+}
+
+func TestPresets(t *testing.T) {
+	t.Run("slack", func(t *testing.T) {
+		result := presetResult(models.DestinationTypeSlack)
+		result.URL = "https://hooks.slack.com/services/T/B/X"
+
+		req, err := slackRequest(context.Background(), result)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if req.Method != http.MethodPost || req.URL.String() != result.URL {
+			t.Errorf("unexpected request: %s %s", req.Method, req.URL)
+		}
+		body := decodeBody(t, req)
+		blocks := body["blocks"].([]any)
+		if len(blocks) != 3 {
+			t.Fatalf("expected header, context and section blocks, got %v", blocks)
+		}
+		section := blocks[2].(map[string]any)["text"].(map[string]any)["text"]
+		if section != "Total: 10€ &amp; more" {
+			t.Errorf("expected the text to be escaped for mrkdwn, got %q", section)
+		}
+	})
+
+	t.Run("discord", func(t *testing.T) {
+		result := presetResult(models.DestinationTypeDiscord)
+		result.URL = "https://discord.com/api/webhooks/1/x"
+
+		req, err := discordRequest(context.Background(), result)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		embed := decodeBody(t, req)["embeds"].([]any)[0].(map[string]any)
+		if embed["title"] != "Invoice <42>" || embed["description"] != "Total: 10€ & more" {
+			t.Errorf("unexpected embed: %v", embed)
+		}
+		if embed["timestamp"] != "2026-01-06T20:00:00Z" {
+			t.Errorf("unexpected timestamp: %v", embed["timestamp"])
+		}
+	})
+
+	t.Run("teams", func(t *testing.T) {
+		result := presetResult(models.DestinationTypeTeams)
+		result.URL = "https://example.webhook.office.com/x"
+
+		req, err := teamsRequest(context.Background(), result)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		attachment := decodeBody(t, req)["attachments"].([]any)[0].(map[string]any)
+		if attachment["contentType"] != "application/vnd.microsoft.card.adaptive" {
+			t.Errorf("unexpected attachment: %v", attachment)
+		}
+	})
+
+	t.Run("matrix", func(t *testing.T) {
+		result := presetResult(models.DestinationTypeMatrix)
+		result.URL = "https://matrix.example.org/"
+		result.Token = "syt_secret"
+		result.Options = map[string]string{"room": "!room:example.org"}
+
+		req, err := matrixRequest(context.Background(), result)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if req.Method != http.MethodPut {
+			t.Errorf("expected PUT, got %s", req.Method)
+		}
+		expected := "/_matrix/client/v3/rooms/%21room:example.org/send/m.room.message/gossiper-1-2-7"
+		if req.URL.EscapedPath() != expected {
+			t.Errorf("expected path %s, got %s", expected, req.URL.EscapedPath())
+		}
+		if req.Header.Get("Authorization") != "Bearer syt_secret" {
+			t.Errorf("unexpected authorization: %q", req.Header.Get("Authorization"))
+		}
+		body := decodeBody(t, req)
+		if !strings.Contains(body["formatted_body"].(string), "Invoice &lt;42&gt;") {
+			t.Errorf("expected the HTML body to be escaped, got %q", body["formatted_body"])
+		}
+	})
+
+	t.Run("telegram", func(t *testing.T) {
+		result := presetResult(models.DestinationTypeTelegram)
+		result.Token = "123:abc"
+		result.Options = map[string]string{"chat_id": "-100"}
+
+		req, err := telegramRequest(context.Background(), result)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if req.URL.String() != "https://api.telegram.org/bot123:abc/sendMessage" {
+			t.Errorf("unexpected URL: %s", req.URL)
+		}
+		body := decodeBody(t, req)
+		if body["chat_id"] != "-100" || body["parse_mode"] != "HTML" {
+			t.Errorf("unexpected body: %v", body)
+		}
+		if !strings.HasPrefix(body["text"].(string), "<b>Invoice &lt;42&gt;</b>") {
+			t.Errorf("unexpected text: %q", body["text"])
+		}
+	})
+
+	t.Run("ntfy", func(t *testing.T) {
+		result := presetResult(models.DestinationTypeNtfy)
+		result.URL = "https://ntfy.sh/alerts"
+		result.Payload = "Custom text"
+
+		req, err := ntfyRequest(context.Background(), result)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		body, _ := io.ReadAll(req.Body)
+		if string(body) != "Custom text" {
+			t.Errorf("expected the rendered template to replace the text, got %q", body)
+		}
+		if req.Header.Get("Title") != "Invoice <42>" {
+			t.Errorf("unexpected title: %q", req.Header.Get("Title"))
+		}
+		if req.Header.Get("Authorization") != "" {
+			t.Errorf("expected no authorization without a token")
+		}
+
+		result.URL = "https://ntfy.sh"
+		if _, err := ntfyRequest(context.Background(), result); err == nil {
+			t.Errorf("expected a URL without topic to be rejected")
+		}
+	})
+}
+
+func TestPresets_TelegramTokenRedacted(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	sender := NewWebhookSender(&http.Client{}, &mockLogger{}, Config{})
+	result := presetResult(models.DestinationTypeTelegram)
+	result.URL, result.Token = server.URL, "123:secret-token"
+	result.Options = map[string]string{"chat_id": "-100"}
+
+	delivered := (&presetDestination{sender: sender, build: telegramRequest}).Deliver(context.Background(), result)
+	var urlErr *url.Error
+	if !errors.As(delivered.Error, &urlErr) {
+		t.Fatalf("expected the request to fail, got %v", delivered.Error)
+	}
+	if strings.Contains(delivered.Error.Error(), "secret-token") {
+		t.Errorf("expected the token to be redacted, got %v", delivered.Error)
+	}
+
+	result.URL = "http://[::1"
+	if _, err := telegramRequest(context.Background(), result); err == nil || strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("expected an invalid API URL to be rejected without the token, got %v", err)
+	}
+}
+
+func TestValidateDestinationSettings(t *testing.T) {
+	tests := []struct {
+		dest  models.Destination
+		field string
+	}{
+		{dest: models.Destination{Type: models.DestinationTypeHTTP, URL: "https://example.com/hook"}},
+		{dest: models.Destination{Type: models.DestinationTypeHTTP}, field: "URL"},
+		{dest: models.Destination{Type: models.DestinationTypeDiscord, URL: "ftp://example.com"}, field: "URL"},
+		{dest: models.Destination{Type: models.DestinationTypeSlack}, field: "URL"},
+		{dest: models.Destination{Type: models.DestinationTypeMatrix, URL: "https://matrix.org"}, field: "Token"},
+		{dest: models.Destination{Type: models.DestinationTypeMatrix, URL: "https://matrix.org", Token: "t"}, field: "Options"},
+		{dest: models.Destination{Type: models.DestinationTypeTelegram, Token: "t", Options: map[string]string{"chat_id": "1"}}},
+		{dest: models.Destination{Type: models.DestinationTypeEmail}, field: "Options"},
+		{dest: models.Destination{Type: models.DestinationTypeEmail, Options: map[string]string{"to": "not an address"}}, field: "Options"},
+		{dest: models.Destination{Type: models.DestinationTypeEmail, Options: map[string]string{"to": "a@example.com, b@example.com"}}},
+		{dest: models.Destination{Type: models.DestinationTypeNATS, URL: "https://example.com", Options: map[string]string{"subject": "a"}}, field: "URL"},
+		{dest: models.Destination{Type: models.DestinationTypeNATS, URL: "nats://localhost:4222"}, field: "Options"},
+		{dest: models.Destination{Type: models.DestinationTypeAMQP, URL: "amqp://localhost", Options: map[string]string{"routing_key": "mail"}}},
+		{dest: models.Destination{Type: models.DestinationTypeRedis, URL: "redis://localhost", Options: map[string]string{"stream": "s", "maxlen": "many"}}, field: "Options"},
+		{dest: models.Destination{Type: models.DestinationTypePull, Token: "short"}, field: "Token"},
+		{dest: models.Destination{Type: models.DestinationTypePull, Token: "0123456789abcdef"}},
+		{dest: models.Destination{Type: "pager"}, field: "Type"},
+	}
+
+	for _, tt := range tests {
+		err := validateDestinationSettings(tt.dest)
+
+		var jobErr *JobError
+		switch {
+		case tt.field == "" && err != nil:
+			t.Errorf("%+v: unexpected error: %v", tt.dest, err)
+		case tt.field != "" && (!errors.As(err, &jobErr) || jobErr.Field != tt.field):
+			t.Errorf("%+v: expected a %s error, got %v", tt.dest, tt.field, err)
+		}
+	}
+}
+
+func TestDispatcher_Deliver(t *testing.T) {
+	mockClient := &mockHTTPClient{
+		responses: map[string]*http.Response{
+			"https://ntfy.sh/alerts":  {StatusCode: 200, Body: io.NopCloser(strings.NewReader("ok"))},
+			"http://example.com/hook": {StatusCode: 202, Body: io.NopCloser(strings.NewReader("ok"))},
+		},
+	}
+	dispatcher := NewDispatcher(NewWebhookSender(mockClient, &mockLogger{}, Config{}), &mockLogger{})
+
+	ntfy := presetResult(models.DestinationTypeNtfy)
+	ntfy.URL = "https://ntfy.sh/alerts"
+	results := dispatcher.DeliverAll(context.Background(), []ProcessResult{
+		ntfy,
+		{JobID: 3, URL: "http://example.com/hook", Method: "POST", Payload: "{}"},
+		{JobID: 4, Type: "pager", URL: "http://example.com/pager"},
+	})
+
+	if results[0].StatusCode != 200 || results[0].DestinationID != 2 {
+		t.Errorf("unexpected ntfy result: %+v", results[0])
+	}
+	if results[1].StatusCode != 202 {
+		t.Errorf("expected results without a type to use the HTTP destination, got %+v", results[1])
+	}
+	if results[2].Error == nil {
+		t.Errorf("expected an unknown type to fail")
+	}
+	if len(mockClient.requests) != 2 {
+		t.Errorf("expected 2 requests, got %d", len(mockClient.requests))
+	}
+}
+
+func TestDispatcher_SealedToken(t *testing.T) {
+	box, err := secrets.New("app-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := box.Seal("ntfy-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockClient := &mockHTTPClient{}
+	dispatcher := NewDispatcher(NewWebhookSender(mockClient, &mockLogger{}, Config{}), &mockLogger{})
+	dispatcher.SetSecrets(box)
+
+	ntfy := presetResult(models.DestinationTypeNtfy)
+	ntfy.URL, ntfy.Token = "https://ntfy.sh/alerts", sealed
+	if result := dispatcher.Deliver(context.Background(), ntfy); result.Error != nil {
+		t.Fatalf("unexpected error: %v", result.Error)
+	}
+	if auth := mockClient.requests[0].Header.Get("Authorization"); auth != "Bearer ntfy-token" {
+		t.Errorf("expected the token to be opened, got %q", auth)
+	}
+
+	ntfy.Token = sealed[:len(sealed)-4]
+	if result := dispatcher.Deliver(context.Background(), ntfy); result.Error == nil || len(mockClient.requests) != 1 {
+		t.Errorf("expected a token that doesn't open to fail the delivery, got %+v", result)
+	}
+}
@@ -1,12 +1,12 @@
 package worker
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"html/template"
-	"regexp"
+	"strings"
 
 	"gitea.v3m.net/idriss/gossiper/pkg/models"
 )
@@ -17,6 +17,7 @@ type MessageProcessor struct {
 	fetcher            MessageFetcherInterface
 	allowedHostname    string
 	allowedHostnameFull string // Precomputed "@hostname" for efficiency
+	compiled           compileCache
 }
 
 func NewMessageProcessor(jobRepo JobRepository, logger Logger, fetcher MessageFetcherInterface, allowedHostname string) *MessageProcessor {
@@ -30,13 +31,22 @@ func NewMessageProcessor(jobRepo JobRepository, logger Logger, fetcher MessageFe
 }
 
 type ProcessResult struct {
-	JobID    int
-	URL      string
-	Method   string
-	Headers  map[string]string
-	Payload  string
-	Response string // Auto-reply message to send back to sender
-	Error    error
+	JobID          int
+	DestinationID  int    // Zero for the job's own URL
+	Destination    string // Destination name, for logs
+	Type           string // Destination type, delivered by the Dispatcher
+	URL            string
+	Method         string
+	Headers        map[string]string
+	Payload        string
+	Token          string
+	Options        map[string]string
+	IdempotencyKey string           // Same for every attempt at the message and destination, sent by generic HTTP destinations
+	Message        *TemplateContext // The message, for destinations that format it themselves
+	Job            *models.Job      // The job the message was processed for, its policies and auto-reply apply to the delivery
+	Collected      bool             // Set when the job collects the message in its digest, there is nothing to deliver yet
+	Rejected       string           // Why the job's rules turned the message down, such results have nothing to deliver
+	Error          error
 }
 
 func (p *MessageProcessor) ParseRawMessage(rawMsg RawMessage) []Message {
@@ -106,70 +116,196 @@ func (p *MessageProcessor) ProcessMessage(ctx context.Context, msg Message) ([]P
 	if err != nil {
 		return nil, fmt.Errorf("failed to get active jobs: %w", err)
 	}
+	p.compiled.prune(msg.To, jobs)
 
 	var results []ProcessResult
+	tc := newTemplateContext(msg, p.logger)
 
 	for _, job := range jobs {
+		results = append(results, p.processJob(ctx, job, msg, tc)...)
+	}
+
+	return results, nil
+}
+
+// ReprocessMessage processes a message again for a single job, with its current configuration.
+// Only the results of the destination are kept, unless it no longer exists and was the job's own URL.
+func (p *MessageProcessor) ReprocessMessage(ctx context.Context, msg Message, jobID, destinationID int) ([]ProcessResult, error) {
+	jobs, err := p.jobRepo.GetActiveJobs(ctx, msg.To)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get active jobs: %w", err)
+	}
+
+	for _, job := range jobs {
+		if job.ID != jobID {
+			continue
+		}
+
+		results := p.processJob(ctx, job, msg, newTemplateContext(msg, p.logger))
+
+		var kept []ProcessResult
+		for _, result := range results {
+			// Rejections by the job's own rules hold for every destination
+			if result.DestinationID == destinationID || result.Rejected != "" && result.DestinationID == 0 {
+				kept = append(kept, result)
+			}
+		}
+		if kept == nil && destinationID == 0 {
+			return results, nil
+		}
+		return kept, nil
+	}
+
+	return nil, nil
+}
+
+// processJob applies a job's rules to a message and renders it for each destination it is routed to
+func (p *MessageProcessor) processJob(ctx context.Context, job *models.Job, msg Message, tc *TemplateContext) []ProcessResult {
+	compiled, err := p.compiled.get(job)
+	if err != nil {
+		return []ProcessResult{{
+			JobID:  job.ID,
+			URL:    job.URL,
+			Method: job.Method,
+			Job:    job,
+			Error:  err,
+		}}
+	}
+
+	if !compiled.fromRegex.MatchString(msg.From) {
+		return []ProcessResult{p.reject(job, 0, msg, fmt.Sprintf("from_regex %q", job.FromRegex))}
+	}
+
+	jobCtx := tc.forJob(job)
+	if compiled.match != nil {
+		if ok, reason := compiled.match.eval(jobCtx); !ok {
+			return []ProcessResult{p.reject(job, 0, msg, reason)}
+		}
+	}
+
+	vars, missing := extractVars(compiled.extractors, jobCtx)
+	if missing != "" {
+		return []ProcessResult{p.reject(job, 0, msg, fmt.Sprintf("required variable %q not found", missing))}
+	}
+	jobCtx.Vars = vars
+
+	if job.Digest != nil {
+		// The message waits in the job's digest, it is delivered with the others once the digest closes
+		return []ProcessResult{{JobID: job.ID, Destination: "digest", Job: job, Collected: true, Message: jobCtx}}
+	}
+
+	// Fan out to every destination the message is routed to
+	var results []ProcessResult
+	for i := range compiled.destinations {
+		dest := &compiled.destinations[i]
+		if dest.match != nil {
+			if ok, reason := dest.match.eval(jobCtx); !ok {
+				results = append(results, p.reject(job, dest.ID, msg, fmt.Sprintf("destination %s: %s", dest.Name, reason)))
+				continue
+			}
+		}
+
 		result := ProcessResult{
-			JobID:    job.ID,
-			URL:      job.URL,
-			Method:   job.Method,
-			Headers:  job.Headers,
-			Response: job.Response,
+			JobID:         job.ID,
+			DestinationID: dest.ID,
+			Destination:   dest.Name,
+			Type:          dest.Type,
+			URL:           dest.URL,
+			Method:        dest.Method,
+			Headers:       dest.Headers,
+			Token:         dest.Token,
+			Options:       dest.Options,
+			Message:       jobCtx,
+			Job:           job,
 		}
 
-		if !p.matchesFromRegex(job.FromRegex, msg.From) {
-			continue
+		if (dest.Type == "" || dest.Type == models.DestinationTypeHTTP) && msg.ID != 0 {
+			// Messages that weren't stored have no identity to build a key from
+			result.IdempotencyKey = idempotencyKey(msg.ID, job.ID, dest.ID)
 		}
 
-		payload, err := p.generatePayload(job, msg)
-		if err != nil {
-			result.Error = fmt.Errorf("failed to generate payload: %w", err)
+		if err := p.renderRequest(&result, dest, jobCtx); err != nil {
+			result.Error = err
 			results = append(results, result)
 			continue
 		}
 
+		payload, err := p.renderPayload(dest, jobCtx)
+		if err == nil {
+			payload, result.Headers, err = encodePayload(dest.format, jobCtx, payload, result.Headers)
+		}
+		if err != nil {
+			result.Error = fmt.Errorf("failed to generate payload: %w", err)
+		}
 		result.Payload = payload
 		results = append(results, result)
 	}
 
-	return results, nil
+	return results
 }
 
-func (p *MessageProcessor) matchesFromRegex(pattern, from string) bool {
-	matched, err := regexp.MatchString(pattern, from)
-	if err != nil {
-		p.logger.Printf("invalid from_regex pattern '%s': %v", pattern, err)
-		return false
+// reject builds the result of a job's rules turning a message down, it is up to the caller to record it
+func (p *MessageProcessor) reject(job *models.Job, destinationID int, msg Message, reason string) ProcessResult {
+	p.logger.Printf("job %d rejected message %d: %s", job.ID, msg.ID, reason)
+	return ProcessResult{JobID: job.ID, DestinationID: destinationID, Job: job, Rejected: reason}
+}
+
+// splitRejections separates the results with something to deliver from the rejections
+func splitRejections(results []ProcessResult) (accepted, rejected []ProcessResult) {
+	for _, result := range results {
+		if result.Rejected != "" {
+			rejected = append(rejected, result)
+		} else {
+			accepted = append(accepted, result)
+		}
 	}
-	return matched
+	return accepted, rejected
 }
 
-func (p *MessageProcessor) generatePayload(job *models.Job, msg Message) (string, error) {
-	if job.PayloadTemplate != "" {
-		return p.executeTemplate(job.PayloadTemplate, msg)
+// renderRequest renders the templated URL and headers of a destination into result
+func (p *MessageProcessor) renderRequest(result *ProcessResult, dest *compiledDestination, data any) error {
+	if dest.url != nil {
+		rendered, err := renderURL(dest.url, dest.URL, data)
+		if err != nil {
+			return fmt.Errorf("failed to generate URL: %w", err)
+		}
+		result.URL = rendered
 	}
 
-	jsonBytes, err := json.Marshal(msg)
+	headers, err := renderHeaders(dest.Headers, dest.headers, data)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal message to JSON: %w", err)
+		return fmt.Errorf("failed to generate headers: %w", err)
 	}
+	result.Headers = headers
+	return nil
+}
 
-	return string(jsonBytes), nil
+// idempotencyKey identifies the delivery of a stored message or digest to a destination, so receivers
+// can drop the duplicates retries and replays send
+func idempotencyKey(parts ...any) string {
+	key := make([]string, len(parts))
+	for i, part := range parts {
+		key[i] = fmt.Sprint(part)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(key, "/")))
+	return hex.EncodeToString(sum[:16])
 }
 
-func (p *MessageProcessor) executeTemplate(templateStr string, msg Message) (string, error) {
-	tmpl, err := template.New("payload").Parse(templateStr)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse template: %w", err)
+// renderPayload renders the destination's payload template, or the message as JSON when it has none.
+// Chat and push destinations format the message themselves, unless given a template.
+func (p *MessageProcessor) renderPayload(dest *compiledDestination, tc *TemplateContext) (string, error) {
+	if dest.payload != nil {
+		return renderPayload(dest.payload, tc, headerValue(dest.Headers, "Content-Type"))
+	}
+	if _, ok := presets[dest.Type]; ok || dest.Type == models.DestinationTypeEmail {
+		return "", nil
 	}
 
-	var buf bytes.Buffer
-	err = tmpl.Execute(&buf, msg)
+	jsonBytes, err := json.Marshal(tc.Message)
 	if err != nil {
-		return "", fmt.Errorf("failed to execute template: %w", err)
+		return "", fmt.Errorf("failed to marshal message to JSON: %w", err)
 	}
 
-	return buf.String(), nil
+	return string(jsonBytes), nil
 }
 
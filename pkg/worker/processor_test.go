@@ -339,6 +339,8 @@ func TestMessageProcessor_ProcessMessage(t *testing.T) {
 				return
 			}
 
+			// Rejections are returned for the poller to record, they have nothing to deliver
+			results, _ = splitRejections(results)
 			if len(results) != tt.expectedResults {
 				t.Errorf("expected %d results, got %d", tt.expectedResults, len(results))
 				return
@@ -357,14 +359,25 @@ func TestMessageProcessor_ProcessMessage(t *testing.T) {
 	}
 }
 
-func TestMessageProcessor_generatePayload(t *testing.T) {
-	processor := &MessageProcessor{
-		jobRepo:         nil,
-		logger:          &mockLogger{},
-		fetcher:         nil,
-		allowedHostname: "example.com",
+// renderJob processes msg with job as the only job of its address, returning the payload of the result
+func renderJob(t *testing.T, job *models.Job, msg Message) (string, error) {
+	t.Helper()
+	if job.FromRegex == "" {
+		job.FromRegex = ".*"
 	}
+	processor := NewMessageProcessor(&mockJobRepository{jobs: map[string][]*models.Job{msg.To: {job}}}, &mockLogger{}, nil, "example.com")
 
+	results, err := processor.ProcessMessage(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected one result, got %+v", results)
+	}
+	return results[0].Payload, results[0].Error
+}
+
+func TestMessageProcessor_ProcessMessage_Payload(t *testing.T) {
 	msg := Message{
 		From:    "sender@example.com",
 		To:      "test@example.com",
@@ -380,7 +393,7 @@ func TestMessageProcessor_generatePayload(t *testing.T) {
 			Method:          method,
 		}
 
-		payload, err := processor.generatePayload(job, msg)
+		payload, err := renderJob(t, job, msg)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -399,7 +412,7 @@ func TestMessageProcessor_generatePayload(t *testing.T) {
 			Method:          method,
 		}
 
-		payload, err := processor.generatePayload(job, msg)
+		payload, err := renderJob(t, job, msg)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -418,9 +431,92 @@ func TestMessageProcessor_generatePayload(t *testing.T) {
 			Method:          method,
 		}
 
-		_, err := processor.generatePayload(job, msg)
+		_, err := renderJob(t, job, msg)
 		if err == nil {
 			t.Error("expected error for invalid template")
 		}
 	})
 }
+
+func TestMessageProcessor_ProcessMessage_Destinations(t *testing.T) {
+	repo := &mockJobRepository{
+		jobs: map[string][]*models.Job{
+			"user@example.com": {
+				{
+					ID:              1,
+					FromRegex:       ".*",
+					URL:             "https://unused.example.com",
+					Method:          "POST",
+					Headers:         map[string]string{"Content-Type": "text/plain"},
+					PayloadTemplate: "{{.Subject}}",
+					Response:        "Thanks",
+					Destinations: []models.Destination{
+						{ID: 10, Name: "accounting", URL: "https://accounting.example.com",
+							Match: &models.MatchRule{Type: models.MatchRuleSubjectRegex, Value: "(?i)invoice"}},
+						{ID: 11, Name: "alerts", URL: "https://alerts.example.com",
+							Match: &models.MatchRule{Type: models.MatchRuleSubjectRegex, Value: "(?i)alert"}},
+						{ID: 12, Name: "archive", URL: "https://archive.example.com", Method: "PUT", PayloadTemplate: "{{.From}}"},
+					},
+				},
+			},
+		},
+	}
+	processor := NewMessageProcessor(repo, &mockLogger{}, nil, "example.com")
+
+	results, err := processor.ProcessMessage(context.Background(), Message{
+		ID:      5,
+		To:      "user@example.com",
+		From:    "sender@example.org",
+		Subject: "Invoice 42",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	results, rejected := splitRejections(results)
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %+v", results)
+	}
+
+	accounting := results[0]
+	if accounting.DestinationID != 10 || accounting.URL != "https://accounting.example.com" {
+		t.Errorf("unexpected first destination: %+v", accounting)
+	}
+	if accounting.Method != "POST" || accounting.Payload != "Invoice 42" || accounting.Headers["Content-Type"] != "text/plain" {
+		t.Errorf("expected the job's method, template and headers to be inherited, got %+v", accounting)
+	}
+	if accounting.Job == nil || accounting.Job.Response != "Thanks" {
+		t.Errorf("expected the job to be carried with its auto-reply, got %+v", accounting.Job)
+	}
+
+	archive := results[1]
+	if archive.DestinationID != 12 || archive.Method != "PUT" || archive.Payload != "sender@example.org" {
+		t.Errorf("unexpected archive destination: %+v", archive)
+	}
+
+	if len(rejected) != 1 || rejected[0].DestinationID != 11 {
+		t.Fatalf("expected the alerts destination to reject the message, got %+v", rejected)
+	}
+	if rejected[0].Rejected != `destination alerts: subject_regex "(?i)alert"` {
+		t.Errorf("unexpected rejection reason: %q", rejected[0].Rejected)
+	}
+}
+
+func TestValidateJob_Destinations(t *testing.T) {
+	job := &models.Job{
+		FromRegex: ".*",
+		Destinations: []models.Destination{
+			{Name: "broken", URL: "https://example.com", PayloadTemplate: "{{.Subject"},
+		},
+	}
+
+	var jobErr *JobError
+	if err := ValidateJob(job); !errors.As(err, &jobErr) || jobErr.Field != "Destinations" {
+		t.Fatalf("expected a Destinations error, got %v", err)
+	}
+
+	err := ValidateDestination(job, models.Destination{Name: "ok", URL: "https://example.com", Match: &models.MatchRule{Type: "nope"}})
+	if !errors.As(err, &jobErr) || jobErr.Field != "Match" {
+		t.Errorf("expected a Match error, got %v", err)
+	}
+}
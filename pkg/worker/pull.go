@@ -0,0 +1,250 @@
+package worker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/notify"
+	"gorm.io/gorm"
+)
+
+// pullFallbackInterval is how often waiting receivers check the queue when wakeups are listened for,
+// in case one got lost
+const pullFallbackInterval = 10 * time.Second
+
+var (
+	// ErrPullMessageNotFound is returned when acknowledging a message that isn't queued
+	ErrPullMessageNotFound = errors.New("message not found")
+
+	// ErrPullReceiptMismatch is returned when acknowledging a message with an outdated receipt,
+	// the message became visible again and was received by another client
+	ErrPullReceiptMismatch = errors.New("receipt is no longer valid")
+)
+
+// PullQueue queues messages of pull destinations for API clients to receive and acknowledge.
+// A received message is hidden for a visibility timeout, and is received again unless acknowledged before it ends.
+type PullQueue struct {
+	db           *models.DB
+	logger       Logger
+	pollInterval time.Duration
+	now          func() time.Time
+
+	// notifier tells the receivers of other processes that messages were queued, it may be nil
+	notifier notify.Notifier
+
+	// arrived is closed, and replaced, when messages were queued, to wake every waiting receiver at once
+	mu      sync.Mutex
+	arrived chan struct{}
+}
+
+// NewPullQueue creates a queue stored in the database
+func NewPullQueue(db *models.DB, logger Logger) *PullQueue {
+	return &PullQueue{
+		db:           db,
+		logger:       logger,
+		pollInterval: time.Second,
+		now:          time.Now,
+		arrived:      make(chan struct{}),
+	}
+}
+
+// SetNotifier has the queue signal queued messages to the receivers of other processes
+func (q *PullQueue) SetNotifier(notifier notify.Notifier) {
+	q.notifier = notifier
+}
+
+// Listen wakes the waiting receivers on each wakeup, until the channel is closed or ctx is done.
+// The queue is checked on every wakeup instead of every second from then on.
+func (q *PullQueue) Listen(ctx context.Context, wakeups <-chan struct{}) {
+	q.mu.Lock()
+	q.pollInterval = pullFallbackInterval
+	q.mu.Unlock()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-wakeups:
+			if !ok {
+				return
+			}
+			q.wake()
+		}
+	}
+}
+
+// wake wakes every receiver waiting for messages
+func (q *PullQueue) wake() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	close(q.arrived)
+	q.arrived = make(chan struct{})
+}
+
+// waiting returns the channel closed on the next wakeup, and how long to wait at most without one
+func (q *PullQueue) waiting() (<-chan struct{}, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.arrived, q.pollInterval
+}
+
+// Deliver queues the rendered payload of a result
+func (q *PullQueue) Deliver(ctx context.Context, result ProcessResult) WebhookResult {
+	webhookResult := WebhookResult{
+		JobID:         result.JobID,
+		DestinationID: result.DestinationID,
+	}
+
+	if result.Error != nil {
+		webhookResult.Error = result.Error
+		q.logger.Printf("skipping queueing for job %d due to processing error: %v", result.JobID, result.Error)
+		return webhookResult
+	}
+
+	msg := &models.PullMessage{
+		JobID:         result.JobID,
+		DestinationID: result.DestinationID,
+		Payload:       result.Payload,
+		ContentType:   contentType(result),
+		VisibleAt:     q.now(),
+	}
+	if result.Message != nil {
+		msg.SMTPMessageID = result.Message.SMTPID
+	}
+
+	if err := q.db.WithContext(ctx).Create(msg).Error; err != nil {
+		webhookResult.Error = fmt.Errorf("failed to queue message: %w", err)
+		q.logger.Printf("failed to queue message for job %d: %v", result.JobID, err)
+		return webhookResult
+	}
+
+	q.logger.Printf("queued message %d for job %d", msg.ID, result.JobID)
+	q.wake()
+	if q.notifier != nil {
+		if err := q.notifier.Notify(ctx); err != nil {
+			q.logger.Printf("failed to signal queued messages: %v", err)
+		}
+	}
+	return webhookResult
+}
+
+// Receive hands out up to limit visible messages of a destination, hiding them for visibility.
+// When none are queued it waits up to wait for some to arrive.
+func (q *PullQueue) Receive(ctx context.Context, destinationID, limit int, visibility, wait time.Duration) ([]models.PullMessage, error) {
+	deadline := q.now().Add(wait)
+	for {
+		// Messages queued while claiming wake the receiver up right away
+		arrived, interval := q.waiting()
+		messages, err := q.claim(ctx, destinationID, limit, visibility)
+		if err != nil || len(messages) > 0 || !q.now().Before(deadline) {
+			return messages, err
+		}
+
+		select {
+		case <-ctx.Done():
+			// The client went away, nothing was claimed for it
+			return nil, nil
+		case <-arrived:
+		case <-time.After(min(interval, deadline.Sub(q.now()))):
+		}
+	}
+}
+
+// claim hides visible messages behind a new receipt, skipping those another receiver claimed first
+func (q *PullQueue) claim(ctx context.Context, destinationID, limit int, visibility time.Duration) ([]models.PullMessage, error) {
+	now := q.now()
+
+	var candidates []models.PullMessage
+	err := q.db.WithContext(ctx).
+		Where("destination_id = ? AND visible_at <= ?", destinationID, now).
+		Order("visible_at ASC, id ASC").
+		Limit(limit).
+		Find(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]models.PullMessage, 0, len(candidates))
+	for _, msg := range candidates {
+		receipt, err := newReceipt()
+		if err != nil {
+			return nil, err
+		}
+
+		res := q.db.WithContext(ctx).
+			Model(&models.PullMessage{}).
+			Where("id = ? AND visible_at = ?", msg.ID, msg.VisibleAt).
+			Updates(map[string]any{
+				"receipt":    receipt,
+				"receives":   gorm.Expr("receives + 1"),
+				"visible_at": now.Add(visibility),
+			})
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.RowsAffected == 0 {
+			continue
+		}
+
+		msg.Receipt = receipt
+		msg.Receives++
+		msg.VisibleAt = now.Add(visibility)
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
+// Ack removes a received message from the queue
+func (q *PullQueue) Ack(ctx context.Context, destinationID, id int, receipt string) error {
+	return q.settle(ctx, destinationID, id, receipt, func(tx *gorm.DB) *gorm.DB {
+		return tx.Delete(&models.PullMessage{})
+	})
+}
+
+// Nack makes a received message visible again after delay
+func (q *PullQueue) Nack(ctx context.Context, destinationID, id int, receipt string, delay time.Duration) error {
+	return q.settle(ctx, destinationID, id, receipt, func(tx *gorm.DB) *gorm.DB {
+		return tx.Model(&models.PullMessage{}).Update("visible_at", q.now().Add(delay))
+	})
+}
+
+// settle applies op to a message as long as receipt is the latest one and its visibility timeout hasn't ended
+func (q *PullQueue) settle(ctx context.Context, destinationID, id int, receipt string, op func(tx *gorm.DB) *gorm.DB) error {
+	res := op(q.db.WithContext(ctx).DB.
+		Where("id = ? AND destination_id = ? AND receipt = ? AND visible_at > ?", id, destinationID, receipt, q.now()))
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		return nil
+	}
+
+	var count int64
+	err := q.db.WithContext(ctx).
+		Model(&models.PullMessage{}).
+		Where("id = ? AND destination_id = ?", id, destinationID).
+		Count(&count).Error
+	switch {
+	case err != nil:
+		return err
+	case count == 0:
+		return ErrPullMessageNotFound
+	default:
+		return ErrPullReceiptMismatch
+	}
+}
+
+func newReceipt() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
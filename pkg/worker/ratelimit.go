@@ -0,0 +1,295 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+// RateLimitError is returned for deliveries held back by a rate limit, they weren't attempted
+type RateLimitError struct {
+	Scope   string // What the limit applies to, such as "job 3" or "host api.example.com"
+	Limit   int
+	Period  time.Duration
+	RetryAt time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	period := "hour"
+	if e.Period == time.Minute {
+		period = "minute"
+	}
+	return fmt.Sprintf("rate limit of %d per %s reached for %s until %s", e.Limit, period, e.Scope, e.RetryAt.Format(time.RFC3339))
+}
+
+// HostRateLimits cap the requests to each destination host, Hosts replace the Default limit for given hosts
+type HostRateLimits struct {
+	Default models.RateLimit
+	Hosts   map[string]models.RateLimit
+}
+
+// rules returns the limits of a host
+func (h HostRateLimits) rules(host string) []rateRule {
+	limit, ok := h.Hosts[host]
+	if !ok {
+		limit = h.Default
+	}
+	return rateRules("host "+host, "host:"+host, limit)
+}
+
+// rateRule limits the events of a key over a period
+type rateRule struct {
+	scope  string
+	key    string
+	limit  int
+	period time.Duration
+}
+
+// rateRules lists the rules of a rate limit, one per period it sets
+func rateRules(scope, key string, limit models.RateLimit) []rateRule {
+	var rules []rateRule
+	if limit.PerMinute > 0 {
+		rules = append(rules, rateRule{scope: scope, key: key, limit: limit.PerMinute, period: time.Minute})
+	}
+	if limit.PerHour > 0 {
+		rules = append(rules, rateRule{scope: scope, key: key, limit: limit.PerHour, period: time.Hour})
+	}
+	return rules
+}
+
+// maxRatePeriod is the longest period of the rate limits, older events are forgotten
+const maxRatePeriod = time.Hour
+
+// ratePruneInterval is how often events older than maxRatePeriod are deleted from the store
+const ratePruneInterval = time.Minute
+
+// RateStore keeps the events counted by rate limits across worker restarts
+type RateStore interface {
+	LoadRateEvents(ctx context.Context, since time.Time) ([]models.RateEvent, error)
+	SaveRateEvents(ctx context.Context, events []models.RateEvent) error
+	PruneRateEvents(ctx context.Context, before time.Time) error
+}
+
+// RateLimiter counts events, such as the deliveries of a job or the requests to a host, over sliding windows.
+// Counts are kept in memory, and saved to the store when one is set so a restarted worker picks them up.
+type RateLimiter struct {
+	mu     sync.Mutex
+	events map[string][]time.Time
+
+	store  RateStore
+	logger Logger
+	pruned time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{events: make(map[string][]time.Time)}
+}
+
+// SetStore makes the limiter save the events it counts, Load restores them
+func (l *RateLimiter) SetStore(store RateStore, logger Logger) {
+	l.store = store
+	l.logger = logger
+}
+
+// Load restores the events of the last maxRatePeriod from the store
+func (l *RateLimiter) Load(ctx context.Context, now time.Time) error {
+	if l.store == nil {
+		return nil
+	}
+
+	events, err := l.store.LoadRateEvents(ctx, now.Add(-maxRatePeriod))
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, event := range events {
+		l.events[event.Key] = append(l.events[event.Key], event.At)
+	}
+	for _, times := range l.events {
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	}
+	return nil
+}
+
+// Reserve records an event at now for every key of rules, unless one of the limits is reached.
+// It then returns a *RateLimitError telling when the limit lets events through again.
+func (l *RateLimiter) Reserve(now time.Time, rules ...rateRule) error {
+	events, prune, err := l.reserve(now, rules)
+	if err != nil {
+		return err
+	}
+
+	// The store is written without holding mu, a slow database doesn't hold up the other keys
+	l.save(events, prune, now)
+	return nil
+}
+
+// reserve counts the events of Reserve, returning them and whether the store is due for pruning
+func (l *RateLimiter) reserve(now time.Time, rules []rateRule) ([]models.RateEvent, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, rule := range rules {
+		events := l.recent(rule.key, now, rule.period)
+		if len(events) >= rule.limit {
+			// A slot frees up when the oldest event of the last ones allowed leaves the period
+			return nil, false, &RateLimitError{
+				Scope:   rule.scope,
+				Limit:   rule.limit,
+				Period:  rule.period,
+				RetryAt: events[len(events)-rule.limit].Add(rule.period),
+			}
+		}
+	}
+
+	var recorded []models.RateEvent
+	seen := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if !seen[rule.key] {
+			seen[rule.key] = true
+			l.events[rule.key] = append(l.events[rule.key], now)
+			recorded = append(recorded, models.RateEvent{Key: rule.key, At: now})
+		}
+	}
+
+	prune := now.Sub(l.pruned) >= ratePruneInterval
+	if prune {
+		l.pruned = now
+	}
+	return recorded, prune, nil
+}
+
+// save stores the events just counted, and deletes those no limit looks back to anymore when prune is set
+func (l *RateLimiter) save(events []models.RateEvent, prune bool, now time.Time) {
+	if l.store == nil || len(events) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	if err := l.store.SaveRateEvents(ctx, events); err != nil {
+		l.logger.Printf("failed to save rate limit events: %v", err)
+	}
+	if prune {
+		if err := l.store.PruneRateEvents(ctx, now.Add(-maxRatePeriod)); err != nil {
+			l.logger.Printf("failed to prune rate limit events: %v", err)
+		}
+	}
+}
+
+// GormRateStore stores rate limit events in the database
+type GormRateStore struct {
+	client *models.DB
+}
+
+func NewGormRateStore(client *models.DB) *GormRateStore {
+	return &GormRateStore{
+		client: client,
+	}
+}
+
+func (s *GormRateStore) LoadRateEvents(ctx context.Context, since time.Time) ([]models.RateEvent, error) {
+	var events []models.RateEvent
+	err := s.client.WithContext(ctx).Where("at > ?", since).Order("at ASC").Find(&events).Error
+	return events, err
+}
+
+func (s *GormRateStore) SaveRateEvents(ctx context.Context, events []models.RateEvent) error {
+	return s.client.WithContext(ctx).Create(&events).Error
+}
+
+func (s *GormRateStore) PruneRateEvents(ctx context.Context, before time.Time) error {
+	return s.client.WithContext(ctx).Where("at <= ?", before).Delete(&models.RateEvent{}).Error
+}
+
+// recent returns the events of key within period, forgetting those older than maxRatePeriod
+func (l *RateLimiter) recent(key string, now time.Time, period time.Duration) []time.Time {
+	events := l.events[key]
+	if expired := sort.Search(len(events), func(i int) bool { return events[i].After(now.Add(-maxRatePeriod)) }); expired > 0 {
+		events = append([]time.Time(nil), events[expired:]...)
+		if len(events) == 0 {
+			delete(l.events, key)
+		} else {
+			l.events[key] = events
+		}
+	}
+
+	start := sort.Search(len(events), func(i int) bool { return events[i].After(now.Add(-period)) })
+	return events[start:]
+}
+
+// validateRateLimit checks the rate limit of a job
+func validateRateLimit(limit *models.RateLimit) error {
+	if limit.PerMinute < 0 || limit.PerHour < 0 {
+		return &JobError{Field: "RateLimit", Err: errors.New("limits can't be negative")}
+	}
+	if limit.PerMinute == 0 && limit.PerHour == 0 {
+		return &JobError{Field: "RateLimit", Err: errors.New("set a limit per minute, per hour or both")}
+	}
+	switch limit.Overflow {
+	case "", models.OverflowQueue, models.OverflowDrop, models.OverflowDigest:
+		return nil
+	default:
+		return &JobError{Field: "Overflow", Err: fmt.Errorf("unknown overflow policy %q, expected queue, drop or digest", limit.Overflow)}
+	}
+}
+
+// throttle reserves a delivery of the message for a job, within its own limit and the one of its user.
+// It returns the error of the limit reached, the job's overflow policy then applies.
+func (p *SMTPMessagePoller) throttle(processed ProcessResult) *RateLimitError {
+	job := processed.Job
+	var rules []rateRule
+	if job.RateLimit != nil {
+		rules = append(rules, rateRules(fmt.Sprintf("job %d", job.ID), fmt.Sprintf("job:%d", job.ID), *job.RateLimit)...)
+	}
+	if job.UserID != 0 {
+		rules = append(rules, rateRules(fmt.Sprintf("user %d", job.UserID), fmt.Sprintf("user:%d", job.UserID), p.userRateLimit)...)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	var limited *RateLimitError
+	errors.As(p.limiter.Reserve(p.now(), rules...), &limited)
+	return limited
+}
+
+// overflow applies the job's overflow policy to a message over its rate limit. Queued messages get an
+// error result, retried once the limit lets them through; the others are settled, and no result returned.
+func (p *SMTPMessagePoller) overflow(ctx context.Context, smtpMsg models.SMTPMessage, processed ProcessResult, limited *RateLimitError, attempt int) *WebhookResult {
+	policy := models.OverflowQueue
+	if limit := processed.Job.RateLimit; limit != nil && limit.Overflow != "" {
+		policy = limit.Overflow
+	}
+
+	switch policy {
+	case models.OverflowDrop:
+		p.logger.Printf("job %d dropped message %d: %v", processed.JobID, smtpMsg.ID, limited)
+		if err := p.deliveryLog.Record(ctx, &models.Delivery{
+			JobID:         processed.JobID,
+			DestinationID: processed.DestinationID,
+			SMTPMessageID: smtpMsg.ID,
+			Status:        models.DeliveryStatusThrottled,
+			Attempts:      attempt,
+			Detail:        limited.Error(),
+		}); err != nil {
+			p.logger.Printf("failed to record delivery for job %d: %v", processed.JobID, err)
+		}
+		return nil
+	case models.OverflowDigest:
+		// The digest closes when the period of the limit is over, it is then delivered as one message
+		opts := &models.DigestOptions{Window: int(limited.Period / time.Second)}
+		if err := p.collect(ctx, smtpMsg, processed, opts, true, attempt); err != nil {
+			return &WebhookResult{JobID: processed.JobID, DestinationID: processed.DestinationID, Error: fmt.Errorf("failed to collect the message in a digest: %w", err)}
+		}
+		return nil
+	default:
+		return &WebhookResult{JobID: processed.JobID, DestinationID: processed.DestinationID, Error: limited}
+	}
+}
@@ -0,0 +1,266 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+func TestRateLimiter_Reserve(t *testing.T) {
+	limiter := NewRateLimiter()
+	now := time.Date(2026, 1, 6, 20, 0, 0, 0, time.UTC)
+	rules := rateRules("job 1", "job:1", models.RateLimit{PerMinute: 2, PerHour: 3})
+
+	for i := 0; i < 2; i++ {
+		if err := limiter.Reserve(now.Add(time.Duration(i)*time.Second), rules...); err != nil {
+			t.Fatalf("expected event %d to be allowed, got %v", i, err)
+		}
+	}
+
+	var limited *RateLimitError
+	if err := limiter.Reserve(now.Add(10*time.Second), rules...); !errors.As(err, &limited) {
+		t.Fatalf("expected the minute limit to be reached, got %v", err)
+	}
+	if limited.Period != time.Minute || !limited.RetryAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected a retry once the first event is a minute old, got %+v", limited)
+	}
+
+	// A minute later, the hour limit still lets one more through
+	if err := limiter.Reserve(now.Add(time.Minute), rules...); err != nil {
+		t.Fatalf("expected an event to be allowed after a minute, got %v", err)
+	}
+	if err := limiter.Reserve(now.Add(2*time.Minute), rules...); !errors.As(err, &limited) || limited.Period != time.Hour {
+		t.Fatalf("expected the hour limit to be reached, got %v", err)
+	}
+	if !limited.RetryAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("expected a retry an hour after the first event, got %v", limited.RetryAt)
+	}
+
+	// Refused events aren't counted
+	if err := limiter.Reserve(now.Add(time.Hour+time.Second), rules...); err != nil {
+		t.Errorf("expected an event to be allowed after an hour, got %v", err)
+	}
+}
+
+func TestSMTPMessagePoller_RateLimits(t *testing.T) {
+	now := time.Date(2026, 1, 6, 20, 0, 0, 0, time.UTC)
+
+	setup := func(t *testing.T, overflow string) (*models.DB, *SMTPMessagePoller, *recordingHTTPClient, func() models.SMTPMessage) {
+		t.Helper()
+		db := newTestDB(t)
+		client := &recordingHTTPClient{}
+		poller := newTestPoller(t, db, client)
+		poller.processor.jobRepo.(*mockJobRepository).jobs["hook@example.com"][0].RateLimit = &models.RateLimit{PerMinute: 1, Overflow: overflow}
+		poller.now = func() time.Time { return now }
+
+		receive := func() models.SMTPMessage {
+			t.Helper()
+			msg := models.SMTPMessage{To: "hook@example.com", From: "alice@example.org", Subject: "Alert", Body: "Disk full", CreatedAt: now}
+			if err := db.Create(&msg).Error; err != nil {
+				t.Fatalf("failed to store message: %v", err)
+			}
+			poller.drain(context.Background())
+			return message(t, db, msg.ID)
+		}
+		return db, poller, client, receive
+	}
+
+	t.Run("queue", func(t *testing.T) {
+		db, poller, client, receive := setup(t, "")
+		receive()
+		queued := receive()
+		if queued.Status != models.MessageStatusRetrying || !queued.NextAttemptAt.Equal(now.Add(time.Minute)) {
+			t.Fatalf("expected the message over the limit to wait a minute, got %q at %v", queued.Status, queued.NextAttemptAt)
+		}
+
+		later := now.Add(time.Minute)
+		poller.now = func() time.Time { return later }
+		poller.drain(context.Background())
+		if msg := message(t, db, queued.ID); msg.Status != models.MessageStatusDelivered {
+			t.Errorf("expected the queued message to be delivered, got %q", msg.Status)
+		}
+		if len(client.bodies) != 2 {
+			t.Errorf("expected 2 deliveries, got %d", len(client.bodies))
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		db, _, client, receive := setup(t, models.OverflowDrop)
+		receive()
+		dropped := receive()
+		if dropped.Status != models.MessageStatusThrottled {
+			t.Fatalf("expected the message over the limit to be dropped, got %q", dropped.Status)
+		}
+		if len(client.bodies) != 1 {
+			t.Errorf("expected 1 delivery, got %d", len(client.bodies))
+		}
+		all := deliveries(t, db)
+		if last := all[len(all)-1]; last.Status != models.DeliveryStatusThrottled || last.Detail == "" {
+			t.Errorf("expected the drop in the delivery log, got %+v", last)
+		}
+	})
+
+	t.Run("digest", func(t *testing.T) {
+		db, poller, client, receive := setup(t, models.OverflowDigest)
+
+		// A regular digest left open, from when the job collected every message, is kept apart
+		regular := models.Digest{JobID: 1, Status: models.DigestStatusOpen, ClosesAt: now.Add(24 * time.Hour)}
+		if err := db.Create(&regular).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		receive()
+		receive()
+		receive()
+		if len(client.bodies) != 1 {
+			t.Fatalf("expected the messages over the limit to wait in a digest, got %v", client.bodies)
+		}
+		var kept models.Digest
+		if err := db.First(&kept, regular.ID).Error; err != nil || kept.Count != 0 {
+			t.Fatalf("expected the regular digest to be left alone, got %+v", kept)
+		}
+
+		// The digest closes once the period of the limit is over
+		later := now.Add(time.Minute + digestCloseGrace)
+		poller.now = func() time.Time { return later }
+		poller.drain(context.Background())
+		if len(client.bodies) != 2 {
+			t.Fatalf("expected the digest to be delivered, got %v", client.bodies)
+		}
+		var payload digestPayload
+		if err := json.Unmarshal([]byte(client.bodies[1]), &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Count != 2 {
+			t.Errorf("expected a digest of 2 messages, got %+v", payload)
+		}
+	})
+
+	t.Run("user", func(t *testing.T) {
+		db, poller, client, receive := setup(t, models.OverflowDrop)
+		job := poller.processor.jobRepo.(*mockJobRepository).jobs["hook@example.com"][0]
+		job.RateLimit, job.UserID = nil, 7
+		poller.userRateLimit = models.RateLimit{PerMinute: 1}
+
+		receive()
+		queued := receive()
+		if queued.Status != models.MessageStatusRetrying {
+			t.Errorf("expected the message over the user limit to be queued, got %q", queued.Status)
+		}
+		if len(client.bodies) != 1 || len(deliveries(t, db)) != 2 {
+			t.Errorf("expected 1 delivery and a failed one, got %d", len(client.bodies))
+		}
+	})
+}
+
+func TestRateLimiter_Store(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 1, 6, 20, 0, 0, 0, time.UTC)
+	rules := rateRules("job 1", "job:1", models.RateLimit{PerHour: 2})
+
+	limiter := NewRateLimiter()
+	limiter.SetStore(NewGormRateStore(db), &mockLogger{})
+	for i := 0; i < 2; i++ {
+		if err := limiter.Reserve(now.Add(time.Duration(i)*time.Minute), rules...); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// A restarted worker picks the counts up where they were
+	restarted := NewRateLimiter()
+	restarted.SetStore(NewGormRateStore(db), &mockLogger{})
+	if err := restarted.Load(context.Background(), now.Add(5*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	var limited *RateLimitError
+	if err := restarted.Reserve(now.Add(5*time.Minute), rules...); !errors.As(err, &limited) || !limited.RetryAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("expected the saved events to count, got %v", err)
+	}
+
+	// Events no limit looks back to anymore are deleted
+	if err := restarted.Reserve(now.Add(2*time.Hour), rules...); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var stored []models.RateEvent
+	if err := db.Find(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || !stored[0].At.Equal(now.Add(2*time.Hour)) {
+		t.Errorf("expected only the latest event to be kept, got %+v", stored)
+	}
+}
+
+func TestWebhookSender_HostRateLimits(t *testing.T) {
+	client := &sequenceHTTPClient{statuses: []int{http.StatusOK}}
+	sender := NewWebhookSender(client, &mockLogger{}, Config{})
+	sender.SetHostRateLimits(HostRateLimits{
+		Default: models.RateLimit{PerHour: 100},
+		Hosts:   map[string]models.RateLimit{"partner.example.com": {PerMinute: 1}},
+	}, NewRateLimiter())
+
+	send := func(url string) WebhookResult {
+		return sender.SendWebhook(context.Background(), ProcessResult{JobID: 1, URL: url, Method: "POST", Payload: "{}"})
+	}
+
+	if result := send("https://partner.example.com/hook"); result.Error != nil {
+		t.Fatalf("expected the first request to go through, got %v", result.Error)
+	}
+	var limited *RateLimitError
+	if result := send("https://partner.example.com:8443/other"); !errors.As(result.Error, &limited) || limited.Scope != "host partner.example.com" {
+		t.Errorf("expected the host limit to be reached, got %v", result.Error)
+	}
+	if result := send("https://example.com/hook"); result.Error != nil {
+		t.Errorf("expected other hosts to keep the default limit, got %v", result.Error)
+	}
+	if client.requests != 2 {
+		t.Errorf("expected 2 requests, got %d", client.requests)
+	}
+}
+
+func TestWebhookSender_OpenCircuitKeepsRateLimitSlots(t *testing.T) {
+	ctx := context.Background()
+	client := &sequenceHTTPClient{statuses: []int{http.StatusOK}}
+	sender := NewWebhookSender(client, &mockLogger{}, Config{})
+	breaker := NewCircuitBreaker(1, time.Minute, time.Hour, nil, nil, &mockLogger{})
+	sender.SetCircuitBreaker(breaker)
+	sender.SetHostRateLimits(HostRateLimits{Hosts: map[string]models.RateLimit{"partner.example.com": {PerMinute: 1}}}, NewRateLimiter())
+
+	send := func() WebhookResult {
+		return sender.SendWebhook(ctx, ProcessResult{JobID: 1, URL: "https://partner.example.com/hook", Method: "POST", Payload: "{}"})
+	}
+
+	breaker.Record(ctx, "partner.example.com", true, "endpoint returned status 503")
+	var open *CircuitOpenError
+	if result := send(); !errors.As(result.Error, &open) {
+		t.Fatalf("expected the circuit to be open, got %v", result.Error)
+	}
+
+	breaker.Record(ctx, "partner.example.com", false, "")
+	if result := send(); result.Error != nil {
+		t.Errorf("expected the skipped delivery not to use the slot, got %v", result.Error)
+	}
+}
+
+func TestValidateRateLimit(t *testing.T) {
+	var jobErr *JobError
+	if err := ValidateJob(&models.Job{RateLimit: &models.RateLimit{PerMinute: 10, Overflow: models.OverflowDrop}}); err != nil {
+		t.Errorf("expected a valid job, got %v", err)
+	}
+	for _, tt := range []struct {
+		limit models.RateLimit
+		field string
+	}{
+		{models.RateLimit{}, "RateLimit"},
+		{models.RateLimit{PerHour: -1}, "RateLimit"},
+		{models.RateLimit{PerMinute: 10, Overflow: "bounce"}, "Overflow"},
+	} {
+		if err := ValidateJob(&models.Job{RateLimit: &tt.limit}); !errors.As(err, &jobErr) || jobErr.Field != tt.field {
+			t.Errorf("expected an error on %s for %+v, got %v", tt.field, tt.limit, err)
+		}
+	}
+}
@@ -13,6 +13,7 @@ type EmailReplier struct {
 	smtpPassword string
 	fromAddress  string
 	logger       Logger
+	sendMail     func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
 }
 
 // NewEmailReplier creates a new email replier
@@ -24,19 +25,44 @@ func NewEmailReplier(host string, port int, user, password, fromAddress string,
 		smtpPassword: password,
 		fromAddress:  fromAddress,
 		logger:       logger,
+		sendMail:     smtp.SendMail,
 	}
 }
 
 // SendReply sends an auto-reply email
 func (e *EmailReplier) SendReply(to, subject, body string) error {
+	return e.Reply(to, "Re: "+subject, body)
+}
+
+// Reply sends a reply email with a subject of its own, such as one a webhook answered with
+func (e *EmailReplier) Reply(to, subject, body string) error {
 	if body == "" {
 		return nil // No reply configured
 	}
 
+	if err := e.send(to, subject, body); err != nil {
+		return fmt.Errorf("failed to send reply email: %w", err)
+	}
+
+	e.logger.Printf("sent auto-reply to %s", to)
+	return nil
+}
+
+// SendNotice sends a notice about their jobs to a user
+func (e *EmailReplier) SendNotice(to, subject, body string) error {
+	if err := e.send(to, subject, body); err != nil {
+		return fmt.Errorf("failed to send notice email: %w", err)
+	}
+
+	e.logger.Printf("sent notice to %s", to)
+	return nil
+}
+
+func (e *EmailReplier) send(to, subject, body string) error {
 	// Build email message
 	message := fmt.Sprintf("From: %s\r\n", e.fromAddress)
 	message += fmt.Sprintf("To: %s\r\n", to)
-	message += fmt.Sprintf("Subject: Re: %s\r\n", subject)
+	message += fmt.Sprintf("Subject: %s\r\n", subject)
 	message += "\r\n"
 	message += body
 
@@ -45,11 +71,5 @@ func (e *EmailReplier) SendReply(to, subject, body string) error {
 
 	// Send email
 	addr := fmt.Sprintf("%s:%d", e.smtpHost, e.smtpPort)
-	err := smtp.SendMail(addr, auth, e.fromAddress, []string{to}, []byte(message))
-	if err != nil {
-		return fmt.Errorf("failed to send reply email: %w", err)
-	}
-
-	e.logger.Printf("sent auto-reply to %s", to)
-	return nil
+	return e.sendMail(addr, auth, e.fromAddress, []string{to}, []byte(message))
 }
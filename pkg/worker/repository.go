@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gorm.io/gorm"
 )
 
 type EntJobRepository struct {
@@ -20,6 +21,7 @@ func (r *EntJobRepository) GetActiveJobs(ctx context.Context, email string) ([]*
 	var jobs []*models.Job
 	result := r.client.WithContext(ctx).
 		Where("email = ? AND is_active = ?", email, true).
+		Preload("Destinations", func(db *gorm.DB) *gorm.DB { return db.Order("id ASC") }).
 		Find(&jobs)
 
 	if result.Error != nil {
@@ -27,4 +29,19 @@ func (r *EntJobRepository) GetActiveJobs(ctx context.Context, email string) ([]*
 	}
 
 	return jobs, nil
-}
\ No newline at end of file
+}
+
+// GormDeliveryLog stores deliveries in the database
+type GormDeliveryLog struct {
+	client *models.DB
+}
+
+func NewGormDeliveryLog(client *models.DB) *GormDeliveryLog {
+	return &GormDeliveryLog{
+		client: client,
+	}
+}
+
+func (l *GormDeliveryLog) Record(ctx context.Context, delivery *models.Delivery) error {
+	return l.client.WithContext(ctx).Create(delivery).Error
+}
@@ -0,0 +1,262 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+// MaxScheduleDelay is the longest a job may hold its messages for, in seconds
+const MaxScheduleDelay = 7 * 24 * 60 * 60
+
+// weekdays are the day names of schedule windows
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// validateSchedule checks the delivery schedule of a job
+func validateSchedule(s *models.DeliverySchedule) error {
+	if s.Delay < 0 || s.Delay > MaxScheduleDelay {
+		return &JobError{Field: "ScheduleDelay", Err: fmt.Errorf("must be between 0 and %d seconds", MaxScheduleDelay)}
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return &JobError{Field: "Timezone", Err: fmt.Errorf("unknown timezone %q, expected a name such as Europe/Paris", s.Timezone)}
+	}
+	for _, day := range s.Days {
+		if _, ok := weekdays[day]; !ok {
+			return &JobError{Field: "ScheduleDays", Err: fmt.Errorf("unknown day %q, expected mon, tue, wed, thu, fri, sat or sun", day)}
+		}
+	}
+	if _, _, err := windowTimes(s); err != nil {
+		return &JobError{Field: "ScheduleWindow", Err: err}
+	}
+	if s.Delay == 0 && !s.HasWindow() {
+		return &JobError{Field: "ScheduleDelay", Err: errors.New("set a delay, a window or both")}
+	}
+	return nil
+}
+
+// windowTimes returns when the window of a schedule opens in the day, and how long it stays open
+func windowTimes(s *models.DeliverySchedule) (time.Duration, time.Duration, error) {
+	if s.Start == "" && s.End == "" {
+		return 0, 24 * time.Hour, nil
+	}
+	if s.Start == "" || s.End == "" {
+		return 0, 0, errors.New("the window needs both a start and an end time")
+	}
+
+	start, err := time.Parse("15:04", s.Start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid start time %q, expected a time such as 09:00", s.Start)
+	}
+	end, err := time.Parse("15:04", s.End)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid end time %q, expected a time such as 17:00", s.End)
+	}
+
+	length := end.Sub(start)
+	if length == 0 {
+		return 0, 0, errors.New("the window must start and end at different times")
+	}
+	if length < 0 {
+		// Overnight windows close the next day
+		length += 24 * time.Hour
+	}
+	return start.Sub(start.Truncate(24 * time.Hour)), length, nil
+}
+
+// nextSlot returns when a message received at receivedAt may be delivered: once its delay is over,
+// at the first time the window of the schedule is open
+func nextSlot(s *models.DeliverySchedule, receivedAt time.Time) time.Time {
+	at := receivedAt.Add(time.Duration(s.Delay) * time.Second)
+	if !s.HasWindow() {
+		return at
+	}
+
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return at
+	}
+	opens, length, err := windowTimes(s)
+	if err != nil {
+		return at
+	}
+
+	days := make(map[time.Weekday]bool, len(s.Days))
+	for _, day := range s.Days {
+		days[weekdays[day]] = true
+	}
+
+	// The window of the day before may still be open overnight
+	local := at.In(loc)
+	for i := -1; i <= 7; i++ {
+		day := time.Date(local.Year(), local.Month(), local.Day()+i, 0, 0, 0, 0, loc)
+		if len(days) > 0 && !days[day.Weekday()] {
+			continue
+		}
+
+		start := time.Date(day.Year(), day.Month(), day.Day(), int(opens.Hours()), int(opens.Minutes())%60, 0, 0, loc)
+		if !start.Add(length).After(at) {
+			continue
+		}
+		if start.After(at) {
+			return start
+		}
+		return at
+	}
+	return at
+}
+
+// schedule holds a delivery back until the next slot of its job's schedule, returning false when it is due already
+func (p *SMTPMessagePoller) schedule(ctx context.Context, smtpMsg models.SMTPMessage, processed ProcessResult) (bool, error) {
+	at := nextSlot(processed.Job.Schedule, smtpMsg.CreatedAt)
+	if !at.After(p.now()) {
+		return false, nil
+	}
+
+	return true, p.deliveryLog.Record(ctx, &models.Delivery{
+		JobID:         processed.JobID,
+		DestinationID: processed.DestinationID,
+		SMTPMessageID: smtpMsg.ID,
+		Status:        models.DeliveryStatusScheduled,
+		ScheduledAt:   at,
+		Detail:        "scheduled for " + at.UTC().Format(time.RFC3339),
+	})
+}
+
+// sendScheduled delivers the scheduled deliveries that are due, returning how many were fetched.
+// The messages whose scheduled deliveries were all cancelled are settled too.
+func (p *SMTPMessagePoller) sendScheduled(ctx context.Context) (int, error) {
+	var due []models.Delivery
+	err := p.db.WithContext(ctx).
+		Where("status = ? AND scheduled_at <= ?", models.DeliveryStatusScheduled, p.now()).
+		Order("scheduled_at ASC, id ASC").
+		Limit(p.batchSize).
+		Find(&due).Error
+	if err != nil {
+		return 0, err
+	}
+
+	for _, delivery := range due {
+		if err := p.sendScheduledDelivery(ctx, delivery); err != nil {
+			p.logger.Printf("error sending scheduled delivery %d: %v", delivery.ID, err)
+		}
+	}
+
+	var cancelled []int
+	err = p.db.WithContext(ctx).
+		Model(&models.SMTPMessage{}).
+		Where("status = ? AND NOT EXISTS (SELECT 1 FROM deliveries WHERE deliveries.smtp_message_id = smtp_messages.id AND deliveries.status = ?)",
+			models.MessageStatusScheduled, models.DeliveryStatusScheduled).
+		Limit(p.batchSize).
+		Pluck("id", &cancelled).Error
+	if err != nil {
+		return len(due), err
+	}
+	for _, id := range cancelled {
+		if err := p.settle(ctx, id); err != nil {
+			p.logger.Printf("failed to settle message %d: %v", id, err)
+		}
+	}
+
+	return len(due), nil
+}
+
+// sendScheduledDelivery delivers a scheduled delivery with the job's current configuration. Failures worth
+// retrying are scheduled again after the backoff, the delivery is then kept up to date in place.
+func (p *SMTPMessagePoller) sendScheduledDelivery(ctx context.Context, delivery models.Delivery) error {
+	attempt := delivery.Attempts + 1
+	next := p.now().Add(p.backoff(attempt))
+	updates := map[string]any{"attempts": attempt, "status": models.DeliveryStatusDead}
+
+	var smtpMsg models.SMTPMessage
+	err := p.db.WithContext(ctx).Preload("Source").First(&smtpMsg, delivery.SMTPMessageID).Error
+	if err != nil {
+		updates["detail"] = fmt.Sprintf("failed to load the message: %v", err)
+		return p.db.WithContext(ctx).Model(&delivery).Updates(updates).Error
+	}
+
+	results, err := p.processor.ReprocessMessage(ctx, messageFromSMTP(smtpMsg), delivery.JobID, delivery.DestinationID)
+	results, rejected := splitRejections(results)
+	switch {
+	case err != nil:
+		// The jobs failed to load, they are tried again like a failed delivery
+		updates["status"], updates["scheduled_at"], updates["detail"] = models.DeliveryStatusScheduled, next, err.Error()
+		if attempt > p.maxRetries {
+			updates["status"] = models.DeliveryStatusDead
+		}
+	case len(results) == 0:
+		updates["detail"] = "the job no longer delivers this message"
+		if len(rejected) > 0 {
+			updates["detail"] = "the job no longer delivers this message: " + rejected[0].Rejected
+		}
+	}
+
+	replied, err := p.repliedJobs(ctx, smtpMsg.ID)
+	if err != nil {
+		return err
+	}
+	for _, processed := range results {
+		if processed.Collected {
+			// The job has since turned to digests, the message joins the open one
+			updates["status"], updates["detail"] = models.DeliveryStatusDigested, ""
+			if err := p.collect(ctx, smtpMsg, processed, processed.Job.Digest, false, attempt); err != nil {
+				updates["status"], updates["detail"] = models.DeliveryStatusDead, fmt.Sprintf("failed to collect the message in a digest: %v", err)
+			}
+			continue
+		}
+
+		if limited := p.throttle(processed); limited != nil {
+			// Scheduled deliveries wait for the rate limit whatever the overflow policy, without using up an attempt
+			updates["attempts"], updates["status"] = delivery.Attempts, models.DeliveryStatusScheduled
+			updates["scheduled_at"], updates["detail"] = limited.RetryAt, limited.Error()
+			continue
+		}
+
+		result := p.dispatcher.Deliver(ctx, processed)
+		status := p.deliveryStatus(processed, result, attempt, &next)
+		updates["status_code"], updates["detail"] = result.StatusCode, ""
+		switch status {
+		case models.DeliveryStatusFailed:
+			updates["status"], updates["scheduled_at"] = models.DeliveryStatusScheduled, next
+			updates["detail"] = failure(result)
+		case models.DeliveryStatusDead:
+			updates["status"], updates["detail"] = status, failure(result)
+		default:
+			updates["status"] = status
+		}
+
+		if result.Error != nil {
+			p.logger.Printf("webhook error for job %d: %v", result.JobID, result.Error)
+		}
+		if !failed(result) {
+			p.respond(ctx, smtpMsg, processed, result, replied, attempt)
+		}
+	}
+
+	if err := p.db.WithContext(ctx).Model(&delivery).Updates(updates).Error; err != nil {
+		return err
+	}
+	return p.settle(ctx, smtpMsg.ID)
+}
+
+// settle updates the status of a scheduled message once its deliveries are all sent or cancelled
+func (p *SMTPMessagePoller) settle(ctx context.Context, messageID int) error {
+	status, err := p.settledStatus(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	return p.db.WithContext(ctx).
+		Model(&models.SMTPMessage{}).
+		Where("id = ? AND status = ?", messageID, models.MessageStatusScheduled).
+		Update("status", status).Error
+}
@@ -0,0 +1,127 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+func TestNextSlot(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skipf("no timezone database: %v", err)
+	}
+	businessHours := &models.DeliverySchedule{Timezone: "Europe/Paris", Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "09:00", End: "17:00"}
+
+	tests := []struct {
+		name     string
+		schedule *models.DeliverySchedule
+		received time.Time
+		want     time.Time
+	}{
+		{"delay", &models.DeliverySchedule{Delay: 300}, time.Date(2026, 1, 6, 20, 0, 0, 0, time.UTC), time.Date(2026, 1, 6, 20, 5, 0, 0, time.UTC)},
+		{"in the window", businessHours, time.Date(2026, 1, 6, 10, 0, 0, 0, paris), time.Date(2026, 1, 6, 10, 0, 0, 0, paris)},
+		{"before the window", businessHours, time.Date(2026, 1, 6, 7, 30, 0, 0, paris), time.Date(2026, 1, 6, 9, 0, 0, 0, paris)},
+		{"after the window", businessHours, time.Date(2026, 1, 6, 18, 0, 0, 0, paris), time.Date(2026, 1, 7, 9, 0, 0, 0, paris)},
+		{"weekend", businessHours, time.Date(2026, 1, 9, 18, 0, 0, 0, paris), time.Date(2026, 1, 12, 9, 0, 0, 0, paris)},
+		{"window in UTC", &models.DeliverySchedule{Start: "09:00", End: "17:00"}, time.Date(2026, 1, 6, 8, 0, 0, 0, paris), time.Date(2026, 1, 6, 9, 0, 0, 0, time.UTC)},
+		{"overnight", &models.DeliverySchedule{Start: "22:00", End: "06:00"}, time.Date(2026, 1, 6, 3, 0, 0, 0, time.UTC), time.Date(2026, 1, 6, 3, 0, 0, 0, time.UTC)},
+		{"overnight after closing", &models.DeliverySchedule{Start: "22:00", End: "06:00"}, time.Date(2026, 1, 6, 7, 0, 0, 0, time.UTC), time.Date(2026, 1, 6, 22, 0, 0, 0, time.UTC)},
+		{"days only", &models.DeliverySchedule{Days: []string{"sat", "sun"}}, time.Date(2026, 1, 6, 7, 0, 0, 0, time.UTC), time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)},
+		{"delay into the next window", &models.DeliverySchedule{Delay: 3600, Start: "09:00", End: "17:00"}, time.Date(2026, 1, 6, 16, 30, 0, 0, time.UTC), time.Date(2026, 1, 7, 9, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextSlot(tt.schedule, tt.received); !got.Equal(tt.want) {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	tests := []struct {
+		name  string
+		job   models.Job
+		field string
+	}{
+		{"delay", models.Job{Schedule: &models.DeliverySchedule{Delay: 300}}, ""},
+		{"business hours", models.Job{Schedule: &models.DeliverySchedule{Timezone: "Europe/Paris", Days: []string{"mon", "fri"}, Start: "09:00", End: "17:00"}}, ""},
+		{"empty", models.Job{Schedule: &models.DeliverySchedule{}}, "ScheduleDelay"},
+		{"negative delay", models.Job{Schedule: &models.DeliverySchedule{Delay: -1}}, "ScheduleDelay"},
+		{"unknown timezone", models.Job{Schedule: &models.DeliverySchedule{Delay: 60, Timezone: "Mars/Olympus"}}, "Timezone"},
+		{"unknown day", models.Job{Schedule: &models.DeliverySchedule{Days: []string{"monday"}}}, "ScheduleDays"},
+		{"start only", models.Job{Schedule: &models.DeliverySchedule{Start: "09:00"}}, "ScheduleWindow"},
+		{"invalid time", models.Job{Schedule: &models.DeliverySchedule{Start: "9am", End: "17:00"}}, "ScheduleWindow"},
+		{"with a digest", models.Job{Schedule: &models.DeliverySchedule{Delay: 60}, Digest: &models.DigestOptions{Window: 60}}, "ScheduleDelay"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateJob(&tt.job)
+			var jobErr *JobError
+			switch {
+			case tt.field == "" && err != nil:
+				t.Errorf("expected a valid job, got %v", err)
+			case tt.field != "" && (!errors.As(err, &jobErr) || jobErr.Field != tt.field):
+				t.Errorf("expected an error on %s, got %v", tt.field, err)
+			}
+		})
+	}
+}
+
+func TestSMTPMessagePoller_ScheduledDeliveries(t *testing.T) {
+	db := newTestDB(t)
+	client := &recordingHTTPClient{}
+	poller := newTestPoller(t, db, client)
+	poller.processor.jobRepo.(*mockJobRepository).jobs["hook@example.com"][0].Schedule = &models.DeliverySchedule{Delay: 300}
+	now := time.Date(2026, 1, 6, 20, 0, 0, 0, time.UTC)
+	poller.now = func() time.Time { return now }
+
+	var msgs []models.SMTPMessage
+	for _, subject := range []string{"Send", "Cancel"} {
+		msg := models.SMTPMessage{To: "hook@example.com", From: "alice@example.org", Subject: subject, Body: "Hello", CreatedAt: now}
+		if err := db.Create(&msg).Error; err != nil {
+			t.Fatalf("failed to store message: %v", err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	// Messages are held for the delay
+	poller.drain(context.Background())
+	if len(client.bodies) != 0 {
+		t.Fatalf("expected no delivery yet, got %v", client.bodies)
+	}
+	scheduled := deliveries(t, db)
+	if len(scheduled) != 2 || scheduled[0].Status != models.DeliveryStatusScheduled || !scheduled[0].ScheduledAt.Equal(now.Add(5*time.Minute)) {
+		t.Fatalf("expected scheduled deliveries in 5 minutes, got %+v", scheduled)
+	}
+	if stored := message(t, db, msgs[0].ID); stored.Status != models.MessageStatusScheduled {
+		t.Errorf("expected the message to be scheduled, got %q", stored.Status)
+	}
+
+	// A cancelled delivery is never sent, and its message settles
+	if err := db.Model(&scheduled[1]).Update("status", models.DeliveryStatusCancelled).Error; err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(5 * time.Minute)
+	poller.drain(context.Background())
+
+	if len(client.bodies) != 1 {
+		t.Fatalf("expected a single delivery, got %v", client.bodies)
+	}
+	got := deliveries(t, db)
+	if len(got) != 2 || got[0].Status != models.DeliveryStatusDelivered || got[0].Attempts != 1 || got[1].Status != models.DeliveryStatusCancelled {
+		t.Errorf("expected the scheduled delivery to be sent in place, got %+v", got)
+	}
+	if stored := message(t, db, msgs[0].ID); stored.Status != models.MessageStatusDelivered {
+		t.Errorf("expected the sent message to be delivered, got %q", stored.Status)
+	}
+	if stored := message(t, db, msgs[1].ID); stored.Status != models.MessageStatusNoMatch {
+		t.Errorf("expected the cancelled message to settle, got %q", stored.Status)
+	}
+}
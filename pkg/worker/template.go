@@ -0,0 +1,205 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// payloadFuncs is the curated set of helpers available to payload templates.
+// text/template's builtins (urlquery, printf, len, ...) remain available as well.
+var payloadFuncs = template.FuncMap{
+	"json":       toJSONString,
+	"b64enc":     b64enc,
+	"trim":       strings.TrimSpace,
+	"regexFind":  regexFind,
+	"date":       date,
+	"default":    defaultValue,
+	"pathEscape": url.PathEscape,
+}
+
+// parsePayloadTemplate parses a payload template with the helper functions registered
+func parsePayloadTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(payloadFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// renderPayload executes a payload template. When the declared content type is JSON the
+// output must be a valid JSON document, so a broken template fails instead of being delivered.
+func renderPayload(tmpl *template.Template, data any, contentType string) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to execute template: %w", err)
+	}
+
+	if isJSONContentType(contentType) && !json.Valid(buf.Bytes()) {
+		return "", fmt.Errorf("template output is not valid JSON")
+	}
+
+	return buf.String(), nil
+}
+
+// renderURL executes the URL template of a destination. Values only make up the path and query,
+// a URL whose scheme or host differ from the template's is refused.
+func renderURL(tmpl *template.Template, source string, data any) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to execute template: %w", err)
+	}
+
+	rendered, err := url.Parse(strings.TrimSpace(buf.String()))
+	if err != nil {
+		return "", fmt.Errorf("rendered URL is invalid: %w", err)
+	}
+	base, err := url.Parse(source)
+	if err != nil || rendered.Scheme != base.Scheme || rendered.Host != base.Host {
+		return "", fmt.Errorf("rendered URL %q changes the scheme or host of %q", rendered.Redacted(), source)
+	}
+
+	return rendered.String(), nil
+}
+
+// renderHeaders returns headers with their templated values executed
+func renderHeaders(headers map[string]string, templates map[string]*template.Template, data any) (map[string]string, error) {
+	if len(templates) == 0 {
+		return headers, nil
+	}
+
+	rendered := make(map[string]string, len(headers))
+	for key, value := range headers {
+		rendered[key] = value
+	}
+	for key, tmpl := range templates {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("failed to execute template of header %s: %w", key, err)
+		}
+		value := strings.TrimSpace(buf.String())
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("header %s spans several lines", key)
+		}
+		rendered[key] = value
+	}
+
+	return rendered, nil
+}
+
+// isJSONContentType reports whether a content type denotes a JSON body, including the +json suffix types
+func isJSONContentType(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// headerValue looks a header up regardless of the case it was configured with
+func headerValue(headers map[string]string, name string) string {
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// toJSONString encodes a value as JSON, a string becomes a quoted and escaped JSON string
+func toJSONString(v any) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+func b64enc(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// regexCacheSize bounds the patterns regexFind keeps compiled, patterns built from message data could grow it
+// without end, it starts over once full
+const regexCacheSize = 256
+
+var regexCache = struct {
+	mu       sync.Mutex
+	patterns map[string]*regexp.Regexp
+}{patterns: make(map[string]*regexp.Regexp)}
+
+// regexFind returns the first match of pattern in s, or an empty string
+func regexFind(pattern, s string) (string, error) {
+	re, err := compileRegex(pattern)
+	if err != nil {
+		return "", err
+	}
+	return re.FindString(s), nil
+}
+
+// compileRegex compiles a pattern of a template once, rather than on every render
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	regexCache.mu.Lock()
+	defer regexCache.mu.Unlock()
+
+	if re, ok := regexCache.patterns[pattern]; ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(regexCache.patterns) >= regexCacheSize {
+		clear(regexCache.patterns)
+	}
+	regexCache.patterns[pattern] = re
+	return re, nil
+}
+
+// date formats a time using a Go layout. It accepts a time.Time or unix seconds,
+// and uses the current time when given anything else.
+func date(layout string, v any) string {
+	t := time.Now()
+	switch tv := v.(type) {
+	case time.Time:
+		t = tv
+	case *time.Time:
+		if tv != nil {
+			t = *tv
+		}
+	case int64:
+		t = time.Unix(tv, 0)
+	case int:
+		t = time.Unix(int64(tv), 0)
+	}
+	return t.Format(layout)
+}
+
+// defaultValue returns def when v is empty, otherwise v
+func defaultValue(def, v any) any {
+	if v == nil {
+		return def
+	}
+	rv := reflect.ValueOf(v)
+	if rv.IsZero() {
+		return def
+	}
+	switch rv.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array:
+		if rv.Len() == 0 {
+			return def
+		}
+	}
+	return v
+}
@@ -0,0 +1,237 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+)
+
+func TestRenderPayload_Functions(t *testing.T) {
+	msg := Message{
+		From:    "sender@example.com",
+		To:      "test@example.com",
+		Subject: `Say "hi" <now>`,
+		Body:    "  Your code is 123456 & more  ",
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{
+			name:     "no HTML escaping",
+			template: `{{.Subject}}`,
+			expected: `Say "hi" <now>`,
+		},
+		{
+			name:     "json quoting",
+			template: `{"subject": {{json .Subject}}}`,
+			expected: `{"subject": "Say \"hi\" <now>"}`,
+		},
+		{
+			name:     "base64",
+			template: `{{b64enc .From}}`,
+			expected: "c2VuZGVyQGV4YW1wbGUuY29t",
+		},
+		{
+			name:     "trim",
+			template: `[{{trim .Body}}]`,
+			expected: "[Your code is 123456 & more]",
+		},
+		{
+			name:     "regexFind",
+			template: `{{regexFind "[0-9]{6}" .Body}}`,
+			expected: "123456",
+		},
+		{
+			name:     "default",
+			template: `{{default "none" .Subject}}|{{"" | default "none"}}`,
+			expected: `Say "hi" <now>|none`,
+		},
+		{
+			name:     "urlquery",
+			template: `{{urlquery .From}}`,
+			expected: "sender%40example.com",
+		},
+		{
+			name:     "date",
+			template: `{{date "2006-01-02" 0}}`,
+			expected: time.Unix(0, 0).Format("2006-01-02"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := parsePayloadTemplate("payload", tt.template)
+			if err != nil {
+				t.Fatalf("unexpected parse error: %v", err)
+			}
+
+			payload, err := renderPayload(tmpl, msg, "")
+			if err != nil {
+				t.Fatalf("unexpected render error: %v", err)
+			}
+
+			if payload != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, payload)
+			}
+		})
+	}
+}
+
+func TestCompileRegex_Cached(t *testing.T) {
+	first, err := compileRegex("[0-9]+")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, _ := compileRegex("[0-9]+")
+	if first != second {
+		t.Error("expected the compiled pattern to be reused")
+	}
+
+	if _, err := compileRegex("(unclosed"); err == nil {
+		t.Error("expected an invalid pattern to fail")
+	}
+}
+
+func TestRenderPayload_JSONContentType(t *testing.T) {
+	msg := Message{Subject: `Quote " inside`}
+
+	valid, err := parsePayloadTemplate("payload", `{"subject": {{json .Subject}}}`)
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	invalid, err := parsePayloadTemplate("payload", `{"subject": "{{.Subject}}"}`)
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+
+	payload, err := renderPayload(valid, msg, "application/json; charset=utf-8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !json.Valid([]byte(payload)) {
+		t.Errorf("expected valid JSON, got %q", payload)
+	}
+
+	if _, err := renderPayload(invalid, msg, "application/json"); err == nil {
+		t.Error("expected an error for invalid JSON output")
+	}
+
+	if _, err := renderPayload(invalid, msg, "application/cloudevents+json"); err == nil {
+		t.Error("expected an error for invalid JSON output with a +json content type")
+	}
+
+	if _, err := renderPayload(invalid, msg, "text/plain"); err != nil {
+		t.Errorf("unexpected error for a non JSON content type: %v", err)
+	}
+}
+
+func TestMessageProcessor_ProcessMessage_JSONHeader(t *testing.T) {
+	msg := Message{To: "hook@example.com", Subject: `He said "hello"`}
+
+	job := &models.Job{
+		PayloadTemplate: `{"text": "{{.Subject}}"}`,
+		Headers:         map[string]string{"content-type": "application/json"},
+	}
+
+	if _, err := renderJob(t, job, msg); err == nil {
+		t.Error("expected an error for a template producing invalid JSON")
+	}
+
+	job.PayloadTemplate = `{"text": {{json .Subject}}}`
+	payload, err := renderJob(t, job, msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `{"text": "He said \"hello\""}`
+	if payload != expected {
+		t.Errorf("expected %q, got %q", expected, payload)
+	}
+}
+
+func TestValidateJob_JSONSample(t *testing.T) {
+	var jobErr *JobError
+	job := &models.Job{FromRegex: ".*", PayloadTemplate: `{"text": "{{.Subject}}"}`, Headers: map[string]string{"Content-Type": "application/json"}}
+	if err := ValidateJob(job); !errors.As(err, &jobErr) || jobErr.Field != "PayloadTemplate" {
+		t.Errorf("expected a JSON template to be checked on a sample message, got %v", err)
+	}
+
+	job.PayloadTemplate = `{"text": {{json .Subject}}, "code": {{.Vars.code}}}`
+	job.Extract = []models.ExtractRule{{Name: "code", Kind: "code"}}
+	if err := ValidateJob(job); err != nil {
+		t.Errorf("expected a JSON template to be valid, got %v", err)
+	}
+
+	// Without a JSON content type the payload is sent as is
+	job.PayloadTemplate, job.Extract, job.Headers = "Subject: {{.Subject}}", nil, nil
+	if err := ValidateJob(job); err != nil {
+		t.Errorf("expected a text template without content type to be valid, got %v", err)
+	}
+}
+
+func TestMessageProcessor_ProcessMessage_TextWithoutContentType(t *testing.T) {
+	repo := &mockJobRepository{jobs: map[string][]*models.Job{
+		"hook@example.com": {{ID: 1, Email: "hook@example.com", FromRegex: ".*", URL: "https://example.com/hook", Method: "POST",
+			PayloadTemplate: `text={{.Body}}`}},
+	}}
+	processor := NewMessageProcessor(repo, &mockLogger{}, nil, "example.com")
+
+	results, err := processor.ProcessMessage(context.Background(), Message{To: "hook@example.com", Body: `Say "hi"`})
+	if err != nil || len(results) != 1 {
+		t.Fatalf("expected one result, got %+v, %v", results, err)
+	}
+	if results[0].Error != nil || results[0].Payload != `text=Say "hi"` {
+		t.Errorf("expected the text payload to be delivered, got %q, %v", results[0].Payload, results[0].Error)
+	}
+}
+
+func TestMessageProcessor_TemplatedRequest(t *testing.T) {
+	var paths, subjects, keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		subjects = append(subjects, r.Header.Get("X-Subject"))
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+	}))
+	defer server.Close()
+
+	repo := &mockJobRepository{jobs: map[string][]*models.Job{
+		"hook@example.com": {{
+			ID: 1, Email: "hook@example.com", FromRegex: ".*", Method: "POST",
+			URL:     server.URL + "/tickets/{{pathEscape .Subject}}",
+			Headers: map[string]string{"X-Subject": "{{.Subject}}"},
+		}},
+	}}
+	processor := NewMessageProcessor(repo, &mockLogger{}, nil, "example.com")
+	sender := NewWebhookSender(http.DefaultClient, &mockLogger{}, Config{})
+
+	send := func(msg Message) ProcessResult {
+		t.Helper()
+		results, err := processor.ProcessMessage(context.Background(), msg)
+		if err != nil || len(results) != 1 {
+			t.Fatalf("expected one result, got %+v, %v", results, err)
+		}
+		sender.SendWebhook(context.Background(), results[0])
+		return results[0]
+	}
+
+	msg := Message{ID: 7, To: "hook@example.com", From: "a@example.org", Subject: "Order 42/b", Body: "Hello"}
+	send(msg)
+	send(msg)
+	send(Message{ID: 8, To: "hook@example.com", From: "a@example.org", Subject: "Order 43", Body: "Hello"})
+
+	if len(paths) != 3 || paths[0] != "/tickets/Order%2042%2Fb" || subjects[0] != "Order 42/b" {
+		t.Fatalf("expected the URL and headers to be rendered, got paths %v and subjects %v", paths, subjects)
+	}
+	if keys[0] == "" || keys[0] != keys[1] || keys[0] == keys[2] {
+		t.Errorf("expected a stable key per message, got %v", keys)
+	}
+}
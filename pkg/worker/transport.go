@@ -0,0 +1,174 @@
+package worker
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/secrets"
+)
+
+// ErrInvalidTransport is returned for jobs whose transport options can't be used, retrying won't help
+var ErrInvalidTransport = errors.New("invalid transport options")
+
+// MaxTransportTimeout is the longest request timeout a job may set, in seconds
+const MaxTransportTimeout = 300
+
+// maxPooledClients bounds the clients kept for jobs, the pool starts over once it is reached
+const maxPooledClients = 1000
+
+// TransportPool builds the HTTP clients of jobs with their own transport options, from the worker's transport.
+// Clients are kept for as long as the options of their jobs don't change, so connections get reused.
+type TransportPool struct {
+	base    *http.Transport
+	timeout time.Duration
+	box     *secrets.Box
+
+	mu      sync.Mutex
+	clients map[string]*http.Client
+}
+
+func NewTransportPool(base *http.Transport, timeout time.Duration, box *secrets.Box) *TransportPool {
+	return &TransportPool{
+		base:    base,
+		timeout: timeout,
+		box:     box,
+		clients: make(map[string]*http.Client),
+	}
+}
+
+// Client returns the client for the options of a job
+func (p *TransportPool) Client(opts *models.TransportOptions) (*http.Client, error) {
+	key := transportKey(opts)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if client, ok := p.clients[key]; ok {
+		return client, nil
+	}
+
+	client, err := p.build(opts)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTransport, err)
+	}
+	if len(p.clients) >= maxPooledClients {
+		for _, stale := range p.clients {
+			stale.CloseIdleConnections()
+		}
+		p.clients = make(map[string]*http.Client)
+	}
+	p.clients[key] = client
+	return client, nil
+}
+
+func (p *TransportPool) build(opts *models.TransportOptions) (*http.Client, error) {
+	clientKey, err := p.box.Open(opts.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("client key: %w", err)
+	}
+	proxy, err := p.box.Open(opts.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %w", err)
+	}
+
+	transport := p.base.Clone()
+	if opts.ClientCert != "" || opts.CACert != "" {
+		tlsConfig, err := tlsConfig(opts.ClientCert, clientKey, opts.CACert)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	if proxy != "" {
+		proxyURL, err := parseProxy(proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	timeout := p.timeout
+	if opts.Timeout > 0 {
+		timeout = time.Duration(opts.Timeout) * time.Second
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// ValidateTransport checks transport options before the client key and proxy get sealed
+func ValidateTransport(opts models.TransportOptions) error {
+	if opts.Timeout < 0 || opts.Timeout > MaxTransportTimeout {
+		return &JobError{Field: "Timeout", Err: fmt.Errorf("must be at most %d seconds", MaxTransportTimeout)}
+	}
+	if _, err := tlsConfig(opts.ClientCert, opts.ClientKey, opts.CACert); err != nil {
+		field := "ClientCert"
+		if errors.Is(err, errCACert) {
+			field = "CACert"
+		}
+		return &JobError{Field: field, Err: err}
+	}
+	if opts.Proxy != "" {
+		if _, err := parseProxy(opts.Proxy); err != nil {
+			return &JobError{Field: "Proxy", Err: err}
+		}
+	}
+	return nil
+}
+
+var errCACert = errors.New("CA bundle has no PEM certificate")
+
+func tlsConfig(cert, key, ca string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cert != "" || key != "" {
+		pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("client certificate and key: %w", err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	if ca != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(ca)) {
+			return nil, errCACert
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+func parseProxy(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("proxy URL scheme must be http, https or socks5, got %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("proxy URL has no host")
+	}
+	return u, nil
+}
+
+// transportKey identifies the client of transport options
+func transportKey(opts *models.TransportOptions) string {
+	h := sha256.New()
+	for _, field := range []string{fmt.Sprint(opts.Timeout), opts.ClientCert, opts.ClientKey, opts.CACert, opts.Proxy} {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,165 @@
+package worker
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
+	"gitea.v3m.net/idriss/gossiper/pkg/secrets"
+)
+
+// testClientCert issues a client certificate from a new CA, returning the CA pool and the PEM certificate and key
+func testClientCert(t *testing.T) (*x509.CertPool, string, string) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "gossiper"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool,
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestTransportPool(t *testing.T) {
+	clientCAs, cert, key := testClientCert(t)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	serverCA := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	box, err := secrets.New("test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedKey, _ := box.Seal(key)
+
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	pool := NewTransportPool(base, time.Minute, box)
+	sender := NewWebhookSender(&http.Client{Transport: base}, &mockLogger{}, Config{})
+	sender.SetTransportPool(pool)
+
+	send := func(transport *models.TransportOptions) WebhookResult {
+		return sender.SendWebhook(context.Background(), ProcessResult{JobID: 1, URL: server.URL, Method: "POST", Job: &models.Job{Transport: transport}})
+	}
+
+	if result := send(nil); result.Error == nil {
+		t.Errorf("expected the private CA to be rejected by default, got %+v", result)
+	}
+	if result := send(&models.TransportOptions{CACert: serverCA}); result.Error == nil {
+		t.Errorf("expected the server to require a client certificate, got %+v", result)
+	}
+
+	opts := &models.TransportOptions{CACert: serverCA, ClientCert: cert, ClientKey: sealedKey, Timeout: 5}
+	if result := send(opts); result.Error != nil || result.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected mutual TLS to succeed, got %+v", result)
+	}
+
+	client, err := pool.Client(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Timeout != 5*time.Second {
+		t.Errorf("expected the job timeout, got %s", client.Timeout)
+	}
+	if again, _ := pool.Client(opts); again != client {
+		t.Error("expected the client to be reused")
+	}
+	if defaults, _ := pool.Client(&models.TransportOptions{CACert: serverCA}); defaults.Timeout != time.Minute {
+		t.Errorf("expected the worker timeout, got %s", defaults.Timeout)
+	}
+
+	// A key stored without sealing is refused rather than used
+	result := send(&models.TransportOptions{CACert: serverCA, ClientCert: cert, ClientKey: key})
+	if !errors.Is(result.Error, ErrInvalidTransport) {
+		t.Errorf("expected invalid transport options, got %+v", result)
+	}
+	if retryable(ProcessResult{}, result) {
+		t.Error("expected invalid transport options not to be retried")
+	}
+}
+
+func TestValidateTransport(t *testing.T) {
+	_, cert, key := testClientCert(t)
+
+	tests := []struct {
+		name  string
+		opts  models.TransportOptions
+		field string
+	}{
+		{"empty", models.TransportOptions{}, ""},
+		{"complete", models.TransportOptions{Timeout: 30, ClientCert: cert, ClientKey: key, CACert: cert, Proxy: "socks5://proxy.example.com:1080"}, ""},
+		{"timeout too long", models.TransportOptions{Timeout: MaxTransportTimeout + 1}, "Timeout"},
+		{"certificate without key", models.TransportOptions{ClientCert: cert}, "ClientCert"},
+		{"key without certificate", models.TransportOptions{ClientKey: key}, "ClientCert"},
+		{"invalid CA bundle", models.TransportOptions{CACert: "not a certificate"}, "CACert"},
+		{"unsupported proxy", models.TransportOptions{Proxy: "ftp://proxy.example.com"}, "Proxy"},
+		{"proxy without host", models.TransportOptions{Proxy: "http://"}, "Proxy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTransport(tt.opts)
+			var jobErr *JobError
+			switch {
+			case tt.field == "" && err != nil:
+				t.Errorf("expected valid options, got %v", err)
+			case tt.field != "" && (!errors.As(err, &jobErr) || jobErr.Field != tt.field):
+				t.Errorf("expected an error on %s, got %v", tt.field, err)
+			}
+		})
+	}
+}
@@ -53,6 +53,14 @@ type Message struct {
 	To      string `json:"To"`
 	Subject string `json:"Subject"`
 	Body    string `json:"Body"`
+
+	// Stored message metadata, not part of the default JSON payload
+	ID         int       `json:"-"`
+	ReceivedAt time.Time `json:"-"`
+	Raw        string    `json:"-"`
+
+	// Verdicts of the SMTP server, forwarded from the stored message
+	Auth models.AuthResults `json:"-"`
 }
 
 type Config struct {
@@ -89,6 +97,17 @@ type JobRepository interface {
 	GetActiveJobs(ctx context.Context, email string) ([]*models.Job, error)
 }
 
+// DeliveryLog records the outcome of each message for each job
+type DeliveryLog interface {
+	Record(ctx context.Context, delivery *models.Delivery) error
+}
+
+// BounceRelay returns the bounces of forwarded mail to the original senders, handled tells whether to was
+// an address rewritten by a forward. Bounces it refuses to relay come with an ErrBounceDropped error.
+type BounceRelay interface {
+	RelayBounce(ctx context.Context, to string, raw []byte) (handled bool, err error)
+}
+
 type MessageFetcherInterface interface {
 	FetchMessage(messageID string) (*EmailEnvelope, error)
 	GetMessageBody(msg *EmailEnvelope) string
@@ -2,15 +2,25 @@ package worker
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
+	"time"
+
+	"gitea.v3m.net/idriss/gossiper/pkg/models"
 )
 
 type WebhookSender struct {
 	httpClient HTTPClient
 	logger     Logger
 	config     Config
+	breaker    *CircuitBreaker
+	transports *TransportPool
+	auth       *Authenticator
+	limiter    *RateLimiter
+	hostLimits HostRateLimits
 }
 
 func NewWebhookSender(httpClient HTTPClient, logger Logger, config Config) *WebhookSender {
@@ -21,17 +31,49 @@ func NewWebhookSender(httpClient HTTPClient, logger Logger, config Config) *Webh
 	}
 }
 
+// SetCircuitBreaker makes the sender fail fast on the hosts that keep failing
+func (w *WebhookSender) SetCircuitBreaker(breaker *CircuitBreaker) {
+	w.breaker = breaker
+}
+
+// SetTransportPool makes the sender call the jobs with transport options through their own clients
+func (w *WebhookSender) SetTransportPool(transports *TransportPool) {
+	w.transports = transports
+}
+
+// SetHostRateLimits makes the sender hold back the requests over the rate limit of their host, counted by limiter
+func (w *WebhookSender) SetHostRateLimits(limits HostRateLimits, limiter *RateLimiter) {
+	w.limiter = limiter
+	w.hostLimits = limits
+}
+
+// SetAuthenticator makes the sender call the jobs with credentials authenticated
+func (w *WebhookSender) SetAuthenticator(auth *Authenticator) {
+	w.auth = auth
+}
+
 type WebhookResult struct {
-	JobID      int
-	StatusCode int
-	Response   string // Auto-reply message to send back to sender
-	Error      error
+	JobID         int
+	DestinationID int
+	StatusCode    int
+	Action        *ResponseAction // What the endpoint answered to do next, generic HTTP destinations only
+	Error         error
 }
 
 func (w *WebhookSender) SendWebhook(ctx context.Context, result ProcessResult) WebhookResult {
+	return w.send(ctx, result, w.buildRequest)
+}
+
+// Deliver makes the sender the generic HTTP Destination
+func (w *WebhookSender) Deliver(ctx context.Context, result ProcessResult) WebhookResult {
+	return w.SendWebhook(ctx, result)
+}
+
+// send builds the request of a processed message and makes the call, results that failed processing are skipped
+func (w *WebhookSender) send(ctx context.Context, result ProcessResult, build func(context.Context, ProcessResult) (*http.Request, error)) WebhookResult {
 	webhookResult := WebhookResult{
-		JobID:    result.JobID,
-		Response: result.Response,
+		JobID:         result.JobID,
+		DestinationID: result.DestinationID,
 	}
 
 	if result.Error != nil {
@@ -40,17 +82,71 @@ func (w *WebhookSender) SendWebhook(ctx context.Context, result ProcessResult) W
 		return webhookResult
 	}
 
-	req, err := w.buildRequest(ctx, result)
+	req, err := build(ctx, result)
 	if err != nil {
 		webhookResult.Error = fmt.Errorf("failed to build request: %w", err)
 		w.logger.Printf("failed to build request for job %d: %v", result.JobID, err)
 		return webhookResult
 	}
 
-	resp, err := w.httpClient.Do(req)
+	client := w.httpClient
+	if transport := result.transport(); transport != nil && w.transports != nil {
+		jobClient, err := w.transports.Client(transport)
+		if err != nil {
+			webhookResult.Error = err
+			w.logger.Printf("skipping webhook for job %d: %v", result.JobID, err)
+			return webhookResult
+		}
+		client = jobClient
+	}
+
+	if err := w.authorize(ctx, client, req, result); err != nil {
+		webhookResult.Error = err
+		w.logger.Printf("failed to authenticate the webhook for job %d: %v", result.JobID, err)
+		return webhookResult
+	}
+
+	// Circuits are kept per host, ports included. The breaker goes first so deliveries to an open circuit
+	// don't use up rate limit slots.
+	host := req.URL.Host
+	if w.breaker != nil {
+		if err := w.breaker.Allow(ctx, host); err != nil {
+			webhookResult.Error = err
+			w.logger.Printf("skipping webhook for job %d: %v", result.JobID, err)
+			return webhookResult
+		}
+	}
+	if w.limiter != nil {
+		if err := w.limiter.Reserve(time.Now(), w.hostLimits.rules(req.URL.Hostname())...); err != nil {
+			if w.breaker != nil {
+				w.breaker.Release(ctx, host)
+			}
+			webhookResult.Error = err
+			w.logger.Printf("skipping webhook for job %d: %v", result.JobID, err)
+			return webhookResult
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && result.auth() != nil && w.auth != nil && w.auth.Expire(result.auth()) {
+		// The endpoint no longer accepts the cached access token, try once more with a new one
+		if retry, buildErr := build(ctx, result); buildErr == nil && w.authorize(ctx, client, retry, result) == nil {
+			resp.Body.Close()
+			resp, err = client.Do(retry)
+		}
+	}
 	if err != nil {
+		err = redactToken(err, result.Token)
 		webhookResult.Error = fmt.Errorf("failed to send request: %w", err)
 		w.logger.Printf("failed to send request for job %d: %v", result.JobID, err)
+		// Blocked addresses were never called, they say nothing about the host
+		if w.breaker != nil {
+			if errors.Is(err, ErrBlockedAddress) {
+				w.breaker.Release(ctx, host)
+			} else {
+				w.breaker.Record(ctx, host, true, webhookResult.Error.Error())
+			}
+		}
 		return webhookResult
 	}
 	defer resp.Body.Close()
@@ -58,9 +154,50 @@ func (w *WebhookSender) SendWebhook(ctx context.Context, result ProcessResult) W
 	webhookResult.StatusCode = resp.StatusCode
 	w.logger.Printf("webhook call for job %d completed with status: %d", result.JobID, resp.StatusCode)
 
+	if (result.Type == "" || result.Type == models.DestinationTypeHTTP) && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxActionBody))
+		if err == nil {
+			webhookResult.Action = parseResponseAction(resp.Header.Get("Content-Type"), body)
+		}
+	}
+
+	// Client errors come from an endpoint that is up, only server errors count against the host
+	if w.breaker != nil {
+		w.breaker.Record(ctx, host, resp.StatusCode >= 500, fmt.Sprintf("endpoint returned status %d", resp.StatusCode))
+	}
+
 	return webhookResult
 }
 
+// authorize adds the credentials of the job to req
+func (w *WebhookSender) authorize(ctx context.Context, client HTTPClient, req *http.Request, result ProcessResult) error {
+	auth := result.auth()
+	if auth == nil {
+		return nil
+	}
+	if w.auth == nil {
+		return fmt.Errorf("%w: the worker can't authenticate webhooks", ErrInvalidAuth)
+	}
+	return w.auth.Authorize(ctx, client, req, auth)
+}
+
+// transport returns the HTTP client settings of the result's job, if any
+func (r ProcessResult) transport() *models.TransportOptions {
+	if r.Job == nil {
+		return nil
+	}
+	return r.Job.Transport
+}
+
+// auth returns the credentials of the result's job, if any. Only generic HTTP destinations send them,
+// chat and push presets authenticate with their own tokens.
+func (r ProcessResult) auth() *models.WebhookAuth {
+	if r.Job == nil || (r.Type != "" && r.Type != models.DestinationTypeHTTP) {
+		return nil
+	}
+	return r.Job.Auth
+}
+
 func (w *WebhookSender) buildRequest(ctx context.Context, result ProcessResult) (*http.Request, error) {
 	req, err := http.NewRequestWithContext(ctx, result.Method, result.URL, strings.NewReader(result.Payload))
 	if err != nil {
@@ -75,6 +212,11 @@ func (w *WebhookSender) buildRequest(ctx context.Context, result ProcessResult)
 		req.Header.Set("Content-Type", "application/json")
 	}
 
+	// Jobs may send a key of their own through their headers
+	if result.IdempotencyKey != "" && req.Header.Get("Idempotency-Key") == "" {
+		req.Header.Set("Idempotency-Key", result.IdempotencyKey)
+	}
+
 	return req, nil
 }
 
@@ -87,4 +229,4 @@ func (w *WebhookSender) SendWebhooks(ctx context.Context, results []ProcessResul
 	}
 
 	return webhookResults
-}
\ No newline at end of file
+}
@@ -10,7 +10,7 @@ import (
 type Worker struct {
 	wsClient       *WebSocketClient
 	processor      *MessageProcessor
-	webhookSender  *WebhookSender
+	dispatcher     *Dispatcher
 	logger         Logger
 	config         Config
 	shutdownOnce   sync.Once
@@ -30,12 +30,12 @@ func NewWorker(deps WorkerDependencies) *Worker {
 	wsClient := NewWebSocketClient(deps.WSDialer, deps.Logger, deps.Config)
 	fetcher := NewMessageFetcher(deps.HTTPClient, deps.Config.APIURL, deps.Logger)
 	processor := NewMessageProcessor(deps.JobRepo, deps.Logger, fetcher, deps.Config.AllowedHostname)
-	webhookSender := NewWebhookSender(deps.HTTPClient, deps.Logger, deps.Config)
+	dispatcher := NewDispatcher(NewWebhookSender(deps.HTTPClient, deps.Logger, deps.Config), deps.Logger)
 
 	return &Worker{
 		wsClient:      wsClient,
 		processor:     processor,
-		webhookSender: webhookSender,
+		dispatcher:    dispatcher,
 		logger:        deps.Logger,
 		config:        deps.Config,
 		shutdownChan:  make(chan struct{}),
@@ -103,13 +103,14 @@ func (w *Worker) processMessageAsync(ctx context.Context, msg Message) {
 		w.logger.Printf("error processing message: %v", err)
 		return
 	}
+	results, _ = splitRejections(results)
 
 	if len(results) == 0 {
 		w.logger.Printf("no matching jobs found for message to: %s", msg.To)
 		return
 	}
 
-	webhookResults := w.webhookSender.SendWebhooks(ctx, results)
+	webhookResults := w.dispatcher.DeliverAll(ctx, results)
 
 	for _, result := range webhookResults {
 		if result.Error != nil {
@@ -24,12 +24,17 @@ const (
 	PageAbout          Page = "about"
 	PageCache          Page = "cache"
 	PageContact        Page = "contact"
+	PageDeadLetters    Page = "dead-letters"
+	PageDeliveries     Page = "deliveries"
+	PageDestinations   Page = "destinations"
 	PageError          Page = "error"
 	PageForgotPassword Page = "forgot-password"
 	PageHome           Page = "home"
+	PageLive           Page = "live"
 	PageLogin          Page = "login"
 	PageRegister       Page = "register"
 	PageResetPassword  Page = "reset-password"
+	PageScheduled      Page = "scheduled"
 	PageSearch         Page = "search"
 	PageTask           Page = "task"
 )